@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -10,7 +12,21 @@ import (
 	"faraway/internal/app"
 )
 
+// exitTimedOut is the exit code when the client ran out of MAX_RUNTIME,
+// the same as timeout(1) uses.
+const exitTimedOut = 124
+
 func main() {
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	flag.Parse()
+	if *checkConfig {
+		if err := app.CheckClientConfig(); err != nil {
+			log.Fatalf("invalid configuration:\n%v", err)
+		}
+		log.Print("configuration OK")
+		return
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer cancel()
 
@@ -19,6 +35,10 @@ func main() {
 	}()
 
 	if err := app.RunClient(ctx); err != nil {
+		if errors.Is(err, app.ErrMaxRuntime) {
+			log.Printf("client timed out: %v", err)
+			os.Exit(exitTimedOut)
+		}
 		log.Fatalf("failed to run client: %v", err)
 	}
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"faraway/internal/app"
+	"faraway/internal/capture"
+)
+
+// exitTimedOut is the exit code when the client ran out of MAX_RUNTIME,
+// the same as timeout(1) uses.
+const exitTimedOut = 124
+
+const usage = `usage: faraway <command> [flags]
+
+commands:
+  server  run the server, configured from the environment;
+          -check-config only validates the configuration
+  client  run the client, configured from the environment;
+          -check-config only validates the configuration
+  demo    run a server and a client in-process and print one quote
+  verify-audit [file]
+          re-check the records of a server audit log, read from stdin
+          without a file; -key is the AUDIT_KEY they were signed with
+  capture -upstream addr [-listen addr] [-out file]
+          relay clients to the server at -upstream, writing every frame
+          either side sends to -out, stdout without one
+  replay [-as client|server] [-conn n] -addr addr [file]
+          replay what one side sent on connection -conn of a capture, read
+          from stdin without a file: as a client to the server at -addr,
+          or as a server to the first client connecting to -addr
+`
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	defer cancel()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the subcommand in args and returns the exit code.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	command, args := args[0], args[1:]
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	var runCommand func() error
+	switch command {
+	case "server":
+		checkConfig := flags.Bool("check-config", false, "validate the configuration and exit")
+		runCommand = func() error {
+			if *checkConfig {
+				return reportConfig(app.CheckServerConfig(), stdout)
+			}
+			return app.RunServer(ctx)
+		}
+	case "client":
+		checkConfig := flags.Bool("check-config", false, "validate the configuration and exit")
+		runCommand = func() error {
+			if *checkConfig {
+				return reportConfig(app.CheckClientConfig(), stdout)
+			}
+			return app.RunClient(ctx)
+		}
+	case "demo":
+		difficulty := flags.Uint64("difficulty", 1, "proof of work difficulty")
+		runCommand = func() error { return app.RunDemo(ctx, *difficulty, stdout) }
+	case "verify-audit":
+		key := flags.String("key", os.Getenv("AUDIT_KEY"), "key the records were signed with")
+		runCommand = func() error { return verifyAudit(flags.Arg(0), []byte(*key), stdout) }
+	case "capture":
+		listen := flags.String("listen", ":9000", "address clients connect to")
+		upstream := flags.String("upstream", "", "address of the server")
+		out := flags.String("out", "", "file the capture is written to")
+		runCommand = func() error {
+			w, done, err := createOutput(*out, stdout)
+			if err != nil {
+				return err
+			}
+			return done(app.RunCapture(ctx, *listen, *upstream, w))
+		}
+	case "replay":
+		as := flags.String("as", string(capture.Client), "side of the capture to replay, client or server")
+		conn := flags.Uint64("conn", 1, "connection of the capture to replay")
+		addr := flags.String("addr", "", "address to connect to as a client, or listen on as a server")
+		out := flags.String("out", "", "file the replayed session is written to")
+		runCommand = func() error {
+			r, err := openInput(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			w, done, err := createOutput(*out, stdout)
+			if err != nil {
+				return err
+			}
+			return done(app.RunReplay(ctx, r, *conn, capture.Side(*as), *addr, w))
+		}
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := runCommand(); err != nil {
+		fmt.Fprintf(stderr, "failed to run %s: %v\n", command, err)
+		if errors.Is(err, app.ErrMaxRuntime) {
+			return exitTimedOut
+		}
+		return 1
+	}
+	return 0
+}
+
+// verifyAudit verifies the audit log at path, or on stdin if path is empty.
+func verifyAudit(path string, key []byte, stdout io.Writer) error {
+	r, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return app.VerifyAuditLog(r, key, stdout)
+}
+
+// openInput opens the file at path, or stdin if path is empty.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// createOutput creates the file at path, or writes to stdout if path is
+// empty. done closes the file and returns the first of err and the error
+// closing it.
+func createOutput(path string, stdout io.Writer) (w io.Writer, done func(err error) error, err error) {
+	if path == "" {
+		return stdout, func(err error) error { return err }, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, func(err error) error {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// reportConfig prints the outcome of a configuration check that passed.
+func reportConfig(err error, stdout io.Writer) error {
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	fmt.Fprintln(stdout, "configuration OK")
+	return nil
+}
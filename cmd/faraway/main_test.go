@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDemoPrintsQuote(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	if code := run(ctx, []string{"demo"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if quote := strings.TrimSpace(stdout.String()); quote == "" || strings.Contains(quote, "\n") {
+		t.Fatalf("expected a single quote line, got %q", stdout.String())
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), []string{"bogus"}, &stdout, &stderr); code != 2 {
+		t.Fatalf("expected exit code 2, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "usage:") {
+		t.Fatalf("expected usage on stderr, got %q", stderr.String())
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	valid := map[string]string{"ADDR": ":8080", "NAME": "wow", "DEADLINE": "5s", "DIFFICULTY": "3"}
+	tests := []struct {
+		name     string
+		override map[string]string
+		code     int
+		report   string
+	}{
+		{"valid", nil, 0, "configuration OK"},
+		{"missing required", map[string]string{"NAME": ""}, 1, `"Name" is required`},
+		{"difficulty out of range", map[string]string{"DIFFICULTY": "99"}, 1, "DIFFICULTY"},
+		{"several problems", map[string]string{"DIFFICULTY": "99", "ALLOW_LIST": "nonsense"}, 1, "ALLOW_LIST"},
+		{"advertised version not semantic", map[string]string{"ADVERTISE_VERSION": "true", "VERSION": "latest"}, 1, "VERSION"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"CONFIG_FILE", "ALLOW_LIST", "CHALLENGE_STORE", "ADVERTISE_VERSION", "VERSION"} {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+			for key, value := range valid {
+				t.Setenv(key, value)
+			}
+			for key, value := range tt.override {
+				t.Setenv(key, value)
+				if value == "" {
+					os.Unsetenv(key)
+				}
+			}
+
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), []string{"server", "-check-config"}, &stdout, &stderr); code != tt.code {
+				t.Fatalf("expected exit code %d, got %d: %s", tt.code, code, stderr.String())
+			}
+			if report := stdout.String() + stderr.String(); !strings.Contains(report, tt.report) {
+				t.Fatalf("expected %q in the report, got %q", tt.report, report)
+			}
+		})
+	}
+}
+
+func TestCheckClientConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxMessageSize string // empty leaves it unset
+		code           int
+		report         string
+	}{
+		{"default message size", "", 0, "configuration OK"},
+		{"reasonable message size", "4096", 0, "configuration OK"},
+		{"zero message size", "0", 1, "MAX_MESSAGE_SIZE must be positive"},
+		{"negative message size", "-1", 1, "MAX_MESSAGE_SIZE must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"CONFIG_FILE", "MAX_MESSAGE_SIZE"} {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+			for key, value := range map[string]string{"SERVER_ADDR": "localhost:8080", "NAME": "wow", "DIFFICULTY": "3"} {
+				t.Setenv(key, value)
+			}
+			if tt.maxMessageSize != "" {
+				t.Setenv("MAX_MESSAGE_SIZE", tt.maxMessageSize)
+			}
+
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), []string{"client", "-check-config"}, &stdout, &stderr); code != tt.code {
+				t.Fatalf("expected exit code %d, got %d: %s", tt.code, code, stderr.String())
+			}
+			if report := stdout.String() + stderr.String(); !strings.Contains(report, tt.report) {
+				t.Fatalf("expected %q in the report, got %q", tt.report, report)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"faraway/internal/app"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -10,6 +11,16 @@ import (
 )
 
 func main() {
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	flag.Parse()
+	if *checkConfig {
+		if err := app.CheckServerConfig(); err != nil {
+			log.Fatalf("invalid configuration:\n%v", err)
+		}
+		log.Print("configuration OK")
+		return
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer cancel()
 
@@ -1,24 +1,20 @@
 package config
 
-import (
-	"fmt"
-
-	"github.com/kelseyhightower/envconfig"
-)
+import "fmt"
 
 type ServerConfig struct {
-	Server
-	Pow
+	Server `yaml:",inline"`
+	Pow    `yaml:",inline"`
 }
 
 type ClientConfig struct {
-	Client
-	Pow
+	Client `yaml:",inline"`
+	Pow    `yaml:",inline"`
 }
 
 func LoadServerConfig() (*ServerConfig, error) {
 	cfg := &ServerConfig{}
-	if err := envconfig.Process("", cfg); err != nil {
+	if err := readConfig(cfg); err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
 	return cfg, nil
@@ -26,7 +22,7 @@ func LoadServerConfig() (*ServerConfig, error) {
 
 func LoadClientConfig() (*ClientConfig, error) {
 	cfg := &ClientConfig{}
-	if err := envconfig.Process("", cfg); err != nil {
+	if err := readConfig(cfg); err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
 	return cfg, nil
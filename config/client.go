@@ -1,6 +1,89 @@
 package config
 
+import "time"
+
 type Client struct {
-	ServerAddr string `envconfig:"SERVER_ADDR" required:"true"`
-	Name       string `envconfig:"NAME" required:"true"`
+	// ServerAddrs is a comma-separated list of servers to fail over between,
+	// either in order or round-robin depending on FAILOVER.
+	ServerAddrs []string `env:"SERVER_ADDR" yaml:"SERVER_ADDR" env-required:"true"`
+	Failover    string   `env:"FAILOVER" yaml:"FAILOVER" default:"ordered"`
+	Name        string   `env:"NAME" yaml:"NAME" env-required:"true"`
+	// Transport is either "tcp" or "websocket". The WebSocket transport
+	// connects to ws://SERVER_ADDR followed by WS_PATH.
+	Transport     string `env:"TRANSPORT" yaml:"TRANSPORT" default:"tcp"`
+	WebSocketPath string `env:"WS_PATH" yaml:"WS_PATH" default:"/ws"`
+	// NonceEncoding is how CPU-bound nonces are encoded: "decimal", "hex"
+	// or "binary".
+	NonceEncoding string `env:"NONCE_ENCODING" yaml:"NONCE_ENCODING" default:"decimal"`
+	// SolveStrategy is "speed" (parallel nonce search) or "memory" (one
+	// solve at a time, fewer threads).
+	SolveStrategy string `env:"SOLVE_STRATEGY" yaml:"SOLVE_STRATEGY" default:"speed"`
+	// SolveProgress logs how many nonces a CPU-bound solve tried so far at
+	// this interval, for long solves at high difficulty; zero logs none.
+	SolveProgress time.Duration `env:"SOLVE_PROGRESS" yaml:"SOLVE_PROGRESS" default:"0"`
+	// MaxMessageSize is the largest challenge, in bytes, the client accepts.
+	MaxMessageSize int64 `env:"MAX_MESSAGE_SIZE" yaml:"MAX_MESSAGE_SIZE" default:"1024"`
+	// PrintQuote fetches a single quote and prints only the quote to
+	// stdout; logs still go to stderr.
+	PrintQuote bool `env:"PRINT_QUOTE" yaml:"PRINT_QUOTE" default:"false"`
+	// WatchInterval fetches a quote at this interval until interrupted,
+	// printing each to stdout with the time it was fetched; zero fetches
+	// as usual.
+	WatchInterval time.Duration `env:"WATCH_INTERVAL" yaml:"WATCH_INTERVAL" default:"0"`
+	// WatchPrefetch solves the challenge for each WATCH_INTERVAL tick ahead
+	// of it, starting half of WatchPrefetch before, so quotes show without
+	// a solve delay. Challenges older than WatchPrefetch by the tick are
+	// solved again; keep it below the server's DEADLINE. Zero disables it.
+	WatchPrefetch time.Duration `env:"WATCH_PREFETCH" yaml:"WATCH_PREFETCH" default:"0"`
+	// DumpChallenge prints a hex dump of every raw challenge frame to
+	// stderr before solving it. Meant for protocol debugging only.
+	DumpChallenge bool `env:"DUMP_CHALLENGE" yaml:"DUMP_CHALLENGE" default:"false"`
+	// EchoChallenge must match the server's ECHO_CHALLENGE setting.
+	EchoChallenge bool `env:"ECHO_CHALLENGE" yaml:"ECHO_CHALLENGE" default:"false"`
+	// MinServerVersion refuses servers not advertising a compatible version:
+	// the same major version, and no older. Empty accepts any server.
+	MinServerVersion string `env:"MIN_SERVER_VERSION" yaml:"MIN_SERVER_VERSION"`
+	// CPUDifficulty and MemoryDifficulty, if set, override DIFFICULTY for
+	// hashcash challenges, between 1 and 64, and argon2 ones, between 1 and
+	// 4. They must match the server's.
+	CPUDifficulty    uint64 `env:"CPU_DIFFICULTY" yaml:"CPU_DIFFICULTY" default:"0"`
+	MemoryDifficulty uint64 `env:"MEMORY_DIFFICULTY" yaml:"MEMORY_DIFFICULTY" default:"0"`
+	// PinDifficulty sends the difficulty solved at along with every
+	// solution, so a server configured with another difficulty fails with
+	// DIFFICULTY_MISMATCH.
+	PinDifficulty bool `env:"PIN_DIFFICULTY" yaml:"PIN_DIFFICULTY" default:"false"`
+	// DifficultyTolerance is how far the difficulty a server advertises in
+	// its hints may be from the pinned one before the client gives up with
+	// a difficulty mismatch, without solving.
+	DifficultyTolerance uint64 `env:"DIFFICULTY_TOLERANCE" yaml:"DIFFICULTY_TOLERANCE" default:"0"`
+	// ReportSolveTime tells servers accepting it how long solving took, to
+	// help them tune the difficulty.
+	ReportSolveTime bool `env:"REPORT_SOLVE_TIME" yaml:"REPORT_SOLVE_TIME" default:"false"`
+	// FollowHints lets the solver follow the advice servers send ahead of
+	// challenges. Solutions are verified the same either way.
+	FollowHints bool `env:"FOLLOW_HINTS" yaml:"FOLLOW_HINTS" default:"false"`
+
+	// ReuseSessions presents the session token servers grant after a solved
+	// challenge instead of solving, until it expires. SessionFile keeps the
+	// token across runs; it is written readable by its owner only.
+	ReuseSessions bool   `env:"REUSE_SESSIONS" yaml:"REUSE_SESSIONS" default:"false"`
+	SessionFile   string `env:"SESSION_FILE" yaml:"SESSION_FILE"`
+	// NoDelay is "true" or "false" to turn TCP_NODELAY on or off on server
+	// connections; empty keeps Go's default, on. Off lets Nagle's algorithm
+	// coalesce small frames, saving packets at the cost of latency.
+	NoDelay string `env:"TCP_NODELAY" yaml:"TCP_NODELAY"`
+	// TLS connects over TLS, verifying the server against TLSCA or the
+	// system roots. TLSCert and TLSKey are presented to servers requiring
+	// client certificates.
+	TLS     bool   `env:"TLS" yaml:"TLS" default:"false"`
+	TLSCA   string `env:"TLS_CA" yaml:"TLS_CA"`
+	TLSCert string `env:"TLS_CERT" yaml:"TLS_CERT"`
+	TLSKey  string `env:"TLS_KEY" yaml:"TLS_KEY"`
+	// MaxRuntime bounds the lifetime of the whole client process, retries
+	// included. Zero means no limit.
+	MaxRuntime time.Duration `env:"MAX_RUNTIME" yaml:"MAX_RUNTIME" default:"0"`
+	// ShutdownTimeout is how long handshakes in flight may finish once the
+	// client is told to stop, before they are aborted. Zero aborts them
+	// right away.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" yaml:"SHUTDOWN_TIMEOUT" default:"5s"`
 }
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// ConfigFileEnv names the environment variable pointing at an optional
+// config file. The file is a YAML mapping of the same variables as the
+// environment, and variables that are set in the environment take
+// precedence over it. Settings set by neither take their defaults.
+const ConfigFileEnv = "CONFIG_FILE"
+
+// defaultTag holds the value a setting takes unless the config file or the
+// environment sets it. cleanenv applies its own env-default over any zero
+// value, including a false or 0 read from the file, so defaults are set
+// before the file is read instead.
+const defaultTag = "default"
+
+// readConfig fills cfg with its defaults, then from the config file, if
+// any, then from the environment. The environment itself is left
+// untouched.
+func readConfig(cfg interface{}) error {
+	if err := setDefaults(reflect.ValueOf(cfg).Elem()); err != nil {
+		return err
+	}
+
+	path := os.Getenv(ConfigFileEnv)
+	if path == "" {
+		return cleanenv.ReadEnv(cfg)
+	}
+
+	// cleanenv would load .env files into the environment, over the
+	// variables set there, and other formats don't go by variable names
+	if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+		return fmt.Errorf("unsupported config file %s: expected .yaml or .yml", path)
+	}
+	return cleanenv.ReadConfig(path, cfg)
+}
+
+// setDefaults sets the fields of the struct v, and of the structs embedded
+// in it, to their defaults.
+func setDefaults(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, structField := v.Field(i), v.Type().Field(i)
+		if structField.Anonymous && field.Kind() == reflect.Struct {
+			if err := setDefaults(field); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := structField.Tag.Lookup(defaultTag)
+		if !ok {
+			continue
+		}
+		if err := setDefault(field, value); err != nil {
+			return fmt.Errorf("invalid default for %s: %w", structField.Name, err)
+		}
+	}
+	return nil
+}
+
+// setDefault parses value into field, as cleanenv parses variables.
+func setDefault(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == reflect.TypeOf(time.Duration(0)):
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case field.CanInt():
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case field.CanUint():
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		field.Set(reflect.ValueOf(strings.Split(value, cleanenv.DefaultSeparator)))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets keys for the duration of the test.
+func clearEnv(t *testing.T, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("unexpected error writing config file: %v", err)
+	}
+	return path
+}
+
+var serverKeys = []string{ConfigFileEnv, "ADDR", "NAME", "DEADLINE", "DIFFICULTY", "MAX_FAILURES", "POOL_BUFFERS", "MAX_NONCE_LENGTH", "BUFFER_SIZE", "ALGORITHMS"}
+
+func TestLoadServerConfigFromFile(t *testing.T) {
+	files := map[string]string{
+		"server.yaml": "---\nADDR: \":8080\"\nNAME: wow\nDEADLINE: 5s\nDIFFICULTY: 3\n",
+		"server.yml":  "# local development\nADDR: \":8080\"\nNAME: 'wow'\nDEADLINE: 5s\nDIFFICULTY: 3 # easy\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			clearEnv(t, serverKeys...)
+			t.Setenv(ConfigFileEnv, writeConfigFile(t, name, content))
+
+			cfg, err := LoadServerConfig()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Server.Addr != ":8080" || cfg.Server.Name != "wow" || cfg.Server.Deadline != 5*time.Second || cfg.Pow.Difficulty != 3 {
+				t.Fatalf("unexpected config: %+v", cfg)
+			}
+			// The file fills the config, not the environment
+			if _, set := os.LookupEnv("ADDR"); set {
+				t.Fatal("expected the config file to leave the environment alone")
+			}
+		})
+	}
+}
+
+func TestLoadServerConfigFromEnv(t *testing.T) {
+	clearEnv(t, serverKeys...)
+	t.Setenv("ADDR", ":9090")
+	t.Setenv("NAME", "env")
+	t.Setenv("DEADLINE", "1s")
+	t.Setenv("DIFFICULTY", "2")
+
+	cfg, err := LoadServerConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.Addr != ":9090" || cfg.Pow.Difficulty != 2 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if !cfg.Server.PoolBuffers || cfg.Server.MaxNonceLength != 64 || !slices.Equal(cfg.Server.Algorithms, []string{"CPU", "Memory"}) {
+		t.Fatalf("expected the defaults, got %+v", cfg.Server)
+	}
+}
+
+func TestConfigFileOverridesDefaults(t *testing.T) {
+	clearEnv(t, serverKeys...)
+	t.Setenv(ConfigFileEnv, writeConfigFile(t, "server.yaml", "ADDR: \":8080\"\nNAME: wow\nDEADLINE: 5s\nDIFFICULTY: 3\nPOOL_BUFFERS: false\nMAX_NONCE_LENGTH: 0\nALGORITHMS: [CPU]\n"))
+
+	cfg, err := LoadServerConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Explicit false and 0 turn off settings that default to on
+	if cfg.Server.PoolBuffers || cfg.Server.MaxNonceLength != 0 || !slices.Equal(cfg.Server.Algorithms, []string{"CPU"}) {
+		t.Fatalf("expected the file's settings over the defaults, got %+v", cfg.Server)
+	}
+	// Settings the file leaves out keep their defaults
+	if cfg.Server.BufferSize != 1024 || cfg.Server.FailureWindow != time.Minute || cfg.Server.ChallengeStore != "memory" {
+		t.Fatalf("expected defaults for settings the file leaves out, got %+v", cfg.Server)
+	}
+
+	t.Setenv("POOL_BUFFERS", "true")
+	if cfg, err := LoadServerConfig(); err != nil || !cfg.Server.PoolBuffers {
+		t.Fatalf("expected the environment over the file, got %v", err)
+	}
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	clearEnv(t, serverKeys...)
+	t.Setenv(ConfigFileEnv, writeConfigFile(t, "server.yaml", "ADDR: \":8080\"\nNAME: file\nDEADLINE: 5s\nDIFFICULTY: 3\nMAX_FAILURES: 7\n"))
+	t.Setenv("NAME", "env")
+	t.Setenv("DIFFICULTY", "4")
+
+	cfg, err := LoadServerConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.Name != "env" || cfg.Pow.Difficulty != 4 {
+		t.Fatalf("expected env to win, got name %q difficulty %d", cfg.Server.Name, cfg.Pow.Difficulty)
+	}
+	if cfg.Server.Addr != ":8080" || cfg.Server.MaxFailures != 7 {
+		t.Fatalf("expected the file to fill the rest, got %+v", cfg.Server)
+	}
+}
+
+func TestMergedConfigIsValidated(t *testing.T) {
+	clearEnv(t, serverKeys...)
+	// Neither the file nor the environment sets DIFFICULTY
+	t.Setenv(ConfigFileEnv, writeConfigFile(t, "server.yaml", "ADDR: \":8080\"\nDEADLINE: 5s\n"))
+	t.Setenv("NAME", "env")
+
+	if _, err := LoadServerConfig(); err == nil {
+		t.Fatal("expected an error for a missing required setting")
+	}
+}
+
+func TestMalformedConfigFile(t *testing.T) {
+	files := map[string]string{
+		"server.yaml": "ADDR\n",
+		"server.env":  "ADDR=:8080\nNAME=wow\nDEADLINE=5s\nDIFFICULTY=3\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			clearEnv(t, serverKeys...)
+			t.Setenv(ConfigFileEnv, writeConfigFile(t, name, content))
+
+			if _, err := LoadServerConfig(); err == nil {
+				t.Fatal("expected an error for a malformed or unsupported config file")
+			}
+		})
+	}
+}
@@ -1,5 +1,5 @@
 package config
 
 type Pow struct {
-	Difficulty uint64 `envconfig:"DIFFICULTY" required:"true"`
+	Difficulty uint64 `env:"DIFFICULTY" yaml:"DIFFICULTY" env-required:"true"`
 }
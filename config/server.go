@@ -3,8 +3,207 @@ package config
 import "time"
 
 type Server struct {
-	Addr      string        `envconfig:"ADDR" required:"true"`
-	Name      string        `envconfig:"NAME" required:"true"`
-	Deadline  time.Duration `envconfig:"DEADLINE" required:"true"`
-	KeepAlive time.Duration `envconfig:"SERVER_KEEP_ALIVE,default=15s"`
+	Addr      string        `env:"ADDR" yaml:"ADDR" env-required:"true"`
+	Name      string        `env:"NAME" yaml:"NAME" env-required:"true"`
+	Deadline  time.Duration `env:"DEADLINE" yaml:"DEADLINE" env-required:"true"`
+	KeepAlive time.Duration `env:"SERVER_KEEP_ALIVE" yaml:"SERVER_KEEP_ALIVE" default:"15s"`
+	// NoDelay is "true" or "false" to turn TCP_NODELAY on or off on client
+	// connections; empty keeps Go's default, on. Off lets Nagle's algorithm
+	// coalesce small frames, saving packets at the cost of latency.
+	NoDelay string `env:"TCP_NODELAY" yaml:"TCP_NODELAY"`
+
+	BufferSize  int  `env:"BUFFER_SIZE" yaml:"BUFFER_SIZE" default:"1024"`
+	PoolBuffers bool `env:"POOL_BUFFERS" yaml:"POOL_BUFFERS" default:"true"`
+
+	// AcceptParallelism is how many goroutines accept connections; more
+	// than one helps with very high connection rates on many cores.
+	AcceptParallelism int `env:"ACCEPT_PARALLELISM" yaml:"ACCEPT_PARALLELISM" default:"1"`
+
+	MaxConnections    int64 `env:"MAX_CONNECTIONS" yaml:"MAX_CONNECTIONS" default:"0"`
+	IPTrackerCapacity int   `env:"IP_TRACKER_CAPACITY" yaml:"IP_TRACKER_CAPACITY" default:"10000"`
+	MaxFailures       int   `env:"MAX_FAILURES" yaml:"MAX_FAILURES" default:"0"`
+	MaxChallenges     int   `env:"MAX_CHALLENGES" yaml:"MAX_CHALLENGES" default:"0"`
+	EntropyPoolSize   int   `env:"ENTROPY_POOL_SIZE" yaml:"ENTROPY_POOL_SIZE" default:"0"`
+	Stealth           bool  `env:"STEALTH" yaml:"STEALTH" default:"false"`
+	Observe           bool  `env:"OBSERVE" yaml:"OBSERVE" default:"false"`
+	DetailedErrors    bool  `env:"DETAILED_ERRORS" yaml:"DETAILED_ERRORS" default:"false"`
+
+	// VerboseClientErrors sends clients the full error behind error frames,
+	// as logged, instead of only a generic message. For development only.
+	VerboseClientErrors bool `env:"VERBOSE_CLIENT_ERRORS" yaml:"VERBOSE_CLIENT_ERRORS" default:"false"`
+
+	// MaxConnectionsPerIP caps the connections one IP may have open at
+	// once; zero means unlimited.
+	MaxConnectionsPerIP int `env:"MAX_CONNECTIONS_PER_IP" yaml:"MAX_CONNECTIONS_PER_IP" default:"0"`
+
+	// MaxSessionBytes cuts off clients sending more than this on one
+	// connection; zero means unlimited.
+	MaxSessionBytes int64 `env:"MAX_SESSION_BYTES" yaml:"MAX_SESSION_BYTES" default:"0"`
+
+	// MaxConnectionAge tells clients still connected after this long to
+	// reconnect; zero leaves connections to Deadline.
+	MaxConnectionAge time.Duration `env:"MAX_CONNECTION_AGE" yaml:"MAX_CONNECTION_AGE" default:"0"`
+
+	// MaxNonceLength rejects solutions longer than this before hashing
+	// them; zero means unlimited.
+	MaxNonceLength int `env:"MAX_NONCE_LENGTH" yaml:"MAX_NONCE_LENGTH" default:"64"`
+
+	// MaxGoroutines sheds new connections while the server runs more
+	// goroutines, as a last resort against leaks; zero disables it.
+	MaxGoroutines int `env:"MAX_GOROUTINES" yaml:"MAX_GOROUTINES" default:"0"`
+
+	// ProbeWindow gives connections this long to close before a challenge
+	// is generated, so load balancer liveness probes cost none. It delays
+	// every handshake as much; zero disables it.
+	ProbeWindow time.Duration `env:"PROBE_WINDOW" yaml:"PROBE_WINDOW" default:"0"`
+
+	// LogRejectedSolutions logs rejected solutions with the challenge and
+	// the client's bytes at debug level. Sensitive, meant for debugging.
+	LogRejectedSolutions bool `env:"LOG_REJECTED_SOLUTIONS" yaml:"LOG_REJECTED_SOLUTIONS" default:"false"`
+
+	// EchoChallenge requires clients to echo back the challenge, tagged
+	// with ChallengeSecret. Instances sharing a secret accept each other's
+	// challenges; an empty secret is replaced by a random one.
+	EchoChallenge   bool   `env:"ECHO_CHALLENGE" yaml:"ECHO_CHALLENGE" default:"false"`
+	ChallengeSecret string `env:"CHALLENGE_SECRET" yaml:"CHALLENGE_SECRET"`
+	// ChallengeSecretFile holds the secret instead of ChallengeSecret, and
+	// is read again on SIGHUP to rotate it; challenges tagged with the
+	// previous secret stay valid until they expire. Without either, SIGHUP
+	// rotates to a new random secret.
+	ChallengeSecretFile string `env:"CHALLENGE_SECRET_FILE" yaml:"CHALLENGE_SECRET_FILE"`
+	// ChallengeStore makes echoed challenges redeemable once: "memory" for
+	// a single instance, "redis" to share it between instances, or "none"
+	// to rely on epochs alone.
+	ChallengeStore string `env:"CHALLENGE_STORE" yaml:"CHALLENGE_STORE" default:"memory"`
+	RedisAddr      string `env:"REDIS_ADDR" yaml:"REDIS_ADDR"`
+	RedisKeyPrefix string `env:"REDIS_KEY_PREFIX" yaml:"REDIS_KEY_PREFIX" default:"faraway:challenge:"`
+	// EpochLength stamps echoed challenges with an epoch advancing this
+	// often; those from before the last EpochWindow epochs are rejected.
+	// Zero disables epochs.
+	EpochLength time.Duration `env:"EPOCH_LENGTH" yaml:"EPOCH_LENGTH" default:"0"`
+	EpochWindow uint64        `env:"EPOCH_WINDOW" yaml:"EPOCH_WINDOW" default:"1"`
+
+	// AuditLog appends a JSON proof record of every successful handshake
+	// to a file, or to stdout when set to "-". AuditKey, if set, signs
+	// them; `faraway verify-audit` re-checks them.
+	AuditLog string `env:"AUDIT_LOG" yaml:"AUDIT_LOG"`
+	AuditKey string `env:"AUDIT_KEY" yaml:"AUDIT_KEY"`
+
+	// TLSCert and TLSKey serve TLS instead of plain TCP. With TLSClientCA
+	// clients must present a certificate it signed, and BindClientCert ties
+	// echoed challenges to that certificate so solutions can't be relayed
+	// between clients.
+	TLSCert        string `env:"TLS_CERT" yaml:"TLS_CERT"`
+	TLSKey         string `env:"TLS_KEY" yaml:"TLS_KEY"`
+	TLSClientCA    string `env:"TLS_CLIENT_CA" yaml:"TLS_CLIENT_CA"`
+	BindClientCert bool   `env:"BIND_CLIENT_CERT" yaml:"BIND_CLIENT_CERT" default:"false"`
+
+	// Algorithms is a comma-separated list of the challenge types offered,
+	// by wire name: CPU (hashcash) and Memory (argon2).
+	Algorithms []string `env:"ALGORITHMS" yaml:"ALGORITHMS" default:"CPU,Memory"`
+
+	// AllowList is a comma-separated list of CIDR=DIFFICULTY entries giving
+	// matching clients another difficulty; 0 exempts them from proof of work.
+	AllowList []string `env:"ALLOW_LIST" yaml:"ALLOW_LIST"`
+
+	// ClientClasses is a comma-separated list of NAME=DIFFICULTY entries,
+	// optionally followed by ":" and the class's algorithms joined by "+",
+	// as in "vip=1,suspect=6:Memory"; 0 exempts the class. ClassRules are
+	// CIDR=NAME or cn:COMMON_NAME=NAME entries putting clients into them,
+	// the first match winning. Allow-listed clients are never classified.
+	ClientClasses []string `env:"CLIENT_CLASSES" yaml:"CLIENT_CLASSES"`
+	ClassRules    []string `env:"CLASS_RULES" yaml:"CLASS_RULES"`
+
+	// NetworkDatabase is the path of a GeoLite2 ASN database in CSV form.
+	// When set, the network and ASN of IPs turned away or failing
+	// handshakes are logged along with them.
+	NetworkDatabase string `env:"NETWORK_DATABASE" yaml:"NETWORK_DATABASE"`
+
+	MaxVerifications         int           `env:"MAX_VERIFICATIONS" yaml:"MAX_VERIFICATIONS" default:"0"`
+	VerificationMemoryKiB    int           `env:"VERIFICATION_MEMORY_KIB" yaml:"VERIFICATION_MEMORY_KIB" default:"0"`
+	VerificationQueueTimeout time.Duration `env:"VERIFICATION_QUEUE_TIMEOUT" yaml:"VERIFICATION_QUEUE_TIMEOUT" default:"1s"`
+	// CostAwareCapacity picks memory-bound challenges, costly to verify,
+	// less often as this many of their verifications are approached in
+	// flight; zero picks among the algorithms uniformly.
+	CostAwareCapacity int `env:"COST_AWARE_CAPACITY" yaml:"COST_AWARE_CAPACITY" default:"0"`
+
+	ChallengeTTL    time.Duration `env:"CHALLENGE_TTL" yaml:"CHALLENGE_TTL" default:"0"`
+	FailureWindow   time.Duration `env:"FAILURE_WINDOW" yaml:"FAILURE_WINDOW" default:"1m"`
+	ChallengeWindow time.Duration `env:"CHALLENGE_WINDOW" yaml:"CHALLENGE_WINDOW" default:"1m"`
+	QuoteCacheTTL   time.Duration `env:"QUOTE_CACHE_TTL" yaml:"QUOTE_CACHE_TTL" default:"0"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" yaml:"SHUTDOWN_TIMEOUT" default:"10s"`
+
+	// QuoteOrder is "random" or "round-robin". QuoteCursorFile keeps the
+	// round-robin position across restarts, saved every
+	// QuoteCursorInterval and on shutdown; empty starts from the first
+	// quote every time.
+	QuoteOrder          string        `env:"QUOTE_ORDER" yaml:"QUOTE_ORDER" default:"random"`
+	QuoteCursorFile     string        `env:"QUOTE_CURSOR_FILE" yaml:"QUOTE_CURSOR_FILE"`
+	QuoteCursorInterval time.Duration `env:"QUOTE_CURSOR_INTERVAL" yaml:"QUOTE_CURSOR_INTERVAL" default:"5s"`
+	// QuotesURL, if set, is an HTTP(S) URL the quotes are fetched from at
+	// startup: a JSON array, JSON objects one per line, or plain text one
+	// per line. The built-in quotes are served if it fails within
+	// QuotesURLTimeout.
+	QuotesURL        string        `env:"QUOTES_URL" yaml:"QUOTES_URL"`
+	QuotesURLTimeout time.Duration `env:"QUOTES_URL_TIMEOUT" yaml:"QUOTES_URL_TIMEOUT" default:"5s"`
+
+	// MinDifficulty is the floor no challenge is issued below, overriding
+	// allow-list entries and tuning; zero disables it. MinCPUDifficulty and
+	// MinMemoryDifficulty, if set, override it for hashcash challenges,
+	// counted in hex digits, and argon2 ones, counted in bits.
+	MinDifficulty       uint64 `env:"MIN_DIFFICULTY" yaml:"MIN_DIFFICULTY" default:"0"`
+	MinCPUDifficulty    uint64 `env:"MIN_CPU_DIFFICULTY" yaml:"MIN_CPU_DIFFICULTY" default:"0"`
+	MinMemoryDifficulty uint64 `env:"MIN_MEMORY_DIFFICULTY" yaml:"MIN_MEMORY_DIFFICULTY" default:"0"`
+
+	// AutoDifficultyTarget tunes the difficulty online towards this median
+	// solve time; zero keeps it fixed. It requires EMBED_DIFFICULTY, for
+	// clients to learn the tuned difficulty. AUTO_DIFFICULTY_MAX is capped
+	// at the highest difficulty every enabled algorithm accepts.
+	AutoDifficultyTarget  time.Duration `env:"AUTO_DIFFICULTY_TARGET" yaml:"AUTO_DIFFICULTY_TARGET" default:"0"`
+	AutoDifficultyMin     uint64        `env:"AUTO_DIFFICULTY_MIN" yaml:"AUTO_DIFFICULTY_MIN" default:"1"`
+	AutoDifficultyMax     uint64        `env:"AUTO_DIFFICULTY_MAX" yaml:"AUTO_DIFFICULTY_MAX" default:"10"`
+	AutoDifficultySamples int           `env:"AUTO_DIFFICULTY_SAMPLES" yaml:"AUTO_DIFFICULTY_SAMPLES" default:"50"`
+	// SaturationShedLoad turns new connections away as busy once tuning is
+	// stuck at AUTO_DIFFICULTY_MAX with solves still too fast, while the
+	// server's load, from 1 to 100 as by MAX_CONNECTIONS and the
+	// verification limits, is at least this. Zero disables shedding.
+	SaturationShedLoad int `env:"SATURATION_SHED_LOAD" yaml:"SATURATION_SHED_LOAD" default:"0"`
+	// PerClientDifficulty tunes towards AutoDifficultyTarget for every
+	// connection on its own, a step per solve, instead of server-wide.
+	// HandshakesPerConnection is how many quotes a connection may be used
+	// for, which gives it solves to tune on; one closes it after its quote.
+	PerClientDifficulty     bool `env:"PER_CLIENT_DIFFICULTY" yaml:"PER_CLIENT_DIFFICULTY" default:"false"`
+	HandshakesPerConnection int  `env:"HANDSHAKES_PER_CONNECTION" yaml:"HANDSHAKES_PER_CONNECTION" default:"1"`
+	// AcceptSolveTimes lets clients report their solve times, which are
+	// then tuned on instead of times measured by the server. Like
+	// ADVERTISE_VERSION, it breaks clients predating it.
+	AcceptSolveTimes bool `env:"ACCEPT_SOLVE_TIMES" yaml:"ACCEPT_SOLVE_TIMES" default:"false"`
+	// SendHints advises clients how to solve each challenge, e.g. on how
+	// many goroutines. Like ADVERTISE_VERSION, it breaks clients predating
+	// it.
+	SendHints bool `env:"SEND_HINTS" yaml:"SEND_HINTS" default:"false"`
+	// AdvertiseLoad adds how busy the server is, from 1 to 100, to hints.
+	// It goes by MAX_CONNECTIONS and the verification limits.
+	AdvertiseLoad bool `env:"ADVERTISE_LOAD" yaml:"ADVERTISE_LOAD" default:"false"`
+
+	// EmbedDifficulty sends the difficulty with every challenge, so clients
+	// needn't be configured to match it. Like
+	// ADVERTISE_VERSION, it breaks clients predating it.
+	EmbedDifficulty bool `env:"EMBED_DIFFICULTY" yaml:"EMBED_DIFFICULTY" default:"false"`
+
+	// SessionTTL grants clients that solved a challenge a session token,
+	// signed with the challenge secret, that spares them solving for this
+	// long. Zero grants none. Like ADVERTISE_VERSION, it breaks clients
+	// predating it.
+	SessionTTL time.Duration `env:"SESSION_TTL" yaml:"SESSION_TTL" default:"0"`
+
+	// AdvertiseVersion sends the server version to clients right after the
+	// preamble. Clients predating it can't parse the frame, so enable it
+	// only once they are upgraded. VERSION defaults to the build's module
+	// version.
+	AdvertiseVersion bool   `env:"ADVERTISE_VERSION" yaml:"ADVERTISE_VERSION" default:"false"`
+	Version          string `env:"VERSION" yaml:"VERSION"`
+
+	WebSocketAddr string `env:"WS_ADDR" yaml:"WS_ADDR"`
+	WebSocketPath string `env:"WS_PATH" yaml:"WS_PATH" default:"/ws"`
 }
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"faraway/internal/server/tcp"
+)
+
+// VerifyAuditLog re-checks every record of an audit log written by the
+// server, reporting each one failing to w, followed by a summary. key must
+// be the server's AUDIT_KEY if records were signed; without it only the
+// solutions are checked.
+func VerifyAuditLog(r io.Reader, key []byte, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	// Records embed the challenge and quote, so allow for long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var records, failed int
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		records++
+
+		var record tcp.AuditRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err == nil {
+			err = tcp.VerifyAuditRecord(key, record)
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "line %d: %v\n", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d audit records failed verification", failed, records)
+	}
+	fmt.Fprintf(w, "%d audit records verified\n", records)
+	return nil
+}
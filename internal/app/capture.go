@@ -0,0 +1,127 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+
+	"faraway/internal/capture"
+)
+
+var ErrReplayDiverged = errors.New("replay diverged from the capture")
+
+// RunCapture relays clients connecting to listen to the server at upstream
+// until ctx is done, writing every frame either side sends to w.
+func RunCapture(ctx context.Context, listen, upstream string, w io.Writer) error {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	logger.Info("capturing", "listen", listener.Addr(), "upstream", upstream)
+
+	recorder := capture.NewRecorder(w)
+	err = capture.Proxy(ctx, listener, upstream, recorder, logger)
+	return errors.Join(err, recorder.Err())
+}
+
+// RunReplay replays what as sent on connection conn of the capture read
+// from r: as a client to the server at addr, as a server to the first
+// client connecting to addr. The replayed session is written to w as a
+// capture of its own, and ErrReplayDiverged returned when it isn't the
+// captured one.
+func RunReplay(ctx context.Context, r io.Reader, conn uint64, as capture.Side, addr string, w io.Writer) error {
+	frames, err := capture.ReadCapture(r)
+	if err != nil {
+		return err
+	}
+	session := capture.Connection(frames, conn)
+	if len(session) == 0 {
+		return fmt.Errorf("no frames of connection %d in the capture", conn)
+	}
+
+	var peer net.Conn
+	switch as {
+	case capture.Client:
+		var dialer net.Dialer
+		if peer, err = dialer.DialContext(ctx, "tcp", addr); err != nil {
+			return fmt.Errorf("failed to connect: %w", err)
+		}
+	case capture.Server:
+		if peer, err = acceptOne(ctx, addr); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot replay as %q", as)
+	}
+
+	var replayed bytes.Buffer
+	recorder := capture.NewRecorder(io.MultiWriter(w, &replayed))
+	if err := capture.Replay(ctx, peer, session, as, recorder); err != nil {
+		return err
+	}
+	if err := recorder.Err(); err != nil {
+		return err
+	}
+
+	got, err := capture.ReadCapture(&replayed)
+	if err != nil {
+		return err
+	}
+	// Either side may be ahead of the other, so each is compared on its own
+	for _, side := range []capture.Side{capture.Client, capture.Server} {
+		want, got := sentBy(session, side), sentBy(got, side)
+		for i := range max(len(want), len(got)) {
+			if i >= len(want) || i >= len(got) || !want[i].Equal(got[i]) {
+				return fmt.Errorf("%w at %s frame %d: expected %s, got %s", ErrReplayDiverged, side, i+1, frameAt(want, i), frameAt(got, i))
+			}
+		}
+	}
+	return nil
+}
+
+// sentBy returns the frames side sent.
+func sentBy(frames []capture.Frame, side capture.Side) []capture.Frame {
+	var sent []capture.Frame
+	for _, f := range frames {
+		if f.From == side {
+			sent = append(sent, f)
+		}
+	}
+	return sent
+}
+
+// acceptOne accepts the first client connecting to addr.
+func acceptOne(ctx context.Context, addr string) (net.Conn, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to accept: %w", err)
+	}
+	return conn, nil
+}
+
+// frameAt describes frame i of frames, which may be missing.
+func frameAt(frames []capture.Frame, i int) string {
+	if i >= len(frames) {
+		return "no frame"
+	}
+	f := frames[i]
+	return fmt.Sprintf("%s %q", f.Kind, f.Text+string(f.Data))
+}
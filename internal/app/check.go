@@ -0,0 +1,225 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"faraway/config"
+	"faraway/internal/client/tcp"
+	"faraway/internal/usecases"
+	"faraway/pkg/pow/argon2"
+	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
+)
+
+// CheckServerConfig loads the server configuration and reports every
+// problem with it, without binding sockets or starting anything.
+func CheckServerConfig() error {
+	cfg, err := config.LoadServerConfig()
+	if err != nil {
+		return err
+	}
+	return validateServerConfig(cfg)
+}
+
+// CheckClientConfig is CheckServerConfig for the client.
+func CheckClientConfig() error {
+	cfg, err := config.LoadClientConfig()
+	if err != nil {
+		return err
+	}
+	return validateClientConfig(cfg)
+}
+
+// validateServerConfig checks the settings cleanenv can't, joining every
+// problem found.
+func validateServerConfig(cfg *config.ServerConfig) error {
+	var problems []error
+	if cfg.Server.Deadline <= 0 {
+		problems = append(problems, errors.New("DEADLINE must be positive"))
+	}
+	if cfg.Server.AcceptParallelism < 0 {
+		problems = append(problems, errors.New("ACCEPT_PARALLELISM must not be negative"))
+	}
+	if cfg.Server.MaxGoroutines < 0 {
+		problems = append(problems, errors.New("MAX_GOROUTINES must not be negative"))
+	}
+	if cfg.Server.ProbeWindow < 0 || (cfg.Server.Deadline > 0 && cfg.Server.ProbeWindow >= cfg.Server.Deadline) {
+		problems = append(problems, errors.New("PROBE_WINDOW must not be negative nor reach DEADLINE"))
+	}
+	if cfg.Server.EpochLength < 0 {
+		problems = append(problems, errors.New("EPOCH_LENGTH must not be negative"))
+	} else if cfg.Server.EpochLength > 0 && !cfg.Server.EchoChallenge {
+		problems = append(problems, errors.New("EPOCH_LENGTH requires ECHO_CHALLENGE"))
+	}
+	if _, err := parseNoDelay(cfg.Server.NoDelay); err != nil {
+		problems = append(problems, fmt.Errorf("TCP_NODELAY: %w", err))
+	}
+	if cfg.Server.MaxSessionBytes < 0 {
+		problems = append(problems, errors.New("MAX_SESSION_BYTES must not be negative"))
+	}
+	if order := cfg.Server.QuoteOrder; order != "random" && order != "round-robin" {
+		problems = append(problems, fmt.Errorf("QUOTE_ORDER: %w, got %q", ErrQuoteOrder, order))
+	}
+	if cfg.Server.QuoteCursorFile != "" && cfg.Server.QuoteCursorInterval <= 0 {
+		problems = append(problems, errors.New("QUOTE_CURSOR_INTERVAL must be positive"))
+	}
+	if cfg.Server.QuotesURL != "" {
+		if u, err := url.Parse(cfg.Server.QuotesURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, errors.New("QUOTES_URL must be an http or https URL"))
+		}
+		if cfg.Server.QuotesURLTimeout <= 0 {
+			problems = append(problems, errors.New("QUOTES_URL_TIMEOUT must be positive"))
+		}
+	}
+	if cfg.Server.MaxNonceLength < 0 {
+		problems = append(problems, errors.New("MAX_NONCE_LENGTH must not be negative"))
+	}
+	if cfg.Server.CostAwareCapacity < 0 {
+		problems = append(problems, errors.New("COST_AWARE_CAPACITY must not be negative"))
+	}
+	if cfg.Server.AdvertiseLoad && !cfg.Server.SendHints {
+		problems = append(problems, errors.New("ADVERTISE_LOAD requires SEND_HINTS"))
+	}
+	if cfg.Server.SessionTTL < 0 {
+		problems = append(problems, errors.New("SESSION_TTL must not be negative"))
+	}
+	algorithms, err := parseAlgorithms(cfg.Server.Algorithms)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("ALGORITHMS: %w", err))
+	} else if _, err := usecases.NewPowUsecaseWithAlgorithms(cfg.Pow.Difficulty, nil, algorithms...); err != nil {
+		problems = append(problems, fmt.Errorf("DIFFICULTY: %w", err))
+	}
+	if cfg.Server.HandshakesPerConnection < 0 {
+		problems = append(problems, errors.New("HANDSHAKES_PER_CONNECTION must not be negative"))
+	}
+	if cfg.Server.AutoDifficultyTarget > 0 && !cfg.Server.EmbedDifficulty {
+		problems = append(problems, errors.New("AUTO_DIFFICULTY_TARGET requires EMBED_DIFFICULTY for clients to follow the tuned difficulty"))
+	}
+	if cfg.Server.AutoDifficultyMin > cfg.Server.AutoDifficultyMax {
+		problems = append(problems, errors.New("AUTO_DIFFICULTY_MIN must not exceed AUTO_DIFFICULTY_MAX"))
+	}
+	if shed := cfg.Server.SaturationShedLoad; shed < 0 || shed > protocol.MaxLoad {
+		problems = append(problems, fmt.Errorf("SATURATION_SHED_LOAD must be between 0 and %d", protocol.MaxLoad))
+	} else if shed > 0 && (cfg.Server.AutoDifficultyTarget <= 0 || cfg.Server.PerClientDifficulty) {
+		problems = append(problems, errors.New("SATURATION_SHED_LOAD requires AUTO_DIFFICULTY_TARGET without PER_CLIENT_DIFFICULTY"))
+	} else if shed > 0 && cfg.Server.MaxConnections <= 0 && cfg.Server.MaxVerifications <= 0 && cfg.Server.VerificationMemoryKiB <= 0 {
+		problems = append(problems, errors.New("SATURATION_SHED_LOAD requires MAX_CONNECTIONS or a verification limit to measure load"))
+	}
+	allowList, err := parseAllowList(cfg.Server.AllowList, algorithms)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("ALLOW_LIST: %w", err))
+	}
+	classes, err := parseClasses(cfg.Server.ClientClasses, algorithms)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("CLIENT_CLASSES: %w", err))
+	} else if _, err := parseClassRules(cfg.Server.ClassRules, classes); err != nil {
+		problems = append(problems, fmt.Errorf("CLASS_RULES: %w", err))
+	}
+	// Each floor must suit its algorithm wherever it is offered, including
+	// allow-list entries and classes with algorithms of their own
+	for _, algorithm := range offeredAlgorithms(algorithms, allowList, classes) {
+		if floor := minDifficulty(cfg, algorithm); floor > 0 {
+			if _, err := usecases.NewPowUsecaseWithAlgorithms(floor, nil, algorithm); err != nil {
+				problems = append(problems, fmt.Errorf("MIN_DIFFICULTY for %s challenges: %w", algorithm, err))
+			}
+		}
+	}
+	if _, err := loadNetworkLookup(cfg.Server.NetworkDatabase); err != nil {
+		problems = append(problems, fmt.Errorf("NETWORK_DATABASE: %w", err))
+	}
+	if cfg.Server.ChallengeSecret != "" && cfg.Server.ChallengeSecretFile != "" {
+		problems = append(problems, errors.New("CHALLENGE_SECRET and CHALLENGE_SECRET_FILE are mutually exclusive"))
+	} else if _, err := loadChallengeSecret(cfg); err != nil {
+		problems = append(problems, fmt.Errorf("CHALLENGE_SECRET_FILE: %w", err))
+	}
+	if _, err := newChallengeStore(cfg); err != nil {
+		problems = append(problems, fmt.Errorf("CHALLENGE_STORE: %w", err))
+	}
+	if _, err := serverTLSConfig(cfg); err != nil {
+		problems = append(problems, fmt.Errorf("TLS_CERT: %w", err))
+	}
+	if cfg.Server.BindClientCert && (cfg.Server.TLSCert == "" || cfg.Server.TLSClientCA == "" || !cfg.Server.EchoChallenge) {
+		problems = append(problems, errors.New("BIND_CLIENT_CERT needs TLS_CERT, TLS_CLIENT_CA and ECHO_CHALLENGE"))
+	}
+	if _, err := advertisedVersion(cfg); err != nil {
+		problems = append(problems, fmt.Errorf("VERSION: %w", err))
+	}
+	return errors.Join(problems...)
+}
+
+// validateClientConfig checks the settings cleanenv can't, joining every
+// problem found.
+func validateClientConfig(cfg *config.ClientConfig) error {
+	var problems []error
+	// Each algorithm's range is checked against the setting it takes its
+	// difficulty from
+	difficulties := solverDifficulties(cfg)
+	cpuSetting, memorySetting := "DIFFICULTY", "DIFFICULTY"
+	if cfg.CPUDifficulty > 0 {
+		cpuSetting = "CPU_DIFFICULTY"
+	}
+	if cfg.MemoryDifficulty > 0 {
+		memorySetting = "MEMORY_DIFFICULTY"
+	}
+	if _, err := hashcash.NewHashCash(difficulties.CPU); err != nil {
+		problems = append(problems, fmt.Errorf("%s: %w", cpuSetting, err))
+	}
+	if _, err := argon2.NewArgon2(difficulties.Memory); err != nil {
+		problems = append(problems, fmt.Errorf("%s: %w", memorySetting, err))
+	}
+	if cfg.DifficultyTolerance > 0 && !cfg.PinDifficulty {
+		problems = append(problems, errors.New("DIFFICULTY_TOLERANCE requires PIN_DIFFICULTY"))
+	}
+	if cfg.MaxMessageSize <= 0 {
+		problems = append(problems, errors.New("MAX_MESSAGE_SIZE must be positive"))
+	}
+	if _, err := hashcash.ParseNonceEncoding(cfg.NonceEncoding); err != nil {
+		problems = append(problems, fmt.Errorf("NONCE_ENCODING: %w", err))
+	}
+	if cfg.MinServerVersion != "" {
+		if _, err := protocol.ParseSemVer(cfg.MinServerVersion); err != nil {
+			problems = append(problems, fmt.Errorf("MIN_SERVER_VERSION: %w", err))
+		}
+	}
+	if _, err := clientTLSConfig(cfg); err != nil {
+		problems = append(problems, fmt.Errorf("TLS: %w", err))
+	}
+	if _, err := usecases.ParseSolveStrategy(cfg.SolveStrategy); err != nil {
+		problems = append(problems, fmt.Errorf("SOLVE_STRATEGY: %w", err))
+	}
+	switch cfg.Failover {
+	case tcp.FailoverOrdered, tcp.FailoverRoundRobin:
+	default:
+		problems = append(problems, fmt.Errorf("FAILOVER: unsupported failover strategy %q", cfg.Failover))
+	}
+	if cfg.ShutdownTimeout < 0 {
+		problems = append(problems, errors.New("SHUTDOWN_TIMEOUT must not be negative"))
+	}
+	if cfg.SolveProgress < 0 {
+		problems = append(problems, errors.New("SOLVE_PROGRESS must not be negative"))
+	}
+	if cfg.WatchInterval < 0 {
+		problems = append(problems, errors.New("WATCH_INTERVAL must not be negative"))
+	} else if cfg.WatchInterval > 0 && cfg.PrintQuote {
+		problems = append(problems, errors.New("WATCH_INTERVAL and PRINT_QUOTE are mutually exclusive"))
+	}
+	if cfg.WatchPrefetch < 0 {
+		problems = append(problems, errors.New("WATCH_PREFETCH must not be negative"))
+	} else if cfg.WatchPrefetch > 0 && cfg.WatchInterval <= 0 {
+		problems = append(problems, errors.New("WATCH_PREFETCH requires WATCH_INTERVAL"))
+	}
+	if _, err := parseNoDelay(cfg.NoDelay); err != nil {
+		problems = append(problems, fmt.Errorf("TCP_NODELAY: %w", err))
+	}
+	if cfg.SessionFile != "" && !cfg.ReuseSessions {
+		problems = append(problems, errors.New("SESSION_FILE requires REUSE_SESSIONS"))
+	}
+	switch cfg.Transport {
+	case "tcp", "websocket":
+	default:
+		problems = append(problems, fmt.Errorf("TRANSPORT: unsupported transport %q", cfg.Transport))
+	}
+	return errors.Join(problems...)
+}
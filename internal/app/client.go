@@ -2,47 +2,219 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net"
+	"os"
 	"time"
 
 	"faraway/config"
 	"faraway/internal/client/tcp"
+	"faraway/internal/domain"
 	"faraway/internal/usecases"
+	"faraway/internal/websocket"
+	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
 )
 
+// ErrMaxRuntime is returned when the client gave up because MaxRuntime
+// passed, as opposed to failing outright.
+var ErrMaxRuntime = errors.New("client exceeded its maximum runtime")
+
 // RunClient started client application
 func RunClient(ctx context.Context) error {
 	cfg, err := config.LoadClientConfig()
 	if err != nil {
 		return fmt.Errorf("failed to load configuration: %w", err)
 	}
+	if err := validateClientConfig(cfg); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
 
 	logger := slog.Default()
 	logger = logger.With("Service", cfg.Name)
 
-	solverUsecase, err := usecases.NewSolverUsecase(cfg.Difficulty)
+	nonceEncoding, err := hashcash.ParseNonceEncoding(cfg.NonceEncoding)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	strategy, err := usecases.ParseSolveStrategy(cfg.SolveStrategy)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	solverUsecase, err := usecases.NewSolverUsecaseWithDifficulties(solverDifficulties(cfg), nonceEncoding, strategy)
 	if err != nil {
 		log.Fatal(ErrPowInit, err)
 	}
+	if reporter, ok := solverUsecase.(usecases.CPUProgressReporter); ok && cfg.SolveProgress > 0 {
+		reporter.ReportCPUProgress(cfg.SolveProgress, func(progress hashcash.Progress) {
+			logger.Info("solving", "tries", progress.Tries, "elapsed", progress.Elapsed)
+		})
+	}
+
+	clientCfg := &tcp.Config{
+		ServerAddrs:    cfg.ServerAddrs,
+		Failover:       cfg.Failover,
+		ConnectTimeout: 5 * time.Second,
+		RequestTimeout: 5 * time.Second,
+		RetryAttempts:  3,
+		RetryDelay:     5 * time.Second,
+		MaxMessageSize: cfg.MaxMessageSize,
+		BufferSize:     1024,
+
+		LaunchInterval:  3 * time.Second,
+		ShutdownTimeout: cfg.ShutdownTimeout,
+
+		PreambleTimeout: 2 * time.Second,
+		EchoChallenge:   cfg.EchoChallenge,
+		ReportSolveTime: cfg.ReportSolveTime,
+		FollowHints:     cfg.FollowHints,
+		ReuseSessions:   cfg.ReuseSessions,
+		SessionFile:     cfg.SessionFile,
+		PrefetchMaxAge:  cfg.WatchPrefetch,
+		Metrics:         logMetrics{logger},
+	}
+	if clientCfg.NoDelay, err = parseNoDelay(cfg.NoDelay); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if clientCfg.TLSConfig, err = clientTLSConfig(cfg); err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	if cfg.MinServerVersion != "" {
+		minimum, err := protocol.ParseSemVer(cfg.MinServerVersion)
+		if err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+		clientCfg.MinServerVersion = &minimum
+	}
+	if cfg.DumpChallenge {
+		clientCfg.ChallengeDump = os.Stderr
+	}
+	if cfg.PinDifficulty {
+		difficulties := solverDifficulties(cfg)
+		clientCfg.PinnedDifficulties = map[protocol.ChallengeType]uint64{
+			protocol.ChallengeTypeCPU:    difficulties.CPU,
+			protocol.ChallengeTypeMemory: difficulties.Memory,
+		}
+		clientCfg.DifficultyTolerance = cfg.DifficultyTolerance
+	}
+	switch cfg.Transport {
+	case "tcp":
+	case "websocket":
+		clientCfg.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return websocket.Dial(ctx, websocket.URL(address, cfg.WebSocketPath))
+		}
+	default:
+		return fmt.Errorf("unsupported transport %q", cfg.Transport)
+	}
 
 	client := tcp.NewClient(
-		&tcp.Config{
-			ServerAddr:     cfg.ServerAddr,
-			ConnectTimeout: 5 * time.Second,
-			RequestTimeout: 5 * time.Second,
-			RetryAttempts:  3,
-			RetryDelay:     5 * time.Second,
-			MaxMessageSize: 1024,
-			BufferSize:     1024,
-		},
+		clientCfg,
 		solverUsecase,
 		logger,
 	)
-	if err := client.Start(ctx); err != nil {
+	return withMaxRuntime(ctx, cfg.MaxRuntime, func(ctx context.Context) error {
+		if cfg.PrintQuote {
+			return printQuote(ctx, client, os.Stdout)
+		}
+		if cfg.WatchInterval > 0 {
+			return watchQuotes(ctx, client, cfg.WatchInterval, os.Stdout)
+		}
+		return runClients(ctx, client, logger)
+	})
+}
+
+// solverDifficulties returns the difficulty each algorithm is solved at:
+// CPU_DIFFICULTY and MEMORY_DIFFICULTY, or DIFFICULTY where unset.
+func solverDifficulties(cfg *config.ClientConfig) usecases.SolverDifficulties {
+	difficulties := usecases.UniformDifficulties(cfg.Difficulty)
+	if cfg.CPUDifficulty > 0 {
+		difficulties.CPU = cfg.CPUDifficulty
+	}
+	if cfg.MemoryDifficulty > 0 {
+		difficulties.Memory = cfg.MemoryDifficulty
+	}
+	return difficulties
+}
+
+// runClients runs the client's handshakes until they are done or ctx is,
+// then logs how they went.
+func runClients(ctx context.Context, client *tcp.Client, logger *slog.Logger) error {
+	summary, err := client.Start(ctx)
+	logger.Info("client summary",
+		"completed", summary.Completed,
+		"aborted", summary.Aborted,
+		"failed", summary.Failed,
+		"interrupted", ctx.Err() != nil,
+		"connect_attempts", summary.ConnectAttempts,
+		"retries", summary.Retries,
+		"failovers", summary.Failovers)
+	if err != nil {
 		return fmt.Errorf("failed to start client: %w", err)
 	}
+	return nil
+}
 
+// withMaxRuntime calls run with a context cancelled after maxRuntime, and
+// returns ErrMaxRuntime once it passes even if run is still busy, e.g.
+// sleeping between retries. A zero maxRuntime just calls run.
+func withMaxRuntime(ctx context.Context, maxRuntime time.Duration, run func(ctx context.Context) error) error {
+	if maxRuntime <= 0 {
+		return run(ctx)
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, maxRuntime, ErrMaxRuntime)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil && errors.Is(context.Cause(ctx), ErrMaxRuntime) {
+			return fmt.Errorf("%w (%s): %v", ErrMaxRuntime, maxRuntime, err)
+		}
+		return err
+	case <-ctx.Done():
+		if errors.Is(context.Cause(ctx), ErrMaxRuntime) {
+			return fmt.Errorf("%w (%s)", ErrMaxRuntime, maxRuntime)
+		}
+		return <-done
+	}
+}
+
+// printQuote fetches one quote and writes just the quote to w, for use in
+// shell pipelines.
+func printQuote(ctx context.Context, client *tcp.Client, w io.Writer) error {
+	quote, err := client.FetchQuote(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch quote: %w", err)
+	}
+	if _, err := fmt.Fprintln(w, quote.String()); err != nil {
+		return fmt.Errorf("failed to print quote: %w", err)
+	}
+	return nil
+}
+
+// watchQuotes prints a quote every interval, each on a line of its own
+// after the time it was fetched, until ctx is done or printing fails.
+func watchQuotes(ctx context.Context, client *tcp.Client, interval time.Duration, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var err error
+	client.Watch(ctx, interval, func(at time.Time, quote domain.Quote) {
+		if _, err = fmt.Fprintf(w, "%s %s\n", at.Format(time.RFC3339), quote.String()); err != nil {
+			cancel()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to print quote: %w", err)
+	}
 	return nil
 }
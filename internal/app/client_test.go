@@ -0,0 +1,181 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"faraway/config"
+	"faraway/internal/client/tcp"
+	"faraway/pkg/protocol"
+)
+
+func TestPrintQuoteWritesOnlyTheQuote(t *testing.T) {
+	cfg := &tcp.Config{
+		ServerAddrs:    []string{"pipe"},
+		ConnectTimeout: time.Second,
+		RequestTimeout: 5 * time.Second,
+		MaxMessageSize: 1024,
+		BufferSize:     1024,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				server.Write(protocol.Preamble)
+				server.Write([]byte{protocol.FrameObserve})
+				server.Write([]byte("SUCCESS:Stay hungry, stay foolish.\n"))
+			}()
+			return client, nil
+		},
+	}
+	client := tcp.NewClient(cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var stdout bytes.Buffer
+	if err := printQuote(context.Background(), client, &stdout); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := stdout.String(); got != "Stay hungry, stay foolish.\n" {
+		t.Fatalf("expected only the quote on stdout, got %q", got)
+	}
+}
+
+func TestMaxRuntimeStopsClientWaitingOnSilentServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer listener.Close()
+	// Accept connections but never send anything
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := tcp.NewClient(&tcp.Config{
+		ServerAddrs:    []string{listener.Addr().String()},
+		ConnectTimeout: time.Second,
+		RequestTimeout: time.Minute,
+		RetryAttempts:  3,
+		RetryDelay:     time.Minute,
+		MaxMessageSize: 1024,
+		BufferSize:     1024,
+	}, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	const maxRuntime = 200 * time.Millisecond
+	start := time.Now()
+	err = withMaxRuntime(context.Background(), maxRuntime, func(ctx context.Context) error {
+		return printQuote(ctx, client, io.Discard)
+	})
+	if elapsed := time.Since(start); elapsed > maxRuntime+time.Second {
+		t.Fatalf("expected the client to stop within %s, took %s", maxRuntime, elapsed)
+	}
+	if !errors.Is(err, ErrMaxRuntime) {
+		t.Fatalf("expected ErrMaxRuntime, got %v", err)
+	}
+}
+
+func TestWithMaxRuntimeKeepsOtherErrors(t *testing.T) {
+	failure := errors.New("failed")
+	err := withMaxRuntime(context.Background(), time.Minute, func(ctx context.Context) error { return failure })
+	if !errors.Is(err, failure) || errors.Is(err, ErrMaxRuntime) {
+		t.Fatalf("expected the run error alone, got %v", err)
+	}
+}
+
+func TestValidateClientDifficulties(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   config.Client
+		problems []string
+	}{
+		{"shared difficulty past argon2's range", config.Client{}, []string{"DIFFICULTY"}},
+		{"memory difficulty overridden", config.Client{MemoryDifficulty: 3}, nil},
+		{"memory override out of range", config.Client{MemoryDifficulty: 11}, []string{"MEMORY_DIFFICULTY"}},
+		{"cpu override out of range", config.Client{CPUDifficulty: 65, MemoryDifficulty: 3}, []string{"CPU_DIFFICULTY"}},
+	}
+	for _, tt := range tests {
+		tt.client.Failover = tcp.FailoverOrdered
+		tt.client.Transport = "tcp"
+		tt.client.MaxMessageSize = 1024
+		cfg := &config.ClientConfig{Client: tt.client, Pow: config.Pow{Difficulty: 12}}
+
+		err := validateClientConfig(cfg)
+		if len(tt.problems) == 0 && err != nil {
+			t.Fatalf("%s: unexpected problems: %v", tt.name, err)
+		}
+		for _, problem := range tt.problems {
+			if err == nil || !strings.HasPrefix(err.Error(), problem+":") {
+				t.Fatalf("%s: expected a %s problem, got %v", tt.name, problem, err)
+			}
+		}
+	}
+	if difficulties := solverDifficulties(&config.ClientConfig{Client: config.Client{MemoryDifficulty: 3}, Pow: config.Pow{Difficulty: 12}}); difficulties.CPU != 12 || difficulties.Memory != 3 {
+		t.Fatalf("expected CPU at DIFFICULTY and memory overridden, got %+v", difficulties)
+	}
+}
+
+func TestCancelledClientSummarizesHandshakes(t *testing.T) {
+	const handshakes = 10
+	dialed := make(chan struct{}, handshakes)
+	release := make(chan struct{})
+	defer close(release)
+	var first atomic.Bool
+	cfg := &tcp.Config{
+		ServerAddrs:     []string{"pipe"},
+		ConnectTimeout:  time.Second,
+		RequestTimeout:  time.Minute,
+		MaxMessageSize:  1024,
+		BufferSize:      1024,
+		ShutdownTimeout: 50 * time.Millisecond,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				server.Write(protocol.Preamble)
+				// The first handshake completes, the others hang until
+				// they are aborted
+				if first.CompareAndSwap(false, true) {
+					server.Write([]byte{protocol.FrameObserve})
+					server.Write([]byte("SUCCESS:Stay hungry, stay foolish.\n"))
+				} else {
+					<-release
+				}
+			}()
+			dialed <- struct{}{}
+			return client, nil
+		},
+	}
+	client := tcp.NewClient(cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for i := 0; i < handshakes; i++ {
+			<-dialed
+		}
+		cancel()
+	}()
+
+	var logs bytes.Buffer
+	start := time.Now()
+	if err := runClients(ctx, client, slog.New(slog.NewTextHandler(&logs, nil))); err != nil {
+		t.Fatalf("expected aborted handshakes not to fail the client, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the client to stop after the shutdown timeout, took %s", elapsed)
+	}
+	if summary := `msg="client summary" completed=1 aborted=9 failed=0 interrupted=true`; !strings.Contains(logs.String(), summary) {
+		t.Fatalf("expected %q in the logs, got:\n%s", summary, logs.String())
+	}
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	clienttcp "faraway/internal/client/tcp"
+	servertcp "faraway/internal/server/tcp"
+	"faraway/internal/usecases"
+)
+
+// RunDemo runs a server and a client in-process over loopback and writes
+// the quote the client earns to w. Only warnings and errors are logged, so
+// the output is just the quote.
+func RunDemo(ctx context.Context, difficulty uint64, w io.Writer) error {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	powUsecase, err := usecases.NewPowUsecase(difficulty)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrPowInit, err)
+	}
+	solverUsecase, err := usecases.NewSolverUsecase(difficulty)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ErrPowInit, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	address := listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	server := servertcp.NewServer(
+		&servertcp.Config{
+			Address:         address,
+			Deadline:        30 * time.Second,
+			ShutdownTimeout: time.Second,
+		},
+		powUsecase,
+		usecases.NewQuoteUsecase(),
+		logger,
+	)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	client := clienttcp.NewClient(
+		&clienttcp.Config{
+			ServerAddrs:     []string{address},
+			ConnectTimeout:  5 * time.Second,
+			RequestTimeout:  30 * time.Second,
+			MaxMessageSize:  1024,
+			BufferSize:      1024,
+			PreambleTimeout: 2 * time.Second,
+		},
+		solverUsecase,
+		logger,
+	)
+	err = printQuote(ctx, client, w)
+
+	cancel()
+	if serveErr := <-served; err == nil && serveErr != nil {
+		err = fmt.Errorf("%s: %w", ErrRunServer, serveErr)
+	}
+	return err
+}
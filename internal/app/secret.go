@@ -0,0 +1,74 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"faraway/config"
+	"faraway/internal/server/tcp"
+)
+
+// errStaticSecret is returned when rotating a secret set by
+// CHALLENGE_SECRET, which can't change while the server runs.
+var errStaticSecret = errors.New("CHALLENGE_SECRET can't be rotated, use CHALLENGE_SECRET_FILE")
+
+// loadChallengeSecret returns the secret challenge tokens are tagged with:
+// the contents of CHALLENGE_SECRET_FILE, CHALLENGE_SECRET, or a random
+// secret when neither is set.
+func loadChallengeSecret(cfg *config.ServerConfig) ([]byte, error) {
+	if cfg.Server.ChallengeSecretFile != "" {
+		secret, err := os.ReadFile(cfg.Server.ChallengeSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		if secret = bytes.TrimSpace(secret); len(secret) == 0 {
+			return nil, fmt.Errorf("%s is empty", cfg.Server.ChallengeSecretFile)
+		}
+		return secret, nil
+	}
+	if cfg.Server.ChallengeSecret != "" {
+		return []byte(cfg.Server.ChallengeSecret), nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate challenge secret: %w", err)
+	}
+	return secret, nil
+}
+
+// rotateChallengeSecretOnHangup rotates the server's challenge secret on
+// every SIGHUP until ctx is done: to the current contents of
+// CHALLENGE_SECRET_FILE, or to a new random secret if none was configured.
+// Instances sharing a secret must share the file and be signalled together.
+func rotateChallengeSecretOnHangup(ctx context.Context, cfg *config.ServerConfig, server *tcp.Server, logger *slog.Logger) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+
+		if cfg.Server.ChallengeSecretFile == "" && cfg.Server.ChallengeSecret != "" {
+			logger.Error("challenge secret rotation failed", "error", errStaticSecret)
+			continue
+		}
+		secret, err := loadChallengeSecret(cfg)
+		if err != nil {
+			logger.Error("challenge secret rotation failed", "error", err)
+			continue
+		}
+		server.RotateChallengeSecret(secret)
+		logger.Info("challenge secret rotated")
+	}
+}
@@ -2,12 +2,26 @@ package app
 
 import (
 	"context"
+	"errors"
 	"faraway/config"
+	"faraway/internal/domain"
 	"faraway/internal/server/tcp"
 	"faraway/internal/usecases"
+	"faraway/pkg/pow"
+	"faraway/pkg/protocol"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net/netip"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 const (
@@ -21,31 +35,475 @@ func RunServer(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to load configuration: %w", err)
 	}
+	if err := validateServerConfig(cfg); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
 
 	logger := slog.Default()
 	logger = logger.With("Service", cfg.Name)
 
-	powUsecase, err := usecases.NewPowUsecase(cfg.Pow.Difficulty)
+	algorithms, err := parseAlgorithms(cfg.Server.Algorithms)
+	if err != nil {
+		return fmt.Errorf("invalid algorithms: %w", err)
+	}
+	var random io.Reader
+	if cfg.Server.EntropyPoolSize > 0 {
+		random = pow.NewEntropyPool(cfg.Server.EntropyPoolSize)
+	}
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(cfg.Pow.Difficulty, random, algorithms...)
 	if err != nil {
 		log.Fatal(ErrPowInit, err)
 	}
-	quoteUsecase := usecases.NewQuoteUsecase()
+	if verificationLogger, ok := powUsecase.(usecases.VerificationLogger); ok {
+		verificationLogger.UseLogger(logger)
+	}
+	powUsecase = usecases.NewInstrumentedPowUsecase(powUsecase, logMetrics{logger})
+	quotes := usecases.DefaultQuotes()
+	if cfg.Server.QuotesURL != "" {
+		if quotes, err = usecases.LoadQuotes(ctx, cfg.Server.QuotesURL, cfg.Server.QuotesURLTimeout); err != nil {
+			logger.Error("loading quotes failed, serving the built-in ones", "url", cfg.Server.QuotesURL, "error", err)
+		} else {
+			logger.Info("loaded quotes", "url", cfg.Server.QuotesURL, "count", len(quotes))
+		}
+	}
+	quoteUsecase, err := newQuoteUsecase(cfg.Server.QuoteOrder, cfg.Server.QuoteCursorFile, quotes)
+	if err != nil {
+		return fmt.Errorf("invalid quote settings: %w", err)
+	}
+	if persister, ok := quoteUsecase.(usecases.CursorPersister); ok && cfg.Server.QuoteCursorFile != "" {
+		go persistQuoteCursor(ctx, persister, cfg.Server.QuoteCursorInterval, logger)
+		// The last quotes served are saved once the server has stopped
+		defer savePersistedCursor(persister, logger)
+	}
+	if cfg.Server.QuoteCacheTTL > 0 {
+		quoteUsecase = usecases.NewCachedQuoteUsecase(quoteUsecase, cfg.Server.QuoteCacheTTL)
+	}
+
+	version, err := advertisedVersion(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid version: %w", err)
+	}
+
+	allowList, err := parseAllowList(cfg.Server.AllowList, algorithms)
+	if err != nil {
+		return fmt.Errorf("invalid allow list: %w", err)
+	}
+
+	classes, err := parseClasses(cfg.Server.ClientClasses, algorithms)
+	if err != nil {
+		return fmt.Errorf("invalid client classes: %w", err)
+	}
+	classRules, err := parseClassRules(cfg.Server.ClassRules, classes)
+	if err != nil {
+		return fmt.Errorf("invalid class rules: %w", err)
+	}
+	var classifier tcp.Classifier
+	if len(classRules) > 0 {
+		classifier = tcp.NewRuleClassifier(classRules)
+	}
+	networkLookup, err := loadNetworkLookup(cfg.Server.NetworkDatabase)
+	if err != nil {
+		return fmt.Errorf("invalid network database: %w", err)
+	}
+
+	var challengeSecret []byte
+	if cfg.Server.EchoChallenge || cfg.Server.SessionTTL > 0 {
+		if challengeSecret, err = loadChallengeSecret(cfg); err != nil {
+			return fmt.Errorf("invalid challenge secret: %w", err)
+		}
+	}
+
+	challengeStore, err := newChallengeStore(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid challenge store: %w", err)
+	}
+	if closer, ok := challengeStore.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	tlsConfig, err := serverTLSConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	auditSink, closeAudit, err := newAuditSink(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid audit log: %w", err)
+	}
+	defer closeAudit()
+
+	noDelay, err := parseNoDelay(cfg.Server.NoDelay)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
 
 	server := tcp.NewServer(
 		&tcp.Config{
-			Address:    cfg.Server.Addr,
-			KeepAlive:  cfg.Server.KeepAlive,
-			Deadline:   cfg.Server.Deadline,
-			BufferSize: 1024,
+			Address:     cfg.Server.Addr,
+			KeepAlive:   cfg.Server.KeepAlive,
+			Deadline:    cfg.Server.Deadline,
+			BufferSize:  cfg.Server.BufferSize,
+			NoDelay:     noDelay,
+			PoolBuffers: cfg.Server.PoolBuffers,
+
+			AcceptParallelism:    cfg.Server.AcceptParallelism,
+			MaxConnections:       cfg.Server.MaxConnections,
+			MaxConnectionsPerIP:  cfg.Server.MaxConnectionsPerIP,
+			MaxSessionBytes:      cfg.Server.MaxSessionBytes,
+			MaxConnectionAge:     cfg.Server.MaxConnectionAge,
+			MaxNonceLength:       cfg.Server.MaxNonceLength,
+			MaxGoroutines:        cfg.Server.MaxGoroutines,
+			IPTrackerCapacity:    cfg.Server.IPTrackerCapacity,
+			MaxFailures:          cfg.Server.MaxFailures,
+			FailureWindow:        cfg.Server.FailureWindow,
+			MaxChallenges:        cfg.Server.MaxChallenges,
+			ChallengeWindow:      cfg.Server.ChallengeWindow,
+			Stealth:              cfg.Server.Stealth,
+			Observe:              cfg.Server.Observe,
+			DetailedErrors:       cfg.Server.DetailedErrors,
+			VerboseErrors:        cfg.Server.VerboseClientErrors,
+			LogRejectedSolutions: cfg.Server.LogRejectedSolutions,
+			ChallengeTTL:         cfg.Server.ChallengeTTL,
+			ShutdownTimeout:      cfg.Server.ShutdownTimeout,
+			EchoChallenge:        cfg.Server.EchoChallenge,
+			ChallengeSecret:      challengeSecret,
+			ChallengeStore:       challengeStore,
+			EpochLength:          cfg.Server.EpochLength,
+			EpochWindow:          cfg.Server.EpochWindow,
+			AllowList:            allowList,
+			Classifier:           classifier,
+			Classes:              classes,
+			NetworkLookup:        networkLookup,
+
+			MaxVerifications:         cfg.Server.MaxVerifications,
+			VerificationMemoryKiB:    cfg.Server.VerificationMemoryKiB,
+			VerificationQueueTimeout: cfg.Server.VerificationQueueTimeout,
+			CostAwareCapacity:        cfg.Server.CostAwareCapacity,
+			MinCPUDifficulty:         minDifficulty(cfg, protocol.ChallengeTypeCPU),
+			MinMemoryDifficulty:      minDifficulty(cfg, protocol.ChallengeTypeMemory),
+			AutoDifficultyTarget:     cfg.Server.AutoDifficultyTarget,
+			AutoDifficultyMin:        cfg.Server.AutoDifficultyMin,
+			AutoDifficultyMax:        cfg.Server.AutoDifficultyMax,
+			AutoDifficultySamples:    cfg.Server.AutoDifficultySamples,
+			ShedLoad:                 cfg.Server.SaturationShedLoad,
+			PerClientDifficulty:      cfg.Server.PerClientDifficulty,
+			HandshakesPerConnection:  cfg.Server.HandshakesPerConnection,
+			AcceptSolveTimes:         cfg.Server.AcceptSolveTimes,
+			SendHints:                cfg.Server.SendHints,
+			AdvertiseLoad:            cfg.Server.AdvertiseLoad,
+			EmbedDifficulty:          cfg.Server.EmbedDifficulty,
+			SessionTTL:               cfg.Server.SessionTTL,
+			AuditSink:                auditSink,
+			AuditKey:                 []byte(cfg.Server.AuditKey),
+			TLSConfig:                tlsConfig,
+			BindClientCert:           cfg.Server.BindClientCert,
+			ProbeWindow:              cfg.Server.ProbeWindow,
+			WebSocketAddress:         cfg.Server.WebSocketAddr,
+			WebSocketPath:            cfg.Server.WebSocketPath,
+			Version:                  version,
 		},
 		powUsecase,
 		quoteUsecase,
 		logger,
 	)
 
+	if cfg.Server.EchoChallenge || cfg.Server.SessionTTL > 0 {
+		go rotateChallengeSecretOnHangup(ctx, cfg, server, logger)
+	}
+
 	if err = server.Run(ctx); err != nil {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
+	if err := server.Close(); err != nil {
+		return fmt.Errorf("failed to release server resources: %w", err)
+	}
 
 	return nil
 }
+
+// parseAlgorithms parses the enabled challenge types by their wire names.
+func parseAlgorithms(names []string) ([]protocol.ChallengeType, error) {
+	algorithms := make([]protocol.ChallengeType, 0, len(names))
+	for _, name := range names {
+		algorithm, err := protocol.ParseChallengeType(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, nil
+}
+
+var ErrQuoteOrder = errors.New(`quote order must be "random" or "round-robin"`)
+
+// newQuoteUsecase returns the usecase serving quotes in order, keeping a
+// round-robin cursor in cursorFile if set.
+func newQuoteUsecase(order, cursorFile string, quotes []domain.Quote) (usecases.QuoteUsecase, error) {
+	switch order {
+	case "random":
+		return usecases.NewQuoteUsecaseWithQuotes(quotes)
+	case "round-robin":
+		return usecases.NewRoundRobinQuoteUsecase(quotes, cursorFile)
+	default:
+		return nil, fmt.Errorf("%w, got %q", ErrQuoteOrder, order)
+	}
+}
+
+// persistQuoteCursor saves the round-robin cursor every interval until ctx
+// is done. A crash serves again the quotes served since the last save.
+func persistQuoteCursor(ctx context.Context, persister usecases.CursorPersister, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			savePersistedCursor(persister, logger)
+		}
+	}
+}
+
+// savePersistedCursor saves the round-robin cursor, logging a failure:
+// quotes are served all the same.
+func savePersistedCursor(persister usecases.CursorPersister, logger *slog.Logger) {
+	if err := persister.PersistCursor(); err != nil {
+		logger.Error("failed to save the quote cursor", "error", err)
+	}
+}
+
+// loadNetworkLookup reads the network database at path, nil when path is
+// empty.
+func loadNetworkLookup(path string) (tcp.NetworkLookup, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return tcp.NewCSVNetworkLookup(file)
+}
+
+// parseNoDelay parses a TCP_NODELAY setting, nil when empty to keep the
+// default.
+func parseNoDelay(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	noDelay, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid boolean %q", value)
+	}
+	return &noDelay, nil
+}
+
+// minDifficulty returns the difficulty floor of challengeType:
+// MIN_CPU_DIFFICULTY or MIN_MEMORY_DIFFICULTY if set, else MIN_DIFFICULTY.
+func minDifficulty(cfg *config.ServerConfig, challengeType protocol.ChallengeType) uint64 {
+	floor := cfg.Server.MinDifficulty
+	if challengeType == protocol.ChallengeTypeCPU && cfg.Server.MinCPUDifficulty > 0 {
+		floor = cfg.Server.MinCPUDifficulty
+	}
+	if challengeType == protocol.ChallengeTypeMemory && cfg.Server.MinMemoryDifficulty > 0 {
+		floor = cfg.Server.MinMemoryDifficulty
+	}
+	return floor
+}
+
+// parseAllowList builds allow-list entries from CIDR=DIFFICULTY strings,
+// offering the enabled algorithms. A zero difficulty exempts matching
+// clients from proof of work.
+func parseAllowList(entries []string, algorithms []protocol.ChallengeType) ([]tcp.AllowListEntry, error) {
+	allowList := make([]tcp.AllowListEntry, 0, len(entries))
+	for _, entry := range entries {
+		cidr, difficulty, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q is not CIDR=DIFFICULTY", entry)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", entry, err)
+		}
+		level, err := strconv.ParseUint(strings.TrimSpace(difficulty), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", entry, err)
+		}
+
+		allowed := tcp.AllowListEntry{Prefix: prefix.Masked()}
+		if level > 0 {
+			if allowed.PowUsecase, err = usecases.NewPowUsecaseWithAlgorithms(level, nil, algorithms...); err != nil {
+				return nil, fmt.Errorf("entry %q: %w", entry, err)
+			}
+		}
+		allowList = append(allowList, allowed)
+	}
+	return allowList, nil
+}
+
+// parseClasses builds class policies from NAME=DIFFICULTY entries, which
+// offer the enabled algorithms, or NAME=DIFFICULTY:ALGORITHMS entries with
+// the algorithms joined by "+". A zero difficulty exempts the class from
+// proof of work.
+func parseClasses(entries []string, algorithms []protocol.ChallengeType) (map[string]tcp.ClassPolicy, error) {
+	classes := make(map[string]tcp.ClassPolicy, len(entries))
+	for _, entry := range entries {
+		name, policy, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("entry %q is not NAME=DIFFICULTY", entry)
+		}
+		if _, ok := classes[name]; ok {
+			return nil, fmt.Errorf("class %q defined twice", name)
+		}
+		difficulty, names, ok := strings.Cut(policy, ":")
+		level, err := strconv.ParseUint(strings.TrimSpace(difficulty), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", entry, err)
+		}
+		classAlgorithms := algorithms
+		if ok {
+			if classAlgorithms, err = parseAlgorithms(strings.Split(names, "+")); err != nil {
+				return nil, fmt.Errorf("entry %q: %w", entry, err)
+			}
+		}
+
+		var class tcp.ClassPolicy
+		if level > 0 {
+			if class.PowUsecase, err = usecases.NewPowUsecaseWithAlgorithms(level, nil, classAlgorithms...); err != nil {
+				return nil, fmt.Errorf("entry %q: %w", entry, err)
+			}
+		}
+		classes[name] = class
+	}
+	return classes, nil
+}
+
+// offeredAlgorithms returns the algorithms the server-wide, allow-list and
+// class usecases offer between them, each once.
+func offeredAlgorithms(algorithms []protocol.ChallengeType, allowList []tcp.AllowListEntry, classes map[string]tcp.ClassPolicy) []protocol.ChallengeType {
+	offered := slices.Clone(algorithms)
+	for _, entry := range allowList {
+		if entry.PowUsecase != nil {
+			offered = append(offered, usecases.EnabledAlgorithms(entry.PowUsecase)...)
+		}
+	}
+	for _, class := range classes {
+		if class.PowUsecase != nil {
+			offered = append(offered, usecases.EnabledAlgorithms(class.PowUsecase)...)
+		}
+	}
+	slices.Sort(offered)
+	return slices.Compact(offered)
+}
+
+// parseClassRules builds classification rules from CIDR=CLASS entries, or
+// cn:COMMON_NAME=CLASS entries matching the client's TLS certificate. Every
+// class must be defined in classes.
+func parseClassRules(entries []string, classes map[string]tcp.ClassPolicy) ([]tcp.ClassRule, error) {
+	rules := make([]tcp.ClassRule, 0, len(entries))
+	for _, entry := range entries {
+		match, class, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q is not CIDR=CLASS", entry)
+		}
+		rule := tcp.ClassRule{Class: strings.TrimSpace(class)}
+		if _, ok := classes[rule.Class]; !ok {
+			return nil, fmt.Errorf("entry %q: undefined class %q", entry, rule.Class)
+		}
+		match = strings.TrimSpace(match)
+		if commonName, ok := strings.CutPrefix(match, "cn:"); ok {
+			rule.CommonName = commonName
+		} else {
+			prefix, err := netip.ParsePrefix(match)
+			if err != nil {
+				return nil, fmt.Errorf("entry %q: %w", entry, err)
+			}
+			rule.Prefix = prefix.Masked()
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// newChallengeStore returns the configured store, or nil for the server's
+// in-memory default.
+func newChallengeStore(cfg *config.ServerConfig) (tcp.ChallengeStore, error) {
+	switch cfg.Server.ChallengeStore {
+	case "memory":
+		return nil, nil
+	case "none":
+		if cfg.Server.EpochLength <= 0 {
+			return nil, fmt.Errorf("EPOCH_LENGTH is required without a store")
+		}
+		return tcp.NewStatelessChallengeStore(), nil
+	case "redis":
+		if cfg.Server.RedisAddr == "" {
+			return nil, fmt.Errorf("REDIS_ADDR is required for the redis store")
+		}
+		client := redis.NewClient(&redis.Options{
+			Addr:         cfg.Server.RedisAddr,
+			DialTimeout:  cfg.Server.Deadline,
+			ReadTimeout:  cfg.Server.Deadline,
+			WriteTimeout: cfg.Server.Deadline,
+		})
+		return tcp.NewRedisChallengeStore(client, cfg.Server.RedisKeyPrefix), nil
+	default:
+		return nil, fmt.Errorf("unsupported store %q", cfg.Server.ChallengeStore)
+	}
+}
+
+// newAuditSink returns the sink for AUDIT_LOG, nil if it is unset, and a
+// function releasing it.
+func newAuditSink(cfg *config.ServerConfig) (tcp.AuditSink, func(), error) {
+	switch cfg.Server.AuditLog {
+	case "":
+		return nil, func() {}, nil
+	case "-":
+		return tcp.NewJSONAuditSink(os.Stdout), func() {}, nil
+	}
+	file, err := os.OpenFile(cfg.Server.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tcp.NewJSONAuditSink(file), func() { file.Close() }, nil
+}
+
+// devVersion is advertised by builds without module version information.
+const devVersion = "0.0.0-dev"
+
+// advertisedVersion returns the version the server advertises, empty if
+// it doesn't.
+func advertisedVersion(cfg *config.ServerConfig) (string, error) {
+	if !cfg.Server.AdvertiseVersion {
+		return "", nil
+	}
+	version := cfg.Server.Version
+	if version == "" {
+		version = devVersion
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+	}
+	if _, err := protocol.ParseSemVer(version); err != nil {
+		return "", err
+	}
+	if len(version) > 255 {
+		return "", fmt.Errorf("version %q is longer than 255 bytes", version)
+	}
+	return version, nil
+}
+
+// logMetrics reports proof of work timings and counters as debug logs.
+type logMetrics struct {
+	logger *slog.Logger
+}
+
+func (m logMetrics) ObserveDuration(operation, algorithm string, duration time.Duration) {
+	m.logger.Debug("pow timing", "operation", operation, "algorithm", algorithm, "duration", duration)
+}
+
+func (m logMetrics) IncCounter(name string) {
+	m.logger.Debug("counter", "name", name)
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"faraway/config"
+	clienttcp "faraway/internal/client/tcp"
+	"faraway/internal/server/tcp"
+	"faraway/internal/usecases"
+	"faraway/pkg/protocol"
+)
+
+func TestParseAllowList(t *testing.T) {
+	allowList, err := parseAllowList([]string{"10.0.0.0/8=0", "192.168.1.5/32=1"}, []protocol.ChallengeType{protocol.ChallengeTypeCPU})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(allowList) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(allowList))
+	}
+	if allowList[0].Prefix.String() != "10.0.0.0/8" || allowList[0].PowUsecase != nil {
+		t.Fatalf("expected an exempt 10.0.0.0/8 entry, got %+v", allowList[0])
+	}
+	if allowList[1].Prefix.String() != "192.168.1.5/32" || allowList[1].PowUsecase == nil {
+		t.Fatalf("expected a 192.168.1.5/32 entry with its own difficulty, got %+v", allowList[1])
+	}
+
+	for _, entry := range []string{"10.0.0.0/8", "not-a-cidr=1", "10.0.0.0/8=x", "10.0.0.0/8=99"} {
+		if _, err := parseAllowList([]string{entry}, []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory}); err == nil {
+			t.Fatalf("expected an error for %q", entry)
+		}
+	}
+}
+
+func TestParseClasses(t *testing.T) {
+	classes, err := parseClasses([]string{"vip=1", "suspect=4:Memory", "health=0"}, []protocol.ChallengeType{protocol.ChallengeTypeCPU})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if classes["health"].PowUsecase != nil {
+		t.Fatal("expected the health class to be exempt")
+	}
+	if got := usecases.EnabledAlgorithms(classes["suspect"].PowUsecase); !slices.Equal(got, []protocol.ChallengeType{protocol.ChallengeTypeMemory}) {
+		t.Fatalf("expected the suspect class to offer Memory only, got %v", got)
+	}
+
+	rules, err := parseClassRules([]string{"cn:partner=vip", "10.1.2.3/8=health"}, classes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules[0].CommonName != "partner" || rules[1].Prefix.String() != "10.0.0.0/8" {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+
+	for _, entry := range []string{"vip", "=1", "vip=x", "vip=1:GPU", "vip=99", "vip=5:Memory", "vip=1,vip=2"} {
+		if _, err := parseClasses(strings.Split(entry, ","), []protocol.ChallengeType{protocol.ChallengeTypeCPU}); err == nil {
+			t.Fatalf("expected an error for %q", entry)
+		}
+	}
+	for _, entry := range []string{"10.0.0.0/8", "10.0.0.0/8=unknown", "not-a-cidr=vip"} {
+		if _, err := parseClassRules([]string{entry}, classes); err == nil {
+			t.Fatalf("expected an error for %q", entry)
+		}
+	}
+}
+
+func TestParseAlgorithms(t *testing.T) {
+	algorithms, err := parseAlgorithms([]string{"CPU", " Memory"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(algorithms, []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory}) {
+		t.Fatalf("unexpected algorithms %v", algorithms)
+	}
+
+	if _, err := parseAlgorithms([]string{"scrypt"}); err == nil {
+		t.Fatal("expected an error for an unknown algorithm")
+	}
+}
+
+func TestMinDifficultyPerAlgorithm(t *testing.T) {
+	cpu := []protocol.ChallengeType{protocol.ChallengeTypeCPU}
+	classes, err := parseClasses([]string{"suspect=2:Memory"}, cpu)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The class offers argon2 though the server only offers hashcash
+	offered := offeredAlgorithms(cpu, nil, classes)
+	if !slices.Equal(offered, []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory}) {
+		t.Fatalf("expected both algorithms offered, got %v", offered)
+	}
+
+	cfg := &config.ServerConfig{Server: config.Server{MinDifficulty: 2, MinCPUDifficulty: 6}}
+	if cpu, memory := minDifficulty(cfg, protocol.ChallengeTypeCPU), minDifficulty(cfg, protocol.ChallengeTypeMemory); cpu != 6 || memory != 2 {
+		t.Fatalf("expected floors of 6 for hashcash and 2 for argon2, got %d and %d", cpu, memory)
+	}
+}
+
+// countingPersister signals cursor saves, failing every one.
+type countingPersister struct {
+	saves chan struct{}
+}
+
+func (p countingPersister) PersistCursor() error {
+	select {
+	case p.saves <- struct{}{}:
+	default:
+	}
+	return errors.New("disk full")
+}
+
+func TestPersistQuoteCursorLogsFailures(t *testing.T) {
+	var logs bytes.Buffer
+	persister := countingPersister{saves: make(chan struct{}, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		persistQuoteCursor(ctx, persister, time.Millisecond, slog.New(slog.NewTextHandler(&logs, nil)))
+	}()
+
+	// Saves keep being attempted after failing
+	for i := 0; i < 2; i++ {
+		select {
+		case <-persister.saves:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the cursor saved periodically")
+		}
+	}
+	cancel()
+	<-done
+	if !strings.Contains(logs.String(), "failed to save the quote cursor") || !strings.Contains(logs.String(), "disk full") {
+		t.Fatalf("expected the failure logged, got %q", logs.String())
+	}
+}
+
+func TestAuditLogVerifies(t *testing.T) {
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(1, nil, protocol.ChallengeTypeCPU)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	solverUsecase, err := usecases.NewSolverUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	key := []byte("audit key")
+
+	var audit bytes.Buffer
+	server := tcp.NewServer(&tcp.Config{
+		Deadline:  5 * time.Second,
+		AuditSink: tcp.NewJSONAuditSink(&audit),
+		AuditKey:  key,
+	}, powUsecase, usecases.NewQuoteUsecase(), logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	client := clienttcp.NewClient(&clienttcp.Config{
+		ServerAddrs:    []string{listener.Addr().String()},
+		ConnectTimeout: 5 * time.Second,
+		RequestTimeout: 5 * time.Second,
+		MaxMessageSize: 1024,
+		BufferSize:     1024,
+	}, solverUsecase, logger)
+	quote, err := client.FetchQuote(ctx)
+	cancel()
+	if err != nil {
+		t.Fatalf("unexpected error fetching quote: %v", err)
+	}
+	// The server is done with the connection, and so the record, once
+	// it has stopped
+	<-served
+
+	var report bytes.Buffer
+	if err := VerifyAuditLog(bytes.NewReader(audit.Bytes()), key, &report); err != nil {
+		t.Fatalf("expected the record to verify, got %v: %s", err, report.String())
+	}
+	if report.String() != "1 audit records verified\n" {
+		t.Fatalf("unexpected report %q", report.String())
+	}
+
+	// Re-check with a tampered quote and with the wrong key
+	var record tcp.AuditRecord
+	if err := json.Unmarshal(audit.Bytes(), &record); err != nil {
+		t.Fatalf("unexpected error decoding the record: %v", err)
+	}
+	if record.Quote != quote {
+		t.Fatalf("expected the record of quote %+v, got %+v", quote, record.Quote)
+	}
+	record.Quote.Text = "forged"
+	tampered, _ := json.Marshal(record)
+	if err := VerifyAuditLog(bytes.NewReader(tampered), key, io.Discard); err == nil {
+		t.Fatal("expected a tampered record to fail verification")
+	}
+	report.Reset()
+	if err := VerifyAuditLog(bytes.NewReader(audit.Bytes()), []byte("other key"), &report); err == nil ||
+		!strings.Contains(report.String(), tcp.ErrAuditSignature.Error()) {
+		t.Fatalf("expected a signature mismatch, got %v: %s", err, report.String())
+	}
+}
+
+func TestVerifyAuditRecordChecksSolution(t *testing.T) {
+	record := tcp.AuditRecord{Type: protocol.ChallengeTypeCPU, Difficulty: 20, Challenge: []byte("challenge"), Solution: []byte("0")}
+	if err := tcp.VerifyAuditRecord(nil, record); !errors.Is(err, tcp.ErrAuditSolution) {
+		t.Fatalf("expected ErrAuditSolution, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"faraway/config"
+)
+
+// serverTLSConfig returns the server's TLS configuration, nil when TLS_CERT
+// is unset. With TLS_CLIENT_CA clients must present a certificate it
+// signed.
+func serverTLSConfig(cfg *config.ServerConfig) (*tls.Config, error) {
+	if cfg.Server.TLSCert == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(cfg.Server.TLSCert, cfg.Server.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.Server.TLSClientCA != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(cfg.Server.TLSClientCA); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// clientTLSConfig returns the client's TLS configuration, nil unless TLS is
+// set. Servers are verified against TLS_CA, or the system roots without it.
+func clientTLSConfig(cfg *config.ClientConfig) (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSCert != "" {
+		certificate, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if cfg.TLSCA != "" {
+		var err error
+		if tlsConfig.RootCAs, err = loadCertPool(cfg.TLSCA); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool reads the PEM certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,310 @@
+// Package capture records the frames client and server exchange, through a
+// proxy sitting between them, and replays either side of a recorded
+// session to the other, so protocol failures seen against real peers can
+// be reproduced.
+//
+// A capture is a stream of JSON frames, one per line, each with the time
+// it was seen, the connection it was seen on and the side that sent it.
+// Streams are split into frames with the protocol package, as a client and
+// a server read them; whatever doesn't decode is kept as a raw frame, so
+// every byte exchanged is in the capture.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"faraway/pkg/protocol"
+)
+
+var (
+	ErrUnexpectedFrame = errors.New("unexpected frame")
+	// ErrFrameTooLong is returned for a text frame whose payload doesn't fit
+	// its length byte, which no peer could have sent.
+	ErrFrameTooLong = errors.New("frame too long")
+)
+
+// maxChallengeSize bounds the challenges decoded; larger ones are kept raw.
+const maxChallengeSize = 1 << 20
+
+// Side is the end of a connection that sent a frame.
+type Side string
+
+const (
+	Client Side = "client"
+	Server Side = "server"
+)
+
+// Kind is the kind of a frame.
+type Kind string
+
+const (
+	KindPreamble     Kind = "preamble"
+	KindVersion      Kind = "version"
+	KindCapabilities Kind = "capabilities"
+	KindHint         Kind = "hint"
+	KindRetryLater   Kind = "retry-later"
+	KindObserve      Kind = "observe"
+	KindChallenge    Kind = "challenge"
+	// KindLine is any line: the lines of a submission, a response, a
+	// session grant.
+	KindLine Kind = "line"
+	// KindRaw holds bytes that didn't decode, up to the end of the stream.
+	KindRaw Kind = "raw"
+)
+
+// Frame is one frame of a capture.
+type Frame struct {
+	Time time.Time `json:"time"`
+	Conn uint64    `json:"conn"`
+	From Side      `json:"from"`
+	Kind Kind      `json:"kind"`
+	// Type is the type of challenge frames; CPU challenges leave it out.
+	Type protocol.ChallengeType `json:"type,omitempty"`
+	// Text is the payload of version, capabilities and hint frames, and
+	// lines without their line break.
+	Text string `json:"text,omitempty"`
+	// Data is the challenge of challenge frames, and the bytes of raw ones.
+	Data []byte `json:"data,omitempty"`
+	// Difficulty is that of challenge frames carrying theirs, as sent by
+	// servers advertising protocol.CapabilityDifficulty.
+	Difficulty uint64 `json:"difficulty,omitempty"`
+}
+
+// Equal reports whether f and other are the same frame sent by the same
+// side, whenever and on whichever connection they were seen.
+func (f Frame) Equal(other Frame) bool {
+	return f.From == other.From && f.Kind == other.Kind && f.Type == other.Type &&
+		f.Text == other.Text && bytes.Equal(f.Data, other.Data) && f.Difficulty == other.Difficulty
+}
+
+// AppendFrame appends the wire encoding of f to dst. It fails on frames
+// that have no wire encoding, such as text frames of over 255 bytes.
+func AppendFrame(dst []byte, f Frame) ([]byte, error) {
+	switch f.Kind {
+	case KindPreamble:
+		return append(dst, protocol.Preamble...), nil
+	case KindVersion:
+		return appendTextFrame(dst, protocol.FrameVersion, f.Text)
+	case KindCapabilities:
+		return appendTextFrame(dst, protocol.FrameCapabilities, f.Text)
+	case KindHint:
+		return appendTextFrame(dst, protocol.FrameHint, f.Text)
+	case KindRetryLater:
+		return append(dst, protocol.FrameRetryLater), nil
+	case KindObserve:
+		return append(dst, protocol.FrameObserve), nil
+	case KindChallenge:
+		if f.Difficulty > 0 {
+			return protocol.AppendChallengeFrameWithDifficulty(dst, f.Type, f.Difficulty, f.Data), nil
+		}
+		return protocol.AppendChallengeFrame(dst, f.Type, f.Data), nil
+	case KindLine:
+		return append(append(dst, f.Text...), '\n'), nil
+	default:
+		return append(dst, f.Data...), nil
+	}
+}
+
+// appendTextFrame appends a frame of one length byte and its payload.
+func appendTextFrame(dst []byte, frameByte byte, text string) ([]byte, error) {
+	if len(text) > 255 {
+		return dst, fmt.Errorf("%w: %d bytes of text", ErrFrameTooLong, len(text))
+	}
+	return append(append(dst, frameByte, byte(len(text))), text...), nil
+}
+
+// Recorder writes frames to a capture as they are seen. It is safe for
+// concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	err     error
+	now     func() time.Time
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{encoder: json.NewEncoder(w), now: time.Now}
+}
+
+// Record timestamps f and writes it to the capture.
+func (r *Recorder) Record(f Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.Time = r.now()
+	if err := r.encoder.Encode(f); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Err returns the first error writing the capture.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// ReadCapture reads all the frames of a capture.
+func ReadCapture(r io.Reader) ([]Frame, error) {
+	decoder := json.NewDecoder(r)
+	var frames []Frame
+	for {
+		var f Frame
+		if err := decoder.Decode(&f); errors.Is(err, io.EOF) {
+			return frames, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read frame %d: %w", len(frames)+1, err)
+		}
+		frames = append(frames, f)
+	}
+}
+
+// Connection returns the frames of a capture seen on connection conn.
+func Connection(frames []Frame, conn uint64) []Frame {
+	var selected []Frame
+	for _, f := range frames {
+		if f.Conn == conn {
+			selected = append(selected, f)
+		}
+	}
+	return selected
+}
+
+// frameReader keeps what was read of the frame being decoded, so a frame
+// that fails to decode is kept raw.
+type frameReader struct {
+	reader *bufio.Reader
+	read   []byte
+	// capabilities are those the server advertised, which the layout of
+	// its challenge frames depends on.
+	capabilities []string
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read = append(r.read, p[:n]...)
+	return n, err
+}
+
+func (r *frameReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.read = append(r.read, b)
+	}
+	return b, err
+}
+
+func (r *frameReader) ReadString(delim byte) (string, error) {
+	s, err := r.reader.ReadString(delim)
+	r.read = append(r.read, s...)
+	return s, err
+}
+
+// decodeState decodes the next frame and returns the state decoding the
+// one after it.
+type decodeState func(r *frameReader) (Frame, decodeState, error)
+
+// decode splits the stream from sends into frames, calling emit with each
+// as soon as it is complete. It reads src to its end.
+func decode(src io.Reader, from Side, emit func(Frame)) {
+	r := &frameReader{reader: bufio.NewReader(src)}
+	state := decodeLine
+	if from == Server {
+		state = decodePreamble
+	}
+	for {
+		r.read = nil
+		frame, next, err := state(r)
+		if err != nil {
+			io.Copy(io.Discard, r)
+			if len(r.read) > 0 {
+				emit(Frame{From: from, Kind: KindRaw, Data: r.read})
+			}
+			return
+		}
+		frame.From = from
+		emit(frame)
+		state = next
+	}
+}
+
+func decodePreamble(r *frameReader) (Frame, decodeState, error) {
+	preamble := make([]byte, len(protocol.Preamble))
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return Frame{}, nil, err
+	}
+	if !bytes.Equal(preamble, protocol.Preamble) {
+		return Frame{}, nil, fmt.Errorf("%w: preamble %q", ErrUnexpectedFrame, preamble)
+	}
+	return Frame{Kind: KindPreamble}, decodeServerFrame, nil
+}
+
+// textFrameKinds are the kinds of the frames of one length byte and a text
+// payload, by their frame byte.
+var textFrameKinds = map[byte]Kind{
+	protocol.FrameVersion:      KindVersion,
+	protocol.FrameCapabilities: KindCapabilities,
+	protocol.FrameHint:         KindHint,
+}
+
+// decodeServerFrame decodes the frames a server sends ahead of its lines.
+func decodeServerFrame(r *frameReader) (Frame, decodeState, error) {
+	frameByte, err := r.ReadByte()
+	if err != nil {
+		return Frame{}, nil, err
+	}
+
+	if kind, ok := textFrameKinds[frameByte]; ok {
+		length, err := r.ReadByte()
+		if err != nil {
+			return Frame{}, nil, err
+		}
+		text := make([]byte, length)
+		if _, err := io.ReadFull(r, text); err != nil {
+			return Frame{}, nil, err
+		}
+		if kind == KindCapabilities {
+			r.capabilities = protocol.ParseCapabilities(string(text))
+		}
+		return Frame{Kind: kind, Text: string(text)}, decodeServerFrame, nil
+	}
+
+	switch frameByte {
+	case protocol.FrameRetryLater:
+		return Frame{Kind: KindRetryLater}, decodeLine, nil
+	case protocol.FrameObserve:
+		return Frame{Kind: KindObserve}, decodeLine, nil
+	}
+	challengeType, err := protocol.ChallengeTypeFromByte(frameByte)
+	if err != nil {
+		return Frame{}, nil, fmt.Errorf("%w: %w", ErrUnexpectedFrame, err)
+	}
+	var difficulty uint64
+	if protocol.CarriesDifficulty(r.capabilities, challengeType) {
+		if difficulty, err = protocol.ReadChallengeDifficulty(r); err != nil {
+			return Frame{}, nil, err
+		}
+	}
+	data, err := protocol.ReadChallengeData(r, maxChallengeSize)
+	if err != nil {
+		return Frame{}, nil, err
+	}
+	return Frame{Kind: KindChallenge, Type: challengeType, Data: data, Difficulty: difficulty}, decodeLine, nil
+}
+
+// decodeLine decodes a line. A line cut short by the end of the stream is
+// kept raw.
+func decodeLine(r *frameReader) (Frame, decodeState, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Frame{}, nil, err
+	}
+	return Frame{Kind: KindLine, Text: strings.TrimSuffix(line, "\n")}, decodeLine, nil
+}
@@ -0,0 +1,235 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	clienttcp "faraway/internal/client/tcp"
+	servertcp "faraway/internal/server/tcp"
+	"faraway/internal/usecases/usecasestest"
+	"faraway/pkg/protocol"
+)
+
+// startServer serves a fixed CPU challenge accepting any solution, so
+// sessions replay identically.
+func startServer(t *testing.T, ctx context.Context) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	server := servertcp.NewServer(
+		&servertcp.Config{Deadline: 5 * time.Second, ShutdownTimeout: time.Second},
+		&usecasestest.PowUsecase{Challenge: []byte("challenge"), Valid: true, Enabled: []protocol.ChallengeType{protocol.ChallengeTypeCPU}},
+		usecasestest.QuoteUsecase{Quote: "test quote"},
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.Serve(ctx, listener)
+	}()
+	t.Cleanup(func() { <-served })
+	return listener.Addr().String()
+}
+
+func newTestClient(addr string) *clienttcp.Client {
+	return clienttcp.NewClient(
+		&clienttcp.Config{
+			ServerAddrs:     []string{addr},
+			ConnectTimeout:  5 * time.Second,
+			RequestTimeout:  5 * time.Second,
+			MaxMessageSize:  1024,
+			BufferSize:      1024,
+			PreambleTimeout: 2 * time.Second,
+		},
+		usecasestest.SolverUsecase{Solution: []byte("42")},
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+}
+
+// expectSameSession checks each side sent the same frames in both
+// sessions.
+func expectSameSession(t *testing.T, want, got []Frame) {
+	t.Helper()
+
+	for _, side := range []Side{Client, Server} {
+		var wantSent, gotSent []Frame
+		for _, f := range want {
+			if f.From == side {
+				wantSent = append(wantSent, f)
+			}
+		}
+		for _, f := range got {
+			if f.From == side {
+				gotSent = append(gotSent, f)
+			}
+		}
+		if len(wantSent) != len(gotSent) {
+			t.Fatalf("expected the %s to send %d frames, got %d: %+v", side, len(wantSent), len(gotSent), gotSent)
+		}
+		for i := range wantSent {
+			if !wantSent[i].Equal(gotSent[i]) {
+				t.Fatalf("expected %s frame %d to be %+v, got %+v", side, i+1, wantSent[i], gotSent[i])
+			}
+		}
+	}
+}
+
+func TestCaptureAndReplaySession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	serverAddr := startServer(t, ctx)
+
+	// Capture a session through the proxy
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	var captured bytes.Buffer
+	proxyCtx, stopProxy := context.WithCancel(ctx)
+	proxied := make(chan error, 1)
+	go func() {
+		proxied <- Proxy(proxyCtx, listener, serverAddr, NewRecorder(&captured), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+	if quote, err := newTestClient(listener.Addr().String()).FetchQuote(ctx); err != nil || quote.Text != "test quote" {
+		t.Fatalf("expected the quote through the proxy, got %+v, %v", quote, err)
+	}
+	stopProxy()
+	if err := <-proxied; err != nil {
+		t.Fatalf("unexpected proxy error: %v", err)
+	}
+
+	frames, err := ReadCapture(&captured)
+	if err != nil {
+		t.Fatalf("unexpected error reading the capture: %v", err)
+	}
+	session := Connection(frames, 1)
+	var challenge, success bool
+	for _, f := range session {
+		challenge = challenge || (f.From == Server && f.Kind == KindChallenge && string(f.Data) == "challenge")
+		success = success || (f.From == Server && f.Kind == KindLine && f.Text == protocol.SuccessPrefix+"test quote")
+	}
+	if !challenge || !success {
+		t.Fatalf("expected the challenge and the quote in the capture, got %+v", session)
+	}
+
+	t.Run("as client", func(t *testing.T) {
+		conn, err := net.Dial("tcp", serverAddr)
+		if err != nil {
+			t.Fatalf("unexpected error connecting: %v", err)
+		}
+		var replayed bytes.Buffer
+		if err := Replay(ctx, conn, session, Client, NewRecorder(&replayed)); err != nil {
+			t.Fatalf("unexpected replay error: %v", err)
+		}
+		got, err := ReadCapture(&replayed)
+		if err != nil {
+			t.Fatalf("unexpected error reading the replay: %v", err)
+		}
+		expectSameSession(t, session, got)
+	})
+
+	t.Run("as server", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		defer listener.Close()
+		fetched := make(chan error, 1)
+		go func() {
+			_, err := newTestClient(listener.Addr().String()).FetchQuote(ctx)
+			fetched <- err
+		}()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("unexpected error accepting: %v", err)
+		}
+
+		var replayed bytes.Buffer
+		if err := Replay(ctx, conn, session, Server, NewRecorder(&replayed)); err != nil {
+			t.Fatalf("unexpected replay error: %v", err)
+		}
+		if err := <-fetched; err != nil {
+			t.Fatalf("expected the client to get the replayed quote, got %v", err)
+		}
+		got, err := ReadCapture(&replayed)
+		if err != nil {
+			t.Fatalf("unexpected error reading the replay: %v", err)
+		}
+		expectSameSession(t, session, got)
+	})
+}
+
+func TestUndecodableBytesAreKeptRaw(t *testing.T) {
+	stream := append(append([]byte(nil), protocol.Preamble...), 0x7F, 'x')
+	var frames []Frame
+	decode(bytes.NewReader(stream), Server, func(f Frame) { frames = append(frames, f) })
+
+	if len(frames) != 2 || frames[0].Kind != KindPreamble || frames[1].Kind != KindRaw {
+		t.Fatalf("expected the preamble and a raw frame, got %+v", frames)
+	}
+	if !bytes.Equal(frames[1].Data, []byte{0x7F, 'x'}) {
+		t.Fatalf("expected the raw frame to hold the rest of the stream, got %q", frames[1].Data)
+	}
+	var encoded []byte
+	for _, f := range frames {
+		var err error
+		if encoded, err = AppendFrame(encoded, f); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if !bytes.Equal(encoded, stream) {
+		t.Fatalf("expected the frames to re-encode to %q, got %q", stream, encoded)
+	}
+}
+
+func TestChallengeDifficultyFollowsCapabilities(t *testing.T) {
+	capabilities := protocol.FormatCapabilities([]string{protocol.CapabilityDifficulty})
+	stream := append(append([]byte(nil), protocol.Preamble...), protocol.FrameCapabilities, byte(len(capabilities)))
+	stream = append(stream, capabilities...)
+	stream = protocol.AppendChallengeFrameWithDifficulty(stream, protocol.ChallengeTypeMemory, 3, []byte("challenge"))
+
+	var frames []Frame
+	decode(bytes.NewReader(stream), Server, func(f Frame) { frames = append(frames, f) })
+
+	if len(frames) != 3 || frames[2].Kind != KindChallenge || frames[2].Difficulty != 3 || string(frames[2].Data) != "challenge" {
+		t.Fatalf("expected a challenge of difficulty 3 after the capabilities, got %+v", frames)
+	}
+	var encoded []byte
+	for _, f := range frames {
+		var err error
+		if encoded, err = AppendFrame(encoded, f); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if !bytes.Equal(encoded, stream) {
+		t.Fatalf("expected the frames to re-encode to %q, got %q", stream, encoded)
+	}
+}
+
+func TestOversizedTextFramesAreNotReplayed(t *testing.T) {
+	hint := Frame{From: Server, Kind: KindHint, Text: strings.Repeat("x", 256)}
+	if _, err := AppendFrame(nil, hint); !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("expected ErrFrameTooLong, got %v", err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	session := []Frame{{From: Server, Kind: KindPreamble}, hint}
+	if err := Replay(context.Background(), serverConn, session, Server, NewRecorder(io.Discard)); !errors.Is(err, ErrFrameTooLong) {
+		t.Fatalf("expected ErrFrameTooLong, got %v", err)
+	}
+	// Nothing of the session was sent
+	if n, err := clientConn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("expected the connection closed with nothing sent, got %d bytes and %v", n, err)
+	}
+}
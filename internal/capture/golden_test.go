@@ -0,0 +1,191 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clienttcp "faraway/internal/client/tcp"
+	servertcp "faraway/internal/server/tcp"
+	"faraway/internal/usecases"
+	"faraway/internal/usecases/usecasestest"
+	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// pipeListener accepts the server ends of in-memory pipes.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// recordHandshake runs one handshake between a real client and server over
+// in-memory pipes, relaying it through the recorder, and returns the frames
+// each side sent.
+func recordHandshake(t *testing.T, powUsecase usecases.PowUsecase, solver usecases.SolverUsecase) []Frame {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	listener := newPipeListener()
+	server := servertcp.NewServer(
+		&servertcp.Config{Deadline: 10 * time.Second, ShutdownTimeout: time.Second},
+		powUsecase,
+		usecasestest.QuoteUsecase{Quote: "test quote"},
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+	serveCtx, stopServing := context.WithCancel(ctx)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.Serve(serveCtx, listener)
+	}()
+
+	var captured bytes.Buffer
+	recorder := NewRecorder(&captured)
+	relayed := make(chan struct{})
+	client := clienttcp.NewClient(
+		&clienttcp.Config{
+			ServerAddrs:     []string{"pipe"},
+			ConnectTimeout:  5 * time.Second,
+			RequestTimeout:  10 * time.Second,
+			MaxMessageSize:  1024,
+			BufferSize:      1024,
+			PreambleTimeout: 2 * time.Second,
+			DialContext: func(_ context.Context, network, address string) (net.Conn, error) {
+				clientConn, relayClient := net.Pipe()
+				relayServer, serverConn := net.Pipe()
+				go func() {
+					defer close(relayed)
+					// The dial context ends once connected
+					Relay(ctx, relayClient, relayServer, 1, recorder)
+				}()
+				listener.conns <- serverConn
+				return clientConn, nil
+			},
+		},
+		solver,
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+	if _, err := client.FetchQuote(ctx); err != nil {
+		t.Logf("handshake failed: %v", err)
+	}
+	<-relayed
+	stopServing()
+	<-served
+
+	frames, err := ReadCapture(&captured)
+	if err != nil {
+		t.Fatalf("unexpected error reading the capture: %v", err)
+	}
+	return frames
+}
+
+// encodeGolden renders frames as a golden file: those the client sent,
+// then those the server sent, each in the order sent. Which side a frame
+// crosses the relay first on is up to the scheduler, so the interleaving
+// isn't kept.
+func encodeGolden(t *testing.T, frames []Frame) []byte {
+	t.Helper()
+
+	var golden bytes.Buffer
+	encoder := json.NewEncoder(&golden)
+	for _, side := range []Side{Client, Server} {
+		for _, f := range frames {
+			if f.From != side {
+				continue
+			}
+			f.Time = time.Time{}
+			if err := encoder.Encode(f); err != nil {
+				t.Fatalf("unexpected error encoding frame: %v", err)
+			}
+		}
+	}
+	return golden.Bytes()
+}
+
+// TestGoldenExchanges runs handshakes with seeded challenges and checks the
+// bytes exchanged haven't drifted from testdata, catching wire format
+// changes. Run with -update to accept intended changes.
+func TestGoldenExchanges(t *testing.T) {
+	solver, err := usecases.NewSolverUsecaseWithStrategy(1, hashcash.NonceDecimal, usecases.SolveStrategyMemory)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		name      string
+		challenge protocol.ChallengeType
+		solver    usecases.SolverUsecase
+	}{
+		{"cpu", protocol.ChallengeTypeCPU, solver},
+		{"memory", protocol.ChallengeTypeMemory, solver},
+		{"invalid_solution", protocol.ChallengeTypeCPU, usecasestest.SolverUsecase{Solution: []byte("not a nonce")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(1, rand.New(rand.NewSource(1)), tt.challenge)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := encodeGolden(t, recordHandshake(t, powUsecase, tt.solver))
+
+			path := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatalf("unexpected error writing %s: %v", path, err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unexpected error reading %s: %v", path, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("exchange drifted from %s, run with -update if intended\nwant:\n%s\ngot:\n%s", path, want, got)
+			}
+		})
+	}
+}
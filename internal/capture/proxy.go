@@ -0,0 +1,82 @@
+package capture
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Proxy accepts clients on listener until ctx is done, relaying each to
+// upstream on a connection of its own and recording what both sides send.
+// Connections are numbered from 1 in the order they were accepted.
+func Proxy(ctx context.Context, listener net.Listener, upstream string, recorder *Recorder, logger *slog.Logger) error {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	var relays sync.WaitGroup
+	defer relays.Wait()
+
+	var dialer net.Dialer
+	for id := uint64(1); ; id++ {
+		client, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		relays.Add(1)
+		go func() {
+			defer relays.Done()
+			server, err := dialer.DialContext(ctx, "tcp", upstream)
+			if err != nil {
+				logger.Error("dialing upstream failed", "conn", id, "upstream", upstream, "error", err)
+				client.Close()
+				return
+			}
+			logger.Debug("relaying connection", "conn", id, "client", client.RemoteAddr())
+			Relay(ctx, client, server, id, recorder)
+		}()
+	}
+}
+
+// Relay forwards what client and server send each other, recording it as
+// connection id, until both stop sending or ctx is done. It closes both.
+func Relay(ctx context.Context, client, server net.Conn, id uint64, recorder *Recorder) {
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+		server.Close()
+	})
+	defer stop()
+
+	var forwarders sync.WaitGroup
+	forward := func(dst, src net.Conn, from Side) {
+		defer forwarders.Done()
+		// The decoder reads ahead of whole frames, so nothing is held back
+		decode(io.TeeReader(src, dst), from, func(f Frame) {
+			f.Conn = id
+			recorder.Record(f)
+		})
+		closeWrite(dst)
+	}
+	forwarders.Add(2)
+	go forward(server, client, Client)
+	go forward(client, server, Server)
+	forwarders.Wait()
+
+	client.Close()
+	server.Close()
+}
+
+// closeWrite tells the peer of conn nothing more will be sent, closing
+// conn altogether when it can't be half-closed.
+func closeWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		halfCloser.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,99 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+var ErrPeerClosed = errors.New("peer closed the connection")
+
+// Replay plays the frames as sent in a captured session over conn, to a
+// peer standing in for the other side, recording both sides as they go.
+// Each frame is sent once the peer sent as many frames as had been seen
+// from the other side ahead of it in the capture, so the replay keeps the
+// order of the session though not its timing. Replay returns once the peer
+// sent as many frames as it did in the capture, or closed the connection,
+// and closes conn. Captures holding frames that have no wire encoding
+// aren't replayed.
+func Replay(ctx context.Context, conn net.Conn, session []Frame, as Side, recorder *Recorder) error {
+	// A frame that can't be sent fails the replay before any is
+	encoded := make([][]byte, len(session))
+	for i, f := range session {
+		if f.From != as {
+			continue
+		}
+		var err error
+		if encoded[i], err = AppendFrame(nil, f); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to encode frame %d: %w", i+1, err)
+		}
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	peer := Server
+	if as == Server {
+		peer = Client
+	}
+
+	var id uint64
+	if len(session) > 0 {
+		id = session[0].Conn
+	}
+	var received atomic.Int64
+	arrived := make(chan struct{}, 1)
+	decoded := make(chan struct{})
+	go func() {
+		defer close(decoded)
+		decode(conn, peer, func(f Frame) {
+			f.Conn = id
+			recorder.Record(f)
+			received.Add(1)
+			select {
+			case arrived <- struct{}{}:
+			default:
+			}
+		})
+	}()
+	defer func() {
+		conn.Close()
+		<-decoded
+	}()
+
+	// awaitPeer waits until the peer sent count frames.
+	awaitPeer := func(count int64) error {
+		for received.Load() < count {
+			select {
+			case <-arrived:
+			case <-decoded:
+				if received.Load() < count {
+					return fmt.Errorf("%w after %d of %d frames", ErrPeerClosed, received.Load(), count)
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	var expected int64
+	for i, f := range session {
+		if f.From != as {
+			expected++
+			continue
+		}
+		if err := awaitPeer(expected); err != nil {
+			return err
+		}
+		if _, err := conn.Write(encoded[i]); err != nil {
+			return fmt.Errorf("failed to replay frame: %w", err)
+		}
+		f.Conn = id
+		recorder.Record(f)
+	}
+	return awaitPeer(expected)
+}
@@ -2,14 +2,21 @@ package tcp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"faraway/internal/domain"
 	"faraway/internal/usecases"
+	"faraway/pkg/protocol"
+	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,16 +24,120 @@ type Client struct {
 	cfg           *Config
 	solverUsecase usecases.SolverUsecase
 	logger        Logger
+	// nextAddr is where the next round-robin connect starts.
+	nextAddr atomic.Uint64
+	// grant is the session token to present instead of solving, when
+	// ReuseSessions is set.
+	grantMu sync.Mutex
+	grant   *sessionGrant
+	// connectAttempts, retries and failovers count what they are named
+	// after for Summary.
+	connectAttempts atomic.Int64
+	retries         atomic.Int64
+	failovers       atomic.Int64
 }
 
+// Counters reported to Config.Metrics.
+const (
+	// CounterConnectAttempts counts dials to any server address.
+	CounterConnectAttempts = "client_connect_attempts"
+	// CounterRetries counts handshakes run again because the server asked
+	// to retry later.
+	CounterRetries = "client_retries"
+	// CounterFailovers counts moves to the next server address after one
+	// was unreachable.
+	CounterFailovers = "client_failovers"
+	// CounterCompleted, CounterAborted and CounterFailed count the outcomes
+	// of the handshakes Start ran, as in Summary.
+	CounterCompleted = "client_completed"
+	CounterAborted   = "client_aborted"
+	CounterFailed    = "client_failed"
+)
+
+// Failover strategies for picking among several server addresses.
+const (
+	// FailoverOrdered always tries ServerAddrs from the first one.
+	FailoverOrdered = "ordered"
+	// FailoverRoundRobin starts each connect at the address after the one
+	// the previous connect started at.
+	FailoverRoundRobin = "round-robin"
+)
+
 type Config struct {
-	ServerAddr     string
+	// ServerAddrs are tried in turn until one accepts the connection.
+	ServerAddrs    []string
+	Failover       string
 	ConnectTimeout time.Duration
 	RequestTimeout time.Duration
 	RetryAttempts  int
 	RetryDelay     time.Duration
+	// LaunchInterval spaces the handshakes Start launches; ShutdownTimeout
+	// is how long those in flight may finish once its context is done.
+	LaunchInterval  time.Duration
+	ShutdownTimeout time.Duration
+	// MaxMessageSize is the largest challenge accepted, in bytes. It must
+	// be positive: no challenge fits otherwise.
 	MaxMessageSize int64
 	BufferSize     int
+	// PreambleTimeout is how long to wait for the server's protocol
+	// preamble before deciding it isn't a proof-of-work server.
+	PreambleTimeout time.Duration
+	// EchoChallenge sends the challenge back ahead of the solution, for
+	// servers verifying solutions statelessly.
+	EchoChallenge bool
+	// PinnedDifficulty, if set, is sent along with every solution so a
+	// server configured with another difficulty reports the mismatch
+	// instead of rejecting the solution as invalid.
+	PinnedDifficulty uint64
+	// PinnedDifficulties overrides PinnedDifficulty for the challenge
+	// types it lists, for clients solving them at different difficulties.
+	PinnedDifficulties map[protocol.ChallengeType]uint64
+	// DifficultyTolerance is how far the difficulty a server advertises in
+	// its hints may be from the pinned one. Further off, the challenge
+	// fails with ErrDifficultyMismatch before it is solved; within it, the
+	// advertised difficulty is pinned instead. The solver still solves at
+	// its own difficulty, which satisfies any advertised one up to it.
+	DifficultyTolerance uint64
+	// MinServerVersion, if set, makes the client refuse servers that don't
+	// advertise a version compatible with it: the same major version, and
+	// no older.
+	MinServerVersion *protocol.SemVer
+	// ReportSolveTime sends how long solving took along with the solution,
+	// to servers advertising CapabilitySolveTime, to help them tune the
+	// difficulty.
+	ReportSolveTime bool
+	// FollowHints lets the solver use the hints servers send ahead of
+	// challenges, such as searching on fewer goroutines. Solutions are the
+	// same either way.
+	FollowHints bool
+	// ReuseSessions keeps the session token servers advertising
+	// CapabilitySession grant after a solved challenge, and presents it
+	// instead of solving until it expires. SessionFile, if set, keeps the
+	// token across runs.
+	ReuseSessions bool
+	SessionFile   string
+	// PrefetchMaxAge, if set, makes Watch receive and solve the challenge
+	// for each tick ahead of it, starting half of PrefetchMaxAge before.
+	// A prefetched challenge older than PrefetchMaxAge by the tick is
+	// discarded and a new one solved, so it must be below the server's
+	// deadline and challenge TTL.
+	PrefetchMaxAge time.Duration
+	// ChallengeDump, if set, receives a hex dump of every challenge frame
+	// as received, for debugging framing against other servers.
+	ChallengeDump io.Writer
+	// NoDelay, if set, turns TCP_NODELAY on or off on connections to the
+	// server. Nil keeps Go's default, which turns it on: the solution goes
+	// out right away instead of Nagle's algorithm holding it back, trading
+	// a few more packets for latency.
+	NoDelay *bool
+	// TLSConfig, if set, runs the protocol over TLS, presenting its
+	// certificates to servers that require client certificates.
+	TLSConfig *tls.Config
+	// DialContext opens the connection to the server. Defaults to a plain
+	// net.Dialer; tests use it to plug in an in-memory transport.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// Metrics, if set, receives the client's counters, named Counter*.
+	Metrics usecases.Metrics
 }
 
 type Logger interface {
@@ -37,7 +148,18 @@ type Logger interface {
 
 type Challenge struct {
 	Data []byte
-	Type string
+	Type protocol.ChallengeType
+	// Observed is set when the server doesn't enforce proof of work and
+	// sends its response right away.
+	Observed bool
+	// Hint is the server's advice on solving the challenge, if it sent any.
+	Hint *protocol.Hint
+	// Difficulty is the difficulty the server sent with the challenge or
+	// advertised in its hint, zero if neither. Hints are advisory, so only
+	// a difficulty sent with the challenge is solved at, as DifficultySent
+	// tells.
+	Difficulty     uint64
+	DifficultySent bool
 }
 
 func NewClient(
@@ -45,21 +167,60 @@ func NewClient(
 	solverUsecase usecases.SolverUsecase,
 	logger Logger,
 ) *Client {
-	return &Client{
+	c := &Client{
 		cfg:           cfg,
 		solverUsecase: solverUsecase,
 		logger:        logger,
 	}
+	if cfg.ReuseSessions {
+		c.loadSessionGrant()
+	}
+	return c
 }
 
-func (c *Client) Start(ctx context.Context) error {
-	var lastErr error
-	var wg sync.WaitGroup
-	const maxConnections = 10
+// Summary counts the outcomes of the handshakes Start ran.
+type Summary struct {
+	// Completed handshakes earned a quote.
+	Completed int
+	// Aborted handshakes were still in flight when the shutdown timeout
+	// ran out.
+	Aborted int
+	// Failed handshakes ended with an error of their own.
+	Failed int
+
+	// ConnectAttempts, Retries and Failovers are the totals of the
+	// counters of the same names over these handshakes.
+	ConnectAttempts int64
+	Retries         int64
+	Failovers       int64
+}
 
-	for attempt := 0; attempt < maxConnections; attempt++ {
-		time.Sleep(3 * time.Second)
+// count reports one more of the counter name to Metrics.
+func (c *Client) count(name string) {
+	if c.cfg.Metrics != nil {
+		c.cfg.Metrics.IncCounter(name)
+	}
+}
+
+// Start runs handshakes on several goroutines, launched LaunchInterval
+// apart, and returns once all are done. When ctx is done no more are
+// launched, and those in flight get ShutdownTimeout to finish before
+// they are aborted. The error is that of a failed handshake, if any.
+func (c *Client) Start(ctx context.Context) (Summary, error) {
+	const maxConnections = 10
 
+	// Handshakes in flight outlive ctx by ShutdownTimeout
+	work, abort := context.WithCancel(context.WithoutCancel(ctx))
+	defer abort()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		summary Summary
+		lastErr error
+	)
+	connectAttempts, retries, failovers := c.connectAttempts.Load(), c.retries.Load(), c.failovers.Load()
+	for attempt := 0; attempt < maxConnections && c.waitToLaunch(ctx, c.cfg.LaunchInterval); attempt++ {
 		wg.Add(1)
 		go func(attempt int) {
 			defer wg.Done()
@@ -68,55 +229,229 @@ func (c *Client) Start(ctx context.Context) error {
 				c.logger.Info("retrying connection",
 					"attempt", attempt+1,
 					"max_attempts", maxConnections)
-				time.Sleep(c.cfg.RetryDelay)
+				if !c.waitToLaunch(ctx, c.cfg.RetryDelay) {
+					return
+				}
 			}
 
-			if err := c.executeSession(ctx); err != nil {
+			_, err := c.executeSessionWithRetry(work)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				summary.Completed++
+				c.count(CounterCompleted)
+			case work.Err() != nil:
+				summary.Aborted++
+				c.count(CounterAborted)
+			default:
+				summary.Failed++
+				c.count(CounterFailed)
 				lastErr = NewClientError("Start", err, "session failed")
 				c.logger.Error("session error",
 					"attempt", attempt+1,
 					"error", err)
-				return
 			}
 		}(attempt)
 	}
 
 	// Wait for all connection attempts to complete
-	wg.Wait()
-	return lastErr
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.logger.Info("shutting down, waiting for handshakes in flight", "timeout", c.cfg.ShutdownTimeout)
+		select {
+		case <-done:
+		case <-time.After(c.cfg.ShutdownTimeout):
+			abort()
+			<-done
+		}
+	}
+	summary.ConnectAttempts = c.connectAttempts.Load() - connectAttempts
+	summary.Retries = c.retries.Load() - retries
+	summary.Failovers = c.failovers.Load() - failovers
+	return summary, lastErr
 }
-func (c *Client) executeSession(ctx context.Context) error {
-	connectCtx, cancel := context.WithTimeout(ctx, c.cfg.ConnectTimeout)
-	defer cancel()
 
-	conn, err := c.connect(connectCtx)
+// waitToLaunch waits for delay and reports whether new work may start,
+// which it may not once ctx is done.
+func (c *Client) waitToLaunch(ctx context.Context, delay time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// executeSessionWithRetry runs a session, running it again after RetryDelay
+// as long as the server asks to retry later and RetryAttempts are left.
+func (c *Client) executeSessionWithRetry(ctx context.Context) (domain.Quote, error) {
+	var quote domain.Quote
+	var err error
+	for retry := 0; retry <= c.cfg.RetryAttempts; retry++ {
+		if retry > 0 {
+			c.retries.Add(1)
+			c.count(CounterRetries)
+			c.logger.Info("server asked to retry later",
+				"retry", retry,
+				"max_retries", c.cfg.RetryAttempts)
+			select {
+			case <-time.After(c.cfg.RetryDelay):
+			case <-ctx.Done():
+				return domain.Quote{}, NewClientError("executeSessionWithRetry", ctx.Err(), "cancelled during backoff")
+			}
+		}
+
+		if quote, err = c.executeSession(ctx); err == nil || !errors.Is(err, ErrRetryLater) {
+			return quote, err
+		}
+	}
+	return domain.Quote{}, NewClientError("executeSessionWithRetry", fmt.Errorf("%w: %w", ErrMaxRetriesExceeded, err), "retry attempts exhausted")
+}
+
+// executeSession runs one handshake and returns the quote it earned. If
+// the server rejected the session token presented, the token is dropped
+// and the handshake runs again, solving.
+func (c *Client) executeSession(ctx context.Context) (domain.Quote, error) {
+	quote, err := c.executeHandshake(ctx)
+	if errors.Is(err, ErrSessionRejected) {
+		c.logger.Info("session token rejected, solving instead", "error", err)
+		c.storeSessionGrant(nil)
+		quote, err = c.executeHandshake(ctx)
+	}
+	return quote, err
+}
+
+// executeHandshake runs one handshake on a new connection.
+func (c *Client) executeHandshake(ctx context.Context) (domain.Quote, error) {
+	session, err := c.openSession(ctx)
 	if err != nil {
-		return err
+		return domain.Quote{}, err
+	}
+	defer session.close()
+
+	if err := session.Execute(); err != nil {
+		return domain.Quote{}, err
 	}
-	defer conn.Close()
+	return session.quote, nil
+}
+
+// openSession connects to a server and receives its preamble. The session
+// must be closed once done with.
+func (c *Client) openSession(ctx context.Context) (*ClientSession, error) {
+	start := time.Now()
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Not every read watches ctx, closing the connection stops them all
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
 
 	session := &ClientSession{
 		conn:    conn,
 		reader:  bufio.NewReader(conn),
-		writer:  bufio.NewWriter(conn),
 		client:  c,
 		context: ctx,
+		stop:    stop,
+	}
+	if err := session.receivePreamble(); err != nil {
+		session.close()
+		return nil, err
 	}
+	session.timings = append(session.timings, "connect", time.Since(start))
+	return session, nil
+}
 
-	return session.Execute()
+// FetchQuote runs a single handshake, retrying as configured, and returns
+// the quote instead of only logging it.
+func (c *Client) FetchQuote(ctx context.Context) (domain.Quote, error) {
+	return c.executeSessionWithRetry(ctx)
 }
 
 func (c *Client) connect(ctx context.Context) (net.Conn, error) {
-	var d net.Dialer
-	conn, err := d.DialContext(ctx, "tcp", c.cfg.ServerAddr)
+	dial := c.cfg.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+
+	addrs := c.cfg.ServerAddrs
+	if len(addrs) == 0 {
+		return nil, NewClientError("connect", ErrNoServerAddress, "")
+	}
+	var start int
+	if c.cfg.Failover == FailoverRoundRobin {
+		start = int((c.nextAddr.Add(1) - 1) % uint64(len(addrs)))
+	}
+
+	var err error
+	for i := range addrs {
+		addr := addrs[(start+i)%len(addrs)]
+
+		var conn net.Conn
+		c.connectAttempts.Add(1)
+		c.count(CounterConnectAttempts)
+		conn, err = c.dialAddr(ctx, dial, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(addrs)-1 {
+			c.failovers.Add(1)
+			c.count(CounterFailovers)
+			c.logger.Info("server unreachable, failing over",
+				"address", addr,
+				"next", addrs[(start+i+1)%len(addrs)],
+				"error", err)
+		}
+	}
+	return nil, err
+}
+
+// dialAddr connects to a single server address within ConnectTimeout.
+func (c *Client) dialAddr(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), addr string) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, c.cfg.ConnectTimeout)
+	defer cancel()
+
+	conn, err := dial(dialCtx, "tcp", addr)
 	if err != nil {
-		return nil, NewClientError("connect", err, "connection failed")
+		return nil, NewClientError("connect", err, fmt.Sprintf("connection to %s failed", addr))
 	}
 
 	if err := conn.SetDeadline(time.Now().Add(c.cfg.RequestTimeout)); err != nil {
 		conn.Close()
 		return nil, NewClientError("connect", err, "setting timeout failed")
 	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && c.cfg.NoDelay != nil {
+		if err := tcpConn.SetNoDelay(*c.cfg.NoDelay); err != nil {
+			c.logger.Debug("setting TCP_NODELAY failed", "error", err)
+		}
+	}
+
+	if c.cfg.TLSConfig != nil {
+		tlsConfig := c.cfg.TLSConfig
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(dialCtx); err != nil {
+			conn.Close()
+			return nil, NewClientError("connect", err, fmt.Sprintf("TLS handshake with %s failed", addr))
+		}
+		conn = tlsConn
+	}
 
 	return conn, nil
 }
@@ -124,118 +459,406 @@ func (c *Client) connect(ctx context.Context) (net.Conn, error) {
 type ClientSession struct {
 	conn    net.Conn
 	reader  *bufio.Reader
-	writer  *bufio.Writer
 	client  *Client
 	context context.Context
+	// quote is set once the server accepted the solution.
+	quote domain.Quote
+	// timings holds the duration of each completed handshake phase as
+	// log fields.
+	timings []interface{}
+	// capabilities are the optional features the server advertised.
+	capabilities []string
+	// solveTime is how long solving the challenge took.
+	solveTime time.Duration
+	// stop stops closing the connection once the context is done.
+	stop func() bool
+}
+
+// close closes the session's connection.
+func (s *ClientSession) close() {
+	if s.stop != nil {
+		s.stop()
+	}
+	s.conn.Close()
+}
+
+// timePhase runs one handshake phase, recording how long it took.
+func (s *ClientSession) timePhase(name string, phase func() error) error {
+	start := time.Now()
+	err := phase()
+	s.timings = append(s.timings, name, time.Since(start))
+	return err
 }
 
 // All magic happens here
 func (s *ClientSession) Execute() error {
-	// Step 1: Receive challenge
-	challenge, err := s.receiveChallenge()
+	defer func() {
+		s.client.logger.Debug("handshake timings", s.timings...)
+	}()
+
+	submit, err := s.prepare()
 	if err != nil {
 		return err
 	}
+	return submit()
+}
 
-	// Step 2: Solve challenge
-	solution, err := s.solveChallenge(challenge)
+// prepare receives the challenge and solves it, and returns the rest of
+// the handshake: submitting the solution, or a session token, and
+// receiving the response.
+func (s *ClientSession) prepare() (func() error, error) {
+	// Step 1: Receive challenge
+	var challenge *Challenge
+	err := s.timePhase("receive_challenge", func() (err error) {
+		challenge, err = s.receiveChallenge()
+		return err
+	})
 	if err != nil {
+		return nil, err
+	}
+
+	if challenge.Observed {
+		s.client.logger.Debug("server is not enforcing proof of work")
+		return func() error { return s.timePhase("receive_response", s.receiveResponse) }, nil
+	}
+
+	// A session token stands in for solving
+	if token, ok := s.reusesSession(); ok {
+		return func() error {
+			s.client.logger.Debug("presenting session token")
+			err := s.timePhase("send_session", func() error { return s.send(s.encodeSessionSubmission(challenge, token)) })
+			if err != nil {
+				return err
+			}
+			return s.timePhase("receive_response", s.receiveResponse)
+		}, nil
+	}
+
+	// Step 2: Solve challenge
+	var solution string
+	err = s.timePhase("solve", func() (err error) {
+		solution, err = s.solveChallenge(challenge)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Step 3: Send solution and receive response
-	return s.sendSolutionAndGetResponse(challenge.Type, solution)
+	return func() error {
+		if err := s.timePhase("send_solution", func() error { return s.sendSolution(challenge, solution) }); err != nil {
+			return err
+		}
+		if err := s.timePhase("receive_response", s.receiveResponse); err != nil {
+			return err
+		}
+		s.receiveSessionGrant()
+		return nil
+	}, nil
+}
+
+// receivePreamble checks that the server opens with the protocol preamble,
+// so reaching some other service fails fast with ErrNotPowServer instead of
+// a confusing framing error later on.
+func (s *ClientSession) receivePreamble() error {
+	errCh := make(chan error, 1)
+	go func() {
+		preamble := make([]byte, len(protocol.Preamble))
+		if _, err := io.ReadFull(s.reader, preamble); err != nil {
+			errCh <- connectionError("receivePreamble", err, "reading preamble failed")
+			return
+		}
+		if !bytes.Equal(preamble[:len(preamble)-1], protocol.Preamble[:len(preamble)-1]) {
+			errCh <- NewClientError("receivePreamble", ErrNotPowServer, fmt.Sprintf("unexpected preamble %q", preamble))
+			return
+		}
+		if version := preamble[len(preamble)-1]; version != protocol.Version {
+			errCh <- NewClientError("receivePreamble", ErrNotPowServer, fmt.Sprintf("unsupported protocol version %d", version))
+			return
+		}
+		errCh <- nil
+	}()
+
+	// A zero timeout leaves it to the connection deadline
+	var timeout <-chan time.Time
+	if s.client.cfg.PreambleTimeout > 0 {
+		timer := time.NewTimer(s.client.cfg.PreambleTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-timeout:
+		return NewClientError("receivePreamble", ErrNotPowServer, "no preamble within timeout")
+	case <-s.context.Done():
+		return NewClientError("receivePreamble", ErrReadTimeout, "read timeout")
+	}
 }
 
 func (s *ClientSession) receiveChallenge() (*Challenge, error) {
 	// Read challenge type
-	var challengeType byte
-	if err := binary.Read(s.reader, binary.BigEndian, &challengeType); err != nil {
+	var challengeTypeByte byte
+	if err := binary.Read(s.reader, binary.BigEndian, &challengeTypeByte); err != nil {
 		return nil, NewClientError("receiveChallenge", err, "reading challengeType failed")
 	}
 
-	if challengeType != 0x00 && challengeType != 0x01 {
-		return nil, NewClientError("receiveChallenge", ErrInvalidChallengeType, "invalid challenge type")
+	// The server version, if advertised, comes ahead of everything else
+	if challengeTypeByte == protocol.FrameVersion {
+		if err := s.receiveVersion(); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(s.reader, binary.BigEndian, &challengeTypeByte); err != nil {
+			return nil, NewClientError("receiveChallenge", err, "reading challengeType failed")
+		}
+	} else if s.client.cfg.MinServerVersion != nil {
+		return nil, NewClientError("receiveChallenge", ErrIncompatibleServer, "server did not advertise its version")
 	}
 
-	// Read challenge length
-	var length int32
-	if err := binary.Read(s.reader, binary.BigEndian, &length); err != nil {
-		return nil, NewClientError("receiveChallenge", err, "reading length failed")
+	// So do the server's capabilities, right after its version
+	if challengeTypeByte == protocol.FrameCapabilities {
+		if err := s.receiveCapabilities(); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(s.reader, binary.BigEndian, &challengeTypeByte); err != nil {
+			return nil, NewClientError("receiveChallenge", err, "reading challengeType failed")
+		}
 	}
 
-	if length <= 0 || length > int32(s.client.cfg.MaxMessageSize) {
-		return nil, NewClientError("receiveChallenge", ErrInvalidMessageSize, "invalid challenge size")
+	// A hint, if any, comes right before the challenge it is about
+	var hint *protocol.Hint
+	if challengeTypeByte == protocol.FrameHint {
+		var err error
+		if hint, err = s.receiveHint(); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(s.reader, binary.BigEndian, &challengeTypeByte); err != nil {
+			return nil, NewClientError("receiveChallenge", err, "reading challengeType failed")
+		}
+	}
+
+	if challengeTypeByte == protocol.FrameRetryLater {
+		return nil, NewClientError("receiveChallenge", ErrRetryLater, "server is draining or at capacity")
 	}
 
-	// Read challenge data
-	data := make([]byte, length)
-	n, err := io.ReadFull(s.reader, data)
+	if challengeTypeByte == protocol.FrameObserve {
+		return &Challenge{Observed: true}, nil
+	}
+
+	challengeType, err := protocol.ChallengeTypeFromByte(challengeTypeByte)
 	if err != nil {
-		if err == io.EOF {
-			return nil, NewClientError("receiveChallenge", ErrConnectionClosed, "unexpected EOF")
+		return nil, NewClientError("receiveChallenge", ErrInvalidChallengeType, "invalid challenge type")
+	}
+
+	// The difficulty, if the server sends it, comes before the length
+	var sentDifficulty uint64
+	if protocol.CarriesDifficulty(s.capabilities, challengeType) {
+		sentDifficulty, err = protocol.ReadChallengeDifficulty(s.reader)
+		if errors.Is(err, protocol.ErrInvalidChallengeDifficulty) {
+			return nil, NewClientError("receiveChallenge", ErrInvalidChallenge, err.Error())
+		}
+		if err != nil {
+			return nil, connectionError("receiveChallenge", err, "reading challenge difficulty failed")
 		}
-		return nil, NewClientError("receiveChallenge", err, "reading challenge failed")
 	}
 
-	if n != int(length) {
-		return nil, NewClientError("receiveChallenge", ErrInvalidMessageSize,
-			"challenge size mismatch")
+	// Read challenge length and data
+	data, err := protocol.ReadChallengeData(s.reader, s.client.cfg.MaxMessageSize)
+	if errors.Is(err, protocol.ErrInvalidChallengeSize) {
+		return nil, NewClientError("receiveChallenge", ErrInvalidMessageSize, "invalid challenge size")
+	}
+	if err != nil {
+		return nil, connectionError("receiveChallenge", err, "reading challenge failed")
 	}
 
-	challengeTypeStr := ""
-	if challengeType == 0x00 {
-		challengeTypeStr = "CPU"
-	} else if challengeType == 0x01 {
-		challengeTypeStr = "Memory"
+	if s.client.cfg.ChallengeDump != nil {
+		dumpChallengeFrame(s.client.cfg.ChallengeDump, challengeType, sentDifficulty, data)
 	}
 
-	return &Challenge{
+	challenge := &Challenge{
 		Data: data,
-		Type: challengeTypeStr,
-	}, nil
+		Type: challengeType,
+		Hint: hint,
+	}
+	if sentDifficulty > 0 {
+		challenge.Difficulty, challenge.DifficultySent = sentDifficulty, true
+	} else if hint != nil {
+		challenge.Difficulty = hint.Difficulty
+	}
+	if err := s.client.checkDifficulty(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// checkDifficulty fails with ErrDifficultyMismatch if the server advertised
+// a difficulty for challenge further than DifficultyTolerance from the one
+// pinned for it. Without either, there is nothing to check.
+func (c *Client) checkDifficulty(challenge *Challenge) error {
+	pinned := c.pinnedDifficulty(challenge.Type)
+	if pinned == 0 || challenge.Difficulty == 0 {
+		return nil
+	}
+	if max(pinned, challenge.Difficulty)-min(pinned, challenge.Difficulty) > c.cfg.DifficultyTolerance {
+		return NewClientError("receiveChallenge", ErrDifficultyMismatch,
+			fmt.Sprintf("server advertises %s difficulty %d, pinned %d with tolerance %d", challenge.Type, challenge.Difficulty, pinned, c.cfg.DifficultyTolerance))
+	}
+	return nil
+}
+
+// receiveVersion reads the version the server advertised and checks it
+// against MinServerVersion.
+func (s *ClientSession) receiveVersion() error {
+	length, err := s.reader.ReadByte()
+	if err != nil {
+		return connectionError("receiveVersion", err, "reading version length failed")
+	}
+	text := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, text); err != nil {
+		return connectionError("receiveVersion", err, "reading version failed")
+	}
+	s.client.logger.Debug("server version", "version", string(text))
+
+	minimum := s.client.cfg.MinServerVersion
+	if minimum == nil {
+		return nil
+	}
+	version, err := protocol.ParseSemVer(string(text))
+	if err != nil {
+		return NewClientError("receiveVersion", ErrIncompatibleServer, err.Error())
+	}
+	switch {
+	case version.Major > minimum.Major:
+		return NewClientError("receiveVersion", ErrIncompatibleServer,
+			fmt.Sprintf("server version %s is a newer major version than %s", version, minimum))
+	case !version.CompatibleWith(*minimum):
+		return NewClientError("receiveVersion", ErrIncompatibleServer,
+			fmt.Sprintf("server version %s is older than the minimum %s", version, minimum))
+	}
+	return nil
+}
+
+// receiveCapabilities reads the optional features the server advertised.
+func (s *ClientSession) receiveCapabilities() error {
+	length, err := s.reader.ReadByte()
+	if err != nil {
+		return connectionError("receiveCapabilities", err, "reading capabilities length failed")
+	}
+	text := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, text); err != nil {
+		return connectionError("receiveCapabilities", err, "reading capabilities failed")
+	}
+	s.capabilities = protocol.ParseCapabilities(string(text))
+	s.client.logger.Debug("server capabilities", "capabilities", s.capabilities)
+	return nil
+}
+
+// receiveHint reads the hint the server sent ahead of its challenge. Hints
+// are advisory, so a malformed one is dropped rather than failing the
+// handshake.
+func (s *ClientSession) receiveHint() (*protocol.Hint, error) {
+	length, err := s.reader.ReadByte()
+	if err != nil {
+		return nil, connectionError("receiveHint", err, "reading hint length failed")
+	}
+	text := make([]byte, length)
+	if _, err := io.ReadFull(s.reader, text); err != nil {
+		return nil, connectionError("receiveHint", err, "reading hint failed")
+	}
+	hint, err := protocol.ParseHint(string(text))
+	if err != nil {
+		s.client.logger.Debug("ignoring challenge hint", "error", err)
+		return nil, nil
+	}
+	s.client.logger.Debug("challenge hint", "iterations", hint.ExpectedIterations, "workers", hint.Workers, "load", hint.Load)
+	return &hint, nil
+}
+
+// dumpChallengeFrame writes the challenge frame, re-encoded exactly as it
+// came off the wire, as a hex dump. difficulty is zero if the frame didn't
+// carry one.
+func dumpChallengeFrame(w io.Writer, challengeType protocol.ChallengeType, difficulty uint64, data []byte) {
+	frame := protocol.AppendChallengeFrame(nil, challengeType, data)
+	if difficulty > 0 {
+		frame = protocol.AppendChallengeFrameWithDifficulty(nil, challengeType, difficulty, data)
+	}
+	fmt.Fprintf(w, "challenge frame (%d bytes):\n%s", len(frame), hex.Dump(frame))
 }
 
 func (s *ClientSession) solveChallenge(challenge *Challenge) (string, error) {
-	if challenge.Type == "CPU" {
-		solution := s.client.solverUsecase.FindCPUBoundSolution(challenge.Data)
-		if solution == "" {
-			return "", NewClientError("solveChallenge", ErrSolutionNotFound, "no solution found for CPU-bound challenge")
-		}
-		return solution, nil
-	} else if challenge.Type == "Memory" {
-		solution, err := s.client.solverUsecase.FindMemoryBoundSolution(challenge.Data)
-		if err != nil {
-			return "", NewClientError("solveChallenge", err, "no solution found for Memory-bound challenge")
-		}
-		return solution, nil
-	} else {
-		return "", NewClientError("solveChallenge", ErrInvalidChallengeType, "invalid challenge type")
+	start := time.Now()
+	var hint *protocol.Hint
+	if s.client.cfg.FollowHints {
+		hint = challenge.Hint
+	}
+	var difficulty uint64
+	if challenge.DifficultySent {
+		difficulty = challenge.Difficulty
+	}
+	solution, err := s.client.solverUsecase.Solve(s.context, domain.Challenge{
+		Type:       challenge.Type,
+		Data:       challenge.Data,
+		Difficulty: difficulty,
+		Hint:       hint,
+	})
+	s.solveTime = time.Since(start)
+	if errors.Is(err, usecases.ErrUnknownAlgorithm) {
+		return "", NewClientError("solveChallenge", ErrInvalidChallengeType, err.Error())
 	}
+	if err != nil {
+		return "", NewClientError("solveChallenge", ErrSolutionNotFound, err.Error())
+	}
+	return string(solution.Data), nil
 }
 
-func (s *ClientSession) sendSolutionAndGetResponse(challengeType, solution string) error {
-	errCh := make(chan error, 1)
+// pinnedDifficulty returns the difficulty pinned for challenges of type t,
+// zero if none is.
+func (c *Client) pinnedDifficulty(t protocol.ChallengeType) uint64 {
+	if difficulty, ok := c.cfg.PinnedDifficulties[t]; ok {
+		return difficulty
+	}
+	return c.cfg.PinnedDifficulty
+}
 
-	go func() {
-		// Send challenge type
-		if _, err := s.writer.WriteString(challengeType + "\n"); err != nil {
-			errCh <- NewClientError("sendChallengeTypeAndSolution", err, "sending challenge type failed")
-			return
-		}
+// encodeSubmission builds everything the client sends after solving: the
+// echoed challenge token if enabled, the challenge type line and the
+// solution line.
+func (s *ClientSession) encodeSubmission(challenge *Challenge, solution string) []byte {
+	// Echo the challenge token so the server can verify statelessly
+	var token []byte
+	if s.client.cfg.EchoChallenge {
+		token = challenge.Data
+	}
 
-		// Send solution
-		if _, err := s.writer.WriteString(solution + "\n"); err != nil {
-			errCh <- NewClientError("sendChallengeTypeAndSolution", err, "sending solution failed")
-			return
-		}
+	// Challenge type, reporting the solve time if the server accepts it
+	pinned := s.client.pinnedDifficulty(challenge.Type)
+	if pinned > 0 && challenge.Difficulty > 0 {
+		// Within tolerance, or receiveChallenge would have failed
+		pinned = challenge.Difficulty
+	}
+	typeLine := protocol.FormatSolutionType(challenge.Type, pinned)
+	if s.client.cfg.ReportSolveTime && s.solveTime > 0 && protocol.HasCapability(s.capabilities, protocol.CapabilitySolveTime) {
+		typeLine = protocol.AppendSolveTime(typeLine, s.solveTime)
+	}
+	return protocol.AppendSubmission(nil, token, typeLine, solution)
+}
+
+// sendSolution sends the submission carrying solution.
+func (s *ClientSession) sendSolution(challenge *Challenge, solution string) error {
+	return s.send(s.encodeSubmission(challenge, solution))
+}
+
+// send sends a submission in a single write, so the wire never carries a
+// partial one the client could still be adding to.
+func (s *ClientSession) send(submission []byte) error {
+	errCh := make(chan error, 1)
 
-		// Flush the writer
-		if err := s.writer.Flush(); err != nil {
-			errCh <- NewClientError("sendChallengeTypeAndSolution", err, "flush failed")
+	go func() {
+		if _, err := s.conn.Write(submission); err != nil {
+			errCh <- connectionError("sendChallengeTypeAndSolution", err, "sending solution failed")
 			return
 		}
-
 		errCh <- nil
 	}()
 
@@ -248,7 +871,11 @@ func (s *ClientSession) sendSolutionAndGetResponse(challengeType, solution strin
 		return NewClientError("sendChallengeTypeAndSolution", ErrWriteTimeout, "write timeout")
 	}
 
-	// Read the server response
+	return nil
+}
+
+// receiveResponse reads and handles the server response line.
+func (s *ClientSession) receiveResponse() error {
 	responseCh := make(chan struct {
 		response string
 		err      error
@@ -265,28 +892,39 @@ func (s *ClientSession) sendSolutionAndGetResponse(challengeType, solution strin
 	select {
 	case result := <-responseCh:
 		if result.err != nil {
-			return NewClientError("sendChallengeTypeAndSolution", result.err, "reading response failed")
+			return connectionError("receiveResponse", result.err, "reading response failed")
 		}
 		return s.handleResponse(strings.TrimSpace(result.response))
 	case <-s.context.Done():
-		return NewClientError("sendChallengeTypeAndSolution", ErrReadTimeout, "read timeout")
+		return NewClientError("receiveResponse", ErrReadTimeout, "read timeout")
 	}
 }
 
 func (s *ClientSession) handleResponse(response string) error {
-	if strings.HasPrefix(response, "SUCCESS:") {
-		quote := strings.TrimPrefix(response, "SUCCESS:")
-		s.client.logger.Info("received quote", "quote", quote)
-		return nil
+	parsed, err := protocol.ParseResponse(response)
+	if err != nil {
+		return NewClientError("handleResponse", ErrInvalidProtocol, err.Error())
 	}
 
-	if strings.HasPrefix(response, "ERROR:") {
-		parts := strings.SplitN(strings.TrimPrefix(response, "ERROR:"), ":", 2)
-		if len(parts) != 2 {
-			return NewClientError("handleResponse", ErrInvalidProtocol, "invalid error format")
-		}
-		return NewClientError("handleResponse", errors.New(parts[0]), parts[1])
+	if parsed.Error == nil {
+		s.quote = domain.Quote(parsed.Quote)
+		s.client.logger.Info("received quote", "quote", s.quote.String())
+		return nil
 	}
 
-	return NewClientError("handleResponse", ErrInvalidProtocol, "invalid response format")
+	info := parsed.Error.Message
+	if len(parsed.Error.Details) > 0 {
+		s.client.logger.Debug("server reported issues", "code", parsed.Error.Code, "details", parsed.Error.Details)
+		info = fmt.Sprintf("%s: %s", info, strings.Join(parsed.Error.Details, "; "))
+	}
+	if parsed.Error.Code == protocol.CodeDifficultyMismatch {
+		return NewClientError("handleResponse", ErrDifficultyMismatch, info)
+	}
+	if parsed.Error.Code == protocol.CodeInvalidSession {
+		return NewClientError("handleResponse", ErrSessionRejected, info)
+	}
+	if parsed.Error.Code == protocol.CodeReconnect {
+		return NewClientError("handleResponse", ErrRetryLater, info)
+	}
+	return NewClientError("handleResponse", errors.New(parsed.Error.Code), info)
 }
@@ -0,0 +1,665 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"faraway/internal/domain"
+	"faraway/internal/usecases"
+	"faraway/pkg/protocol"
+)
+
+// newTestSession returns a client session talking over one end of an
+// in-memory pipe, and the other end acting as the server.
+func newTestSession(t *testing.T, cfg *Config) (*ClientSession, net.Conn) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	if cfg == nil {
+		cfg = &Config{MaxMessageSize: 1024, BufferSize: 1024}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	session := &ClientSession{
+		conn:    clientConn,
+		reader:  bufio.NewReader(clientConn),
+		client:  newTestClient(cfg),
+		context: ctx,
+	}
+	return session, serverConn
+}
+
+// pipeDialer returns a client config dialing into an in-memory pipe whose
+// server end is handed to serve.
+func pipeDialer(serve func(server net.Conn)) *Config {
+	return &Config{
+		ServerAddrs:    []string{"pipe"},
+		ConnectTimeout: time.Second,
+		RequestTimeout: 5 * time.Second,
+		MaxMessageSize: 1024,
+		BufferSize:     1024,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				server.Write(protocol.Preamble)
+				serve(server)
+			}()
+			return client, nil
+		},
+	}
+}
+
+func newTestClient(cfg *Config) *Client {
+	return NewClient(cfg, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestReceiveChallengeUnknownType(t *testing.T) {
+	cfg := pipeDialer(func(server net.Conn) {
+		// Keep the connection open: reading any further framing would hang
+		server.Write([]byte{0x02})
+	})
+
+	start := time.Now()
+	_, err := newTestClient(cfg).executeSession(context.Background())
+	if !errors.Is(err, ErrInvalidChallengeType) {
+		t.Fatalf("expected ErrInvalidChallengeType, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected immediate rejection, took %v", elapsed)
+	}
+}
+
+func TestNonPowServerFailsFast(t *testing.T) {
+	tests := []struct {
+		name  string
+		serve func(server net.Conn)
+	}{
+		{"echo server", func(server net.Conn) { io.Copy(server, server) }},
+		{"other service banner", func(server net.Conn) { server.Write([]byte("SSH-2.0-OpenSSH\r\n")) }},
+		{"other protocol version", func(server net.Conn) { server.Write([]byte{'P', 'o', 'W', protocol.Version + 1}) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := pipeDialer(nil)
+			cfg.PreambleTimeout = 50 * time.Millisecond
+			cfg.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				t.Cleanup(func() { server.Close() })
+				go tt.serve(server)
+				return client, nil
+			}
+
+			start := time.Now()
+			_, err := newTestClient(cfg).executeSession(context.Background())
+			if !errors.Is(err, ErrNotPowServer) {
+				t.Fatalf("expected ErrNotPowServer, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("expected a quick failure, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestReceiveChallengeTruncatedFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"truncated length", []byte{protocol.ChallengeTypeCPU.Byte(), 0x00, 0x00}},
+		{"truncated data", []byte{protocol.ChallengeTypeCPU.Byte(), 0x00, 0x00, 0x00, 0x0a, 'a', 'b', 'c'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := pipeDialer(func(server net.Conn) {
+				server.Write(tt.frame)
+				server.Close()
+			})
+
+			_, err := newTestClient(cfg).executeSession(context.Background())
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("expected unexpected EOF, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReceiveChallengeRetryLater(t *testing.T) {
+	session, server := newTestSession(t, nil)
+
+	go func() {
+		server.Write([]byte{protocol.FrameRetryLater})
+		server.Close()
+	}()
+
+	_, err := session.receiveChallenge()
+	if !errors.Is(err, ErrRetryLater) {
+		t.Fatalf("expected ErrRetryLater, got %v", err)
+	}
+	if !IsRetryableError(err) {
+		t.Fatalf("expected retry-later to be retryable, got %v", err)
+	}
+}
+
+func TestChallengeDump(t *testing.T) {
+	var dump bytes.Buffer
+	session, server := newTestSession(t, &Config{MaxMessageSize: 1024, BufferSize: 1024, ChallengeDump: &dump})
+
+	frame := []byte{protocol.ChallengeTypeMemory.Byte(), 0x00, 0x00, 0x00, 0x04, 0xde, 0xad, 0xbe, 0xef}
+	go server.Write(frame)
+
+	challenge, err := session.receiveChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(challenge.Data, frame[5:]) {
+		t.Fatalf("expected challenge %x, got %x", frame[5:], challenge.Data)
+	}
+	expected := "challenge frame (9 bytes):\n" + hex.Dump(frame)
+	if dump.String() != expected {
+		t.Fatalf("expected dump\n%s\ngot\n%s", expected, dump.String())
+	}
+}
+
+func TestServerVersionCheck(t *testing.T) {
+	minimum := protocol.SemVer{Major: 1, Minor: 4, Patch: 0}
+	tests := []struct {
+		name    string
+		version string
+		minimum *protocol.SemVer
+		err     error
+	}{
+		{"compatible", "1.5.2", &minimum, nil},
+		{"too old", "1.3.9", &minimum, ErrIncompatibleServer},
+		{"too new", "2.0.0", &minimum, ErrIncompatibleServer},
+		{"not advertised", "", &minimum, ErrIncompatibleServer},
+		{"no minimum", "0.0.0-dev", nil, nil},
+		{"neither", "", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, server := newTestSession(t, &Config{MaxMessageSize: 1024, BufferSize: 1024, MinServerVersion: tt.minimum})
+
+			var frames []byte
+			if tt.version != "" {
+				frames = append([]byte{protocol.FrameVersion, byte(len(tt.version))}, tt.version...)
+			}
+			frames = append(frames, protocol.ChallengeTypeCPU.Byte(), 0x00, 0x00, 0x00, 0x01, 'c')
+			go server.Write(frames)
+
+			challenge, err := session.receiveChallenge()
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				if IsRetryableError(err) {
+					t.Fatalf("expected an incompatible server not to be retried, got %v", err)
+				}
+				return
+			}
+			if err != nil || string(challenge.Data) != "c" {
+				t.Fatalf("expected the challenge, got %+v (%v)", challenge, err)
+			}
+		})
+	}
+}
+
+func TestAdvertisedDifficultyCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		advertised uint64
+		tolerance  uint64
+		err        error
+		pinned     string
+	}{
+		{"matched", 4, 0, nil, "CPU/4"},
+		{"within tolerance", 5, 1, nil, "CPU/5"},
+		{"out of tolerance", 6, 1, ErrDifficultyMismatch, ""},
+		{"not advertised", 0, 0, nil, "CPU/4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, server := newTestSession(t, &Config{MaxMessageSize: 1024, BufferSize: 1024, PinnedDifficulty: 4, DifficultyTolerance: tt.tolerance})
+
+			hint := protocol.FormatHint(protocol.Hint{ExpectedIterations: 16, Workers: 1, Difficulty: tt.advertised})
+			frames := append([]byte{protocol.FrameHint, byte(len(hint))}, hint...)
+			frames = append(frames, protocol.ChallengeTypeCPU.Byte(), 0x00, 0x00, 0x00, 0x01, 'c')
+			go server.Write(frames)
+
+			challenge, err := session.receiveChallenge()
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				if IsRetryableError(err) {
+					t.Fatalf("expected a difficulty mismatch not to be retried, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			submission := string(session.encodeSubmission(challenge, "42"))
+			if !strings.HasPrefix(submission, tt.pinned+"\n") {
+				t.Fatalf("expected the submission to pin %q, got %q", tt.pinned, submission)
+			}
+		})
+	}
+}
+
+func TestReceiveChallengeSentDifficulty(t *testing.T) {
+	capabilities := protocol.FormatCapabilities([]string{protocol.CapabilityDifficulty})
+	advertised := append([]byte{protocol.FrameCapabilities, byte(len(capabilities))}, capabilities...)
+	tests := []struct {
+		name   string
+		frames []byte
+		want   uint64 // zero when the challenge carries none
+		err    error
+	}{
+		{"memory", append(advertised, protocol.AppendChallengeFrameWithDifficulty(nil, protocol.ChallengeTypeMemory, 3, []byte("c"))...), 3, nil},
+		{"cpu", append(advertised, protocol.AppendChallengeFrameWithDifficulty(nil, protocol.ChallengeTypeCPU, 2, []byte("c"))...), 2, nil},
+		{"not advertised", protocol.AppendChallengeFrame(nil, protocol.ChallengeTypeMemory, []byte("c")), 0, nil},
+		{"zero", append(advertised, protocol.AppendChallengeFrameWithDifficulty(nil, protocol.ChallengeTypeMemory, 0, []byte("c"))...), 0, ErrInvalidChallenge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, server := newTestSession(t, nil)
+			go server.Write(tt.frames)
+
+			challenge, err := session.receiveChallenge()
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil || string(challenge.Data) != "c" {
+				t.Fatalf("expected the challenge, got %+v (%v)", challenge, err)
+			}
+			if challenge.Difficulty != tt.want || challenge.DifficultySent != (tt.want != 0) {
+				t.Fatalf("expected sent difficulty %d, got %+v", tt.want, challenge)
+			}
+		})
+	}
+}
+
+func TestExecuteObserveModeSkipsSolving(t *testing.T) {
+	// The session has no solver: any attempt to solve would panic
+	session, server := newTestSession(t, nil)
+
+	go func() {
+		server.Write([]byte{protocol.FrameObserve})
+		server.Write([]byte("SUCCESS:observed quote\n"))
+		server.Close()
+	}()
+
+	if err := session.Execute(); err != nil {
+		t.Fatalf("unexpected error in observe mode: %v", err)
+	}
+}
+
+func TestServerCloseAfterSolutionIsRetryable(t *testing.T) {
+	session, server := newTestSession(t, nil)
+
+	go func() {
+		reader := bufio.NewReader(server)
+		reader.ReadString('\n')
+		reader.ReadString('\n')
+		server.Close()
+	}()
+
+	if err := session.sendSolution(&Challenge{Type: protocol.ChallengeTypeCPU}, "42"); err != nil {
+		t.Fatalf("unexpected error sending solution: %v", err)
+	}
+	err := session.receiveResponse()
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+	if !IsRetryableError(err) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+}
+
+func TestReconnectResponseIsRetryable(t *testing.T) {
+	session, _ := newTestSession(t, nil)
+
+	err := session.handleResponse("ERROR:" + protocol.CodeReconnect + ":Connection reached its maximum age, reconnect")
+	if !errors.Is(err, ErrRetryLater) {
+		t.Fatalf("expected ErrRetryLater, got %v", err)
+	}
+	if !IsRetryableError(err) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+}
+
+func TestEchoChallengePrecedesSolution(t *testing.T) {
+	session, server := newTestSession(t, &Config{MaxMessageSize: 1024, BufferSize: 1024, EchoChallenge: true})
+
+	lines := make(chan []string, 1)
+	go func() {
+		reader := bufio.NewReader(server)
+		var got []string
+		for i := 0; i < 3; i++ {
+			line, _ := reader.ReadString('\n')
+			got = append(got, strings.TrimSpace(line))
+		}
+		lines <- got
+		server.Write([]byte("SUCCESS:quote\n"))
+	}()
+
+	challenge := &Challenge{Type: protocol.ChallengeTypeCPU, Data: []byte("token")}
+	if err := session.sendSolution(challenge, "42"); err != nil {
+		t.Fatalf("unexpected error sending solution: %v", err)
+	}
+	if err := session.receiveResponse(); err != nil {
+		t.Fatalf("unexpected error receiving response: %v", err)
+	}
+	got := <-lines
+	expected := []string{base64.StdEncoding.EncodeToString([]byte("token")), "CPU", "42"}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Fatalf("expected lines %q, got %q", expected, got)
+	}
+}
+
+func TestDetailedErrorResponse(t *testing.T) {
+	session, _ := newTestSession(t, nil)
+
+	err := session.handleResponse(`ERROR:{"code":"CHALLENGE_EXPIRED","message":"Challenge expired","details":["expired","invalid solution"]}`)
+	if err == nil || !strings.Contains(err.Error(), "CHALLENGE_EXPIRED") ||
+		!strings.Contains(err.Error(), "expired; invalid solution") {
+		t.Fatalf("expected the code and every detail in the error, got %v", err)
+	}
+}
+
+func TestRetryLaterRedials(t *testing.T) {
+	var dials atomic.Int32
+	cfg := pipeDialer(func(server net.Conn) {
+		defer server.Close()
+		if dials.Add(1) == 1 {
+			server.Write([]byte{protocol.FrameRetryLater})
+			return
+		}
+		server.Write([]byte{protocol.FrameObserve})
+		server.Write([]byte("SUCCESS:quote after backoff\n"))
+	})
+	cfg.RetryAttempts = 3
+	cfg.RetryDelay = time.Millisecond
+
+	if _, err := newTestClient(cfg).executeSessionWithRetry(context.Background()); err != nil {
+		t.Fatalf("unexpected error after retry: %v", err)
+	}
+	if got := dials.Load(); got != 2 {
+		t.Fatalf("expected 2 dials, got %d", got)
+	}
+}
+
+func TestRetryLaterExhaustsAttempts(t *testing.T) {
+	var dials atomic.Int32
+	cfg := pipeDialer(func(server net.Conn) {
+		defer server.Close()
+		dials.Add(1)
+		server.Write([]byte{protocol.FrameRetryLater})
+	})
+	cfg.RetryAttempts = 2
+	cfg.RetryDelay = time.Millisecond
+
+	_, err := newTestClient(cfg).executeSessionWithRetry(context.Background())
+	if !errors.Is(err, ErrMaxRetriesExceeded) || !errors.Is(err, ErrRetryLater) {
+		t.Fatalf("expected ErrMaxRetriesExceeded wrapping ErrRetryLater, got %v", err)
+	}
+	if got := dials.Load(); got != 3 {
+		t.Fatalf("expected 3 dials, got %d", got)
+	}
+}
+
+func TestOtherErrorsAreNotRetried(t *testing.T) {
+	var dials atomic.Int32
+	cfg := pipeDialer(func(server net.Conn) {
+		defer server.Close()
+		dials.Add(1)
+		server.Write([]byte{0x02})
+	})
+	cfg.RetryAttempts = 3
+	cfg.RetryDelay = time.Millisecond
+
+	_, err := newTestClient(cfg).executeSessionWithRetry(context.Background())
+	if !errors.Is(err, ErrInvalidChallengeType) {
+		t.Fatalf("expected ErrInvalidChallengeType, got %v", err)
+	}
+	if got := dials.Load(); got != 1 {
+		t.Fatalf("expected a single dial, got %d", got)
+	}
+}
+
+func TestConnectFailsOverToLiveAddress(t *testing.T) {
+	cfg := pipeDialer(func(server net.Conn) {
+		defer server.Close()
+		server.Write([]byte{protocol.FrameObserve})
+		server.Write([]byte("SUCCESS:quote from live server\n"))
+	})
+	pipeDial := cfg.DialContext
+	cfg.ServerAddrs = []string{"dead", "live"}
+	cfg.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "dead" {
+			return nil, errors.New("connection refused")
+		}
+		return pipeDial(ctx, network, address)
+	}
+
+	var logs bytes.Buffer
+	client := NewClient(cfg, nil, slog.New(slog.NewTextHandler(&logs, nil)))
+	if _, err := client.executeSessionWithRetry(context.Background()); err != nil {
+		t.Fatalf("unexpected error with a live address: %v", err)
+	}
+	if !strings.Contains(logs.String(), "failing over") || !strings.Contains(logs.String(), "address=dead") {
+		t.Fatalf("expected the failover to be logged, got %q", logs.String())
+	}
+}
+
+// countingMetrics records the counters reported to it.
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *countingMetrics) ObserveDuration(operation, algorithm string, duration time.Duration) {}
+
+func (m *countingMetrics) IncCounter(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name]++
+}
+
+func TestStartCountsRetriesAndFailovers(t *testing.T) {
+	// Every handshake finds the first address dead and fails over, and the
+	// first to reach the live one is asked to retry later
+	var served atomic.Int32
+	cfg := pipeDialer(func(server net.Conn) {
+		defer server.Close()
+		if served.Add(1) == 1 {
+			server.Write([]byte{protocol.FrameRetryLater})
+			return
+		}
+		server.Write([]byte{protocol.FrameObserve})
+		server.Write([]byte("SUCCESS:quote\n"))
+	})
+	pipeDial := cfg.DialContext
+	cfg.ServerAddrs = []string{"dead", "live"}
+	cfg.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "dead" {
+			return nil, errors.New("connection refused")
+		}
+		return pipeDial(ctx, network, address)
+	}
+	cfg.RetryAttempts = 1
+	cfg.RetryDelay = time.Millisecond
+	cfg.LaunchInterval = time.Millisecond
+	metrics := &countingMetrics{counts: map[string]int{}}
+	cfg.Metrics = metrics
+
+	summary, err := newTestClient(cfg).Start(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Start runs 10 handshakes, one of them twice, each run dialing both
+	// addresses
+	want := Summary{Completed: 10, ConnectAttempts: 22, Retries: 1, Failovers: 11}
+	if summary != want {
+		t.Fatalf("expected summary %+v, got %+v", want, summary)
+	}
+	for name, count := range map[string]int{
+		CounterConnectAttempts: 22,
+		CounterRetries:         1,
+		CounterFailovers:       11,
+		CounterCompleted:       10,
+		CounterAborted:         0,
+		CounterFailed:          0,
+	} {
+		if got := metrics.counts[name]; got != count {
+			t.Errorf("expected %s to be %d, got %d", name, count, got)
+		}
+	}
+}
+
+func TestConnectRoundRobin(t *testing.T) {
+	var dialed []string
+	cfg := &Config{
+		ServerAddrs:    []string{"a", "b", "c"},
+		Failover:       FailoverRoundRobin,
+		ConnectTimeout: time.Second,
+		RequestTimeout: time.Second,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			client, server := net.Pipe()
+			t.Cleanup(func() { server.Close() })
+			return client, nil
+		},
+	}
+	client := newTestClient(cfg)
+
+	for i := 0; i < 4; i++ {
+		conn, err := client.connect(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error connecting: %v", err)
+		}
+		conn.Close()
+	}
+	if got := strings.Join(dialed, ","); got != "a,b,c,a" {
+		t.Fatalf("expected round-robin order a,b,c,a, got %s", got)
+	}
+}
+
+// fixedSolver returns the same solution for any challenge.
+type fixedSolver struct {
+	usecases.SolverUsecase
+	solution string
+}
+
+func (f fixedSolver) Solve(ctx context.Context, challenge domain.Challenge) (domain.Solution, error) {
+	return domain.Solution{Type: challenge.Type, Data: []byte(f.solution)}, nil
+}
+
+func TestExecuteLogsPhaseTimings(t *testing.T) {
+	cfg := pipeDialer(func(server net.Conn) {
+		defer server.Close()
+		server.Write([]byte{protocol.ChallengeTypeCPU.Byte(), 0x00, 0x00, 0x00, 0x01, 'c'})
+		reader := bufio.NewReader(server)
+		reader.ReadString('\n')
+		reader.ReadString('\n')
+		server.Write([]byte("SUCCESS:quote\n"))
+	})
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client := NewClient(cfg, fixedSolver{solution: "42"}, logger)
+	if _, err := client.executeSession(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var entry map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if err := json.Unmarshal([]byte(line), &entry); err == nil && entry["msg"] == "handshake timings" {
+			break
+		}
+		entry = nil
+	}
+	if entry == nil {
+		t.Fatalf("expected a handshake timings entry, got %q", logs.String())
+	}
+	for _, phase := range []string{"connect", "receive_challenge", "solve", "send_solution", "receive_response"} {
+		if _, ok := entry[phase].(float64); !ok {
+			t.Fatalf("expected a %s duration field, got %v", phase, entry)
+		}
+	}
+}
+
+// writeCountingConn counts the writes made to a connection.
+type writeCountingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *writeCountingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+func TestSubmissionIsOneWrite(t *testing.T) {
+	session, server := newTestSession(t, &Config{MaxMessageSize: 1024, BufferSize: 1024, EchoChallenge: true})
+	conn := &writeCountingConn{Conn: session.conn}
+	session.conn = conn
+
+	// The server reads a byte at a time, so the write is still in
+	// progress while it reads
+	received := make(chan []byte, 1)
+	go func() {
+		var data []byte
+		b := make([]byte, 1)
+		for bytes.Count(data, []byte("\n")) < 3 {
+			if _, err := server.Read(b); err != nil {
+				break
+			}
+			data = append(data, b[0])
+			time.Sleep(time.Millisecond)
+		}
+		received <- data
+	}()
+
+	challenge := &Challenge{Type: protocol.ChallengeTypeCPU, Data: []byte("token")}
+	if err := session.sendSolution(challenge, "42"); err != nil {
+		t.Fatalf("unexpected error sending solution: %v", err)
+	}
+	expected := base64.StdEncoding.EncodeToString([]byte("token")) + "\nCPU\n42\n"
+	if got := <-received; string(got) != expected {
+		t.Fatalf("expected the server to receive %q, got %q", expected, got)
+	}
+	if writes := conn.writes.Load(); writes != 1 {
+		t.Fatalf("expected the submission in one write, got %d", writes)
+	}
+}
@@ -3,6 +3,9 @@ package tcp
 import (
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"syscall"
 )
 
 var (
@@ -11,17 +14,23 @@ var (
 	ErrInvalidMessageSize = errors.New("invalid message size")
 
 	// Connection errors
-	ErrConnectionClosed = errors.New("connection closed")
-	ErrReadTimeout      = errors.New("read operation timeout")
-	ErrWriteTimeout     = errors.New("write operation timeout")
+	ErrConnectionClosed   = errors.New("connection closed")
+	ErrReadTimeout        = errors.New("read operation timeout")
+	ErrWriteTimeout       = errors.New("write operation timeout")
+	ErrNoServerAddress    = errors.New("no server address configured")
+	ErrNotPowServer       = errors.New("not a proof-of-work server")
+	ErrIncompatibleServer = errors.New("incompatible server version")
 
 	// Challenge errors
 	ErrInvalidChallenge     = errors.New("invalid challenge format")
 	ErrSolutionNotFound     = errors.New("solution not found")
 	ErrInvalidChallengeType = errors.New("invalid challenge type")
+	ErrDifficultyMismatch   = errors.New("server uses a different difficulty than pinned")
+	ErrSessionRejected      = errors.New("server rejected the session token")
 
 	// System errors
 	ErrMaxRetriesExceeded = errors.New("maximum retry attempts exceeded")
+	ErrRetryLater         = errors.New("server asked to retry later")
 )
 
 type ClientError struct {
@@ -50,6 +59,26 @@ func NewClientError(op string, err error, info string) error {
 }
 
 // Helper functions
+
+// isClosedError reports whether err means the peer or the local side closed
+// the connection, as opposed to a timeout or protocol error.
+func isClosedError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// connectionError wraps err as ErrConnectionClosed when it signals a closed
+// connection, and as-is otherwise.
+func connectionError(op string, err error, info string) error {
+	if isClosedError(err) {
+		return NewClientError(op, fmt.Errorf("%w: %w", ErrConnectionClosed, err), info)
+	}
+	return NewClientError(op, err, info)
+}
+
 func IsRetryableError(err error) bool {
 	var clientErr *ClientError
 	if errors.As(err, &clientErr) {
@@ -60,6 +89,8 @@ func IsRetryableError(err error) bool {
 			return true
 		case errors.Is(err, ErrWriteTimeout):
 			return true
+		case errors.Is(err, ErrRetryLater):
+			return true
 		default:
 			return false
 		}
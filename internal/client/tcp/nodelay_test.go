@@ -0,0 +1,48 @@
+//go:build unix
+
+package tcp
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConnectAppliesNoDelay(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer listener.Close()
+
+	for _, noDelay := range []bool{false, true} {
+		client := newTestClient(&Config{
+			ServerAddrs:    []string{listener.Addr().String()},
+			ConnectTimeout: time.Second,
+			RequestTimeout: time.Second,
+			NoDelay:        &noDelay,
+		})
+		conn, err := client.connect(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error connecting: %v", err)
+		}
+		defer conn.Close()
+
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var value int
+		var sockErr error
+		if err := raw.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		}); err != nil || sockErr != nil {
+			t.Fatalf("unexpected error reading TCP_NODELAY: %v, %v", err, sockErr)
+		}
+		if (value != 0) != noDelay {
+			t.Fatalf("expected TCP_NODELAY %v, got %d", noDelay, value)
+		}
+	}
+}
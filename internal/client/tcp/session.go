@@ -0,0 +1,129 @@
+package tcp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"faraway/pkg/protocol"
+)
+
+// sessionGrant is a session token a server granted, as kept in SessionFile.
+type sessionGrant struct {
+	Token  []byte    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// loadSessionGrant reads the grant kept in SessionFile, if any. A missing
+// file just means no grant yet.
+func (c *Client) loadSessionGrant() {
+	if c.cfg.SessionFile == "" {
+		return
+	}
+	data, err := os.ReadFile(c.cfg.SessionFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	var grant sessionGrant
+	if err == nil {
+		err = json.Unmarshal(data, &grant)
+	}
+	if err != nil {
+		c.logger.Error("ignoring session file", "path", c.cfg.SessionFile, "error", err)
+		return
+	}
+	c.grant = &grant
+}
+
+// storeSessionGrant keeps grant, nil to drop the current one, and writes
+// it to SessionFile if set. The file only ever holds a token, readable by
+// the owner alone.
+func (c *Client) storeSessionGrant(grant *sessionGrant) {
+	c.grantMu.Lock()
+	defer c.grantMu.Unlock()
+	c.grant = grant
+	if c.cfg.SessionFile == "" {
+		return
+	}
+
+	var err error
+	if grant == nil {
+		if err = os.Remove(c.cfg.SessionFile); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	} else {
+		var data []byte
+		if data, err = json.Marshal(grant); err == nil {
+			err = os.WriteFile(c.cfg.SessionFile, data, 0o600)
+		}
+	}
+	if err != nil {
+		c.logger.Error("saving session file failed", "path", c.cfg.SessionFile, "error", err)
+	}
+}
+
+// sessionToken returns the granted session token if it is still valid.
+func (c *Client) sessionToken() []byte {
+	c.grantMu.Lock()
+	defer c.grantMu.Unlock()
+	if c.grant == nil || !time.Now().Before(c.grant.Expiry) {
+		return nil
+	}
+	return c.grant.Token
+}
+
+// reusesSession reports whether the client presents a session token
+// instead of solving the challenge, and returns the token.
+func (s *ClientSession) reusesSession() ([]byte, bool) {
+	if !s.client.cfg.ReuseSessions || !protocol.HasCapability(s.capabilities, protocol.CapabilitySession) {
+		return nil, false
+	}
+	token := s.client.sessionToken()
+	return token, token != nil
+}
+
+// encodeSessionSubmission builds what the client sends to present token
+// instead of a solution, echoing the challenge token first if enabled.
+func (s *ClientSession) encodeSessionSubmission(challenge *Challenge, token []byte) []byte {
+	var echoed []byte
+	if s.client.cfg.EchoChallenge {
+		echoed = challenge.Data
+	}
+	return protocol.AppendSubmission(nil, echoed, protocol.SessionType, base64.StdEncoding.EncodeToString(token))
+}
+
+// receiveSessionGrant reads the grant line a server advertising
+// CapabilitySession sends after a solved challenge. The quote was already
+// received, so failing to is only logged.
+func (s *ClientSession) receiveSessionGrant() {
+	if !s.client.cfg.ReuseSessions || !protocol.HasCapability(s.capabilities, protocol.CapabilitySession) {
+		return
+	}
+
+	lineCh := make(chan string, 1)
+	go func() {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			s.client.logger.Debug("reading session grant failed", "error", err)
+		}
+		lineCh <- line
+	}()
+
+	var line string
+	select {
+	case line = <-lineCh:
+	case <-s.context.Done():
+		return
+	}
+	token, ttl, err := protocol.ParseSessionGrant(strings.TrimSpace(line))
+	if err != nil {
+		s.client.logger.Debug("ignoring session grant", "error", err)
+		return
+	}
+	s.client.storeSessionGrant(&sessionGrant{Token: token, Expiry: time.Now().Add(ttl)})
+	s.client.logger.Debug("session granted", "ttl", ttl)
+}
@@ -0,0 +1,109 @@
+package tcp
+
+import (
+	"context"
+	"time"
+
+	"faraway/internal/domain"
+)
+
+// Watch fetches a quote every interval, solving a challenge or presenting
+// a session token each time, and passes each one to emit along with when
+// it was fetched, until ctx is done. Ticks missed while fetching are
+// skipped rather than caught up on. A failed fetch is tried again after
+// RetryDelay, doubling up to interval while fetches keep failing.
+//
+// With PrefetchMaxAge set, the challenge for the next tick is received and
+// solved ahead of it, so quotes come without waiting for a solve.
+func (c *Client) Watch(ctx context.Context, interval time.Duration, emit func(time.Time, domain.Quote)) error {
+	var backoff time.Duration
+	var pending *prefetched
+	defer func() { pending.discard() }()
+	next := time.Now()
+	for c.waitToLaunch(ctx, time.Until(next)) {
+		quote, err := c.fetchWatched(ctx, pending)
+		pending = nil
+		now := time.Now()
+		switch {
+		case err == nil:
+			emit(now, quote)
+			backoff = 0
+			if next = next.Add(interval); next.Before(now) {
+				next = now
+			}
+			if c.cfg.PrefetchMaxAge > 0 && c.waitToLaunch(ctx, time.Until(next.Add(-c.cfg.PrefetchMaxAge/2))) {
+				pending = c.prefetch(ctx)
+			}
+		case ctx.Err() != nil:
+			return nil
+		default:
+			backoff = min(max(2*backoff, c.cfg.RetryDelay), interval)
+			if backoff <= 0 {
+				backoff = interval
+			}
+			c.logger.Error("fetching quote failed", "error", err, "retry_in", backoff)
+			next = now.Add(backoff)
+		}
+	}
+	return nil
+}
+
+// prefetched is a handshake run up to submitting its solution.
+type prefetched struct {
+	session *ClientSession
+	submit  func() error
+	// openedAt is when the connection was opened, before the challenge
+	// was issued.
+	openedAt time.Time
+}
+
+// prefetch opens a session and solves its challenge, holding the solution
+// back. It returns nil if that fails, leaving the next fetch to start
+// over.
+func (c *Client) prefetch(ctx context.Context) *prefetched {
+	openedAt := time.Now()
+	session, err := c.openSession(ctx)
+	if err != nil {
+		c.logger.Debug("prefetching challenge failed", "error", err)
+		return nil
+	}
+	submit, err := session.prepare()
+	if err != nil {
+		session.close()
+		c.logger.Debug("prefetching challenge failed", "error", err)
+		return nil
+	}
+	return &prefetched{session: session, submit: submit, openedAt: openedAt}
+}
+
+// discard closes the prefetched session, if any, unused.
+func (p *prefetched) discard() {
+	if p != nil {
+		p.session.close()
+	}
+}
+
+// fetchWatched submits the prefetched solution, if any, and otherwise, or
+// if it expired or failed, fetches a quote from scratch. A solution is
+// expired once its challenge is older than PrefetchMaxAge.
+func (c *Client) fetchWatched(ctx context.Context, pending *prefetched) (domain.Quote, error) {
+	if pending == nil {
+		return c.executeSessionWithRetry(ctx)
+	}
+	defer pending.discard()
+
+	if age := time.Since(pending.openedAt); age > c.cfg.PrefetchMaxAge {
+		c.logger.Debug("prefetched challenge expired, solving again", "age", age)
+		return c.executeSessionWithRetry(ctx)
+	}
+	// The connection deadline was set when it was opened
+	if err := pending.session.conn.SetDeadline(time.Now().Add(c.cfg.RequestTimeout)); err != nil {
+		c.logger.Debug("prefetched session unusable, solving again", "error", err)
+		return c.executeSessionWithRetry(ctx)
+	}
+	if err := pending.submit(); err != nil {
+		c.logger.Debug("prefetched solution failed, solving again", "error", err)
+		return c.executeSessionWithRetry(ctx)
+	}
+	return pending.session.quote, nil
+}
@@ -0,0 +1,146 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"faraway/internal/domain"
+	"faraway/internal/usecases/usecasestest"
+	"faraway/pkg/protocol"
+)
+
+func TestWatchFetchesOneQuotePerTick(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	var dials atomic.Int32
+	cfg := pipeDialer(func(server net.Conn) {
+		defer server.Close()
+		// The second fetch fails and is retried before the next tick
+		if dial := dials.Add(1); dial != 2 {
+			server.Write([]byte{protocol.FrameObserve})
+			fmt.Fprintf(server, "SUCCESS:quote %d\n", dial)
+		}
+	})
+	cfg.RetryDelay = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var quotes []string
+	var times []time.Time
+	err := newTestClient(cfg).Watch(ctx, interval, func(at time.Time, quote domain.Quote) {
+		quotes = append(quotes, quote.Text)
+		times = append(times, at)
+		if len(quotes) == 3 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := []string{"quote 1", "quote 3", "quote 4"}; !slices.Equal(quotes, want) {
+		t.Fatalf("expected quotes %q, got %q", want, quotes)
+	}
+	if got := dials.Load(); got != 4 {
+		t.Fatalf("expected 4 dials, got %d", got)
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < interval/2 {
+			t.Fatalf("expected quotes about %s apart, got %s between quotes %d and %d", interval, gap, i, i+1)
+		}
+	}
+}
+
+// timedSolver records when each of its solves finished.
+type timedSolver struct {
+	usecasestest.SolverUsecase
+
+	mu     sync.Mutex
+	solved []time.Time
+}
+
+func (s *timedSolver) Solve(ctx context.Context, challenge domain.Challenge) (domain.Solution, error) {
+	solution, err := s.SolverUsecase.Solve(ctx, challenge)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.solved = append(s.solved, time.Now())
+	return solution, err
+}
+
+// watchWithPrefetch watches quotes from a server issuing a challenge on
+// every connection, until two quotes were fetched, and returns when they
+// were, how many connections were made and the solver.
+func watchWithPrefetch(t *testing.T, interval, maxAge time.Duration) ([]time.Time, int32, *timedSolver) {
+	t.Helper()
+
+	var dials atomic.Int32
+	cfg := pipeDialer(func(server net.Conn) {
+		defer server.Close()
+		dial := dials.Add(1)
+		server.Write(protocol.AppendChallengeFrame(nil, protocol.ChallengeTypeCPU, []byte("challenge")))
+		reader := bufio.NewReader(server)
+		for i := 0; i < 2; i++ {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return
+			}
+		}
+		fmt.Fprintf(server, "SUCCESS:quote %d\n", dial)
+	})
+	cfg.PrefetchMaxAge = maxAge
+	solver := &timedSolver{SolverUsecase: usecasestest.SolverUsecase{Solution: []byte("42"), Delay: 50 * time.Millisecond}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var times []time.Time
+	err := NewClient(cfg, solver, slog.New(slog.NewTextHandler(io.Discard, nil))).Watch(ctx, interval, func(at time.Time, quote domain.Quote) {
+		times = append(times, at)
+		if len(times) == 2 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return times, dials.Load(), solver
+}
+
+func TestWatchPrefetchKeepsSolutionReady(t *testing.T) {
+	times, dials, solver := watchWithPrefetch(t, 200*time.Millisecond, time.Second)
+
+	if dials != 2 {
+		t.Fatalf("expected a connection per quote, got %d", dials)
+	}
+	solver.mu.Lock()
+	defer solver.mu.Unlock()
+	if len(solver.solved) != 2 {
+		t.Fatalf("expected a solve per quote, got %d", len(solver.solved))
+	}
+	// The second challenge was solved right after the first quote, long
+	// before its tick
+	if ahead := times[1].Sub(solver.solved[1]); ahead < 50*time.Millisecond {
+		t.Fatalf("expected the solution ready well ahead of the quote, got %s ahead", ahead)
+	}
+}
+
+func TestWatchPrefetchExpiredIsSolvedAgain(t *testing.T) {
+	// Prefetching starts 20ms ahead of the tick, and the solve alone
+	// outlasts the 40ms the challenge may age
+	_, dials, solver := watchWithPrefetch(t, 200*time.Millisecond, 40*time.Millisecond)
+
+	if dials != 3 {
+		t.Fatalf("expected the expired prefetch to be replaced by a new connection, got %d connections", dials)
+	}
+	solver.mu.Lock()
+	defer solver.mu.Unlock()
+	if len(solver.solved) != 3 {
+		t.Fatalf("expected the expired challenge to be solved again, got %d solves", len(solver.solved))
+	}
+}
@@ -1,12 +1,57 @@
 package domain
 
+import (
+	"strings"
+
+	"faraway/pkg/protocol"
+)
+
 // ProofOfWork defines the PoW entity, including the challenge and difficulty.
 type ProofOfWork struct {
 	Challenge  []byte
 	Difficulty uint64
 }
 
-// Quote defines a simple quote structure.
+// Challenge is a proof-of-work challenge as received by a client.
+//
+// Challenges and solutions have one JSON form shared by every tool, e.g.
+// {"type":"CPU","data":"<base64>","difficulty":4}, so one logged by the
+// server can be fed to another tool verbatim.
+type Challenge struct {
+	Type protocol.ChallengeType `json:"type"`
+	Data []byte                 `json:"data"`
+	// Difficulty is zero where it isn't known, as on the wire unless the
+	// server advertises protocol.CapabilityDifficulty, and challenges are
+	// solved at it when set.
+	Difficulty uint64 `json:"difficulty,omitempty"`
+	// Hint is the server's advice on solving, if any. It is only ever
+	// advisory, so it isn't part of the shared form.
+	Hint *protocol.Hint `json:"-"`
+}
+
+// Solution is the answer to a challenge, ready to be submitted.
+type Solution struct {
+	Type protocol.ChallengeType `json:"type"`
+	Data []byte                 `json:"data"`
+}
+
+// Quote defines a simple quote structure. Author and Source are optional.
 type Quote struct {
-	Text string
+	Text   string `json:"text"`
+	Author string `json:"author,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// String renders the quote for people, followed by its attribution.
+func (q Quote) String() string {
+	var attribution []string
+	for _, part := range []string{q.Author, q.Source} {
+		if part != "" {
+			attribution = append(attribution, part)
+		}
+	}
+	if len(attribution) == 0 {
+		return q.Text
+	}
+	return q.Text + " — " + strings.Join(attribution, ", ")
 }
@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"faraway/pkg/protocol"
+)
+
+func TestChallengeJSON(t *testing.T) {
+	challenge := Challenge{Type: protocol.ChallengeTypeMemory, Data: []byte{0x00, 0xFF, 'x'}, Difficulty: 4}
+
+	encoded, err := json.Marshal(challenge)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := `{"type":"Memory","data":"AP94","difficulty":4}`; string(encoded) != expected {
+		t.Fatalf("expected %s, got %s", expected, encoded)
+	}
+
+	var decoded Challenge
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, challenge) {
+		t.Fatalf("expected %+v after a round trip, got %+v", challenge, decoded)
+	}
+}
+
+func TestSolutionJSON(t *testing.T) {
+	solution := Solution{Type: protocol.ChallengeTypeCPU, Data: []byte("hex:2a")}
+
+	encoded, err := json.Marshal(solution)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := `{"type":"CPU","data":"aGV4OjJh"}`; string(encoded) != expected {
+		t.Fatalf("expected %s, got %s", expected, encoded)
+	}
+
+	var decoded Solution
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, solution) {
+		t.Fatalf("expected %+v after a round trip, got %+v", solution, decoded)
+	}
+}
+
+func TestChallengeJSONRejectsUnknownType(t *testing.T) {
+	var decoded Challenge
+	if err := json.Unmarshal([]byte(`{"type":"scrypt","data":""}`), &decoded); err == nil {
+		t.Fatal("expected an error for an unknown challenge type")
+	}
+	if _, err := json.Marshal(Challenge{Type: protocol.ChallengeTypeInvalid}); err == nil {
+		t.Fatal("expected an error marshaling an invalid challenge type")
+	}
+}
+
+func TestQuoteString(t *testing.T) {
+	tests := []struct {
+		quote    Quote
+		expected string
+	}{
+		{Quote{Text: "Be yourself."}, "Be yourself."},
+		{Quote{Text: "Be yourself.", Author: "Oscar Wilde"}, "Be yourself. — Oscar Wilde"},
+		{Quote{Text: "Be yourself.", Source: "Letters"}, "Be yourself. — Letters"},
+		{Quote{Text: "Be yourself.", Author: "Oscar Wilde", Source: "Letters"}, "Be yourself. — Oscar Wilde, Letters"},
+	}
+	for _, tt := range tests {
+		if got := tt.quote.String(); got != tt.expected {
+			t.Fatalf("expected %q, got %q", tt.expected, got)
+		}
+	}
+}
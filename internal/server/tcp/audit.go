@@ -0,0 +1,130 @@
+package tcp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"faraway/internal/domain"
+	"faraway/internal/usecases"
+	"faraway/pkg/protocol"
+)
+
+var (
+	ErrAuditSignature = errors.New("audit record signature mismatch")
+	ErrAuditSolution  = errors.New("audit record solution invalid")
+)
+
+// AuditRecord is a replayable proof of one successful handshake: with it
+// anyone can re-check that the client solved the challenge it was served
+// the quote for, without access to the server. Challenge is what the
+// client solved, i.e. the token in echo mode.
+type AuditRecord struct {
+	Time       time.Time              `json:"time"`
+	ClientIP   string                 `json:"client_ip"`
+	Type       protocol.ChallengeType `json:"type"`
+	Difficulty uint64                 `json:"difficulty"`
+	Challenge  []byte                 `json:"challenge"`
+	Solution   []byte                 `json:"solution"`
+	Quote      domain.Quote           `json:"quote"`
+	// Signature is an HMAC-SHA256 of the record without it, present when
+	// the server has an audit key.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// AuditSink receives the audit record of every successful handshake.
+// Records are only ever appended.
+type AuditSink interface {
+	Append(ctx context.Context, record AuditRecord) error
+}
+
+type jsonAuditSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONAuditSink returns an AuditSink writing one JSON record per line
+// to w, e.g. stdout or a file opened for appending.
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *jsonAuditSink) Append(_ context.Context, record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoder.Encode(record)
+}
+
+// signedAuditPayload is what an audit record's signature covers.
+func signedAuditPayload(key []byte, record AuditRecord) []byte {
+	record.Signature = nil
+	// A struct of plain fields always encodes
+	payload, _ := json.Marshal(record)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// SignAuditRecord returns record signed with key.
+func SignAuditRecord(key []byte, record AuditRecord) AuditRecord {
+	record.Signature = signedAuditPayload(key, record)
+	return record
+}
+
+// VerifyAuditRecord re-checks an audit record independently of any
+// server: its signature when key is set, and that its solution solves its
+// challenge at its difficulty.
+func VerifyAuditRecord(key []byte, record AuditRecord) error {
+	if len(key) > 0 && !hmac.Equal(record.Signature, signedAuditPayload(key, record)) {
+		return ErrAuditSignature
+	}
+
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(record.Difficulty, nil, record.Type)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAuditSolution, err)
+	}
+	valid := false
+	switch record.Type {
+	case protocol.ChallengeTypeCPU:
+		valid = powUsecase.ValidateCPUBoundSolution(record.Challenge, record.Solution)
+	case protocol.ChallengeTypeMemory:
+		if valid, err = powUsecase.ValidateMemoryBoundSolution(record.Challenge, record.Solution); err != nil {
+			return fmt.Errorf("%w: %v", ErrAuditSolution, err)
+		}
+	}
+	if !valid {
+		return ErrAuditSolution
+	}
+	return nil
+}
+
+// audit appends the record of a successful handshake to the audit sink, if
+// any. The client already has its quote, so failures are only logged.
+func (s *Session) audit(challengeType protocol.ChallengeType, challenge, solution []byte, solvedAt time.Time) {
+	sink := s.server.cfg.AuditSink
+	if sink == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:       solvedAt.UTC(),
+		ClientIP:   remoteIP(s.conn),
+		Type:       challengeType,
+		Difficulty: s.difficulty,
+		Challenge:  challenge,
+		Solution:   solution,
+		Quote:      s.quote,
+	}
+	if len(s.server.cfg.AuditKey) > 0 {
+		record = SignAuditRecord(s.server.cfg.AuditKey, record)
+	}
+	if err := sink.Append(s.context, record); err != nil {
+		s.server.logger.Error("failed to append audit record", "ip", record.ClientIP, "error", err)
+	}
+}
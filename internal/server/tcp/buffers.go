@@ -0,0 +1,102 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// bufferPool hands out the buffered reader and writer of a connection.
+// When pooling, buffers of finished connections are reused, so connection
+// churn doesn't allocate fresh buffers for every client.
+type bufferPool struct {
+	size    int // zero means bufio's default
+	pooled  bool
+	readers sync.Pool
+	writers sync.Pool
+}
+
+func newBufferPool(cfg *Config) *bufferPool {
+	return &bufferPool{size: cfg.BufferSize, pooled: cfg.PoolBuffers}
+}
+
+func (p *bufferPool) getReader(r io.Reader) *bufio.Reader {
+	if p.pooled {
+		if br, ok := p.readers.Get().(*bufio.Reader); ok {
+			br.Reset(r)
+			return br
+		}
+	}
+	if p.size > 0 {
+		return bufio.NewReaderSize(r, p.size)
+	}
+	return bufio.NewReader(r)
+}
+
+func (p *bufferPool) getWriter(w io.Writer) *bufio.Writer {
+	if p.pooled {
+		if bw, ok := p.writers.Get().(*bufio.Writer); ok {
+			bw.Reset(w)
+			return bw
+		}
+	}
+	if p.size > 0 {
+		return bufio.NewWriterSize(w, p.size)
+	}
+	return bufio.NewWriter(w)
+}
+
+// drain drops the pooled buffers, so their memory can be reclaimed.
+func (p *bufferPool) drain() {
+	for p.readers.Get() != nil {
+	}
+	for p.writers.Get() != nil {
+	}
+}
+
+// put returns the buffers of a finished connection to the pool; a nil
+// buffer is skipped. Resetting them discards anything left buffered and
+// drops the connection, so nothing leaks to the next one.
+func (p *bufferPool) put(br *bufio.Reader, bw *bufio.Writer) {
+	if !p.pooled {
+		return
+	}
+	if br != nil {
+		br.Reset(nil)
+		p.readers.Put(br)
+	}
+	if bw != nil {
+		bw.Reset(nil)
+		p.writers.Put(bw)
+	}
+}
+
+// sessionByteLimit fails reads once a connection sent its allowance of
+// bytes.
+type sessionByteLimit struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+}
+
+// limitSessionBytes returns r limited to limit bytes, or r itself if limit
+// is zero.
+func limitSessionBytes(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &sessionByteLimit{r: r, limit: limit, remaining: limit}
+}
+
+func (l *sessionByteLimit) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, NewConnectionError("read", ErrSessionBytes, fmt.Sprintf("more than %d bytes", l.limit))
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
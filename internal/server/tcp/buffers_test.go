@@ -0,0 +1,73 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBufferPoolDoesNotLeakBetweenConnections(t *testing.T) {
+	pool := newBufferPool(&Config{PoolBuffers: true, BufferSize: 64})
+
+	// A connection leaves unread input and unflushed output behind
+	reader := pool.getReader(strings.NewReader("secret input"))
+	if _, err := reader.Peek(1); err != nil {
+		t.Fatalf("unexpected error filling reader: %v", err)
+	}
+	var first bytes.Buffer
+	writer := pool.getWriter(&first)
+	writer.WriteString("secret output")
+	pool.put(reader, writer)
+
+	// The next connection must see neither
+	reader = pool.getReader(strings.NewReader(""))
+	if data, _ := io.ReadAll(reader); len(data) != 0 {
+		t.Fatalf("expected no leftover input, got %q", data)
+	}
+	var second bytes.Buffer
+	writer = pool.getWriter(&second)
+	if writer.Buffered() != 0 {
+		t.Fatalf("expected an empty writer, got %d bytes buffered", writer.Buffered())
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	if first.Len() != 0 || second.Len() != 0 {
+		t.Fatalf("expected nothing written, got %q and %q", first.String(), second.String())
+	}
+}
+
+func TestBufferPoolSize(t *testing.T) {
+	for _, pooled := range []bool{false, true} {
+		pool := newBufferPool(&Config{PoolBuffers: pooled, BufferSize: 64})
+		if size := pool.getReader(nil).Size(); size != 64 {
+			t.Fatalf("pooled=%v: expected reader size 64, got %d", pooled, size)
+		}
+		if size := pool.getWriter(nil).Size(); size != 64 {
+			t.Fatalf("pooled=%v: expected writer size 64, got %d", pooled, size)
+		}
+	}
+}
+
+// BenchmarkConnectionChurn handles short-lived connections back to back;
+// compare allocations with and without pooled buffers.
+func BenchmarkConnectionChurn(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%v", pooled), func(b *testing.B) {
+			server := newTestServer(&Config{Observe: true, PoolBuffers: pooled})
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				clientConn, serverConn := net.Pipe()
+				go server.handleConnection(serverConn)
+				if _, err := io.Copy(io.Discard, bufio.NewReader(clientConn)); err != nil {
+					b.Fatalf("unexpected error reading: %v", err)
+				}
+				clientConn.Close()
+			}
+		})
+	}
+}
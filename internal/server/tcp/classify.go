@@ -0,0 +1,94 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/netip"
+
+	"faraway/internal/usecases"
+)
+
+// ClientInfo is what is known about a connection when it is classified,
+// before any challenge is issued.
+type ClientInfo struct {
+	IP string
+	// Certificate is the client's verified TLS certificate, nil without
+	// one.
+	Certificate *x509.Certificate
+}
+
+// Classifier sorts connections into classes, each getting the ClassPolicy
+// configured for it. Connections in a class without a policy, such as the
+// empty one, get the server's defaults.
+type Classifier interface {
+	Classify(info ClientInfo) string
+}
+
+// ClassPolicy is how clients of a class are challenged: with PowUsecase,
+// which sets their difficulty and algorithms, or not at all when it is
+// nil. Unlike allow-listed clients they are still rate limited.
+type ClassPolicy struct {
+	PowUsecase usecases.PowUsecase
+}
+
+// ClassRule puts clients within Prefix, or presenting a certificate for
+// CommonName, into Class. Whichever of the two is unset matches any client.
+type ClassRule struct {
+	Prefix     netip.Prefix
+	CommonName string
+	Class      string
+}
+
+type ruleClassifier struct {
+	rules []ClassRule
+}
+
+// NewRuleClassifier returns a Classifier picking the class of the first
+// matching rule, or the empty class if none matches.
+func NewRuleClassifier(rules []ClassRule) Classifier {
+	return &ruleClassifier{rules: rules}
+}
+
+func (c *ruleClassifier) Classify(info ClientInfo) string {
+	addr, err := netip.ParseAddr(info.IP)
+	for _, rule := range c.rules {
+		if rule.Prefix.IsValid() && (err != nil || !rule.Prefix.Contains(addr.Unmap())) {
+			continue
+		}
+		if rule.CommonName != "" && (info.Certificate == nil || info.Certificate.Subject.CommonName != rule.CommonName) {
+			continue
+		}
+		return rule.Class
+	}
+	return ""
+}
+
+// classify returns the class of the connection and its policy, if the
+// class has one.
+func (s *Server) classify(ctx context.Context, conn net.Conn, ip string) (string, ClassPolicy, bool) {
+	if s.cfg.Classifier == nil {
+		return "", ClassPolicy{}, false
+	}
+	class := s.cfg.Classifier.Classify(ClientInfo{IP: ip, Certificate: peerCertificate(ctx, conn)})
+	policy, ok := s.cfg.Classes[class]
+	return class, policy, ok
+}
+
+// peerCertificate returns the client's TLS certificate, completing the
+// handshake if needed, or nil if there is none.
+func peerCertificate(ctx context.Context, conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	// A failed handshake fails the connection's first read or write anyway
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil
+	}
+	if certificates := tlsConn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+		return certificates[0]
+	}
+	return nil
+}
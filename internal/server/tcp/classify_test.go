@@ -0,0 +1,118 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"faraway/internal/usecases"
+	"faraway/pkg/protocol"
+)
+
+type classifierFunc func(info ClientInfo) string
+
+func (f classifierFunc) Classify(info ClientInfo) string {
+	return f(info)
+}
+
+func TestClassifiedDifficulty(t *testing.T) {
+	policy := func(difficulty uint64) ClassPolicy {
+		powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(difficulty, nil, protocol.ChallengeTypeCPU)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return ClassPolicy{PowUsecase: powUsecase}
+	}
+	classes := map[string]string{"192.0.2.1": "vip", "192.0.2.2": "suspect", "192.0.2.3": "exempt"}
+
+	tests := []struct {
+		ip         string
+		difficulty string // empty when exempt from proof of work
+	}{
+		{"192.0.2.1", "difficulty=2"},
+		{"192.0.2.2", "difficulty=5"},
+		{"192.0.2.3", ""},
+		// Unclassified clients get the server's fake usecase
+		{"192.0.2.4", "difficulty=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			var logs lockedBuffer
+			server := newTestServer(&Config{
+				Classifier: classifierFunc(func(info ClientInfo) string { return classes[info.IP] }),
+				Classes:    map[string]ClassPolicy{"vip": policy(2), "suspect": policy(5), "exempt": {}},
+			})
+			server.logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+			clientConn, serverConn := net.Pipe()
+			handled := make(chan struct{})
+			go func() {
+				defer close(handled)
+				server.handleConnection(&remoteAddrConn{
+					Conn:       serverConn,
+					remoteAddr: &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 4242},
+				})
+			}()
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(clientConn)
+			readPreamble(t, reader)
+
+			if tt.difficulty == "" {
+				if frame, err := reader.ReadByte(); err != nil || frame != protocol.FrameObserve {
+					t.Fatalf("expected the no-challenge frame, got %x (%v)", frame, err)
+				}
+				clientConn.Close()
+				<-handled
+				return
+			}
+			readChallengeFrame(t, reader)
+			clientConn.Close()
+			<-handled
+
+			var sent string
+			for _, line := range strings.Split(logs.String(), "\n") {
+				if strings.Contains(line, "challenge sent") {
+					sent = line
+				}
+			}
+			if !strings.Contains(sent, " "+tt.difficulty+" ") {
+				t.Fatalf("expected a challenge with %s, got %q", tt.difficulty, sent)
+			}
+		})
+	}
+}
+
+func TestRuleClassifier(t *testing.T) {
+	classifier := NewRuleClassifier([]ClassRule{
+		{CommonName: "partner", Class: "vip"},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Class: "internal"},
+		{Prefix: netip.MustParsePrefix("0.0.0.0/0"), CommonName: "legacy", Class: "legacy"},
+	})
+	certificate := func(name string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	}
+
+	tests := []struct {
+		info     ClientInfo
+		expected string
+	}{
+		{ClientInfo{IP: "203.0.113.7", Certificate: certificate("partner")}, "vip"},
+		{ClientInfo{IP: "10.1.2.3", Certificate: certificate("partner")}, "vip"},
+		{ClientInfo{IP: "10.1.2.3"}, "internal"},
+		{ClientInfo{IP: "203.0.113.7", Certificate: certificate("legacy")}, "legacy"},
+		{ClientInfo{IP: "2001:db8::1", Certificate: certificate("legacy")}, ""},
+		{ClientInfo{IP: "203.0.113.7"}, ""},
+	}
+	for _, tt := range tests {
+		if class := classifier.Classify(tt.info); class != tt.expected {
+			t.Fatalf("expected %+v to be classified %q, got %q", tt.info, tt.expected, class)
+		}
+	}
+}
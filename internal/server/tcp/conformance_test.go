@@ -0,0 +1,135 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"faraway/internal/usecases"
+	"faraway/pkg/protocol"
+)
+
+// conformanceClient speaks the protocol using nothing but pkg/protocol and
+// its documentation, as a third-party client would.
+type conformanceClient struct {
+	t      *testing.T
+	reader *bufio.Reader
+	w      io.Writer
+}
+
+// readChallenge reads everything the server sends up to the challenge.
+func (c *conformanceClient) readChallenge() (protocol.ChallengeType, []byte) {
+	c.t.Helper()
+
+	preamble := make([]byte, len(protocol.Preamble))
+	if _, err := io.ReadFull(c.reader, preamble); err != nil || !bytes.Equal(preamble, protocol.Preamble) {
+		c.t.Fatalf("expected preamble %q, got %q (%v)", protocol.Preamble, preamble, err)
+	}
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			c.t.Fatalf("unexpected error reading frame: %v", err)
+		}
+		switch b {
+		case protocol.FrameVersion, protocol.FrameCapabilities:
+			length, _ := c.reader.ReadByte()
+			if _, err := io.ReadFull(c.reader, make([]byte, length)); err != nil {
+				c.t.Fatalf("unexpected error reading frame 0x%02x: %v", b, err)
+			}
+			continue
+		}
+		challengeType, err := protocol.ChallengeTypeFromByte(b)
+		if err != nil {
+			c.t.Fatalf("unexpected frame 0x%02x: %v", b, err)
+		}
+		challenge, err := protocol.ReadChallengeData(c.reader, 1024)
+		if err != nil {
+			c.t.Fatalf("unexpected error reading challenge: %v", err)
+		}
+		return challengeType, challenge
+	}
+}
+
+// submit sends a solution and returns the server's response.
+func (c *conformanceClient) submit(challengeType protocol.ChallengeType, difficulty uint64, solution string) protocol.Response {
+	c.t.Helper()
+
+	if _, err := c.w.Write(protocol.AppendSubmission(nil, nil, protocol.FormatSolutionType(challengeType, difficulty), solution)); err != nil {
+		c.t.Fatalf("unexpected error sending submission: %v", err)
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("unexpected error reading response: %v", err)
+	}
+	response, err := protocol.ParseResponse(line)
+	if err != nil {
+		c.t.Fatalf("unexpected error parsing response %q: %v", line, err)
+	}
+	return response
+}
+
+// solveCPU solves a CPU challenge as the package documentation describes.
+func solveCPU(challenge []byte, difficulty uint64) string {
+	for nonce := uint64(0); ; nonce++ {
+		solution := strconv.FormatUint(nonce, 10)
+		hash := sha256.Sum256(append(append([]byte(nil), challenge...), solution...))
+		if strings.HasPrefix(hex.EncodeToString(hash[:]), strings.Repeat("0", int(difficulty))) {
+			return solution
+		}
+	}
+}
+
+func TestProtocolConformance(t *testing.T) {
+	const difficulty = 2
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(difficulty, nil, protocol.ChallengeTypeCPU)
+	if err != nil {
+		t.Fatalf("unexpected error creating usecase: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		solve    func(challenge []byte) string
+		wantCode string
+	}{
+		{"solved", func(challenge []byte) string { return solveCPU(challenge, difficulty) }, ""},
+		{"not solved", func([]byte) string { return "not-a-nonce" }, protocol.CodeInvalidSolution},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(&Config{Version: "1.0.0", AcceptSolveTimes: true})
+			server.powUsecase = powUsecase
+
+			clientConn, serverConn := net.Pipe()
+			t.Cleanup(func() { clientConn.Close() })
+			go server.handleConnection(serverConn)
+			if err := clientConn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatalf("unexpected error setting deadline: %v", err)
+			}
+
+			client := &conformanceClient{t: t, reader: bufio.NewReader(clientConn), w: clientConn}
+			challengeType, challenge := client.readChallenge()
+			if challengeType != protocol.ChallengeTypeCPU {
+				t.Fatalf("expected a CPU challenge, got %v", challengeType)
+			}
+
+			response := client.submit(challengeType, difficulty, tt.solve(challenge))
+			if tt.wantCode == "" {
+				if response.Error != nil || response.Quote.Text != "test quote" {
+					t.Fatalf("expected the quote, got %+v", response)
+				}
+				return
+			}
+			if response.Error == nil || response.Error.Code != tt.wantCode {
+				t.Fatalf("expected error %s, got %+v", tt.wantCode, response)
+			}
+		})
+	}
+}
@@ -0,0 +1,719 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clienttcp "faraway/internal/client/tcp"
+	"faraway/internal/domain"
+	"faraway/internal/usecases"
+	"faraway/internal/usecases/usecasestest"
+	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
+)
+
+// socketConn buffers both directions of a net.Pipe end the way a socket's
+// kernel buffers would: writes never block on the peer reading, and data
+// the peer sent stays readable after it closed. Without this a server
+// answering a slow client deadlocks on the synchronous pipe.
+type socketConn struct {
+	net.Conn
+	// rewrite, if set, edits outgoing bytes before they hit the pipe.
+	rewrite func([]byte) []byte
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    error
+	out    chan []byte
+	closed bool
+}
+
+func newSocketConn(conn net.Conn, rewrite func([]byte) []byte) *socketConn {
+	c := &socketConn{Conn: conn, rewrite: rewrite, out: make(chan []byte, 16)}
+	c.cond = sync.NewCond(&c.mu)
+	go func() {
+		chunk := make([]byte, 1024)
+		for {
+			n, err := conn.Read(chunk)
+			c.mu.Lock()
+			c.buf.Write(chunk[:n])
+			if err != nil {
+				c.err = err
+			}
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for data := range c.out {
+			// Like a socket, data sent to a closed peer is lost silently
+			conn.Write(data)
+		}
+	}()
+	return c
+}
+
+func (c *socketConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.buf.Len() == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.buf.Len() > 0 {
+		return c.buf.Read(p)
+	}
+	return 0, c.err
+}
+
+func (c *socketConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	data := bytes.Clone(p)
+	if c.rewrite != nil {
+		data = c.rewrite(data)
+	}
+	c.out <- data
+	return len(p), nil
+}
+
+func (c *socketConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.out)
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// recordingConn records what the server side of a connection reads and
+// writes.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	read    bytes.Buffer
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.read.Write(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mu.Lock()
+	c.written.Write(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *recordingConn) frames() (read, written []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.read.Bytes()), bytes.Clone(c.written.Bytes())
+}
+
+// challengeFrame is the wire encoding of a challenge of the given type.
+func challengeFrame(challengeType protocol.ChallengeType, data []byte) []byte {
+	frame := []byte{challengeType.Byte()}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(data)))
+	return append(frame, data...)
+}
+
+func TestHandshakeOutcomeMatrix(t *testing.T) {
+	challenge := []byte("challenge")
+	renameType := func(data []byte) []byte {
+		return bytes.Replace(data, []byte("CPU\n"), []byte("GPU\n"), 1)
+	}
+
+	tests := []struct {
+		name      string
+		algorithm protocol.ChallengeType
+		valid     bool
+		delay     time.Duration
+		rewrite   func([]byte) []byte
+		// sent is what the server reads; empty when it gave up waiting
+		sent     string
+		response string
+		code     string
+	}{
+		{name: "CPU valid", algorithm: protocol.ChallengeTypeCPU, valid: true,
+			sent: "CPU\nsolution\n", response: "SUCCESS:test quote\n"},
+		{name: "CPU invalid", algorithm: protocol.ChallengeTypeCPU,
+			sent: "CPU\nsolution\n", response: "ERROR:INVALID_SOLUTION:" + ErrRespInvalidSolution.Message + "\n", code: "INVALID_SOLUTION"},
+		{name: "Memory valid", algorithm: protocol.ChallengeTypeMemory, valid: true,
+			sent: "Memory\nsolution\n", response: "SUCCESS:test quote\n"},
+		{name: "Memory invalid", algorithm: protocol.ChallengeTypeMemory,
+			sent: "Memory\nsolution\n", response: "ERROR:INVALID_SOLUTION:" + ErrRespInvalidSolution.Message + "\n", code: "INVALID_SOLUTION"},
+		{name: "unknown type", algorithm: protocol.ChallengeTypeCPU, valid: true, rewrite: renameType,
+			sent: "GPU\nsolution\n", response: "ERROR:INVALID_FORMAT:" + ErrRespInvalidFormat.Message + "\n", code: "INVALID_FORMAT"},
+		{name: "timeout", algorithm: protocol.ChallengeTypeCPU, valid: true, delay: 300 * time.Millisecond,
+			response: "ERROR:TIMEOUT:" + ErrRespTimeout.Message + "\n", code: "TIMEOUT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(&Config{Deadline: 100 * time.Millisecond})
+			server.powUsecase = &usecasestest.PowUsecase{
+				Challenge: challenge,
+				Valid:     tt.valid,
+				Enabled:   []protocol.ChallengeType{tt.algorithm},
+			}
+
+			var recorded *recordingConn
+			handled := make(chan struct{})
+			cfg := &clienttcp.Config{
+				ServerAddrs:    []string{"pipe"},
+				ConnectTimeout: time.Second,
+				RequestTimeout: 5 * time.Second,
+				MaxMessageSize: 1024,
+				BufferSize:     1024,
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					clientConn, serverConn := net.Pipe()
+					recorded = &recordingConn{Conn: serverConn}
+					go func() {
+						defer close(handled)
+						server.handleConnection(recorded)
+					}()
+					return newSocketConn(clientConn, tt.rewrite), nil
+				},
+			}
+			client := clienttcp.NewClient(cfg,
+				usecasestest.SolverUsecase{Solution: []byte("solution"), Delay: tt.delay},
+				slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+			quote, err := client.FetchQuote(context.Background())
+			select {
+			case <-handled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("server did not finish handling the connection")
+			}
+
+			read, written := recorded.frames()
+			expected := append(append(bytes.Clone(protocol.Preamble), challengeFrame(tt.algorithm, challenge)...), tt.response...)
+			if !bytes.Equal(written, expected) {
+				t.Fatalf("expected server to write %q, got %q", expected, written)
+			}
+			if string(read) != tt.sent {
+				t.Fatalf("expected server to read %q, got %q", tt.sent, read)
+			}
+
+			if tt.code == "" {
+				if err != nil || quote.Text != "test quote" {
+					t.Fatalf("expected the quote, got %q (%v)", quote, err)
+				}
+				return
+			}
+			var clientErr *clienttcp.ClientError
+			if !errors.As(err, &clientErr) || clientErr.Op != "handleResponse" || clientErr.Err.Error() != tt.code {
+				t.Fatalf("expected the client to observe %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestPinnedDifficulty(t *testing.T) {
+	tests := []struct {
+		name   string
+		pinned uint64
+		err    error
+	}{
+		{"not pinned", 0, nil},
+		{"matching pin", 1, nil},
+		{"mismatched pin", 3, clienttcp.ErrDifficultyMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The fake issues challenges of difficulty 1
+			server := newTestServer(&Config{})
+			cfg := &clienttcp.Config{
+				ServerAddrs:      []string{"pipe"},
+				ConnectTimeout:   time.Second,
+				RequestTimeout:   5 * time.Second,
+				MaxMessageSize:   1024,
+				BufferSize:       1024,
+				PinnedDifficulty: tt.pinned,
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					clientConn, serverConn := net.Pipe()
+					go server.handleConnection(serverConn)
+					return newSocketConn(clientConn, nil), nil
+				},
+			}
+			client := clienttcp.NewClient(cfg,
+				usecasestest.SolverUsecase{Solution: []byte("solution")},
+				slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+			quote, err := client.FetchQuote(context.Background())
+			if tt.err == nil {
+				if err != nil || quote.Text != "test quote" {
+					t.Fatalf("expected the quote, got %q (%v)", quote, err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestQuoteWithAuthorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		quote usecasestest.QuoteUsecase
+		frame string
+	}{
+		{"attributed", usecasestest.QuoteUsecase{Quote: "Stay hungry, stay foolish.", Author: "Steve Jobs"},
+			`SUCCESS:{"text":"Stay hungry, stay foolish.","author":"Steve Jobs"}` + "\n"},
+		{"bare", usecasestest.QuoteUsecase{Quote: "Stay hungry, stay foolish."},
+			"SUCCESS:Stay hungry, stay foolish.\n"},
+		{"bare text looking like JSON", usecasestest.QuoteUsecase{Quote: "{braces}"},
+			`SUCCESS:{"text":"{braces}"}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(&Config{})
+			server.quoteUsecase = tt.quote
+
+			var recorded *recordingConn
+			handled := make(chan struct{})
+			cfg := &clienttcp.Config{
+				ServerAddrs:    []string{"pipe"},
+				ConnectTimeout: time.Second,
+				RequestTimeout: 5 * time.Second,
+				MaxMessageSize: 1024,
+				BufferSize:     1024,
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					clientConn, serverConn := net.Pipe()
+					recorded = &recordingConn{Conn: serverConn}
+					go func() {
+						defer close(handled)
+						server.handleConnection(recorded)
+					}()
+					return newSocketConn(clientConn, nil), nil
+				},
+			}
+			client := clienttcp.NewClient(cfg,
+				usecasestest.SolverUsecase{Solution: []byte("solution")},
+				slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+			quote, err := client.FetchQuote(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if quote.Text != tt.quote.Quote || quote.Author != tt.quote.Author {
+				t.Fatalf("expected %+v, got %+v", tt.quote, quote)
+			}
+			<-handled
+			if _, written := recorded.frames(); !bytes.HasSuffix(written, []byte(tt.frame)) {
+				t.Fatalf("expected success frame %q, got %q", tt.frame, written)
+			}
+		})
+	}
+}
+
+func TestClientReportsSolveTime(t *testing.T) {
+	for _, accept := range []bool{true, false} {
+		server := newTestServer(&Config{AcceptSolveTimes: accept})
+		server.powUsecase = &usecasestest.PowUsecase{
+			Challenge: []byte("challenge"),
+			Valid:     true,
+			Enabled:   []protocol.ChallengeType{protocol.ChallengeTypeCPU},
+		}
+
+		var recorded *recordingConn
+		handled := make(chan struct{})
+		cfg := &clienttcp.Config{
+			ServerAddrs:     []string{"pipe"},
+			ConnectTimeout:  time.Second,
+			RequestTimeout:  5 * time.Second,
+			MaxMessageSize:  1024,
+			BufferSize:      1024,
+			ReportSolveTime: true,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				clientConn, serverConn := net.Pipe()
+				recorded = &recordingConn{Conn: serverConn}
+				go func() {
+					defer close(handled)
+					server.handleConnection(recorded)
+				}()
+				return newSocketConn(clientConn, nil), nil
+			},
+		}
+		client := clienttcp.NewClient(cfg,
+			usecasestest.SolverUsecase{Solution: []byte("solution"), Delay: 20 * time.Millisecond},
+			slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+		if _, err := client.FetchQuote(context.Background()); err != nil {
+			t.Fatalf("unexpected error (accept=%v): %v", accept, err)
+		}
+		<-handled
+
+		read, _ := recorded.frames()
+		typeLine, _, _ := bytes.Cut(read, []byte("\n"))
+		_, solveTime, err := protocol.CutSolveTime(string(typeLine))
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", typeLine, err)
+		}
+		switch {
+		case accept && solveTime < 20*time.Millisecond:
+			t.Fatalf("expected a solve time of at least 20ms, got %q", typeLine)
+		case !accept && solveTime != 0:
+			t.Fatalf("expected no report to a server not accepting it, got %q", typeLine)
+		}
+	}
+}
+
+func TestChallengeHintIsAdvisory(t *testing.T) {
+	const difficulty = 2
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(difficulty, nil, protocol.ChallengeTypeCPU)
+	if err != nil {
+		t.Fatalf("unexpected error creating usecase: %v", err)
+	}
+	// A solver on several workers, which the hint narrows to one
+	solverUsecase, err := usecases.NewSolverUsecaseWithStrategy(difficulty, hashcash.NonceDecimal, usecases.SolveStrategySpeed)
+	if err != nil {
+		t.Fatalf("unexpected error creating solver: %v", err)
+	}
+
+	for _, follow := range []bool{true, false} {
+		server := newTestServer(&Config{SendHints: true})
+		server.powUsecase = powUsecase
+
+		var recorded *recordingConn
+		handled := make(chan struct{})
+		cfg := &clienttcp.Config{
+			ServerAddrs:    []string{"pipe"},
+			ConnectTimeout: time.Second,
+			RequestTimeout: 5 * time.Second,
+			MaxMessageSize: 1024,
+			BufferSize:     1024,
+			FollowHints:    follow,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				clientConn, serverConn := net.Pipe()
+				recorded = &recordingConn{Conn: serverConn}
+				go func() {
+					defer close(handled)
+					server.handleConnection(recorded)
+				}()
+				return newSocketConn(clientConn, nil), nil
+			},
+		}
+		client := clienttcp.NewClient(cfg, solverUsecase, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+		quote, err := client.FetchQuote(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error (follow=%v): %v", follow, err)
+		}
+		if quote.Text != "test quote" {
+			t.Fatalf("expected the quote (follow=%v), got %+v", follow, quote)
+		}
+		<-handled
+
+		_, written := recorded.frames()
+		hint := protocol.FormatHint(protocol.Hint{ExpectedIterations: 256, Workers: 1, Difficulty: difficulty})
+		if !bytes.Contains(written, append([]byte{protocol.FrameHint, byte(len(hint))}, hint...)) {
+			t.Fatalf("expected the hint frame ahead of the challenge, got %q", written)
+		}
+	}
+}
+
+func TestEmbeddedDifficultyOverridesClientConfig(t *testing.T) {
+	const difficulty = 2
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(difficulty, nil, protocol.ChallengeTypeMemory)
+	if err != nil {
+		t.Fatalf("unexpected error creating usecase: %v", err)
+	}
+	// Configured for another difficulty than the server's
+	solverUsecase, err := usecases.NewSolverUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error creating solver: %v", err)
+	}
+
+	server := newTestServer(&Config{EmbedDifficulty: true})
+	server.powUsecase = powUsecase
+
+	var recorded *recordingConn
+	handled := make(chan struct{})
+	cfg := &clienttcp.Config{
+		ServerAddrs:    []string{"pipe"},
+		ConnectTimeout: time.Second,
+		RequestTimeout: 10 * time.Second,
+		MaxMessageSize: 1024,
+		BufferSize:     1024,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			clientConn, serverConn := net.Pipe()
+			recorded = &recordingConn{Conn: serverConn}
+			go func() {
+				defer close(handled)
+				server.handleConnection(recorded)
+			}()
+			return newSocketConn(clientConn, nil), nil
+		},
+	}
+	client := clienttcp.NewClient(cfg, solverUsecase, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	quote, err := client.FetchQuote(context.Background())
+	if err != nil || quote.Text != "test quote" {
+		t.Fatalf("expected the quote, got %+v (%v)", quote, err)
+	}
+	<-handled
+
+	_, written := recorded.frames()
+	capabilities := protocol.FormatCapabilities([]string{protocol.CapabilityDifficulty})
+	if !bytes.Contains(written, append([]byte{protocol.FrameCapabilities, byte(len(capabilities))}, capabilities...)) {
+		t.Fatalf("expected the difficulty capability advertised, got %q", written)
+	}
+	if !bytes.Contains(written, []byte{protocol.ChallengeTypeMemory.Byte(), 0, 0, 0, difficulty}) {
+		t.Fatalf("expected the difficulty after the challenge type, got %q", written)
+	}
+}
+
+func TestClientFollowsTunedDifficulty(t *testing.T) {
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(1, nil, protocol.ChallengeTypeCPU)
+	if err != nil {
+		t.Fatalf("unexpected error creating usecase: %v", err)
+	}
+	// Configured for the difficulty the server starts at, not the one it
+	// is tuned to
+	solverUsecase, err := usecases.NewSolverUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error creating solver: %v", err)
+	}
+
+	var logs lockedBuffer
+	// Every solve is far quicker than the target, so each steps it up
+	server := NewServer(&Config{
+		Deadline:              5 * time.Second,
+		AutoDifficultyTarget:  time.Hour,
+		AutoDifficultyMin:     1,
+		AutoDifficultyMax:     3,
+		AutoDifficultySamples: 1,
+		EmbedDifficulty:       true,
+	}, powUsecase, usecasestest.QuoteUsecase{Quote: "test quote"}, slog.New(slog.NewTextHandler(&logs, nil)))
+
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	cfg := &clienttcp.Config{
+		ServerAddrs:    []string{"pipe"},
+		ConnectTimeout: time.Second,
+		RequestTimeout: 10 * time.Second,
+		MaxMessageSize: 1024,
+		BufferSize:     1024,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			clientConn, serverConn := net.Pipe()
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				server.handleConnection(serverConn)
+			}()
+			return newSocketConn(clientConn, nil), nil
+		},
+	}
+	client := clienttcp.NewClient(cfg, solverUsecase, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for i := 0; i < 3; i++ {
+		quote, err := client.FetchQuote(context.Background())
+		if err != nil || quote.Text != "test quote" {
+			t.Fatalf("expected quote %d, got %+v (%v):\n%s", i+1, quote, err, logs.String())
+		}
+	}
+	handlers.Wait()
+
+	if !strings.Contains(logs.String(), `msg="difficulty adjusted" from=2 to=3`) {
+		t.Fatalf("expected the difficulty raised twice, got:\n%s", logs.String())
+	}
+	if strings.Count(logs.String(), `msg="challenge solved"`) != 3 {
+		t.Fatalf("expected every challenge solved, got:\n%s", logs.String())
+	}
+}
+
+func TestPerClientDifficultyOverReusedConnection(t *testing.T) {
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(1, nil, protocol.ChallengeTypeCPU)
+	if err != nil {
+		t.Fatalf("unexpected error creating usecase: %v", err)
+	}
+	solverUsecase, err := usecases.NewSolverUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error creating solver: %v", err)
+	}
+
+	// Every solve is far quicker than the target, so each steps the
+	// connection's difficulty up
+	server := NewServer(&Config{
+		Deadline:                5 * time.Second,
+		AutoDifficultyTarget:    time.Hour,
+		AutoDifficultyMin:       1,
+		AutoDifficultyMax:       3,
+		PerClientDifficulty:     true,
+		HandshakesPerConnection: 4,
+		EmbedDifficulty:         true,
+	}, powUsecase, usecasestest.QuoteUsecase{Quote: "test quote"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		server.handleConnection(serverConn)
+	}()
+
+	clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(clientConn)
+	readPreamble(t, reader)
+	frame := make([]byte, 2)
+	if _, err := io.ReadFull(reader, frame); err != nil || frame[0] != protocol.FrameCapabilities {
+		t.Fatalf("expected the capabilities frame, got %q (%v)", frame, err)
+	}
+	capabilities := make([]byte, frame[1])
+	if _, err := io.ReadFull(reader, capabilities); err != nil {
+		t.Fatalf("unexpected error reading capabilities: %v", err)
+	}
+	if !protocol.HasCapability(protocol.ParseCapabilities(string(capabilities)), protocol.CapabilityDifficulty) {
+		t.Fatalf("expected the difficulty capability advertised, got %q", capabilities)
+	}
+
+	// Each handshake is solved by the client at the difficulty sent with
+	// its challenge, which rises with every solve
+	for i, want := range []uint64{1, 2, 3, 3} {
+		typeByte, err := reader.ReadByte()
+		if err != nil {
+			t.Fatalf("unexpected error reading challenge %d: %v", i+1, err)
+		}
+		challengeType, err := protocol.ChallengeTypeFromByte(typeByte)
+		if err != nil {
+			t.Fatalf("unexpected challenge type %d: %v", i+1, err)
+		}
+		difficulty, err := protocol.ReadChallengeDifficulty(reader)
+		if err != nil {
+			t.Fatalf("unexpected error reading difficulty %d: %v", i+1, err)
+		}
+		if difficulty != want {
+			t.Fatalf("expected challenge %d at difficulty %d, got %d", i+1, want, difficulty)
+		}
+		data, err := protocol.ReadChallengeData(reader, 1024)
+		if err != nil {
+			t.Fatalf("unexpected error reading challenge %d: %v", i+1, err)
+		}
+		solution, err := solverUsecase.Solve(context.Background(), domain.Challenge{Type: challengeType, Data: data, Difficulty: difficulty})
+		if err != nil {
+			t.Fatalf("unexpected error solving challenge %d: %v", i+1, err)
+		}
+		if _, err := clientConn.Write(protocol.AppendSubmission(nil, nil, challengeType.String(), string(solution.Data))); err != nil {
+			t.Fatalf("unexpected error writing solution %d: %v", i+1, err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected error reading response %d: %v", i+1, err)
+		}
+		if !strings.HasPrefix(line, protocol.SuccessPrefix) {
+			t.Fatalf("expected solution %d at difficulty %d accepted, got %q", i+1, difficulty, line)
+		}
+	}
+	<-handled
+}
+
+// countingSolver counts the challenges it solved.
+type countingSolver struct {
+	usecasestest.SolverUsecase
+	solved atomic.Int32
+}
+
+func (c *countingSolver) Solve(ctx context.Context, challenge domain.Challenge) (domain.Solution, error) {
+	c.solved.Add(1)
+	return c.SolverUsecase.Solve(ctx, challenge)
+}
+
+func TestClientReusesSessionToken(t *testing.T) {
+	server := newTestServer(&Config{SessionTTL: time.Minute, ChallengeSecret: []byte("secret")})
+	server.powUsecase = &usecasestest.PowUsecase{Challenge: []byte("challenge"), Valid: true, Enabled: cpuOnly}
+
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	sessionFile := filepath.Join(t.TempDir(), "session.json")
+	newClient := func(solver usecases.SolverUsecase) *clienttcp.Client {
+		cfg := &clienttcp.Config{
+			ServerAddrs:    []string{"pipe"},
+			ConnectTimeout: time.Second,
+			RequestTimeout: 5 * time.Second,
+			MaxMessageSize: 1024,
+			BufferSize:     1024,
+			ReuseSessions:  true,
+			SessionFile:    sessionFile,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				clientConn, serverConn := net.Pipe()
+				handlers.Add(1)
+				go func() {
+					defer handlers.Done()
+					server.handleConnection(serverConn)
+				}()
+				return newSocketConn(clientConn, nil), nil
+			},
+		}
+		return clienttcp.NewClient(cfg, solver, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	solver := &countingSolver{SolverUsecase: usecasestest.SolverUsecase{Solution: []byte("42")}}
+	client := newClient(solver)
+
+	fetch := func(client *clienttcp.Client, wantSolved int32) {
+		t.Helper()
+		quote, err := client.FetchQuote(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if quote.Text != "test quote" {
+			t.Fatalf("expected the quote, got %+v", quote)
+		}
+		if solved := solver.solved.Load(); solved != wantSolved {
+			t.Fatalf("expected %d solves, got %d", wantSolved, solved)
+		}
+	}
+
+	// The first fetch solves and is granted a session token
+	fetch(client, 1)
+	info, err := os.Stat(sessionFile)
+	if err != nil {
+		t.Fatalf("expected the session file to be written: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Fatalf("expected the session file to be private, got %v", mode)
+	}
+
+	// The second presents the token instead of solving, as does a client
+	// picking the token up from the session file
+	fetch(client, 1)
+	fetch(newClient(solver), 1)
+
+	// Once the secret that signed it is gone the token is rejected, and the
+	// client falls back to solving
+	server.RotateChallengeSecret([]byte("next"))
+	server.RotateChallengeSecret([]byte("last"))
+	fetch(client, 2)
+	fetch(client, 2)
+}
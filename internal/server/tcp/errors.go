@@ -3,6 +3,12 @@ package tcp
 import (
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"faraway/pkg/protocol"
 )
 
 // Custom error types
@@ -15,19 +21,33 @@ var (
 	ErrConnectionClosed = errors.New("connection closed")
 	ErrReadTimeout      = errors.New("read operation timeout")
 	ErrWriteTimeout     = errors.New("write operation timeout")
+	ErrProbe            = errors.New("connection closed without a reply")
+	ErrSessionBytes     = errors.New("client sent more than the session allows")
+	ErrConnectionAge    = errors.New("connection reached its maximum age")
 
 	// Challenge errors
 	ErrChallengeFailed      = errors.New("failed to generate challenge")
 	ErrChallengeDelivery    = errors.New("failed to deliver challenge")
 	ErrInvalidChallengeType = errors.New("invalid challenge type")
+	ErrChallengeExpired     = errors.New("challenge expired")
+	ErrChallengeLimit       = errors.New("challenge limit reached")
+	ErrChallengeForged      = errors.New("challenge token failed verification")
+	ErrChallengeReplayed    = errors.New("challenge already redeemed")
+	ErrChallengeStore       = errors.New("challenge store unavailable")
+	ErrDifficultyMismatch   = errors.New("pinned difficulty does not match the challenge")
+	ErrClientCertRequired   = errors.New("client certificate required")
+	ErrSessionInvalid       = errors.New("session token failed verification")
 
 	// Solution errors
-	ErrSolutionFormat     = errors.New("invalid solution format")
-	ErrSolutionValidation = errors.New("solution validation failed")
+	ErrSolutionFormat      = errors.New("invalid solution format")
+	ErrSolutionValidation  = errors.New("solution validation failed")
+	ErrVerificationBusy    = errors.New("no verification capacity")
+	ErrVerificationTimeout = errors.New("verification exceeded the session deadline")
 
 	// System errors
-	ErrServerShutdown = errors.New("server is shutting down")
-	ErrInternal       = errors.New("internal server error")
+	ErrServerShutdown  = errors.New("server is shutting down")
+	ErrShutdownTimeout = errors.New("handlers still active after shutdown timeout")
+	ErrInternal        = errors.New("internal server error")
 )
 
 // Error types with additional context
@@ -59,48 +79,158 @@ func NewConnectionError(op string, err error, info string) error {
 
 // Helper functions for common error cases
 func IsTimeoutError(err error) bool {
-	return errors.Is(err, ErrReadTimeout) || errors.Is(err, ErrWriteTimeout)
+	return errors.Is(err, ErrReadTimeout) || errors.Is(err, ErrWriteTimeout) || errors.Is(err, ErrVerificationTimeout)
+}
+
+// isClosedError reports whether err means the peer or the local side closed
+// the connection, as opposed to a timeout or protocol error.
+func isClosedError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// isDeadlineError reports whether err comes from an I/O operation that ran
+// past the connection deadline.
+func isDeadlineError(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
 }
 
 func IsProtocolError(err error) bool {
 	return errors.Is(err, ErrInvalidProtocol) || errors.Is(err, ErrInvalidSolution)
 }
 
-// Error response types
-type ErrorResponse struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+// IsMalformedInputError reports whether err was caused by input that doesn't
+// conform to the protocol, as opposed to a well-formed but wrong solution.
+func IsMalformedInputError(err error) bool {
+	return errors.Is(err, ErrInvalidProtocol) ||
+		errors.Is(err, ErrInvalidChallengeType) ||
+		errors.Is(err, ErrSolutionFormat) ||
+		errors.Is(err, ErrChallengeForged) ||
+		errors.Is(err, ErrSessionInvalid) ||
+		errors.Is(err, ErrSessionBytes)
 }
 
+// Error response types
+type ErrorResponse = protocol.ErrorResponse
+
 // Common error responses
 var (
 	ErrRespInvalidFormat = ErrorResponse{
-		Code:    "INVALID_FORMAT",
+		Code:    protocol.CodeInvalidFormat,
 		Message: "Invalid message format",
 	}
 	ErrRespTimeout = ErrorResponse{
-		Code:    "TIMEOUT",
+		Code:    protocol.CodeTimeout,
 		Message: "Operation timed out",
 	}
 	ErrRespInvalidSolution = ErrorResponse{
-		Code:    "INVALID_SOLUTION",
+		Code:    protocol.CodeInvalidSolution,
 		Message: "Invalid proof of work solution",
 	}
+	ErrRespChallengeExpired = ErrorResponse{
+		Code:    protocol.CodeChallengeExpired,
+		Message: "Challenge expired",
+	}
+	ErrRespRateLimited = ErrorResponse{
+		Code:    protocol.CodeRateLimited,
+		Message: "Too many challenges requested",
+	}
+	ErrRespServerBusy = ErrorResponse{
+		Code:    protocol.CodeServerBusy,
+		Message: "Server is too busy to verify the solution",
+	}
+	ErrRespInvalidChallenge = ErrorResponse{
+		Code:    protocol.CodeInvalidChallenge,
+		Message: "Echoed challenge was not issued by this server",
+	}
+	ErrRespChallengeUsed = ErrorResponse{
+		Code:    protocol.CodeChallengeUsed,
+		Message: "Challenge was already redeemed",
+	}
+	ErrRespDifficultyMismatch = ErrorResponse{
+		Code:    protocol.CodeDifficultyMismatch,
+		Message: "Pinned difficulty does not match the server's",
+	}
+	ErrRespSessionBytes = ErrorResponse{
+		Code:    protocol.CodeInvalidFormat,
+		Message: "Sent more than a handshake takes",
+	}
+	ErrRespInvalidSession = ErrorResponse{
+		Code:    protocol.CodeInvalidSession,
+		Message: "Session token is invalid or expired",
+	}
+	ErrRespReconnect = ErrorResponse{
+		Code:    protocol.CodeReconnect,
+		Message: "Connection reached its maximum age, reconnect",
+	}
 )
 
-// Helper function to convert errors to responses
+// Helper function to convert errors to responses. For several joined
+// errors the response is that of the first one.
 func ToErrorResponse(err error) ErrorResponse {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok && len(joined.Unwrap()) > 0 {
+		err = joined.Unwrap()[0]
+	}
+
 	switch {
-	case errors.Is(err, ErrInvalidProtocol):
+	case errors.Is(err, ErrSessionBytes):
+		return ErrRespSessionBytes
+	case errors.Is(err, ErrInvalidProtocol), errors.Is(err, ErrSolutionFormat), errors.Is(err, ErrInvalidChallengeType):
 		return ErrRespInvalidFormat
+	case errors.Is(err, ErrConnectionAge):
+		return ErrRespReconnect
 	case IsTimeoutError(err):
 		return ErrRespTimeout
 	case errors.Is(err, ErrInvalidSolution):
 		return ErrRespInvalidSolution
+	case errors.Is(err, ErrChallengeExpired):
+		return ErrRespChallengeExpired
+	case errors.Is(err, ErrChallengeLimit):
+		return ErrRespRateLimited
+	case errors.Is(err, ErrChallengeForged):
+		return ErrRespInvalidChallenge
+	case errors.Is(err, ErrChallengeReplayed):
+		return ErrRespChallengeUsed
+	case errors.Is(err, ErrDifficultyMismatch):
+		return ErrRespDifficultyMismatch
+	case errors.Is(err, ErrSessionInvalid):
+		return ErrRespInvalidSession
+	case errors.Is(err, ErrVerificationBusy):
+		return ErrRespServerBusy
 	default:
 		return ErrorResponse{
-			Code:    "INTERNAL_ERROR",
+			Code:    protocol.CodeInternalError,
 			Message: "An internal error occurred",
 		}
 	}
 }
+
+// errorDetails lists the message of every error joined in err.
+func errorDetails(err error) []string {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []string{err.Error()}
+	}
+	var details []string
+	for _, e := range joined.Unwrap() {
+		details = append(details, errorDetails(e)...)
+	}
+	return details
+}
+
+// safeErrorDetails lists the response message of every error joined in
+// err, leaving out the context only meant for logs.
+func safeErrorDetails(err error) []string {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []string{ToErrorResponse(err).Message}
+	}
+	var details []string
+	for _, e := range joined.Unwrap() {
+		details = append(details, safeErrorDetails(e)...)
+	}
+	return details
+}
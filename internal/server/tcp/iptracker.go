@@ -0,0 +1,172 @@
+package tcp
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultIPTrackerCapacity = 10000
+
+// ipState is the per-IP reputation kept by the server.
+type ipState struct {
+	failures    int       // failed handshakes within the failure window
+	lastFailure time.Time // when the last handshake failed
+
+	challenges      int       // challenges issued within the current window
+	challengeWindow time.Time // when the current challenge window started
+}
+
+// countChallenge counts an issued challenge in the current window, starting
+// a new window when the previous one is over.
+func (st *ipState) countChallenge(now time.Time, window time.Duration) {
+	if now.Sub(st.challengeWindow) >= window {
+		st.challenges = 0
+		st.challengeWindow = now
+	}
+	st.challenges++
+}
+
+// recordFailure counts a failed handshake, starting a new count when the
+// previous failure is older than window.
+func (st *ipState) recordFailure(now time.Time, window time.Duration) {
+	if now.Sub(st.lastFailure) > window {
+		st.failures = 0
+	}
+	st.failures++
+	st.lastFailure = now
+}
+
+// penalized reports whether the IP reached maxFailures within window.
+func (st ipState) penalized(now time.Time, maxFailures int, window time.Duration) bool {
+	return maxFailures > 0 && st.failures >= maxFailures && now.Sub(st.lastFailure) <= window
+}
+
+type ipEntry struct {
+	ip    string
+	state ipState
+}
+
+// ipTracker keeps per-IP state in a size-bounded LRU so that a flood of
+// distinct source addresses can't grow it without limit. Evicting an entry
+// just resets that IP to its baseline.
+type ipTracker struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // front is the most recently seen IP
+}
+
+func newIPTracker(capacity int) *ipTracker {
+	if capacity <= 0 {
+		capacity = defaultIPTrackerCapacity
+	}
+	return &ipTracker{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// update runs fn on the state of ip under the tracker lock, creating the
+// state if needed, and returns a copy of the updated state.
+func (t *ipTracker) update(ip string, fn func(*ipState)) ipState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, ok := t.entries[ip]
+	if ok {
+		t.order.MoveToFront(elem)
+	} else {
+		elem = t.order.PushFront(&ipEntry{ip: ip})
+		t.entries[ip] = elem
+		t.evict()
+	}
+
+	entry := elem.Value.(*ipEntry)
+	fn(&entry.state)
+	return entry.state
+}
+
+// get returns the state of ip without refreshing its recency.
+func (t *ipTracker) get(ip string) (ipState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, ok := t.entries[ip]
+	if !ok {
+		return ipState{}, false
+	}
+	return elem.Value.(*ipEntry).state, true
+}
+
+// reset forgets every IP.
+func (t *ipTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clear(t.entries)
+	t.order.Init()
+}
+
+func (t *ipTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.order.Len()
+}
+
+// evict drops least recently seen entries above capacity. Caller holds mu.
+func (t *ipTracker) evict() {
+	for t.order.Len() > t.capacity {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(*ipEntry).ip)
+	}
+}
+
+// ipConnections counts the open connections of each IP. An IP is only kept
+// while it has connections open, so unlike the LRU-bounded ipTracker it
+// can't lose a count that is still to be released.
+type ipConnections struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newIPConnections() *ipConnections {
+	return &ipConnections{counts: make(map[string]int)}
+}
+
+// acquire counts a new connection from ip unless it already has limit open,
+// returning how many it has open.
+func (c *ipConnections) acquire(ip string, limit int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[ip] >= limit {
+		return c.counts[ip], false
+	}
+	c.counts[ip]++
+	return c.counts[ip], true
+}
+
+// release counts a connection from ip as closed.
+func (c *ipConnections) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[ip] <= 1 {
+		delete(c.counts, ip)
+		return
+	}
+	c.counts[ip]--
+}
+
+// remoteIP returns the IP part of the connection's remote address.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,95 @@
+package tcp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIPTrackerEvictsOldest(t *testing.T) {
+	tracker := newIPTracker(3)
+
+	for i := 0; i < 3; i++ {
+		tracker.update(fmt.Sprintf("10.0.0.%d", i), func(s *ipState) { s.failures++ })
+	}
+
+	// Touch the oldest entry so that 10.0.0.1 becomes the least recently seen
+	tracker.update("10.0.0.0", func(s *ipState) { s.failures++ })
+	tracker.update("10.0.0.3", func(s *ipState) { s.failures++ })
+
+	if _, ok := tracker.get("10.0.0.1"); ok {
+		t.Fatalf("expected least recently seen IP to be evicted")
+	}
+	state, ok := tracker.get("10.0.0.0")
+	if !ok {
+		t.Fatalf("expected recently touched IP to be kept")
+	}
+	if state.failures != 2 {
+		t.Fatalf("expected 2 failures, got %d", state.failures)
+	}
+}
+
+func TestIPTrackerBounded(t *testing.T) {
+	const capacity = 100
+	tracker := newIPTracker(capacity)
+
+	for i := 0; i < 10*capacity; i++ {
+		tracker.update(fmt.Sprintf("192.168.%d.%d", i/256, i%256), func(s *ipState) { s.failures++ })
+	}
+
+	if tracker.len() != capacity {
+		t.Fatalf("expected %d entries, got %d", capacity, tracker.len())
+	}
+	if len(tracker.entries) != capacity {
+		t.Fatalf("expected index of %d entries, got %d", capacity, len(tracker.entries))
+	}
+
+	// An evicted IP starts again from baseline
+	state := tracker.update("192.168.0.0", func(s *ipState) {})
+	if state.failures != 0 {
+		t.Fatalf("expected evicted IP to reset to baseline, got %d failures", state.failures)
+	}
+}
+
+func TestIPTrackerConcurrentUpdates(t *testing.T) {
+	tracker := newIPTracker(8)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				ip := fmt.Sprintf("10.0.%d.%d", g, i%16)
+				tracker.update(ip, func(s *ipState) { s.recordFailure(now, time.Minute) })
+				tracker.get(ip)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if tracker.len() != 8 {
+		t.Fatalf("expected 8 entries, got %d", tracker.len())
+	}
+}
+
+func TestIPStateFailureWindow(t *testing.T) {
+	now := time.Now()
+	var state ipState
+
+	state.recordFailure(now, time.Minute)
+	state.recordFailure(now, time.Minute)
+	if !state.penalized(now, 2, time.Minute) {
+		t.Fatalf("expected IP to be penalized after 2 failures")
+	}
+	if state.penalized(now.Add(2*time.Minute), 2, time.Minute) {
+		t.Fatalf("expected penalty to expire after the failure window")
+	}
+
+	state.recordFailure(now.Add(2*time.Minute), time.Minute)
+	if state.failures != 1 {
+		t.Fatalf("expected failure count to restart after the window, got %d", state.failures)
+	}
+}
@@ -0,0 +1,110 @@
+package tcp
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+)
+
+var ErrNetworkDatabase = errors.New("invalid network database")
+
+// NetworkInfo is the network a client IP belongs to, as found by a
+// NetworkLookup.
+type NetworkInfo struct {
+	Network netip.Prefix
+	// ASN is the number of the autonomous system announcing Network, and
+	// Organization the name it is registered under.
+	ASN          uint32
+	Organization string
+}
+
+// NetworkLookup finds the network of client IPs, so abuse logged against
+// an IP also shows the network behind it. Whole networks behind an attack
+// then stand out from the individual IPs.
+type NetworkLookup interface {
+	LookupNetwork(addr netip.Addr) (NetworkInfo, bool)
+}
+
+// NopNetworkLookup knows no network.
+type NopNetworkLookup struct{}
+
+func (NopNetworkLookup) LookupNetwork(netip.Addr) (NetworkInfo, bool) {
+	return NetworkInfo{}, false
+}
+
+// tableNetworkLookup finds networks in a table sorted by first address.
+// Networks in it don't overlap, so an address is in the last network
+// starting at or before it, if in any.
+type tableNetworkLookup struct {
+	networks []NetworkInfo
+}
+
+// NewCSVNetworkLookup returns a NetworkLookup reading networks in the CSV
+// form of MaxMind's GeoLite2 ASN database: a header line, then one
+// network,autonomous_system_number,autonomous_system_organization record
+// per network.
+func NewCSVNetworkLookup(r io.Reader) (NetworkLookup, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNetworkDatabase, err)
+	}
+	if len(records) > 0 {
+		// The header
+		records = records[1:]
+	}
+
+	networks := make([]NetworkInfo, 0, len(records))
+	for i, record := range records {
+		prefix, err := netip.ParsePrefix(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrNetworkDatabase, i+2, err)
+		}
+		asn, err := strconv.ParseUint(record[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrNetworkDatabase, i+2, err)
+		}
+		networks = append(networks, NetworkInfo{Network: prefix.Masked(), ASN: uint32(asn), Organization: record[2]})
+	}
+	slices.SortFunc(networks, func(a, b NetworkInfo) int {
+		return a.Network.Addr().Compare(b.Network.Addr())
+	})
+	return &tableNetworkLookup{networks: networks}, nil
+}
+
+func (l *tableNetworkLookup) LookupNetwork(addr netip.Addr) (NetworkInfo, bool) {
+	addr = addr.Unmap()
+	// The first network starting after addr, so the one before may hold it
+	i, _ := slices.BinarySearchFunc(l.networks, addr, func(info NetworkInfo, addr netip.Addr) int {
+		if info.Network.Addr().Compare(addr) <= 0 {
+			return -1
+		}
+		return 1
+	})
+	if i == 0 || !l.networks[i-1].Network.Contains(addr) {
+		return NetworkInfo{}, false
+	}
+	return l.networks[i-1], true
+}
+
+// networkFields returns log fields describing the network of ip, none
+// without a NetworkLookup or when it doesn't know ip.
+func (s *Server) networkFields(ip string) []interface{} {
+	if s.cfg.NetworkLookup == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	info, ok := s.cfg.NetworkLookup.LookupNetwork(addr)
+	if !ok {
+		return nil
+	}
+	return []interface{}{"network", info.Network.String(), "asn", info.ASN, "as_org", info.Organization}
+}
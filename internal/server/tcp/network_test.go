@@ -0,0 +1,110 @@
+package tcp
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testNetworkDatabase = `network,autonomous_system_number,autonomous_system_organization
+203.0.113.0/24,64500,"Example Hosting, Inc."
+198.51.100.0/25,64501,Other Net
+2001:db8::/32,64502,Documentation
+`
+
+// stubNetworkLookup knows a single network.
+type stubNetworkLookup struct {
+	info NetworkInfo
+}
+
+func (l stubNetworkLookup) LookupNetwork(addr netip.Addr) (NetworkInfo, bool) {
+	return l.info, l.info.Network.Contains(addr.Unmap())
+}
+
+func TestCSVNetworkLookup(t *testing.T) {
+	lookup, err := NewCSVNetworkLookup(strings.NewReader(testNetworkDatabase))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ip  string
+		asn uint32 // zero when in no network
+	}{
+		{"203.0.113.7", 64500},
+		{"::ffff:203.0.113.7", 64500},
+		{"198.51.100.127", 64501},
+		{"198.51.100.128", 0},
+		{"192.0.2.1", 0},
+		{"2001:db8::1", 64502},
+		{"2001:db9::1", 0},
+	}
+	for _, tt := range tests {
+		info, ok := lookup.LookupNetwork(netip.MustParseAddr(tt.ip))
+		if ok != (tt.asn != 0) || info.ASN != tt.asn {
+			t.Fatalf("expected ASN %d for %s, got %+v (found=%v)", tt.asn, tt.ip, info, ok)
+		}
+	}
+	if info, _ := lookup.LookupNetwork(netip.MustParseAddr("203.0.113.7")); info.Organization != "Example Hosting, Inc." {
+		t.Fatalf("expected the organization, got %q", info.Organization)
+	}
+
+	if _, err := NewCSVNetworkLookup(strings.NewReader("network,asn,org\nnot-a-network,1,x\n")); !errors.Is(err, ErrNetworkDatabase) {
+		t.Fatalf("expected ErrNetworkDatabase, got %v", err)
+	}
+}
+
+func TestNetworkFieldsEnrichClientErrors(t *testing.T) {
+	lookup := stubNetworkLookup{NetworkInfo{Network: netip.MustParsePrefix("203.0.113.0/24"), ASN: 64500, Organization: "Example Hosting"}}
+	tests := []struct {
+		name   string
+		lookup NetworkLookup
+		fields bool
+	}{
+		{"provider", lookup, true},
+		{"no-op", NopNetworkLookup{}, false},
+		{"none", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs lockedBuffer
+			server := newTestServer(&Config{NetworkLookup: tt.lookup})
+			server.logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			handled := make(chan struct{})
+			go func() {
+				defer close(handled)
+				server.handleConnection(&remoteAddrConn{
+					Conn:       serverConn,
+					remoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242},
+				})
+			}()
+
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(clientConn)
+			readPreamble(t, reader)
+			readChallengeFrame(t, reader)
+			if _, err := clientConn.Write([]byte("GARBAGE\nGARBAGE\n")); err != nil {
+				t.Fatalf("unexpected error writing garbage: %v", err)
+			}
+			if _, err := reader.ReadString('\n'); err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			<-handled
+
+			for _, field := range []string{"network=203.0.113.0/24", "asn=64500", `as_org="Example Hosting"`} {
+				if strings.Contains(logs.String(), field) != tt.fields {
+					t.Fatalf("expected %s logged=%v, got logs:\n%s", field, tt.fields, logs.String())
+				}
+			}
+		})
+	}
+}
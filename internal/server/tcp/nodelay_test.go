@@ -0,0 +1,59 @@
+//go:build unix
+
+package tcp
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// tcpNoDelay reads TCP_NODELAY off the socket of conn.
+func tcpNoDelay(t *testing.T, conn *net.TCPConn) bool {
+	t.Helper()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var value int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}); err != nil || sockErr != nil {
+		t.Fatalf("unexpected error reading TCP_NODELAY: %v, %v", err, sockErr)
+	}
+	return value != 0
+}
+
+func TestSetNoDelay(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error accepting: %v", err)
+	}
+	defer conn.Close()
+	tcpConn := conn.(*net.TCPConn)
+
+	if err := setNoDelay(conn, nil); err != nil || !tcpNoDelay(t, tcpConn) {
+		t.Fatalf("expected Go's default to be kept, got %v", err)
+	}
+	off, on := false, true
+	if err := setNoDelay(conn, &off); err != nil || tcpNoDelay(t, tcpConn) {
+		t.Fatalf("expected TCP_NODELAY to be turned off, got %v", err)
+	}
+	// Through TLS, to the connection underneath
+	if err := setNoDelay(tls.Server(conn, &tls.Config{}), &on); err != nil || !tcpNoDelay(t, tcpConn) {
+		t.Fatalf("expected TCP_NODELAY to be turned on, got %v", err)
+	}
+}
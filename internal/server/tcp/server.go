@@ -3,13 +3,26 @@ package tcp
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"faraway/internal/domain"
 	"faraway/internal/usecases"
+	"faraway/internal/websocket"
+	"faraway/pkg/pow/argon2"
+	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
+	"net/netip"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"math/rand"
@@ -20,6 +33,29 @@ type Server struct {
 	powUsecase   usecases.PowUsecase
 	quoteUsecase usecases.QuoteUsecase
 	logger       Logger
+	ipTracker    *ipTracker
+	ipConns      *ipConnections
+	verifiers    *verifierPool
+	buffers      *bufferPool
+	tuner        *difficultyTuner
+	clientTuner  *clientTuner
+	now          func() time.Time
+	// floors issue the challenges of each algorithm raised to its floor.
+	floors map[protocol.ChallengeType]difficultyFloor
+	// secrets starts out with ChallengeSecret alone.
+	secrets atomic.Pointer[challengeSecrets]
+
+	activeConns atomic.Int64
+	draining    atomic.Bool
+	handlers    sync.WaitGroup
+	// verifications counts verifications until they return, including
+	// those abandoned by their handler.
+	verifications sync.WaitGroup
+	// memoryVerifications counts memory-bound verifications in flight.
+	memoryVerifications atomic.Int64
+	// ownsStore is set when the challenge store is the default one the
+	// server created.
+	ownsStore bool
 }
 
 type Config struct {
@@ -27,6 +63,220 @@ type Config struct {
 	KeepAlive  time.Duration
 	Deadline   time.Duration
 	BufferSize int
+	// NoDelay, if set, turns TCP_NODELAY on or off on accepted connections,
+	// TLS ones included. Nil keeps Go's default, which turns it on: frames
+	// go out right away instead of Nagle's algorithm holding small ones
+	// back to coalesce them, trading a few more packets for latency.
+	NoDelay *bool
+	// PoolBuffers reuses the read and write buffers of finished connections
+	// instead of allocating new ones for every connection.
+	PoolBuffers bool
+	// AcceptParallelism is how many goroutines accept connections on the
+	// listener at once, for connection rates a single one can't keep up
+	// with on many cores. Zero or one accepts on a single goroutine.
+	AcceptParallelism int
+	// MaxConnections is the number of concurrently handled connections above
+	// which new clients are told to retry later. Zero means unlimited.
+	MaxConnections int64
+	// MaxGoroutines is a last-resort circuit breaker: while the process
+	// runs more goroutines than this, new connections are told to retry
+	// later, whatever leaked them. Zero disables it.
+	MaxGoroutines int
+	// MaxConnectionsPerIP is the number of connections one IP may have
+	// open at once, allow-listed or not; further ones are told to retry
+	// later. Zero means unlimited.
+	MaxConnectionsPerIP int
+	// MaxSessionBytes is the number of bytes a client may send on one
+	// connection. A valid handshake takes a few hundred at most, so a
+	// client sending more is cut off with an INVALID_FORMAT error instead
+	// of being buffered. Zero means unlimited.
+	MaxSessionBytes int64
+	// MaxNonceLength is the longest solution, in bytes, the server will
+	// hash. No encoding takes more than a few dozen, so longer ones are
+	// rejected as malformed before any verification. Zero means unlimited.
+	MaxNonceLength int
+	// MaxConnectionAge is how long a connection may stay open, when
+	// shorter than Deadline. A connection reaching it is answered with a
+	// RECONNECT error instead of a timeout: the client is told to connect
+	// again, solving anew unless it holds a session token, which SessionTTL
+	// bounds in turn. It isn't counted as a failure against the IP. Zero
+	// leaves connections to Deadline.
+	MaxConnectionAge time.Duration
+	// IPTrackerCapacity bounds the number of source IPs whose reputation
+	// is remembered.
+	IPTrackerCapacity int
+	// MaxFailures is the number of failed handshakes within FailureWindow
+	// after which an IP is told to retry later. Zero disables the check.
+	MaxFailures   int
+	FailureWindow time.Duration
+	// MaxChallenges caps how many challenges a single IP can trigger within
+	// ChallengeWindow. Zero means unlimited.
+	MaxChallenges   int
+	ChallengeWindow time.Duration
+	// Stealth makes the server silently close connections that send
+	// malformed input instead of answering with a descriptive error frame.
+	Stealth bool
+	// Observe serves quotes without enforcing proof of work, only logging
+	// the challenge that would have been issued.
+	Observe bool
+	// WebSocketAddress, when set, additionally serves the protocol over
+	// WebSocket binary messages on WebSocketPath at this address.
+	WebSocketAddress string
+	WebSocketPath    string
+	// MaxVerifications caps concurrent memory-bound verifications, and
+	// VerificationMemoryKiB caps them by the argon2 memory they'd use; the
+	// tighter limit wins. Verifications wait at most VerificationQueueTimeout
+	// for a slot. Zero limits verify inline without any cap.
+	MaxVerifications         int
+	VerificationMemoryKiB    int
+	VerificationQueueTimeout time.Duration
+	// CostAwareCapacity makes challenge type selection account for the
+	// server's verification cost: memory-bound challenges, far costlier to
+	// verify, are picked less often the more memory-bound verifications are
+	// in flight, and not at all once this many are. Zero picks uniformly.
+	CostAwareCapacity int
+	// ShutdownTimeout bounds how long Run waits for in-flight connections
+	// once its context is cancelled. Zero waits indefinitely.
+	ShutdownTimeout time.Duration
+	// EchoChallenge makes clients echo the challenge back with their
+	// solution, as a token tagged with ChallengeSecret. Solutions are then
+	// verified against the echoed token alone, so no per-connection state
+	// is needed. The secret can be changed with RotateChallengeSecret.
+	EchoChallenge   bool
+	ChallengeSecret []byte
+	// ChallengeStore makes echoed challenges redeemable once. It defaults
+	// to an in-memory store; share one between instances behind a load
+	// balancer.
+	ChallengeStore ChallengeStore
+	// EpochLength, when set, stamps echoed challenges with the epoch, a
+	// counter advancing every EpochLength, they were issued in. Solutions
+	// to challenges older than the current epoch and the EpochWindow before
+	// it are rejected, bounding replay without per-challenge state.
+	EpochLength time.Duration
+	EpochWindow uint64
+	// DetailedErrors reports every issue with a solution, not only the
+	// first, as a JSON error frame with a details list. Meant for protocol
+	// development, as it verifies solutions that are already known bad.
+	DetailedErrors bool
+	// VerboseErrors sends clients the full text of errors, with the
+	// operation and context otherwise only logged, as details of error
+	// frames. It tells clients about the server's internals, so it is meant
+	// for development only.
+	VerboseErrors bool
+	// LogRejectedSolutions logs every rejected solution at debug level
+	// together with its challenge and how it compares to the expected
+	// result. The logs carry client input verbatim, so keep it off unless
+	// diagnosing client bugs.
+	LogRejectedSolutions bool
+	// AllowList relaxes proof of work for trusted clients, such as internal
+	// health checks. The first entry matching the client IP applies.
+	AllowList []AllowListEntry
+	// Classifier, if set, sorts clients that aren't allow-listed into
+	// classes, and those with a policy in Classes are challenged by it.
+	Classifier Classifier
+	Classes    map[string]ClassPolicy
+	// NetworkLookup, if set, adds the network and ASN of IPs turned away
+	// or failing handshakes to what is logged about them.
+	NetworkLookup NetworkLookup
+	// ChallengeTTL is how long after a challenge is issued a solution for it
+	// is still accepted, regardless of the connection deadline. Zero disables
+	// the check.
+	ChallengeTTL time.Duration
+	// AutoDifficultyTarget is the median solve time the difficulty is tuned
+	// towards, within AutoDifficultyMin and AutoDifficultyMax, looking at
+	// AutoDifficultySamples solves per adjustment. Zero keeps the
+	// difficulty fixed. The range is capped at the highest difficulty all
+	// enabled algorithms accept, see usecases.MaxDifficulty. Clients must
+	// learn the tuned difficulty from the challenge, see EmbedDifficulty.
+	AutoDifficultyTarget  time.Duration
+	AutoDifficultyMin     uint64
+	AutoDifficultyMax     uint64
+	AutoDifficultySamples int
+	// ShedLoad makes the server turn new connections away with a
+	// retry-later frame while the tuned difficulty is saturated, at
+	// AutoDifficultyMax with solves still too fast, and its load, as
+	// advertised in hints, is at least this. Challenges any harder would
+	// only shut out legitimate clients. Zero keeps issuing challenges at
+	// the ceiling.
+	ShedLoad int
+	// PerClientDifficulty tunes the difficulty towards AutoDifficultyTarget
+	// for every connection on its own instead of server-wide, a step per
+	// solve, within AutoDifficultyMin and AutoDifficultyMax. Connections
+	// start at the usecase's difficulty; it takes HandshakesPerConnection
+	// for a connection to see more than one. Clients must learn the
+	// difficulty from the challenge, see EmbedDifficulty.
+	PerClientDifficulty bool
+	// HandshakesPerConnection is how many handshakes a connection may
+	// carry. After each successful one but the last, the next challenge is
+	// sent right away, each handshake with a Deadline of its own; a client
+	// wanting no more quotes closes the connection, which ends it quietly.
+	// Zero or one closes the connection after its handshake.
+	HandshakesPerConnection int
+	// MinCPUDifficulty and MinMemoryDifficulty are the floors no hashcash
+	// and argon2 challenge is issued below, whichever usecase, allow-list
+	// entry or tuning chose its difficulty: a challenge that would be
+	// easier is replaced by one at the floor. They are separate because
+	// hashcash counts hex digits and argon2 bits. Exempt allow-list entries
+	// and Observe mode issue no challenge and are unaffected. Zero disables
+	// a floor.
+	MinCPUDifficulty    uint64
+	MinMemoryDifficulty uint64
+	// Version, when set, is advertised to clients in a FrameVersion frame
+	// right after the preamble, so they can refuse an incompatible server.
+	// It should be a semantic version, at most 255 bytes long.
+	Version string
+	// AcceptSolveTimes advertises CapabilitySolveTime, letting clients
+	// report how long they took to solve. Reports are trusted only for
+	// difficulty tuning. Like Version, the frame breaks clients predating
+	// it.
+	AcceptSolveTimes bool
+	// SendHints precedes every challenge with a FrameHint advising the
+	// client how to solve it. Like Version, the frame breaks clients
+	// predating it.
+	SendHints bool
+	// AdvertiseLoad adds the server's load to every hint, so clients can
+	// back off while it is busy. The load is the fill of whichever is
+	// fuller of MaxConnections and the memory-bound verification slots, so
+	// it needs one of them. It is advisory and needs SendHints.
+	AdvertiseLoad bool
+	// EmbedDifficulty advertises CapabilityDifficulty and sends the
+	// difficulty with every challenge, so clients solve at it whatever they
+	// are configured with, and follow the difficulty as it is tuned. Like
+	// Version, the frame breaks clients predating it.
+	EmbedDifficulty bool
+	// SessionTTL, when set, advertises CapabilitySession: clients that
+	// solve a challenge are granted a session token, tagged with the
+	// challenge secret, that they may present instead of a solution until
+	// it expires. A random secret is used if ChallengeSecret is empty.
+	SessionTTL time.Duration
+	// AuditSink, if set, receives an AuditRecord for every successful
+	// handshake, signed with AuditKey when that is set.
+	AuditSink AuditSink
+	AuditKey  []byte
+	// TLSConfig, if set, makes Run serve TLS on Address.
+	TLSConfig *tls.Config
+	// BindClientCert binds echoed challenge tokens to the fingerprint of
+	// the client's TLS certificate, so a token solved by one client is
+	// rejected when relayed by another. It needs EchoChallenge, and
+	// TLSConfig requiring client certificates: connections without one
+	// are closed. Without echo mode challenges are already tied to the
+	// connection they were issued on.
+	BindClientCert bool
+	// ProbeWindow is how long a connection is given to close on its own
+	// before a challenge is generated for it, so load balancer liveness
+	// probes that connect and close right away cost no challenge. It
+	// delays every handshake by as much, so keep it to milliseconds. Zero
+	// disables the wait; probes closing later are still only logged at
+	// debug level.
+	ProbeWindow time.Duration
+}
+
+// AllowListEntry relaxes proof of work for clients within Prefix: they get
+// challenges from PowUsecase, typically at a lower difficulty, or none at
+// all when PowUsecase is nil.
+type AllowListEntry struct {
+	Prefix     netip.Prefix
+	PowUsecase usecases.PowUsecase
 }
 
 type Logger interface {
@@ -41,12 +291,90 @@ type Challenge struct {
 }
 
 func NewServer(cfg *Config, powUsecase usecases.PowUsecase, quoteUsecase usecases.QuoteUsecase, logger Logger) *Server {
-	return &Server{
+	// What the caller left out is filled in on a copy of its config
+	copied := *cfg
+	cfg = &copied
+	ownsStore := cfg.EchoChallenge && cfg.ChallengeStore == nil
+	if ownsStore {
+		cfg.ChallengeStore = NewMemoryChallengeStore()
+	}
+	if cfg.SessionTTL > 0 && len(cfg.ChallengeSecret) == 0 {
+		secret, err := randomSecret()
+		if err != nil {
+			// Tokens tagged with no secret could be forged by anyone
+			logger.Error("session secret unavailable, sessions disabled", "error", err)
+			cfg.SessionTTL = 0
+		}
+		cfg.ChallengeSecret = secret
+	}
+	s := &Server{
 		cfg:          cfg,
 		powUsecase:   powUsecase,
 		quoteUsecase: quoteUsecase,
 		logger:       logger,
+		ipTracker:    newIPTracker(cfg.IPTrackerCapacity),
+		ipConns:      newIPConnections(),
+		verifiers:    newVerifierPool(cfg),
+		buffers:      newBufferPool(cfg),
+		tuner:        newDifficultyTuner(cfg, powUsecase, logger),
+		clientTuner:  newClientTuner(cfg, powUsecase),
+		now:          time.Now,
+		ownsStore:    ownsStore,
+	}
+	s.secrets.Store(&challengeSecrets{current: cfg.ChallengeSecret})
+	s.floors = newDifficultyFloors(cfg, powUsecase, logger)
+	return s
+}
+
+// difficultyFloor issues challenges of one algorithm at its floor; err is
+// why its usecase couldn't be created, in which case no challenge of the
+// algorithm is issued below the floor.
+type difficultyFloor struct {
+	difficulty uint64
+	usecase    usecases.PowUsecase
+	err        error
+}
+
+// minDifficulty returns the floor of challengeType, zero if it has none.
+func (cfg *Config) minDifficulty(challengeType protocol.ChallengeType) uint64 {
+	switch challengeType {
+	case protocol.ChallengeTypeCPU:
+		return cfg.MinCPUDifficulty
+	case protocol.ChallengeTypeMemory:
+		return cfg.MinMemoryDifficulty
+	}
+	return 0
+}
+
+// newDifficultyFloors builds a floor for every algorithm with one that any
+// of the server's, allow-list or class usecases offers.
+func newDifficultyFloors(cfg *Config, powUsecase usecases.PowUsecase, logger Logger) map[protocol.ChallengeType]difficultyFloor {
+	offered := usecases.EnabledAlgorithms(powUsecase)
+	for _, entry := range cfg.AllowList {
+		if entry.PowUsecase != nil {
+			offered = append(offered, usecases.EnabledAlgorithms(entry.PowUsecase)...)
+		}
+	}
+	for _, class := range cfg.Classes {
+		if class.PowUsecase != nil {
+			offered = append(offered, usecases.EnabledAlgorithms(class.PowUsecase)...)
+		}
+	}
+
+	floors := make(map[protocol.ChallengeType]difficultyFloor)
+	for _, algorithm := range offered {
+		difficulty := cfg.minDifficulty(algorithm)
+		if _, ok := floors[algorithm]; ok || difficulty == 0 {
+			continue
+		}
+		floor := difficultyFloor{difficulty: difficulty}
+		floor.usecase, floor.err = usecases.NewPowUsecaseWithAlgorithms(difficulty, nil, algorithm)
+		if floor.err != nil {
+			logger.Error("difficulty floor unusable, no challenges of its type will be issued below it", "type", algorithm, "min_difficulty", difficulty, "error", floor.err)
+		}
+		floors[algorithm] = floor
 	}
+	return floors
 }
 
 func (s *Server) Run(ctx context.Context) error {
@@ -59,13 +387,269 @@ func (s *Server) Run(ctx context.Context) error {
 		return NewConnectionError("Run", err, "failed to start listener")
 	}
 	defer listener.Close()
+	if s.cfg.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.cfg.TLSConfig)
+	}
 
 	s.logger.Info("server started", "address", s.cfg.Address)
 
-	return s.serve(ctx, listener)
+	if s.cfg.WebSocketAddress != "" {
+		wsListener, err := lc.Listen(ctx, "tcp", s.cfg.WebSocketAddress)
+		if err != nil {
+			return NewConnectionError("Run", err, "failed to start websocket listener")
+		}
+		go s.serveWebSocket(ctx, wsListener)
+	}
+
+	return s.Serve(ctx, listener)
 }
 
+// Serve handles connections accepted on listener until ctx is done, then
+// waits for in-flight connections like Run. It lets callers own the
+// listener, e.g. to serve on a port picked by the system, on one inherited
+// through socket activation, or on a fake in tests. The listener is closed
+// once ctx is done.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		s.Drain()
+		listener.Close()
+	}()
+
+	err := s.serve(ctx, listener)
+	if waitErr := s.waitForHandlers(); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// waitForHandlers waits for in-flight connections to finish, giving up after
+// ShutdownTimeout so a hung handler can't keep the process from exiting.
+func (s *Server) waitForHandlers() error {
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	if s.cfg.ShutdownTimeout <= 0 {
+		<-done
+		return nil
+	}
+
+	timer := time.NewTimer(s.cfg.ShutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		active := s.activeConns.Load()
+		s.logger.Error("shutdown timed out, abandoning handlers", "active", active)
+		return NewConnectionError("Run", ErrShutdownTimeout, fmt.Sprintf("%d handlers still active", active))
+	}
+}
+
+// Close releases what the server holds once Run or Serve returned: it
+// waits for handlers abandoned at shutdown and the verifications they left
+// running, for at most ShutdownTimeout, then drops pooled buffers, the IP
+// tracker and the default challenge store. Stores passed in Config are the
+// caller's to close. The server can't be used afterwards.
+func (s *Server) Close() error {
+	if err := s.waitForHandlers(); err != nil {
+		// Abandoned handlers may still start verifications
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		s.verifications.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if s.cfg.ShutdownTimeout > 0 {
+		timer := time.NewTimer(s.cfg.ShutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		return NewConnectionError("Close", ErrShutdownTimeout, "verifications still running")
+	}
+
+	s.buffers.drain()
+	s.ipTracker.reset()
+	if store, ok := s.cfg.ChallengeStore.(*memoryChallengeStore); ok && s.ownsStore {
+		store.reset()
+	}
+	return nil
+}
+
+// WebSocketHandler returns an HTTP handler serving the same challenge
+// protocol as the TCP listener, carried in WebSocket binary messages.
+func (s *Server) WebSocketHandler() http.Handler {
+	return websocket.Handler(s.trackConnection)
+}
+
+func (s *Server) serveWebSocket(ctx context.Context, listener net.Listener) {
+	path := websocket.NormalizePath(s.cfg.WebSocketPath)
+	mux := http.NewServeMux()
+	mux.Handle(path, s.WebSocketHandler())
+
+	httpServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: s.cfg.Deadline,
+	}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+
+	s.logger.Info("websocket server started", "address", listener.Addr().String(), "path", path)
+	if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("websocket server failed", "error", err)
+	}
+}
+
+// Drain makes the server answer every new connection with a retry-later
+// frame instead of a challenge, so clients don't waste a solve on a server
+// that is about to go away.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// shouldRetryLater reports whether a new connection must be turned away.
+func (s *Server) shouldRetryLater(active int64) bool {
+	if s.draining.Load() {
+		return true
+	}
+	if s.cfg.MaxGoroutines > 0 && runtime.NumGoroutine() > s.cfg.MaxGoroutines {
+		return true
+	}
+	if s.cfg.MaxConnections > 0 && active > s.cfg.MaxConnections {
+		return true
+	}
+	return s.cfg.ShedLoad > 0 && s.tuner != nil && s.tuner.saturated.Load() && s.load() >= s.cfg.ShedLoad
+}
+
+// load is how busy the server is, between 1 and protocol.MaxLoad, going by
+// whichever is fuller of its connection limit and verification slots. It
+// is zero when neither is bounded.
+func (s *Server) load() int {
+	if s.cfg.MaxConnections <= 0 && s.verifiers == nil {
+		return 0
+	}
+	var fill float64
+	if s.cfg.MaxConnections > 0 {
+		fill = float64(s.activeConns.Load()) / float64(s.cfg.MaxConnections)
+	}
+	if s.verifiers != nil {
+		fill = max(fill, float64(len(s.verifiers.slots))/float64(cap(s.verifiers.slots)))
+	}
+	return min(max(int(math.Ceil(fill*protocol.MaxLoad)), 1), protocol.MaxLoad)
+}
+
+// allowListed returns the allow-list entry matching ip, if any.
+func (s *Server) allowListed(ip string) (AllowListEntry, bool) {
+	if len(s.cfg.AllowList) == 0 {
+		return AllowListEntry{}, false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return AllowListEntry{}, false
+	}
+	addr = addr.Unmap()
+	for _, entry := range s.cfg.AllowList {
+		if entry.Prefix.Contains(addr) {
+			return entry, true
+		}
+	}
+	return AllowListEntry{}, false
+}
+
+// tuneSession has the session challenge at the difficulty tuned for its
+// connection, if PerClientDifficulty tuned one yet.
+func (s *Server) tuneSession(session *Session) {
+	if s.clientTuner == nil || session.tunedDifficulty == 0 {
+		return
+	}
+	powUsecase, err := s.clientTuner.usecase(session.tunedDifficulty)
+	if err != nil {
+		s.logger.Error("client difficulty unusable", "ip", remoteIP(session.conn), "difficulty", session.tunedDifficulty, "error", err)
+		return
+	}
+	session.pow = powUsecase
+	session.clientTuned = true
+}
+
+// tuneClient sets the difficulty of the session's next challenge from how
+// long it took to solve one of the given difficulty.
+func (s *Server) tuneClient(session *Session, solveTime time.Duration, difficulty uint64) {
+	next := s.clientTuner.next(solveTime, difficulty)
+	session.tunedDifficulty = next
+	if next != difficulty {
+		s.logger.Debug("client difficulty adjusted", "ip", remoteIP(session.conn), "from", difficulty, "to", next, "solve_time", solveTime)
+	}
+}
+
+// isPenalized reports whether ip failed too many handshakes recently.
+func (s *Server) isPenalized(ip string) bool {
+	state, ok := s.ipTracker.get(ip)
+	return ok && state.penalized(s.now(), s.cfg.MaxFailures, s.cfg.FailureWindow)
+}
+
+// allowChallenge counts a challenge request from ip and reports whether it
+// is still within the per-IP challenge limit.
+func (s *Server) allowChallenge(ip string) (ipState, bool) {
+	if s.cfg.MaxChallenges <= 0 {
+		return ipState{}, true
+	}
+	state := s.ipTracker.update(ip, func(st *ipState) { st.countChallenge(s.now(), s.cfg.ChallengeWindow) })
+	return state, state.challenges <= s.cfg.MaxChallenges
+}
+
+// Bounds of the delay between failing Accept calls.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// errorResponseTimeout is how long an error response may take to write.
+// The session deadline may already have passed, timeouts being errors too.
+const errorResponseTimeout = time.Second
+
+// serve runs AcceptParallelism accept loops on listener, returning once all
+// of them have.
 func (s *Server) serve(ctx context.Context, listener net.Listener) error {
+	acceptors := max(s.cfg.AcceptParallelism, 1)
+	if acceptors == 1 {
+		return s.acceptLoop(ctx, listener)
+	}
+
+	errs := make([]error, acceptors)
+	var loops sync.WaitGroup
+	for i := range acceptors {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			errs[i] = s.acceptLoop(ctx, listener)
+		}()
+	}
+	loops.Wait()
+
+	// The loops stop for the same reason, so one error tells it
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acceptLoop accepts connections and hands each to a handler goroutine
+// until ctx is done or listener is closed.
+func (s *Server) acceptLoop(ctx context.Context, listener net.Listener) error {
+	var backoff time.Duration
 	for {
 		select {
 		case <-ctx.Done():
@@ -77,15 +661,57 @@ func (s *Server) serve(ctx context.Context, listener net.Listener) error {
 					s.logger.Debug("listener closed")
 					return nil
 				}
-				s.logger.Error("accept failed", "error", err)
+				// Errors such as running out of file descriptors tend to
+				// persist for a while, so back off instead of spinning
+				backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+				s.logger.Error("accept failed", "error", err, "backoff", backoff)
+				select {
+				case <-ctx.Done():
+				case <-time.After(backoff):
+				}
 				continue
 			}
-			go s.handleConnection(conn)
+			backoff = 0
+			if err := setNoDelay(conn, s.cfg.NoDelay); err != nil {
+				s.logger.Debug("setting TCP_NODELAY failed", "error", err)
+			}
+			s.handlers.Add(1)
+			go func() {
+				defer s.handlers.Done()
+				s.handleConnection(conn)
+			}()
 		}
 	}
 }
 
+// setNoDelay sets TCP_NODELAY on conn, or on the connection under it for
+// TLS connections, unless noDelay is nil. Connections other than TCP ones
+// are left alone.
+func setNoDelay(conn net.Conn, noDelay *bool) error {
+	if noDelay == nil {
+		return nil
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return tcpConn.SetNoDelay(*noDelay)
+	}
+	return nil
+}
+
+// trackConnection handles a connection accepted outside the serve loop,
+// counting it as in flight for shutdown.
+func (s *Server) trackConnection(conn net.Conn) {
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+	s.handleConnection(conn)
+}
+
 func (s *Server) handleConnection(conn net.Conn) {
+	active := s.activeConns.Add(1)
+	defer s.activeConns.Add(-1)
+
 	defer func() {
 		if err := conn.Close(); err != nil {
 			s.logger.Error("connection close failed",
@@ -93,25 +719,147 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 	}()
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Deadline)
-	defer cancel()
-
-	if err := conn.SetDeadline(time.Now().Add(s.cfg.Deadline)); err != nil {
-		s.logger.Error("set deadline failed",
-			"error", NewConnectionError("handleConnection", err, "setting timeout failed"))
-		return
+	// The connection deadline may go off a little ahead of the context,
+	// so reaching the maximum age is told by the time
+	connCtx := context.Background()
+	var agedAt time.Time
+	if age := s.cfg.MaxConnectionAge; age > 0 {
+		agedAt = time.Now().Add(age)
+		var cancelAge context.CancelFunc
+		connCtx, cancelAge = context.WithDeadline(connCtx, agedAt)
+		defer cancelAge()
 	}
+	ctx, cancel := context.WithTimeout(connCtx, s.cfg.Deadline)
+	defer cancel()
 
 	session := &Session{
 		conn:    conn,
-		reader:  bufio.NewReader(conn),
-		writer:  bufio.NewWriter(conn),
+		reader:  s.buffers.getReader(limitSessionBytes(conn, s.cfg.MaxSessionBytes)),
+		writer:  s.buffers.getWriter(conn),
 		server:  s,
 		context: ctx,
 	}
+	defer session.releaseBuffers()
 
-	if err := session.Handle(); err != nil {
-		s.handleError(session.writer, err)
+	if s.cfg.BindClientCert {
+		binding, err := clientCertBinding(ctx, conn)
+		if err != nil {
+			s.logger.Debug("closing connection without a client certificate", "ip", remoteIP(conn), "error", err)
+			return
+		}
+		session.certBinding = binding
+	}
+
+	// Buffered only: it goes out together with whatever is sent first
+	session.writer.Write(protocol.Preamble)
+	if s.cfg.Version != "" {
+		session.writer.Write([]byte{protocol.FrameVersion, byte(len(s.cfg.Version))})
+		session.writer.WriteString(s.cfg.Version)
+	}
+	if capabilities := s.capabilities(); len(capabilities) > 0 {
+		frame := protocol.FormatCapabilities(capabilities)
+		session.writer.Write([]byte{protocol.FrameCapabilities, byte(len(frame))})
+		session.writer.WriteString(frame)
+	}
+
+	ip := remoteIP(conn)
+	if s.shouldRetryLater(active) || s.isPenalized(ip) {
+		s.logger.Debug("turning connection away", append([]interface{}{"ip", ip, "active", active, "goroutines", runtime.NumGoroutine(), "draining", s.draining.Load()}, s.networkFields(ip)...)...)
+		if err := session.sendRetryLater(); err != nil {
+			s.logger.Error("retry-later delivery failed", "error", err)
+		}
+		return
+	}
+	if limit := s.cfg.MaxConnectionsPerIP; limit > 0 {
+		open, ok := s.ipConns.acquire(ip, limit)
+		if !ok {
+			s.logger.Debug("turning connection away, too many open from its IP", append([]interface{}{"ip", ip, "open", open}, s.networkFields(ip)...)...)
+			if err := session.sendRetryLater(); err != nil {
+				s.logger.Error("retry-later delivery failed", "error", err)
+			}
+			return
+		}
+		defer s.ipConns.release(ip)
+	}
+
+	handle := session.Handle
+	// Only connections solving challenges carry more than one handshake
+	reuse := s.cfg.HandshakesPerConnection > 1
+	allowListed := false
+	if entry, ok := s.allowListed(ip); ok {
+		// Allow-listed clients are trusted, so they aren't rate limited either
+		s.logger.Debug("allow-listed client", "ip", ip, "exempt", entry.PowUsecase == nil)
+		session.policy = entry.PowUsecase
+		allowListed = true
+		if entry.PowUsecase == nil {
+			handle, reuse = session.Exempt, false
+		}
+	} else if state, ok := s.allowChallenge(ip); !ok {
+		s.handleError(session.writer,
+			NewConnectionError("handleConnection", ErrChallengeLimit, fmt.Sprintf("%d challenges in window", state.challenges)),
+			ip, state.failures)
+		return
+	} else if class, policy, ok := s.classify(ctx, conn, ip); ok {
+		s.logger.Debug("classified client", "ip", ip, "class", class, "exempt", policy.PowUsecase == nil)
+		session.policy = policy.PowUsecase
+		if policy.PowUsecase == nil {
+			handle, reuse = session.Exempt, false
+		}
+	}
+	session.pow = session.policy
+
+	if s.cfg.Observe {
+		handle, reuse = session.Observe, false
+	}
+
+	if s.cfg.ProbeWindow > 0 && session.closedWithin(s.cfg.ProbeWindow) {
+		s.logger.Debug("liveness probe", "ip", ip)
+		return
+	}
+
+	err := handle()
+	for handshakes := 1; reuse && err == nil && handshakes < s.cfg.HandshakesPerConnection; handshakes++ {
+		if !allowListed {
+			if state, ok := s.allowChallenge(ip); !ok {
+				err = NewConnectionError("handleConnection", ErrChallengeLimit, fmt.Sprintf("%d challenges in window", state.challenges))
+				break
+			}
+		}
+		next, cancelNext := context.WithTimeout(connCtx, s.cfg.Deadline)
+		session.nextHandshake(next)
+		err = handle()
+		cancelNext()
+		if errors.Is(err, ErrProbe) {
+			s.logger.Debug("client done with its connection", "ip", ip, "handshakes", handshakes)
+			return
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrProbe) {
+			s.logger.Debug("liveness probe", "ip", ip, "error", err)
+			return
+		}
+		if IsTimeoutError(err) && !agedAt.IsZero() && !time.Now().Before(agedAt) {
+			// The server cut the connection short, not the client
+			err = NewConnectionError("handleConnection", ErrConnectionAge, err.Error())
+			s.logger.Debug("closing connection at its maximum age", "ip", ip, "error", err)
+			if err := conn.SetWriteDeadline(time.Now().Add(errorResponseTimeout)); err != nil {
+				s.logger.Debug("extending write deadline failed", "error", err)
+			}
+			if err := sendErrorResponse(session.writer, ToErrorResponse(err)); err != nil {
+				s.logger.Debug("reconnect delivery failed", "error", err)
+			}
+			return
+		}
+		state := s.ipTracker.update(ip, func(st *ipState) { st.recordFailure(s.now(), s.cfg.FailureWindow) })
+		if s.cfg.Stealth && IsMalformedInputError(err) {
+			s.logger.Debug("closing connection on malformed input", append([]interface{}{"ip", ip, "failures", state.failures, "error", err}, s.networkFields(ip)...)...)
+			return
+		}
+		if err := conn.SetWriteDeadline(time.Now().Add(errorResponseTimeout)); err != nil {
+			s.logger.Debug("extending write deadline failed", "error", err)
+		}
+		s.handleError(session.writer, err, ip, state.failures)
 	}
 }
 
@@ -121,6 +869,72 @@ type Session struct {
 	writer  *bufio.Writer
 	server  *Server
 	context context.Context
+
+	// policy is the PowUsecase of allow-listed and classified clients, nil
+	// for others. pow overrides the server's PowUsecase with it, with the
+	// one of the difficulty tuned for the connection, or for challenges
+	// raised to the difficulty floor.
+	policy        usecases.PowUsecase
+	pow           usecases.PowUsecase
+	issuedAt      time.Time              // when the challenge was sent
+	difficulty    uint64                 // difficulty of the challenge sent
+	challengeType protocol.ChallengeType // type of the challenge sent
+	// pinned is the difficulty the client pinned with its solution, zero
+	// if it didn't.
+	pinned uint64
+	// reportedSolveTime is the solve time the client reported, zero if it
+	// didn't or AcceptSolveTimes is off.
+	reportedSolveTime time.Duration
+	// presentedSession is set when the client presented a session token
+	// instead of a solution.
+	presentedSession bool
+	// quote is set once the quote was delivered.
+	quote domain.Quote
+	// certBinding is the client's certificate fingerprint when
+	// BindClientCert is set.
+	certBinding []byte
+	// clientTuned is set when pow issues challenges at the difficulty
+	// tuned for this connection, tunedDifficulty, which is zero until the
+	// first solve.
+	clientTuned     bool
+	tunedDifficulty uint64
+
+	// readAbandoned is set when a read timed out while its goroutine may
+	// still be using the reader.
+	readAbandoned bool
+}
+
+// releaseBuffers hands the session buffers back for reuse. A reader that
+// may still be in use by an abandoned read is left to the garbage collector.
+func (s *Session) releaseBuffers() {
+	reader := s.reader
+	if s.readAbandoned {
+		reader = nil
+	}
+	s.server.buffers.put(reader, s.writer)
+}
+
+// nextHandshake readies the session for another handshake on its
+// connection, bounded by ctx. What the connection learned, its policy, TLS
+// binding and tuned difficulty, carries over.
+func (s *Session) nextHandshake(ctx context.Context) {
+	s.context = ctx
+	s.pow = s.policy
+	s.clientTuned = false
+	s.issuedAt, s.difficulty, s.challengeType = time.Time{}, 0, protocol.ChallengeTypeInvalid
+	s.pinned, s.reportedSolveTime, s.presentedSession = 0, 0, false
+	s.quote = domain.Quote{}
+	if s.policy == nil {
+		s.server.tuneSession(s)
+	}
+}
+
+// powUsecase returns the PowUsecase challenges of this session come from.
+func (s *Session) powUsecase() usecases.PowUsecase {
+	if s.pow != nil {
+		return s.pow
+	}
+	return s.server.powUsecase
 }
 
 // All magic happens here
@@ -131,197 +945,584 @@ func (s *Session) Handle() error {
 		return fmt.Errorf("failed to send challenge: %w", err)
 	}
 
-	// Step 2: Read solution
+	// Step 2: Read solution, preceded by the challenge token in echo mode
+	var token []byte
+	if s.server.cfg.EchoChallenge {
+		if token, err = s.readEchoedChallenge(); err != nil {
+			return fmt.Errorf("failed to read echoed challenge: %w", err)
+		}
+	}
 	challengeType, solution, err := s.readSolution()
 	if err != nil {
 		return fmt.Errorf("failed to read solution: %w", err)
 	}
+	solvedAt := s.server.now()
+	if s.presentedSession {
+		return s.redeemSession(solution)
+	}
 
-	// Step 3: Validate and respond
-	err = s.validateAndRespond(challengeType, challenge, solution)
-	if err != nil {
-		return fmt.Errorf("failed to validate and respond: %w", err)
+	// A solution for another type than issued is never verified: the type
+	// the client names is not to be trusted. In echo mode the token is
+	// bound to the type issued, and checked below.
+	if !s.server.cfg.EchoChallenge && challengeType != s.challengeType {
+		return NewConnectionError("Handle", ErrInvalidChallengeType,
+			fmt.Sprintf("solution for a %s challenge, %s was issued", challengeType, s.challengeType))
+	}
+
+	// Step 3: Validate and respond. Normally the first issue found is
+	// reported; with detailed errors every check runs so all issues are.
+	var issues []error
+	if s.server.cfg.EchoChallenge {
+		// Trust only the echoed token, not what this connection was sent
+		if err := verifyChallengeToken(*s.server.secrets.Load(), s.certBinding, token, challengeType, s.server.now(), s.server.oldestEpoch(s.server.now())); err != nil {
+			issues = append(issues, err)
+		} else if err := s.consumeChallenge(token); err != nil {
+			issues = append(issues, err)
+		}
+		challenge = token
+	} else if s.isChallengeExpired() {
+		issues = append(issues, NewConnectionError("Handle", ErrChallengeExpired, "solution arrived after challenge expiry"))
+	}
+	if s.pinned != 0 && s.pinned != s.difficulty {
+		issues = append(issues, NewConnectionError("Handle", ErrDifficultyMismatch,
+			fmt.Sprintf("client pinned difficulty %d, challenge has %d", s.pinned, s.difficulty)))
+	}
+	if len(issues) == 0 || s.server.cfg.DetailedErrors {
+		if err := s.validateSolution(challengeType, challenge, solution); err != nil {
+			issues = append(issues, fmt.Errorf("failed to validate solution: %w", err))
+		}
+	}
+	if len(issues) > 0 {
+		return errors.Join(issues...)
 	}
 
+	// Allow-listed clients solve easier challenges, which would skew tuning
+	if s.server.tuner != nil && s.pow == nil {
+		s.server.tuner.observe(s.solveTime(solvedAt), s.difficulty)
+	}
+	if s.server.clientTuner != nil && (s.pow == nil || s.clientTuned) {
+		s.server.tuneClient(s, s.solveTime(solvedAt), s.difficulty)
+	}
+	if err := s.respondWithQuote(); err != nil {
+		return err
+	}
+	s.server.logger.Info("challenge solved",
+		"type", challengeType,
+		"difficulty", s.difficulty,
+		"ip", remoteIP(s.conn),
+		"elapsed", solvedAt.Sub(s.issuedAt))
+	s.audit(challengeType, challenge, solution, solvedAt)
+	s.grantSession()
 	return nil
 }
 
-func (s *Session) sendChallenge() ([]byte, error) {
-	var challengeType string
-	var pow *domain.ProofOfWork
-	var err error
+// solveTime is how long the client took to solve its challenge: the time
+// it reported if any, as that leaves out the network round trip, but never
+// more than the server measured itself.
+func (s *Session) solveTime(solvedAt time.Time) time.Duration {
+	measured := solvedAt.Sub(s.issuedAt)
+	if s.reportedSolveTime <= 0 {
+		return measured
+	}
+	return min(s.reportedSolveTime, measured)
+}
 
-	// Randomly decide between CPU-bound and memory-bound challenge
-	if shouldSendCPUBoundChallenge() {
-		challengeType = "CPU"
-		pow, err = s.server.powUsecase.GenerateCPUBoundChallenge()
-	} else {
-		challengeType = "Memory"
-		pow, err = s.server.powUsecase.GenerateMemoryBoundChallenge()
+// consumeChallenge redeems an echoed challenge token, so a solution for it
+// is accepted only once.
+func (s *Session) consumeChallenge(token []byte) error {
+	ok, err := s.server.cfg.ChallengeStore.Consume(s.context, token)
+	if err != nil {
+		return NewConnectionError("consumeChallenge", ErrChallengeStore, err.Error())
+	}
+	if !ok {
+		return NewConnectionError("consumeChallenge", ErrChallengeReplayed, "challenge already redeemed")
 	}
+	return nil
+}
 
+// Observe serves the quote without enforcing proof of work. The challenge
+// that would have been issued is still generated and logged together with
+// its estimated client cost, so the impact of enforcement can be gauged.
+func (s *Session) Observe() error {
+	challengeType, pow, err := s.generateChallenge()
 	if err != nil {
-		return nil, NewConnectionError("sendChallenge", ErrChallengeFailed, fmt.Sprintf("%s-bound challenge generation failed", challengeType))
+		return err
 	}
 
-	// Send challenge type (1 byte for challenge type, e.g., 0 = CPU, 1 = Memory)
-	if err := s.sendChallengeType(challengeType); err != nil {
+	s.server.logger.Info("challenge not enforced", append([]interface{}{
+		"type", challengeType,
+		"difficulty", pow.Difficulty,
+	}, estimatedCost(challengeType, pow.Difficulty)...)...)
+
+	if err := s.writer.WriteByte(protocol.FrameObserve); err != nil {
+		return NewConnectionError("Observe", err, "write frame failed")
+	}
+	return s.respondWithQuote()
+}
+
+// Exempt serves the quote right away to an allow-listed client that
+// doesn't have to do any proof of work.
+func (s *Session) Exempt() error {
+	if err := s.writer.WriteByte(protocol.FrameObserve); err != nil {
+		return NewConnectionError("Exempt", err, "write frame failed")
+	}
+	return s.respondWithQuote()
+}
+
+// generateChallenge picks the challenge type and generates the challenge.
+func (s *Session) generateChallenge() (protocol.ChallengeType, *domain.ProofOfWork, error) {
+	// Randomly decide between the enabled challenge types
+	challengeType := s.server.pickChallengeType(usecases.EnabledAlgorithms(s.powUsecase()))
+	pow, err := generateChallengeOfType(s.powUsecase(), challengeType)
+
+	// This is the last point the difficulty can change, so the floor is
+	// enforced here; the solution is then verified at the floor as well
+	if floor, ok := s.server.floors[challengeType]; ok && err == nil && pow.Difficulty < floor.difficulty {
+		if floor.err != nil {
+			return protocol.ChallengeTypeInvalid, nil, NewConnectionError("sendChallenge", ErrChallengeFailed, "difficulty floor unusable")
+		}
+		s.server.logger.Debug("challenge raised to the difficulty floor", "type", challengeType, "difficulty", pow.Difficulty, "min_difficulty", floor.difficulty)
+		s.pow = floor.usecase
+		pow, err = generateChallengeOfType(s.pow, challengeType)
+	}
+
+	if err != nil {
+		return protocol.ChallengeTypeInvalid, nil, NewConnectionError("sendChallenge", ErrChallengeFailed, fmt.Sprintf("%s-bound challenge generation failed", challengeType))
+	}
+	s.issuedAt = s.server.now()
+	s.difficulty = pow.Difficulty
+	s.challengeType = challengeType
+
+	return challengeType, pow, nil
+}
+
+func (s *Session) sendChallenge() ([]byte, error) {
+	challengeType, pow, err := s.generateChallenge()
+	if err != nil {
 		return nil, err
 	}
 
-	// Send challenge length
-	length := int32(len(pow.Challenge))
-	if err := binary.Write(s.writer, binary.BigEndian, length); err != nil {
-		return nil, NewConnectionError("sendChallenge", ErrChallengeDelivery, "write length failed")
+	// A client done with a reused connection may close it before the next
+	// challenge is on its way, which is no more a failure than a probe
+	if err := s.setDeadline(); isClosedError(err) {
+		return nil, NewConnectionError("sendChallenge", ErrProbe, "connection closed before the challenge was delivered")
+	} else if err != nil {
+		return nil, NewConnectionError("sendChallenge", ErrConnectionClosed, fmt.Sprintf("setting deadline failed: %v", err))
 	}
 
-	// Send challenge data (either CPU-bound or memory-bound challenge)
-	errCh := make(chan error, 1)
-	go func() {
-		_, err := s.writer.Write(pow.Challenge)
-		if err == nil {
-			err = s.writer.Flush()
+	if s.server.cfg.EchoChallenge {
+		pow.Challenge = signChallengeToken(s.server.secrets.Load().current, s.certBinding, challengeType, pow.Challenge, s.issuedAt.Add(s.tokenTTL()), s.server.epochAt(s.issuedAt))
+		if err := s.server.cfg.ChallengeStore.Issue(s.context, pow.Challenge, s.tokenTTL()); err != nil {
+			return nil, NewConnectionError("sendChallenge", ErrChallengeFailed, err.Error())
 		}
-		errCh <- err
-	}()
+	}
 
-	s.server.logger.Info("challenge sent", "type", challengeType, "difficulty", pow.Difficulty, "length", length)
+	if !challengeType.Valid() {
+		return nil, NewConnectionError("sendChallenge", ErrChallengeDelivery, "unknown challenge type")
+	}
 
-	select {
-	case err := <-errCh:
-		if err != nil {
-			return nil, NewConnectionError("sendChallenge", ErrChallengeDelivery, "write challenge data failed")
+	if s.server.cfg.SendHints {
+		hint := challengeHint(challengeType, pow.Difficulty)
+		if s.server.cfg.AdvertiseLoad {
+			hint.Load = s.server.load()
 		}
-	case <-s.context.Done():
-		return nil, NewConnectionError("sendChallenge", ErrWriteTimeout, "context deadline exceeded")
+		text := protocol.FormatHint(hint)
+		s.writer.Write([]byte{protocol.FrameHint, byte(len(text))})
+		s.writer.WriteString(text)
 	}
 
+	// Writes are bounded by the connection deadline, so they happen on this
+	// goroutine and nothing touches the writer once we return.
+	frame := protocol.AppendChallengeFrame(nil, challengeType, pow.Challenge)
+	if s.server.cfg.EmbedDifficulty {
+		frame = protocol.AppendChallengeFrameWithDifficulty(nil, challengeType, pow.Difficulty, pow.Challenge)
+	}
+	_, err = s.writer.Write(frame)
+	if err == nil {
+		err = s.writer.Flush()
+	}
+	if isDeadlineError(err) {
+		return nil, NewConnectionError("sendChallenge", ErrWriteTimeout, "connection deadline exceeded")
+	}
+	if isClosedError(err) {
+		return nil, NewConnectionError("sendChallenge", ErrProbe, "connection closed before the challenge was delivered")
+	}
+	if err != nil {
+		return nil, NewConnectionError("sendChallenge", ErrChallengeDelivery, "write challenge data failed")
+	}
+
+	s.server.logger.Info("challenge sent", "type", challengeType, "difficulty", pow.Difficulty, "length", len(pow.Challenge))
+
 	return pow.Challenge, nil
 }
 
-// Helper function to determine which challenge to send
-func shouldSendCPUBoundChallenge() bool {
-	return rand.Intn(2) == 0
+// refreshDeadline sets the connection deadline from the session context
+// right before an I/O step, so socket operations never outlive the session.
+// A failure means the connection is unusable.
+func (s *Session) refreshDeadline(op string) error {
+	if err := s.setDeadline(); err != nil {
+		return NewConnectionError(op, ErrConnectionClosed, fmt.Sprintf("setting deadline failed: %v", err))
+	}
+	return nil
+}
+
+// setDeadline sets the connection deadline from the session context, if it
+// has one.
+func (s *Session) setDeadline() error {
+	deadline, ok := s.context.Deadline()
+	if !ok {
+		return nil
+	}
+	return s.conn.SetDeadline(deadline)
+}
+
+// isChallengeExpired reports whether the challenge TTL has passed since the
+// challenge was issued.
+func (s *Session) isChallengeExpired() bool {
+	ttl := s.server.cfg.ChallengeTTL
+	return ttl > 0 && s.server.now().Sub(s.issuedAt) > ttl
 }
 
-// Helper function to send the challenge type (as a single byte)
-func (s *Session) sendChallengeType(challengeType string) error {
-	var challengeByte byte
-	if challengeType == "CPU" {
-		challengeByte = 0x00
-	} else if challengeType == "Memory" {
-		challengeByte = 0x01
-	} else {
-		return NewConnectionError("sendChallenge", ErrChallengeDelivery, "unknown challenge type")
+// tokenTTL is how long an echoed challenge token stays valid: the challenge
+// TTL if set, the connection deadline otherwise.
+func (s *Session) tokenTTL() time.Duration {
+	if s.server.cfg.ChallengeTTL > 0 {
+		return s.server.cfg.ChallengeTTL
 	}
+	return s.server.cfg.Deadline
+}
 
-	// Send challenge type
-	if err := s.writer.WriteByte(challengeByte); err != nil {
-		return NewConnectionError("sendChallenge", ErrChallengeDelivery, "write challenge type failed")
+// readEchoedChallenge reads the base64 challenge token line the client
+// echoes back ahead of its solution.
+func (s *Session) readEchoedChallenge() ([]byte, error) {
+	if err := s.refreshDeadline("readEchoedChallenge"); err != nil {
+		return nil, err
+	}
+
+	line, err := s.reader.ReadString('\n')
+	if line == "" && isClosedError(err) {
+		err = ErrProbe
+	}
+	if err != nil {
+		return nil, NewConnectionError("readEchoedChallenge", err, "reading challenge token failed")
+	}
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return nil, NewConnectionError("readEchoedChallenge", ErrInvalidProtocol, "challenge token is not base64")
+	}
+	return token, nil
+}
+
+// closedWithin reports whether the client closes the connection within
+// window without sending anything, as liveness probes do.
+func (s *Session) closedWithin(window time.Duration) bool {
+	// A TLS handshake timing out would break the connection for good, so
+	// it gets the whole session deadline; probes fail it right away.
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(s.context); err != nil {
+			return isClosedError(err)
+		}
+	}
+	if err := s.conn.SetReadDeadline(time.Now().Add(window)); err != nil {
+		return isClosedError(err)
+	}
+	// Anything the client did send stays buffered for the handshake
+	_, err := s.reader.Peek(1)
+	return isClosedError(err)
+}
+
+// sendRetryLater sends the retry-later control frame in place of a challenge.
+func (s *Session) sendRetryLater() error {
+	if err := s.refreshDeadline("sendRetryLater"); err != nil {
+		return err
+	}
+	if err := s.writer.WriteByte(protocol.FrameRetryLater); err != nil {
+		return NewConnectionError("sendRetryLater", err, "write frame failed")
+	}
+	if err := s.writer.Flush(); err != nil {
+		return NewConnectionError("sendRetryLater", err, "flush failed")
 	}
 	return nil
 }
 
-func (s *Session) readSolution() (string, []byte, error) {
+// generateChallengeOfType generates a challenge of the given type.
+func generateChallengeOfType(powUsecase usecases.PowUsecase, challengeType protocol.ChallengeType) (*domain.ProofOfWork, error) {
+	if challengeType == protocol.ChallengeTypeCPU {
+		return powUsecase.GenerateCPUBoundChallenge()
+	}
+	return powUsecase.GenerateMemoryBoundChallenge()
+}
+
+// pickChallengeType picks one of the enabled challenge types at random.
+func pickChallengeType(enabled []protocol.ChallengeType) protocol.ChallengeType {
+	return enabled[rand.Intn(len(enabled))]
+}
+
+// pickChallengeType picks one of the enabled challenge types. With
+// CostAwareCapacity, the memory-bound type is picked as often as any other
+// while none of its verifications are in flight, and less often the closer
+// they come to the capacity.
+func (s *Server) pickChallengeType(enabled []protocol.ChallengeType) protocol.ChallengeType {
+	capacity := s.cfg.CostAwareCapacity
+	if capacity <= 0 || len(enabled) < 2 || !slices.Contains(enabled, protocol.ChallengeTypeMemory) {
+		return pickChallengeType(enabled)
+	}
+
+	load := min(float64(s.memoryVerifications.Load())/float64(capacity), 1)
+	if rand.Float64() < (1-load)/float64(len(enabled)) {
+		return protocol.ChallengeTypeMemory
+	}
+	cheaper := slices.DeleteFunc(slices.Clone(enabled), func(t protocol.ChallengeType) bool {
+		return t == protocol.ChallengeTypeMemory
+	})
+	return pickChallengeType(cheaper)
+}
+
+// estimatedCost returns log fields describing the work a client needs to
+// solve a challenge of the given type and difficulty.
+func estimatedCost(challengeType protocol.ChallengeType, difficulty uint64) []interface{} {
+	if challengeType == protocol.ChallengeTypeCPU {
+		return []interface{}{"expected_hashes", hashcash.ExpectedIterations(difficulty)}
+	}
+	// Every iteration is one pass over the whole memory
+	return []interface{}{
+		"iterations", argon2.ExpectedIterations(difficulty),
+		"memory_kib", argon2.MemoryKiB,
+		"memory_kib_processed", argon2.ExpectedIterations(difficulty) * argon2.MemoryKiB,
+	}
+}
+
+// parallelSearchIterations is the expected hashcash search length below
+// which extra workers don't pay for starting.
+const parallelSearchIterations = 1 << 16
+
+// challengeHint advises clients how to solve a challenge. Every argon2 pass
+// already runs on several threads over 64 MiB, so memory-bound challenges
+// are best solved one pass at a time, as are short hashcash searches.
+func challengeHint(challengeType protocol.ChallengeType, difficulty uint64) protocol.Hint {
+	if challengeType == protocol.ChallengeTypeMemory {
+		return protocol.Hint{ExpectedIterations: uint64(argon2.ExpectedIterations(difficulty)), Workers: 1, Difficulty: difficulty}
+	}
+	iterations := hashcash.ExpectedIterations(difficulty)
+	hint := protocol.Hint{ExpectedIterations: uint64(min(iterations, 1<<63)), Difficulty: difficulty}
+	if iterations < parallelSearchIterations {
+		hint.Workers = 1
+	}
+	return hint
+}
+
+// solutionRead is what readSolution read off the connection.
+type solutionRead struct {
+	challengeType protocol.ChallengeType
+	pinned        uint64
+	solveTime     time.Duration
+	// session is set when the client presented a session token, carried
+	// in solution, instead of solving.
+	session  bool
+	solution []byte
+	err      error
+}
+
+func (s *Session) readSolution() (protocol.ChallengeType, []byte, error) {
+	if err := s.refreshDeadline("readChallengeTypeAndSolution"); err != nil {
+		return protocol.ChallengeTypeInvalid, nil, err
+	}
+
 	// Channel for the results
-	resultCh := make(chan struct {
-		challengeType string
-		solution      []byte
-		err           error
-	}, 1)
+	resultCh := make(chan solutionRead, 1)
 
 	go func() {
-		// Read challenge type
+		// Read challenge type. Running into the connection deadline is the
+		// same timeout as the context expiring.
 		challengeTypeLine, err := s.reader.ReadString('\n')
+		if isDeadlineError(err) {
+			err = ErrReadTimeout
+		}
+		// Closing without a word is a probe, unless the token came first
+		if challengeTypeLine == "" && isClosedError(err) && !s.server.cfg.EchoChallenge {
+			err = ErrProbe
+		}
 		if err != nil {
-			resultCh <- struct {
-				challengeType string
-				solution      []byte
-				err           error
-			}{"", nil, NewConnectionError("readChallengeTypeAndSolution", err, "reading challenge type failed")}
+			resultCh <- solutionRead{challengeType: protocol.ChallengeTypeInvalid, err: NewConnectionError("readChallengeTypeAndSolution", err, "reading challenge type failed")}
 			return
 		}
 
-		// Parse the challenge type
-		challengeType := strings.TrimSpace(challengeTypeLine)
+		// The solve time report is advisory, so a malformed one is dropped
+		// rather than failing the handshake
+		typeLine := strings.TrimSpace(challengeTypeLine)
+		var solveTime time.Duration
+		if s.server.cfg.AcceptSolveTimes {
+			if typeLine, solveTime, err = protocol.CutSolveTime(typeLine); err != nil {
+				s.server.logger.Debug("ignoring reported solve time", "error", err)
+			}
+		}
+
+		// Parse the challenge type and the difficulty the client pinned,
+		// unless a session token comes in place of a solution
+		var challengeType protocol.ChallengeType
+		var pinned uint64
+		session := typeLine == protocol.SessionType && s.server.cfg.SessionTTL > 0
+		if !session {
+			if challengeType, pinned, err = protocol.ParseSolutionType(typeLine); err != nil {
+				resultCh <- solutionRead{challengeType: protocol.ChallengeTypeInvalid, err: NewConnectionError("readChallengeTypeAndSolution", ErrInvalidChallengeType, err.Error())}
+				return
+			}
+		}
 
 		// Read solution
 		solutionLine, err := s.reader.ReadString('\n')
+		if isDeadlineError(err) {
+			err = ErrReadTimeout
+		}
 		if err != nil {
-			resultCh <- struct {
-				challengeType string
-				solution      []byte
-				err           error
-			}{challengeType, nil, NewConnectionError("readChallengeTypeAndSolution", err, "reading solution failed")}
+			resultCh <- solutionRead{challengeType: challengeType, pinned: pinned, solveTime: solveTime, err: NewConnectionError("readChallengeTypeAndSolution", err, "reading solution failed")}
 			return
 		}
 
-		// Parse the solution
+		// Parse the solution, refusing to hash absurdly long ones
 		solution, err := parseSolution(solutionLine)
-		resultCh <- struct {
-			challengeType string
-			solution      []byte
-			err           error
-		}{challengeType, solution, err}
+		if limit := s.server.cfg.MaxNonceLength; err == nil && !session && limit > 0 && len(solution) > limit {
+			err = NewConnectionError("readChallengeTypeAndSolution", ErrSolutionFormat, fmt.Sprintf("%d-byte nonce", len(solution)))
+		}
+		resultCh <- solutionRead{challengeType, pinned, solveTime, session, solution, err}
 	}()
 
 	select {
 	case result := <-resultCh:
+		s.pinned = result.pinned
+		s.reportedSolveTime = result.solveTime
+		s.presentedSession = result.session
 		return result.challengeType, result.solution, result.err
 	case <-s.context.Done():
-		return "", nil, NewConnectionError("readChallengeTypeAndSolution", ErrReadTimeout, "context deadline exceeded")
+		s.readAbandoned = true
+		return protocol.ChallengeTypeInvalid, nil, NewConnectionError("readChallengeTypeAndSolution", ErrReadTimeout, "context deadline exceeded")
 	}
 }
 
-func (s *Session) validateAndRespond(challengeType string, challenge, solution []byte) error {
+func (s *Session) validateSolution(challengeType protocol.ChallengeType, challenge, solution []byte) error {
+	// The tuner may have changed the usecase's difficulty since the
+	// challenge was issued; the client was asked to solve it at the old one
+	validator, atIssued := s.powUsecase().(usecases.DifficultyValidator)
+	atIssued = atIssued && s.difficulty > 0
+
 	switch challengeType {
-	case "CPU":
-		if !s.server.powUsecase.ValidateCPUBoundSolution(challenge, solution) {
-			return NewConnectionError("validateAndRespond", ErrInvalidSolution, "validation failed")
+	case protocol.ChallengeTypeCPU:
+		var isValidated bool
+		if atIssued {
+			isValidated = validator.ValidateCPUBoundSolutionAt(challenge, solution, s.difficulty)
+		} else {
+			isValidated = s.powUsecase().ValidateCPUBoundSolution(challenge, solution)
+		}
+		if !isValidated {
+			s.logRejected(challengeType, challenge, solution)
+			return NewConnectionError("validateSolution", ErrInvalidSolution, "validation failed")
+		}
+	case protocol.ChallengeTypeMemory:
+		isValidated, err := s.server.verifiers.run(s.context, &s.server.verifications, func() (bool, error) {
+			s.server.memoryVerifications.Add(1)
+			defer s.server.memoryVerifications.Add(-1)
+			if atIssued {
+				return validator.ValidateMemoryBoundSolutionAt(challenge, solution, s.difficulty)
+			}
+			return s.powUsecase().ValidateMemoryBoundSolution(challenge, solution)
+		})
+		if errors.Is(err, usecases.ErrInvalidSolutionFormat) {
+			s.logRejected(challengeType, challenge, solution)
+			return NewConnectionError("validateSolution", ErrSolutionFormat, err.Error())
+		}
+		if errors.Is(err, ErrVerificationBusy) || errors.Is(err, ErrVerificationTimeout) {
+			return err
 		}
-	case "Memory":
-		isValidated, err := s.server.powUsecase.ValidateMemoryBoundSolution(challenge, solution)
 		if err != nil {
-			return NewConnectionError("validateAndRespond", err, "validation failed")
+			return NewConnectionError("validateSolution", err, "validation failed")
 		}
 		if !isValidated {
-			return NewConnectionError("validateAndRespond", ErrInvalidSolution, "validation failed")
+			s.logRejected(challengeType, challenge, solution)
+			return NewConnectionError("validateSolution", ErrInvalidSolution, "validation failed")
 		}
 	default:
-		return NewConnectionError("validateAndRespond", ErrInvalidChallengeType, "unknown challenge type")
+		return NewConnectionError("validateSolution", ErrInvalidChallengeType, "unknown challenge type")
 	}
 
-	quote := s.server.quoteUsecase.GetRandomQuote()
-	response := formatSuccessResponse(quote)
+	return nil
+}
 
-	errCh := make(chan error, 1)
-	go func() {
-		_, err := s.writer.WriteString(response)
-		if err == nil {
-			err = s.writer.Flush()
-		}
-		errCh <- err
-	}()
+// logRejected logs a rejected solution with the offending bytes when
+// LogRejectedSolutions is set. If the usecase can explain solutions, the
+// computed result is logged next to the expected one.
+func (s *Session) logRejected(challengeType protocol.ChallengeType, challenge, solution []byte) {
+	if !s.server.cfg.LogRejectedSolutions {
+		return
+	}
 
-	select {
-	case err := <-errCh:
+	fields := []interface{}{
+		"type", challengeType,
+		"difficulty", s.difficulty,
+		"challenge", hex.EncodeToString(challenge),
+		"solution", fmt.Sprintf("%q", solution),
+	}
+	if explainer, ok := s.powUsecase().(usecases.SolutionExplainer); ok {
+		var computed, expected string
+		var err error
+		if challengeType == protocol.ChallengeTypeCPU {
+			computed, expected = explainer.ExplainCPUBoundSolution(challenge, solution)
+		} else {
+			computed, expected, err = explainer.ExplainMemoryBoundSolution(challenge, solution)
+		}
 		if err != nil {
-			return NewConnectionError("validateAndRespond", err, "write response failed")
+			computed = err.Error()
 		}
-	case <-s.context.Done():
-		return NewConnectionError("validateAndRespond", ErrWriteTimeout, "context deadline exceeded")
+		fields = append(fields, "computed", computed, "expected", expected)
+	}
+	s.server.logger.Debug("solution rejected", fields...)
+}
+
+// respondWithQuote writes the success response carrying a random quote.
+func (s *Session) respondWithQuote() error {
+	if err := s.refreshDeadline("respondWithQuote"); err != nil {
+		return err
+	}
+
+	quote := s.server.quoteUsecase.GetRandomQuote()
+	response := protocol.FormatSuccess(protocol.Quote(quote))
+
+	_, err := s.writer.WriteString(response)
+	if err == nil {
+		err = s.writer.Flush()
+	}
+	if isDeadlineError(err) {
+		return NewConnectionError("respondWithQuote", ErrWriteTimeout, "connection deadline exceeded")
+	}
+	if err != nil {
+		return NewConnectionError("respondWithQuote", err, "write response failed")
 	}
 
+	s.quote = quote
 	return nil
 }
 
-func (s *Server) handleError(writer *bufio.Writer, err error) {
+func (s *Server) handleError(writer *bufio.Writer, err error, ip string, failures int) {
 	response := ToErrorResponse(err)
-	s.logger.Error("client error",
+	s.logger.Error("client error", append([]interface{}{
 		"code", response.Code,
 		"message", response.Message,
-		"error", err)
+		"ip", ip,
+		"failures", failures,
+		"error", err}, s.networkFields(ip)...)...)
+
+	// There is no point in answering on a connection that is gone, or
+	// whose peer stopped reading
+	if errors.Is(err, ErrConnectionClosed) || errors.Is(err, ErrWriteTimeout) {
+		return
+	}
 
+	// Clients are told what went wrong, not where
+	switch {
+	case s.cfg.VerboseErrors:
+		response.Details = errorDetails(err)
+	case s.cfg.DetailedErrors:
+		response.Details = safeErrorDetails(err)
+	}
 	if err := sendErrorResponse(writer, response); err != nil {
 		s.logger.Error("failed to send error response", "error", err)
 	}
@@ -333,13 +1534,9 @@ func parseSolution(line string) ([]byte, error) {
 	return []byte(strings.TrimSpace(line)), nil
 }
 
-func formatSuccessResponse(quote string) string {
-	return fmt.Sprintf("SUCCESS:%s\n", quote)
-}
-
+// sendErrorResponse writes the error response line.
 func sendErrorResponse(writer *bufio.Writer, response ErrorResponse) error {
-	_, err := writer.WriteString(fmt.Sprintf("ERROR:%s:%s\n", response.Code, response.Message))
-	if err != nil {
+	if _, err := writer.WriteString(protocol.FormatError(response)); err != nil {
 		return err
 	}
 	return writer.Flush()
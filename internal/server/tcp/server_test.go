@@ -0,0 +1,1736 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"faraway/internal/domain"
+	"faraway/internal/usecases"
+	"faraway/internal/usecases/usecasestest"
+	"faraway/pkg/pow/argon2"
+	"faraway/pkg/protocol"
+)
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// cpuOnly restricts fake usecases to CPU challenges, so tests can answer
+// them as such without reading the type off the challenge frame.
+var cpuOnly = []protocol.ChallengeType{protocol.ChallengeTypeCPU}
+
+func newTestServer(cfg *Config) *Server {
+	if cfg.Deadline == 0 {
+		cfg.Deadline = 5 * time.Second
+	}
+	return NewServer(cfg,
+		&usecasestest.PowUsecase{Challenge: []byte("challenge"), Valid: true, Enabled: cpuOnly},
+		usecasestest.QuoteUsecase{Quote: "test quote"},
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+}
+
+// serveTestConn handles one in-memory connection and returns the client end.
+func serveTestConn(t *testing.T, server *Server) net.Conn {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+
+	go server.handleConnection(serverConn)
+
+	if err := clientConn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("unexpected error setting deadline: %v", err)
+	}
+	readPreamble(t, clientConn)
+	return clientConn
+}
+
+// readPreamble reads and checks the protocol preamble.
+func readPreamble(t *testing.T, reader io.Reader) {
+	t.Helper()
+
+	preamble := make([]byte, len(protocol.Preamble))
+	if _, err := io.ReadFull(reader, preamble); err != nil {
+		t.Fatalf("unexpected error reading preamble: %v", err)
+	}
+	if !bytes.Equal(preamble, protocol.Preamble) {
+		t.Fatalf("expected preamble %q, got %q", protocol.Preamble, preamble)
+	}
+}
+
+// readChallengeFrame reads a challenge frame off the client end of a connection.
+func readChallengeFrame(t *testing.T, reader *bufio.Reader) []byte {
+	t.Helper()
+
+	if _, err := reader.ReadByte(); err != nil {
+		t.Fatalf("unexpected error reading challenge type: %v", err)
+	}
+	var length int32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		t.Fatalf("unexpected error reading challenge length: %v", err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		t.Fatalf("unexpected error reading challenge data: %v", err)
+	}
+	return data
+}
+
+func TestValidationOutcomeFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		valid    bool
+		expected string
+	}{
+		{"valid solution", true, "SUCCESS:test quote\n"},
+		{"invalid solution", false, "ERROR:INVALID_SOLUTION:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(&Config{})
+			server.powUsecase = &usecasestest.PowUsecase{Challenge: []byte("challenge"), Valid: tt.valid, Enabled: cpuOnly}
+
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			readChallengeFrame(t, reader)
+
+			// The fake doesn't look at the solution, only the type matters
+			if _, err := conn.Write([]byte("CPU\n0\n")); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			if !strings.HasPrefix(line, tt.expected) {
+				t.Fatalf("expected response starting with %q, got %q", tt.expected, line)
+			}
+		})
+	}
+}
+
+func TestMaxSessionBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     string
+		expected string
+	}{
+		{"handshake within the limit", "CPU\n0\n", "SUCCESS:test quote\n"},
+		{"oversized solution", "CPU\n" + strings.Repeat("0", 1024) + "\n", "ERROR:INVALID_FORMAT:Sent more than a handshake takes\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(&Config{MaxSessionBytes: 64})
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			readChallengeFrame(t, reader)
+
+			// The server stops reading at the limit, so write concurrently
+			go conn.Write([]byte(tt.sent))
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			if line != tt.expected {
+				t.Fatalf("expected response %q, got %q", tt.expected, line)
+			}
+			if _, err := reader.ReadByte(); err != io.EOF {
+				t.Fatalf("expected the connection to be closed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMaxNonceLength(t *testing.T) {
+	tests := []struct {
+		name          string
+		nonce         string
+		expected      string
+		wantValidated int32
+	}{
+		{"nonce within the limit", "12345", "SUCCESS:test quote\n", 1},
+		{"multi-kilobyte nonce", strings.Repeat("9", 4096), "ERROR:INVALID_FORMAT:Invalid message format\n", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			powUsecase := &countingPowUsecase{PowUsecase: usecasestest.PowUsecase{Challenge: []byte("challenge"), Valid: true, Enabled: cpuOnly}}
+			server := newTestServer(&Config{MaxNonceLength: 64})
+			server.powUsecase = powUsecase
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			readChallengeFrame(t, reader)
+
+			if _, err := conn.Write([]byte("CPU\n" + tt.nonce + "\n")); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			if line != tt.expected {
+				t.Fatalf("expected response %q, got %q", tt.expected, line)
+			}
+			if validated := powUsecase.validated.Load(); validated != tt.wantValidated {
+				t.Fatalf("expected %d validations, got %d", tt.wantValidated, validated)
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe to log into from handler goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogRejectedSolutions(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			var logs lockedBuffer
+			server := newTestServer(&Config{LogRejectedSolutions: enabled})
+			server.powUsecase = &usecasestest.PowUsecase{Challenge: []byte("challenge"), Valid: false, Enabled: cpuOnly}
+			server.logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			readChallengeFrame(t, reader)
+
+			if _, err := conn.Write([]byte("CPU\nbad-nonce\n")); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+			// The rejection is logged before the error response is sent
+			if _, err := reader.ReadString('\n'); err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+
+			logged := strings.Contains(logs.String(), "solution rejected")
+			if logged != enabled {
+				t.Fatalf("expected rejection logged=%v, got logs:\n%s", enabled, logs.String())
+			}
+			if !enabled {
+				return
+			}
+			for _, want := range []string{"bad-nonce", "challenge=6368616c6c656e6765", "difficulty="} {
+				if !strings.Contains(logs.String(), want) {
+					t.Fatalf("expected %q in logs:\n%s", want, logs.String())
+				}
+			}
+		})
+	}
+}
+
+func TestSolvedChallengeIsLogged(t *testing.T) {
+	var logs lockedBuffer
+	clock := &testClock{now: time.Now()}
+	server := newTestServer(&Config{})
+	server.now = clock.Now
+	server.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	conn := serveTestConn(t, server)
+	reader := bufio.NewReader(conn)
+	readChallengeFrame(t, reader)
+
+	clock.Advance(1500 * time.Millisecond)
+	if _, err := conn.Write([]byte("CPU\n42\n")); err != nil {
+		t.Fatalf("unexpected error writing solution: %v", err)
+	}
+	// The success is logged right after the quote is sent
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	conn.Close()
+
+	var entry struct {
+		Type       string
+		Difficulty uint64
+		IP         string
+		Elapsed    time.Duration
+	}
+	deadline := time.Now().Add(time.Second)
+	for entry.Type == "" && time.Now().Before(deadline) {
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, `"msg":"challenge solved"`) {
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("unexpected error decoding log line %q: %v", line, err)
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if entry.Type != "CPU" || entry.Difficulty != 1 || entry.IP == "" || entry.Elapsed != 1500*time.Millisecond {
+		t.Fatalf("expected the CPU solve logged with its difficulty, IP and elapsed time, got %+v in logs:\n%s", entry, logs.String())
+	}
+}
+
+func TestSolutionForAnotherTypeIsRejected(t *testing.T) {
+	tests := []struct {
+		issued protocol.ChallengeType
+		named  protocol.ChallengeType
+	}{
+		{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory},
+		{protocol.ChallengeTypeMemory, protocol.ChallengeTypeCPU},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s issued, %s named", tt.issued, tt.named), func(t *testing.T) {
+			// The fake would accept any solution of either type
+			powUsecase := &countingPowUsecase{PowUsecase: usecasestest.PowUsecase{
+				Challenge: []byte("challenge"),
+				Valid:     true,
+				Enabled:   []protocol.ChallengeType{tt.issued},
+			}}
+			server := newTestServer(&Config{})
+			server.powUsecase = powUsecase
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			session := &Session{
+				conn:    serverConn,
+				reader:  bufio.NewReader(serverConn),
+				writer:  bufio.NewWriter(serverConn),
+				server:  server,
+				context: context.Background(),
+			}
+			handled := make(chan error, 1)
+			go func() { handled <- session.Handle() }()
+
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(clientConn)
+			issued, err := reader.ReadByte()
+			if err != nil || issued != tt.issued.Byte() {
+				t.Fatalf("expected a %s challenge, got %x (%v)", tt.issued, issued, err)
+			}
+			reader.UnreadByte()
+			readChallengeFrame(t, reader)
+			if _, err := clientConn.Write([]byte(tt.named.String() + "\nsolution\n")); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+
+			if err := <-handled; !errors.Is(err, ErrInvalidChallengeType) {
+				t.Fatalf("expected ErrInvalidChallengeType, got %v", err)
+			}
+			if validated := powUsecase.validated.Load(); validated != 0 {
+				t.Fatalf("expected no solution verified, %d were", validated)
+			}
+		})
+	}
+}
+
+func TestStealthModeClosesOnGarbage(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"garbage challenge type", "GARBAGE\nGARBAGE\n"},
+		{"garbage memory-bound solution", "Memory\nGARBAGE\n"},
+		{"bad memory-bound encoding", "Memory\n!!!$!!!\n"},
+	}
+
+	powUsecase, err := usecases.NewPowUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(&Config{Stealth: true})
+			server.powUsecase = powUsecase
+
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			readChallengeFrame(t, reader)
+
+			if _, err := conn.Write([]byte(tt.payload)); err != nil {
+				t.Fatalf("unexpected error writing garbage: %v", err)
+			}
+
+			rest, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("expected a bare close, got %v", err)
+			}
+			if len(rest) != 0 {
+				t.Fatalf("expected no error frame in stealth mode, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestDescriptiveErrorOnGarbage(t *testing.T) {
+	conn := serveTestConn(t, newTestServer(&Config{}))
+	reader := bufio.NewReader(conn)
+	readChallengeFrame(t, reader)
+
+	if _, err := conn.Write([]byte("GARBAGE\nGARBAGE\n")); err != nil {
+		t.Fatalf("unexpected error writing garbage: %v", err)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if !strings.HasPrefix(line, "ERROR:") {
+		t.Fatalf("expected an error frame, got %q", line)
+	}
+}
+
+func TestSolutionAfterChallengeExpiry(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	server := newTestServer(&Config{ChallengeTTL: time.Second})
+	server.now = clock.Now
+
+	conn := serveTestConn(t, server)
+	reader := bufio.NewReader(conn)
+	readChallengeFrame(t, reader)
+
+	clock.Advance(time.Second + time.Millisecond)
+
+	// The fake usecase accepts any solution, so only expiry can reject it
+	if _, err := conn.Write([]byte("CPU\n42\n")); err != nil {
+		t.Fatalf("unexpected error writing solution: %v", err)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if !strings.HasPrefix(line, "ERROR:"+ErrRespChallengeExpired.Code) {
+		t.Fatalf("expected %s error, got %q", ErrRespChallengeExpired.Code, line)
+	}
+}
+
+func TestMaxConnectionAgeAsksToReconnect(t *testing.T) {
+	server := newTestServer(&Config{MaxConnectionAge: 50 * time.Millisecond, MaxFailures: 1, FailureWindow: time.Minute})
+
+	// The client holds on to the connection without ever answering
+	conn := serveTestConn(t, server)
+	reader := bufio.NewReader(conn)
+	readChallengeFrame(t, reader)
+
+	start := time.Now()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if !strings.HasPrefix(line, "ERROR:"+protocol.CodeReconnect+":") {
+		t.Fatalf("expected %s error, got %q", protocol.CodeReconnect, line)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the connection closed at its maximum age, took %s", elapsed)
+	}
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+
+	// Reaching the age is no failure of the client's
+	readChallengeFrame(t, bufio.NewReader(serveTestConn(t, server)))
+}
+
+func TestDetailedErrorsReportEveryIssue(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	server := newTestServer(&Config{ChallengeTTL: time.Second, DetailedErrors: true})
+	server.powUsecase = &usecasestest.PowUsecase{Challenge: []byte("challenge"), Valid: false, Enabled: cpuOnly}
+	server.now = clock.Now
+
+	conn := serveTestConn(t, server)
+	reader := bufio.NewReader(conn)
+	readChallengeFrame(t, reader)
+
+	clock.Advance(2 * time.Second)
+
+	if _, err := conn.Write([]byte("CPU\n42\n")); err != nil {
+		t.Fatalf("unexpected error writing solution: %v", err)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	var response ErrorResponse
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "ERROR:")), &response); err != nil {
+		t.Fatalf("expected a JSON error frame, got %q: %v", line, err)
+	}
+	if response.Code != ErrRespChallengeExpired.Code {
+		t.Fatalf("expected primary code %s, got %s", ErrRespChallengeExpired.Code, response.Code)
+	}
+	if len(response.Details) != 2 ||
+		response.Details[0] != ErrRespChallengeExpired.Message ||
+		response.Details[1] != ErrRespInvalidSolution.Message {
+		t.Fatalf("expected expiry and invalid solution details, got %q", response.Details)
+	}
+}
+
+func TestClientErrorsKeepDetailInLogs(t *testing.T) {
+	const detail = "solution arrived after challenge expiry"
+	tests := []struct {
+		name    string
+		verbose bool
+	}{
+		{"safe", false},
+		{"verbose", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs lockedBuffer
+			clock := &testClock{now: time.Now()}
+			server := newTestServer(&Config{ChallengeTTL: time.Second, VerboseErrors: tt.verbose})
+			server.logger = slog.New(slog.NewTextHandler(&logs, nil))
+			server.now = clock.Now
+
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			readChallengeFrame(t, reader)
+
+			clock.Advance(2 * time.Second)
+			if _, err := conn.Write([]byte("CPU\n42\n")); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			response, err := protocol.ParseResponse(line)
+			if err != nil || response.Error == nil {
+				t.Fatalf("expected an error frame, got %q: %v", line, err)
+			}
+			if response.Error.Code != ErrRespChallengeExpired.Code || response.Error.Message != ErrRespChallengeExpired.Message {
+				t.Fatalf("expected %+v, got %+v", ErrRespChallengeExpired, *response.Error)
+			}
+			if strings.Contains(line, detail) != tt.verbose {
+				t.Fatalf("expected the detail sent=%v, got %q", tt.verbose, line)
+			}
+
+			// The connection is closed once the error is logged
+			if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+				t.Fatalf("expected the connection to be closed, got %v", err)
+			}
+			if !strings.Contains(logs.String(), detail) || !strings.Contains(logs.String(), "Handle") {
+				t.Fatalf("expected the full error logged, got logs:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestSolutionWithinChallengeTTL(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	server := newTestServer(&Config{ChallengeTTL: time.Second})
+	server.now = clock.Now
+
+	conn := serveTestConn(t, server)
+	reader := bufio.NewReader(conn)
+	readChallengeFrame(t, reader)
+
+	clock.Advance(time.Second)
+
+	if _, err := conn.Write([]byte("CPU\n42\n")); err != nil {
+		t.Fatalf("unexpected error writing solution: %v", err)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if !strings.HasPrefix(line, "SUCCESS:") {
+		t.Fatalf("expected success, got %q", line)
+	}
+}
+
+func TestObserveModeServesQuoteWithoutChallenge(t *testing.T) {
+	conn := serveTestConn(t, newTestServer(&Config{Observe: true}))
+	reader := bufio.NewReader(conn)
+
+	frame, err := reader.ReadByte()
+	if err != nil {
+		t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	if frame != protocol.FrameObserve {
+		t.Fatalf("expected observe frame 0x%02x, got 0x%02x", protocol.FrameObserve, frame)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if line != "SUCCESS:test quote\n" {
+		t.Fatalf("expected quote right away, got %q", line)
+	}
+}
+
+func TestDrainSendsRetryLater(t *testing.T) {
+	server := newTestServer(&Config{})
+	server.Drain()
+
+	frame, err := io.ReadAll(serveTestConn(t, server))
+	if err != nil {
+		t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	if len(frame) != 1 || frame[0] != protocol.FrameRetryLater {
+		t.Fatalf("expected only the retry-later frame, got %x", frame)
+	}
+}
+
+// hangingPowUsecase blocks challenge generation until release is closed,
+// standing in for a handler stuck in a call that ignores cancellation.
+// entered, if set, receives a value as each generation starts blocking.
+type hangingPowUsecase struct {
+	usecasestest.PowUsecase
+	release chan struct{}
+	entered chan struct{}
+}
+
+func (h *hangingPowUsecase) hang() {
+	if h.entered != nil {
+		h.entered <- struct{}{}
+	}
+	<-h.release
+}
+
+func (h *hangingPowUsecase) GenerateCPUBoundChallenge() (*domain.ProofOfWork, error) {
+	h.hang()
+	return h.PowUsecase.GenerateCPUBoundChallenge()
+}
+
+func (h *hangingPowUsecase) GenerateMemoryBoundChallenge() (*domain.ProofOfWork, error) {
+	h.hang()
+	return h.PowUsecase.GenerateMemoryBoundChallenge()
+}
+
+// countingPowUsecase counts the challenges generated and the solutions
+// validated.
+type countingPowUsecase struct {
+	usecasestest.PowUsecase
+	generated atomic.Int32
+	validated atomic.Int32
+}
+
+func (c *countingPowUsecase) ValidateCPUBoundSolution(challenge, solution []byte) bool {
+	c.validated.Add(1)
+	return c.PowUsecase.ValidateCPUBoundSolution(challenge, solution)
+}
+
+func (c *countingPowUsecase) ValidateMemoryBoundSolution(challenge, solution []byte) (bool, error) {
+	c.validated.Add(1)
+	return c.PowUsecase.ValidateMemoryBoundSolution(challenge, solution)
+}
+
+func (c *countingPowUsecase) GenerateCPUBoundChallenge() (*domain.ProofOfWork, error) {
+	c.generated.Add(1)
+	return c.PowUsecase.GenerateCPUBoundChallenge()
+}
+
+func (c *countingPowUsecase) GenerateMemoryBoundChallenge() (*domain.ProofOfWork, error) {
+	c.generated.Add(1)
+	return c.PowUsecase.GenerateMemoryBoundChallenge()
+}
+
+func TestLivenessProbe(t *testing.T) {
+	tests := []struct {
+		name          string
+		probeWindow   time.Duration
+		wantGenerated int32
+	}{
+		{"closed within the probe window", 50 * time.Millisecond, 0},
+		{"closed before the challenge write", 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs lockedBuffer
+			powUsecase := &countingPowUsecase{PowUsecase: usecasestest.PowUsecase{Challenge: []byte("challenge"), Valid: true, Enabled: cpuOnly}}
+			server := newTestServer(&Config{ProbeWindow: tt.probeWindow})
+			server.powUsecase = powUsecase
+			server.logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("unexpected error listening: %v", err)
+			}
+			defer listener.Close()
+
+			// Connect and close right away, like a load balancer probe
+			clientConn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatalf("unexpected error dialing: %v", err)
+			}
+			clientConn.Close()
+			serverConn, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("unexpected error accepting: %v", err)
+			}
+			server.handleConnection(serverConn)
+
+			if generated := powUsecase.generated.Load(); generated != tt.wantGenerated {
+				t.Fatalf("expected %d challenges generated, got %d", tt.wantGenerated, generated)
+			}
+			if !strings.Contains(logs.String(), "liveness probe") || strings.Contains(logs.String(), "level=ERROR") {
+				t.Fatalf("expected the probe logged at debug level only, got logs:\n%s", logs.String())
+			}
+			if state, _ := server.ipTracker.get(remoteIP(serverConn)); state.failures != 0 {
+				t.Fatalf("expected the probe not to count as a failure, got %d", state.failures)
+			}
+		})
+	}
+
+	t.Run("clients are served after the probe window", func(t *testing.T) {
+		server := newTestServer(&Config{ProbeWindow: 10 * time.Millisecond})
+		readChallengeFrame(t, bufio.NewReader(serveTestConn(t, server)))
+	})
+}
+
+// freeAddress returns a loopback address nothing is listening on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestRunReturnsAfterShutdownTimeout(t *testing.T) {
+	address := freeAddress(t)
+	server := newTestServer(&Config{Address: address, Deadline: time.Minute, ShutdownTimeout: 100 * time.Millisecond})
+	hanging := &hangingPowUsecase{release: make(chan struct{})}
+	defer close(hanging.release)
+	server.powUsecase = hanging
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- server.Run(ctx) }()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", address); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer conn.Close()
+
+	for server.activeConns.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrShutdownTimeout) {
+			t.Fatalf("expected ErrShutdownTimeout, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "1 handlers still active") {
+			t.Fatalf("expected the leaked handler count in %q", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after the shutdown timeout")
+	}
+}
+
+func TestMaxConnectionsSendsRetryLater(t *testing.T) {
+	server := newTestServer(&Config{MaxConnections: 1})
+
+	// The first connection holds the only slot while waiting for a solution
+	first := bufio.NewReader(serveTestConn(t, server))
+	readChallengeFrame(t, first)
+
+	frame, err := io.ReadAll(serveTestConn(t, server))
+	if err != nil {
+		t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	if len(frame) != 1 || frame[0] != protocol.FrameRetryLater {
+		t.Fatalf("expected only the retry-later frame, got %x", frame)
+	}
+}
+
+func TestHintAdvertisesLoad(t *testing.T) {
+	tests := []struct {
+		name   string
+		others int64
+		load   int
+	}{
+		{"idle", 0, 10},
+		{"busy", 8, 90},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(&Config{MaxConnections: 10, SendHints: true, AdvertiseLoad: true})
+			// Connections handled besides the test's own
+			server.activeConns.Add(tt.others)
+
+			reader := bufio.NewReader(serveTestConn(t, server))
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(reader, header); err != nil {
+				t.Fatalf("unexpected error reading hint frame: %v", err)
+			}
+			if header[0] != protocol.FrameHint {
+				t.Fatalf("expected a hint frame, got %x", header[0])
+			}
+			text := make([]byte, header[1])
+			if _, err := io.ReadFull(reader, text); err != nil {
+				t.Fatalf("unexpected error reading hint: %v", err)
+			}
+			hint, err := protocol.ParseHint(string(text))
+			if err != nil {
+				t.Fatalf("unexpected error parsing hint %q: %v", text, err)
+			}
+			if hint.Load != tt.load {
+				t.Fatalf("expected load %d, got %d", tt.load, hint.Load)
+			}
+		})
+	}
+}
+
+func TestMaxGoroutinesShedsLoad(t *testing.T) {
+	hanging := &hangingPowUsecase{release: make(chan struct{}), entered: make(chan struct{})}
+	defer close(hanging.release)
+	server := newTestServer(&Config{})
+	server.powUsecase = hanging
+
+	// Handlers stuck in challenge generation pile up goroutines
+	for i := 0; i < 10; i++ {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go server.handleConnection(serverConn)
+		<-hanging.entered
+	}
+	server.cfg.MaxGoroutines = runtime.NumGoroutine() - 5
+
+	frame, err := io.ReadAll(serveTestConn(t, server))
+	if err != nil {
+		t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	if len(frame) != 1 || frame[0] != protocol.FrameRetryLater {
+		t.Fatalf("expected the retry-later frame above MaxGoroutines, got %x", frame)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	const limit = 2
+	server := newTestServer(&Config{MaxConnectionsPerIP: limit})
+
+	// connect opens a connection from ip, returning its client end after
+	// the preamble
+	connect := func(ip string) net.Conn {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() { clientConn.Close() })
+		go server.handleConnection(&remoteAddrConn{
+			Conn:       serverConn,
+			remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 4242},
+		})
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		readPreamble(t, clientConn)
+		return clientConn
+	}
+
+	// Each of these holds a slot while waiting for a solution
+	var held []net.Conn
+	for i := 0; i < limit; i++ {
+		conn := connect("203.0.113.7")
+		readChallengeFrame(t, bufio.NewReader(conn))
+		held = append(held, conn)
+	}
+
+	frame, err := io.ReadAll(connect("203.0.113.7"))
+	if err != nil {
+		t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	if len(frame) != 1 || frame[0] != protocol.FrameRetryLater {
+		t.Fatalf("expected the connection over the limit to get only the retry-later frame, got %x", frame)
+	}
+
+	// Other IPs have slots of their own
+	readChallengeFrame(t, bufio.NewReader(connect("198.51.100.1")))
+
+	// Closing a connection frees its slot once the server is done with it
+	held[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.ipConns.mu.Lock()
+		open := server.ipConns.counts["203.0.113.7"]
+		server.ipConns.mu.Unlock()
+		if open < limit {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the closed connection's slot was not released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	readChallengeFrame(t, bufio.NewReader(connect("203.0.113.7")))
+}
+
+func TestEstimatedCostScalesWithDifficulty(t *testing.T) {
+	for _, challengeType := range []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory} {
+		low := estimatedCost(challengeType, 1)
+		high := estimatedCost(challengeType, 2)
+
+		lowCost := fmt.Sprint(low[len(low)-1])
+		highCost := fmt.Sprint(high[len(high)-1])
+		if lowCost == highCost {
+			t.Fatalf("expected %v cost to grow with difficulty, got %v for both", challengeType, lowCost)
+		}
+	}
+
+	memory := estimatedCost(protocol.ChallengeTypeMemory, 3)
+	if memory[len(memory)-1] != float64(8*argon2.MemoryKiB) {
+		t.Fatalf("expected 8 passes over %d KiB, got %v", argon2.MemoryKiB, memory)
+	}
+}
+
+func TestRepeatedFailuresAreTurnedAway(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	server := newTestServer(&Config{MaxFailures: 2, FailureWindow: time.Minute})
+	server.now = clock.Now
+
+	// In-memory connections all share the same remote address
+	for i := 0; i < 2; i++ {
+		conn := serveTestConn(t, server)
+		reader := bufio.NewReader(conn)
+		readChallengeFrame(t, reader)
+		conn.Write([]byte("GARBAGE\n"))
+		io.ReadAll(reader)
+	}
+
+	frame, err := io.ReadAll(serveTestConn(t, server))
+	if err != nil {
+		t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	if len(frame) != 1 || frame[0] != protocol.FrameRetryLater {
+		t.Fatalf("expected penalized IP to get the retry-later frame, got %x", frame)
+	}
+
+	clock.Advance(time.Minute + time.Second)
+	readChallengeFrame(t, bufio.NewReader(serveTestConn(t, server)))
+}
+
+// failingDeadlineConn fails every SetDeadline call after the first ok ones.
+type failingDeadlineConn struct {
+	net.Conn
+	ok    int
+	calls int
+}
+
+func (c *failingDeadlineConn) SetDeadline(t time.Time) error {
+	c.calls++
+	if c.calls > c.ok {
+		return errors.New("set deadline: broken connection")
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func TestSetDeadlineFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   int
+	}{
+		{"before the challenge", 0},
+		{"mid-session", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+
+			server := newTestServer(&Config{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				server.handleConnection(&failingDeadlineConn{Conn: serverConn, ok: tt.ok})
+			}()
+
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(clientConn)
+			if tt.ok > 0 {
+				readPreamble(t, reader)
+				readChallengeFrame(t, reader)
+			}
+
+			// No error frame is written to a connection whose deadline can't be set
+			rest, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("expected a clean close, got %v", err)
+			}
+			if len(rest) != 0 {
+				t.Fatalf("expected nothing more on the wire, got %q", rest)
+			}
+			<-done
+		})
+	}
+}
+
+// remoteAddrConn overrides the remote address of a connection.
+type remoteAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func TestAllowList(t *testing.T) {
+	server := newTestServer(&Config{AllowList: []AllowListEntry{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+		{Prefix: netip.MustParsePrefix("192.168.1.0/24"), PowUsecase: &usecasestest.PowUsecase{Challenge: []byte("easy"), Valid: true, Enabled: cpuOnly}},
+	}})
+
+	tests := []struct {
+		name      string
+		ip        string
+		challenge string // empty when exempt from proof of work
+	}{
+		{"exempt", "10.1.2.3", ""},
+		{"lower difficulty", "192.168.1.5", "easy"},
+		{"normal", "203.0.113.7", "challenge"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go server.handleConnection(&remoteAddrConn{
+				Conn:       serverConn,
+				remoteAddr: &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 4242},
+			})
+
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(clientConn)
+			readPreamble(t, reader)
+
+			if tt.challenge == "" {
+				frame, err := reader.ReadByte()
+				if err != nil || frame != protocol.FrameObserve {
+					t.Fatalf("expected the no-challenge frame, got %x (%v)", frame, err)
+				}
+			} else {
+				if challenge := readChallengeFrame(t, reader); string(challenge) != tt.challenge {
+					t.Fatalf("expected challenge %q, got %q", tt.challenge, challenge)
+				}
+				if _, err := clientConn.Write([]byte("CPU\n42\n")); err != nil {
+					t.Fatalf("unexpected error writing solution: %v", err)
+				}
+			}
+
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			if line != "SUCCESS:test quote\n" {
+				t.Fatalf("expected the quote, got %q", line)
+			}
+		})
+	}
+}
+
+func TestMinDifficultyClampsAllowList(t *testing.T) {
+	// The allow-listed fake issues challenges of difficulty 1
+	easy := &usecasestest.PowUsecase{Challenge: []byte("easy"), Valid: true, Enabled: []protocol.ChallengeType{protocol.ChallengeTypeCPU}}
+	server := NewServer(&Config{
+		Deadline:         5 * time.Second,
+		MinCPUDifficulty: 3,
+		AllowList:        []AllowListEntry{{Prefix: netip.MustParsePrefix("192.168.1.0/24"), PowUsecase: easy}},
+	}, easy, usecasestest.QuoteUsecase{Quote: "test quote"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.5"), Port: 4242}
+
+	session := &Session{server: server, pow: easy}
+	if _, _, err := session.generateChallenge(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.difficulty != 3 {
+		t.Fatalf("expected the challenge clamped to difficulty 3, got %d", session.difficulty)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.handleConnection(&remoteAddrConn{Conn: serverConn, remoteAddr: remoteAddr})
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(clientConn)
+	readPreamble(t, reader)
+	if challenge := readChallengeFrame(t, reader); string(challenge) == "easy" {
+		t.Fatal("expected a challenge issued at the floor, got the allow-list one")
+	}
+
+	// The fake would accept anything; the floor verifies for real
+	if _, err := clientConn.Write([]byte("CPU\n42\n")); err != nil {
+		t.Fatalf("unexpected error writing solution: %v", err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if !strings.HasPrefix(line, "ERROR:INVALID_SOLUTION:") {
+		t.Fatalf("expected the solution checked at the floor, got %q", line)
+	}
+}
+
+func TestMinDifficultyPerAlgorithm(t *testing.T) {
+	cpu := &usecasestest.PowUsecase{Challenge: []byte("easy"), Valid: true, Enabled: []protocol.ChallengeType{protocol.ChallengeTypeCPU}}
+	// A class offering argon2 only, which the server-wide usecase doesn't
+	memory := &usecasestest.PowUsecase{Challenge: []byte("easy"), Valid: true, Enabled: []protocol.ChallengeType{protocol.ChallengeTypeMemory}}
+	server := NewServer(&Config{
+		Deadline: 5 * time.Second,
+		// A hashcash floor in hex digits argon2 couldn't issue at all
+		MinCPUDifficulty:    6,
+		MinMemoryDifficulty: 2,
+		Classes:             map[string]ClassPolicy{"suspect": {PowUsecase: memory}},
+	}, cpu, usecasestest.QuoteUsecase{Quote: "test quote"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name       string
+		pow        usecases.PowUsecase
+		difficulty uint64
+	}{
+		{"server-wide hashcash", cpu, 6},
+		{"class argon2", memory, 2},
+	}
+	for _, tt := range tests {
+		session := &Session{server: server, pow: tt.pow}
+		challengeType, _, err := session.generateChallenge()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if session.difficulty != tt.difficulty || !slices.Equal(usecases.EnabledAlgorithms(session.pow), []protocol.ChallengeType{challengeType}) {
+			t.Fatalf("%s: expected a %v challenge at the floor of %d, got difficulty %d", tt.name, challengeType, tt.difficulty, session.difficulty)
+		}
+	}
+}
+
+func TestSendChallengeWriteTimeout(t *testing.T) {
+	// Nothing reads the client end, so writes block until the deadline
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	session := &Session{
+		conn:    serverConn,
+		reader:  bufio.NewReader(serverConn),
+		writer:  bufio.NewWriter(serverConn),
+		server:  newTestServer(&Config{}),
+		context: ctx,
+	}
+
+	_, err := session.sendChallenge()
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || !errors.Is(err, ErrWriteTimeout) {
+		t.Fatalf("expected a ServerError wrapping ErrWriteTimeout, got %v", err)
+	}
+
+	// Nothing may still be writing: under -race a leftover writer shows up here
+	if _, err := session.writer.WriteString("after timeout"); err == nil {
+		t.Fatal("expected the failed writer to reject further writes")
+	}
+}
+
+func TestRefreshDeadlineReturnsConnectionClosed(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	session := &Session{
+		conn:    &failingDeadlineConn{Conn: serverConn},
+		server:  newTestServer(&Config{}),
+		context: ctx,
+	}
+	if err := session.refreshDeadline("test"); !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestChallengeLimitPerWindow(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	server := newTestServer(&Config{MaxChallenges: 2, ChallengeWindow: time.Minute})
+	server.now = clock.Now
+
+	for i := 0; i < 2; i++ {
+		readChallengeFrame(t, bufio.NewReader(serveTestConn(t, server)))
+	}
+
+	line, err := bufio.NewReader(serveTestConn(t, server)).ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if !strings.HasPrefix(line, "ERROR:"+ErrRespRateLimited.Code) {
+		t.Fatalf("expected %s error, got %q", ErrRespRateLimited.Code, line)
+	}
+
+	// A new window starts from zero
+	clock.Advance(time.Minute)
+	readChallengeFrame(t, bufio.NewReader(serveTestConn(t, server)))
+}
+
+// flakyListener fails the first failures Accept calls with a temporary
+// error, then hands out the connections sent on conns.
+type flakyListener struct {
+	failures int
+	conns    chan net.Conn
+	closed   chan struct{}
+
+	mu    sync.Mutex
+	calls []time.Time
+}
+
+func newFlakyListener(failures int) *flakyListener {
+	return &flakyListener{failures: failures, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.calls = append(l.calls, time.Now())
+	failing := len(l.calls) <= l.failures
+	l.mu.Unlock()
+
+	if failing {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: errors.New("too many open files")}
+	}
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *flakyListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *flakyListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestServeRecoversFromAcceptErrors(t *testing.T) {
+	const failures = 3
+	server := newTestServer(&Config{})
+	listener := newFlakyListener(failures)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(context.Background(), listener)
+	}()
+
+	// The connection is only accepted once the failures are over
+	clientConn, serverConn := net.Pipe()
+	listener.conns <- serverConn
+	if err := clientConn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("unexpected error setting deadline: %v", err)
+	}
+	reader := bufio.NewReader(clientConn)
+	readPreamble(t, reader)
+	readChallengeFrame(t, reader)
+
+	listener.mu.Lock()
+	calls := append([]time.Time(nil), listener.calls...)
+	listener.mu.Unlock()
+	for i := 1; i <= failures; i++ {
+		if gap := calls[i].Sub(calls[i-1]); gap < minAcceptBackoff {
+			t.Fatalf("expected a backoff of at least %s after failure %d, got %s", minAcceptBackoff, i, gap)
+		}
+	}
+
+	// Serve waits for the connection to be handled before returning
+	clientConn.Close()
+	listener.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("expected serve to stop cleanly, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the listener closed")
+	}
+}
+
+func TestChallengesOnlyOfEnabledAlgorithms(t *testing.T) {
+	for _, algorithm := range []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(1, nil, algorithm)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			server := newTestServer(&Config{})
+			server.powUsecase = powUsecase
+
+			for i := 0; i < 10; i++ {
+				reader := bufio.NewReader(serveTestConn(t, server))
+				typeByte, err := reader.ReadByte()
+				if err != nil {
+					t.Fatalf("unexpected error reading challenge type: %v", err)
+				}
+				if typeByte != algorithm.Byte() {
+					t.Fatalf("expected only %v challenges, got type 0x%02x", algorithm, typeByte)
+				}
+			}
+		})
+	}
+}
+
+// TestCostAwareSelectionShiftsTowardsCPU simulates memory-bound
+// verifications in flight and checks fewer memory-bound challenges are
+// picked the more there are, and none at capacity.
+func TestCostAwareSelectionShiftsTowardsCPU(t *testing.T) {
+	enabled := []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory}
+	server := newTestServer(&Config{CostAwareCapacity: 4})
+
+	memoryShare := func(inflight int64) float64 {
+		server.memoryVerifications.Store(inflight)
+		const picks = 4000
+		var memory int
+		for i := 0; i < picks; i++ {
+			if server.pickChallengeType(enabled) == protocol.ChallengeTypeMemory {
+				memory++
+			}
+		}
+		return float64(memory) / picks
+	}
+
+	idle, half, full := memoryShare(0), memoryShare(2), memoryShare(8)
+	if idle < 0.4 || idle > 0.6 {
+		t.Fatalf("expected about half the challenges memory-bound when idle, got %.2f", idle)
+	}
+	if half < 0.15 || half > 0.35 {
+		t.Fatalf("expected about a quarter memory-bound at half capacity, got %.2f", half)
+	}
+	if full != 0 {
+		t.Fatalf("expected no memory-bound challenges at capacity, got %.2f", full)
+	}
+
+	server.cfg.CostAwareCapacity = 0
+	if uniform := memoryShare(8); uniform < 0.4 || uniform > 0.6 {
+		t.Fatalf("expected a uniform pick without CostAwareCapacity, got %.2f", uniform)
+	}
+}
+
+// closeTrackingConn counts writes attempted after the connection was closed.
+type closeTrackingConn struct {
+	net.Conn
+	closed         atomic.Bool
+	writesAfterEnd atomic.Int32
+}
+
+func (c *closeTrackingConn) Write(p []byte) (int, error) {
+	if c.closed.Load() {
+		c.writesAfterEnd.Add(1)
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *closeTrackingConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
+
+// TestNoWritesOutliveTheSession stops reading at each write of a session so
+// the deadline ends it mid-write. Writes happen on the session goroutine,
+// so nothing may touch the connection once it is closed, and no error
+// response is attempted to a peer that stopped reading; run with -race.
+func TestNoWritesOutliveTheSession(t *testing.T) {
+	tests := []struct {
+		name string
+		// read is how much the client reads before it stops
+		read func(t *testing.T, reader *bufio.Reader, conn net.Conn)
+	}{
+		{"challenge unread", func(t *testing.T, reader *bufio.Reader, conn net.Conn) {}},
+		{"response unread", func(t *testing.T, reader *bufio.Reader, conn net.Conn) {
+			readPreamble(t, reader)
+			readChallengeFrame(t, reader)
+			if _, err := conn.Write([]byte("CPU\n0\n")); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			tracked := &closeTrackingConn{Conn: serverConn}
+
+			server := newTestServer(&Config{Deadline: 100 * time.Millisecond})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				server.handleConnection(tracked)
+			}()
+
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			tt.read(t, bufio.NewReader(clientConn), clientConn)
+
+			select {
+			case <-done:
+			case <-time.After(errorResponseTimeout):
+				t.Fatal("session did not end at its deadline")
+			}
+			if !tracked.closed.Load() {
+				t.Fatal("expected the connection to be closed")
+			}
+			// Give anything still running the chance to write
+			time.Sleep(100 * time.Millisecond)
+			if n := tracked.writesAfterEnd.Load(); n != 0 {
+				t.Fatalf("expected no writes after close, got %d", n)
+			}
+		})
+	}
+}
+
+func TestVersionAdvertisedAfterPreamble(t *testing.T) {
+	server := newTestServer(&Config{Version: "1.2.3"})
+	reader := bufio.NewReader(serveTestConn(t, server))
+
+	frame := make([]byte, 2+len("1.2.3"))
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		t.Fatalf("unexpected error reading version frame: %v", err)
+	}
+	if expected := append([]byte{protocol.FrameVersion, 5}, "1.2.3"...); !bytes.Equal(frame, expected) {
+		t.Fatalf("expected version frame %q, got %q", expected, frame)
+	}
+	readChallengeFrame(t, reader)
+}
+
+func TestParallelAcceptorsShutDownTogether(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	server := newTestServer(&Config{AcceptParallelism: 4})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	var clients sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Errorf("unexpected error dialing: %v", err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			// The preamble and the challenge type byte
+			if _, err := io.ReadFull(conn, make([]byte, len(protocol.Preamble)+1)); err != nil {
+				t.Errorf("unexpected error reading challenge: %v", err)
+			}
+		}()
+	}
+	clients.Wait()
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil && !errors.Is(err, ErrServerShutdown) {
+			t.Fatalf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after its context was cancelled")
+	}
+	if active := server.activeConns.Load(); active != 0 {
+		t.Fatalf("expected every connection handled before Serve returned, %d are active", active)
+	}
+}
+
+// BenchmarkAcceptParallelism accepts connections at as high a rate as the
+// clients can open them; compare a single acceptor with several.
+func BenchmarkAcceptParallelism(b *testing.B) {
+	for _, acceptors := range []int{1, 4} {
+		b.Run(fmt.Sprintf("acceptors=%d", acceptors), func(b *testing.B) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatalf("unexpected error listening: %v", err)
+			}
+			// Observe mode answers right away, so accepting dominates
+			server := newTestServer(&Config{Observe: true, AcceptParallelism: acceptors})
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() { served <- server.Serve(ctx, listener) }()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", listener.Addr().String())
+					if err != nil {
+						b.Errorf("unexpected error dialing: %v", err)
+						return
+					}
+					io.Copy(io.Discard, conn)
+					conn.Close()
+				}
+			})
+			b.StopTimer()
+
+			cancel()
+			<-served
+		})
+	}
+}
+
+func TestServeOnCallerListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	server := newTestServer(&Config{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("unexpected error setting deadline: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	readPreamble(t, reader)
+	readChallengeFrame(t, reader)
+	if _, err := conn.Write([]byte("CPU\n0\n")); err != nil {
+		t.Fatalf("unexpected error writing solution: %v", err)
+	}
+	if line, err := reader.ReadString('\n'); err != nil || line != "SUCCESS:test quote\n" {
+		t.Fatalf("expected the quote, got %q (%v)", line, err)
+	}
+	conn.Close()
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil && !errors.Is(err, ErrServerShutdown) {
+			t.Fatalf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after its context was cancelled")
+	}
+	// Serve closes the listener it was given on shutdown
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the listener to be closed, got %v", err)
+	}
+}
+
+func TestReportedSolveTimeFeedsTuner(t *testing.T) {
+	tests := []struct {
+		name     string
+		typeLine string
+		expected time.Duration
+	}{
+		{"reported", "CPU;250ms", 250 * time.Millisecond},
+		{"reported with a pin", "CPU/1;250ms", 250 * time.Millisecond},
+		{"longer than measured", "CPU;5s", time.Second},
+		{"not reported", "CPU", time.Second},
+		{"malformed", "CPU;soon", time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &testClock{now: time.Now()}
+			server := newTestServer(&Config{AcceptSolveTimes: true})
+			server.now = clock.Now
+			server.tuner = &difficultyTuner{
+				setter:  &recordingSetter{difficulty: 1},
+				target:  time.Second,
+				min:     1,
+				max:     8,
+				samples: 10,
+				logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			frame := make([]byte, 2+len(protocol.CapabilitySolveTime))
+			if _, err := io.ReadFull(reader, frame); err != nil {
+				t.Fatalf("unexpected error reading capabilities frame: %v", err)
+			}
+			if expected := append([]byte{protocol.FrameCapabilities, byte(len(protocol.CapabilitySolveTime))}, protocol.CapabilitySolveTime...); !bytes.Equal(frame, expected) {
+				t.Fatalf("expected capabilities frame %q, got %q", expected, frame)
+			}
+			readChallengeFrame(t, reader)
+
+			// The server measures a second between challenge and solution
+			clock.Advance(time.Second)
+			if _, err := conn.Write([]byte(tt.typeLine + "\n42\n")); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			if line != "SUCCESS:test quote\n" {
+				t.Fatalf("expected the quote, got %q", line)
+			}
+
+			server.tuner.mu.Lock()
+			defer server.tuner.mu.Unlock()
+			if len(server.tuner.window) != 1 || server.tuner.window[0] != tt.expected {
+				t.Fatalf("expected the tuner to record %v, got %v", tt.expected, server.tuner.window)
+			}
+		})
+	}
+}
+
+func TestServerStartStopLeavesNoGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		server := newTestServer(&Config{EchoChallenge: true, ChallengeSecret: []byte("secret"), PoolBuffers: true})
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(ctx, listener) }()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error dialing: %v", err)
+		}
+		reader := bufio.NewReader(conn)
+		readPreamble(t, reader)
+		readTokenFrame(t, reader)
+		conn.Close()
+
+		cancel()
+		if err := <-served; err != nil {
+			t.Fatalf("unexpected error serving: %v", err)
+		}
+		if err := server.Close(); err != nil {
+			t.Fatalf("unexpected error closing: %v", err)
+		}
+		if n := server.ipTracker.len(); n != 0 {
+			t.Fatalf("expected the IP tracker to be emptied, got %d entries", n)
+		}
+		if n := len(server.cfg.ChallengeStore.(*memoryChallengeStore).expires); n != 0 {
+			t.Fatalf("expected the challenge store to be emptied, got %d challenges", n)
+		}
+	}
+
+	// Goroutines of closed connections may take a moment to exit
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Fatalf("expected at most %d goroutines after stopping every server, got %d", baseline, n)
+	}
+}
+
+func TestCloseWaitsForAbandonedVerifications(t *testing.T) {
+	server := newTestServer(&Config{})
+	release := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := server.verifiers.run(ctx, &server.verifications, func() (bool, error) {
+		<-release
+		return true, nil
+	}); !errors.Is(err, ErrVerificationTimeout) {
+		t.Fatalf("expected the verification to be abandoned, got %v", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- server.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("expected Close to wait for the verification, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+}
+
+func TestSessionsNeedASecret(t *testing.T) {
+	cfg := &Config{SessionTTL: time.Minute, EchoChallenge: true}
+	server := newTestServer(cfg)
+	if len(server.secrets.Load().current) == 0 || !slices.Contains(server.capabilities(), protocol.CapabilitySession) {
+		t.Fatal("expected sessions under a random secret")
+	}
+	// The caller's config is left as it was
+	if cfg.ChallengeSecret != nil || cfg.ChallengeStore != nil {
+		t.Fatalf("expected the caller's config untouched, got %+v", cfg)
+	}
+
+	secretRandom = iotest.ErrReader(errors.New("no entropy"))
+	t.Cleanup(func() { secretRandom = rand.Reader })
+	server = newTestServer(&Config{SessionTTL: time.Minute})
+	if len(server.secrets.Load().current) != 0 {
+		t.Fatal("expected no secret without entropy")
+	}
+	// Tokens tagged with no secret could be forged, so none are granted
+	if slices.Contains(server.capabilities(), protocol.CapabilitySession) || server.cfg.SessionTTL != 0 {
+		t.Fatal("expected sessions disabled without a secret")
+	}
+}
@@ -0,0 +1,126 @@
+package tcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	"faraway/pkg/protocol"
+)
+
+// A session token lets a client that solved a challenge skip solving until
+// it expires:
+//
+//	expiry (8 bytes, unix nanoseconds) | HMAC-SHA256
+//
+// It is tagged with the challenge secrets, under a label of its own so it
+// can't pass for a challenge token or the other way round, and with the
+// same binding as challenge tokens.
+const (
+	sessionTokenLength = 8 + tokenMACLength
+	sessionTokenLabel  = "faraway session token"
+)
+
+// signSessionToken returns a session token tagged with secret and binding,
+// which may be empty.
+func signSessionToken(secret, binding []byte, expiry time.Time) []byte {
+	token := binary.BigEndian.AppendUint64(make([]byte, 0, sessionTokenLength), uint64(expiry.UnixNano()))
+	return sessionTag(secret, binding, token).Sum(token)
+}
+
+// verifySessionToken checks the token's tag against binding and either
+// secret, and that it hasn't expired at now.
+func verifySessionToken(secrets challengeSecrets, binding, token []byte, now time.Time) error {
+	if len(token) != sessionTokenLength {
+		return NewConnectionError("verifySessionToken", ErrSessionInvalid, "token has the wrong length")
+	}
+
+	signed, tag := token[:8], token[8:]
+	tagged := func(secret []byte) bool {
+		return hmac.Equal(tag, sessionTag(secret, binding, signed).Sum(nil))
+	}
+	if !tagged(secrets.current) && (secrets.previous == nil || !tagged(secrets.previous)) {
+		return NewConnectionError("verifySessionToken", ErrSessionInvalid, "tag mismatch")
+	}
+
+	expiry := time.Unix(0, int64(binary.BigEndian.Uint64(signed)))
+	if now.After(expiry) {
+		return NewConnectionError("verifySessionToken", ErrSessionInvalid, "token expired")
+	}
+	return nil
+}
+
+// sessionTag returns the MAC of a session token, with signed written.
+func sessionTag(secret, binding, signed []byte) hash.Hash {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sessionTokenLabel))
+	mac.Write(signed)
+	mac.Write(binding)
+	return mac
+}
+
+// secretRandom is where random session secrets are read from.
+var secretRandom io.Reader = rand.Reader
+
+// randomSecret returns a secret for session tokens when no challenge
+// secret was configured. Tokens then only verify on this instance.
+func randomSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(secretRandom, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// capabilities lists the capabilities advertised to clients.
+func (s *Server) capabilities() []string {
+	var capabilities []string
+	if s.cfg.AcceptSolveTimes {
+		capabilities = append(capabilities, protocol.CapabilitySolveTime)
+	}
+	if s.cfg.SessionTTL > 0 {
+		capabilities = append(capabilities, protocol.CapabilitySession)
+	}
+	if s.cfg.EmbedDifficulty {
+		capabilities = append(capabilities, protocol.CapabilityDifficulty)
+	}
+	return capabilities
+}
+
+// redeemSession answers a client that presented a session token, base64
+// encoded in encoded, in place of a solution. The token alone is verified:
+// a challenge echoed ahead of it is ignored, and not consumed.
+func (s *Session) redeemSession(encoded []byte) error {
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return NewConnectionError("redeemSession", ErrSessionInvalid, "session token is not base64")
+	}
+	if err := verifySessionToken(*s.server.secrets.Load(), s.certBinding, token, s.server.now()); err != nil {
+		return err
+	}
+	return s.respondWithQuote()
+}
+
+// grantSession sends a client that solved its challenge a session token
+// when SessionTTL is set. The quote was already delivered, so failing to
+// is only logged.
+func (s *Session) grantSession() {
+	ttl := s.server.cfg.SessionTTL
+	if ttl <= 0 {
+		return
+	}
+	token := signSessionToken(s.server.secrets.Load().current, s.certBinding, s.server.now().Add(ttl))
+	_, err := s.writer.WriteString(protocol.FormatSessionGrant(token, ttl))
+	if err == nil {
+		err = s.writer.Flush()
+	}
+	if err != nil {
+		s.server.logger.Debug("session grant delivery failed", "error", err)
+	}
+}
@@ -0,0 +1,157 @@
+package tcp
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ChallengeStore remembers issued challenges so that each can be redeemed
+// once. Echoed challenge tokens are otherwise valid until they expire, so
+// a solved token could be replayed; instances sharing a store, and the
+// challenge secret, also share that guarantee.
+type ChallengeStore interface {
+	// Issue records challenge as redeemable for ttl.
+	Issue(ctx context.Context, challenge []byte, ttl time.Duration) error
+	// Consume redeems challenge, reporting false if it wasn't issued, has
+	// expired or was already redeemed.
+	Consume(ctx context.Context, challenge []byte) (bool, error)
+}
+
+// challengeKey is the fixed-size key a challenge is stored under.
+func challengeKey(challenge []byte) string {
+	sum := sha256.Sum256(challenge)
+	return hex.EncodeToString(sum[:])
+}
+
+type statelessChallengeStore struct{}
+
+// NewStatelessChallengeStore returns a ChallengeStore that keeps no state
+// and redeems every challenge, any number of times. Replay is then only
+// bounded by expiry and epochs, see Config.EpochLength.
+func NewStatelessChallengeStore() ChallengeStore {
+	return statelessChallengeStore{}
+}
+
+func (statelessChallengeStore) Issue(context.Context, []byte, time.Duration) error { return nil }
+
+func (statelessChallengeStore) Consume(context.Context, []byte) (bool, error) { return true, nil }
+
+type memoryChallengeStore struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+	// queue orders issued challenges by expiry, so each Issue drops only
+	// those that expired instead of going over every challenge.
+	queue expiryQueue
+}
+
+// NewMemoryChallengeStore returns a ChallengeStore for a single instance.
+func NewMemoryChallengeStore() ChallengeStore {
+	return &memoryChallengeStore{
+		now:     time.Now,
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (s *memoryChallengeStore) Issue(_ context.Context, challenge []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	// Challenges that were never redeemed are dropped here. Redeemed ones
+	// leave their entry in the queue until it expires.
+	for len(s.queue) > 0 && !now.Before(s.queue[0].expiry) {
+		entry := heap.Pop(&s.queue).(expiryEntry)
+		if expiry, ok := s.expires[entry.key]; ok && expiry.Equal(entry.expiry) {
+			delete(s.expires, entry.key)
+		}
+	}
+	key := challengeKey(challenge)
+	s.expires[key] = now.Add(ttl)
+	heap.Push(&s.queue, expiryEntry{key: key, expiry: now.Add(ttl)})
+	return nil
+}
+
+// reset forgets every issued challenge.
+func (s *memoryChallengeStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.expires)
+	s.queue = nil
+}
+
+type expiryEntry struct {
+	key    string
+	expiry time.Time
+}
+
+// expiryQueue is a heap.Interface of challenges, soonest to expire first.
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].expiry.Before(q[j].expiry) }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *expiryQueue) Push(x any) { *q = append(*q, x.(expiryEntry)) }
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+func (s *memoryChallengeStore) Consume(_ context.Context, challenge []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := challengeKey(challenge)
+	expiry, ok := s.expires[key]
+	if !ok {
+		return false, nil
+	}
+	delete(s.expires, key)
+	return s.now().Before(expiry), nil
+}
+
+type redisChallengeStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisChallengeStore returns a ChallengeStore shared by every instance
+// using the same Redis server. Keys are prefixed with prefix and expire in
+// Redis, so nothing needs cleaning up. Handshakes share the client's
+// connection pool.
+func NewRedisChallengeStore(client *redis.Client, prefix string) ChallengeStore {
+	return &redisChallengeStore{client: client, prefix: prefix}
+}
+
+// Close closes the Redis client.
+func (s *redisChallengeStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisChallengeStore) Issue(ctx context.Context, challenge []byte, ttl time.Duration) error {
+	if err := s.client.SetNX(ctx, s.prefix+challengeKey(challenge), 1, max(ttl, time.Millisecond)).Err(); err != nil {
+		return fmt.Errorf("failed to issue challenge: %w", err)
+	}
+	return nil
+}
+
+func (s *redisChallengeStore) Consume(ctx context.Context, challenge []byte) (bool, error) {
+	// DEL is atomic, so only one instance sees the key go away
+	deleted, err := s.client.Del(ctx, s.prefix+challengeKey(challenge)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to consume challenge: %w", err)
+	}
+	return deleted == 1, nil
+}
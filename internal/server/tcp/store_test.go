@@ -0,0 +1,110 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMemoryChallengeStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	store := NewMemoryChallengeStore().(*memoryChallengeStore)
+	store.now = func() time.Time { return now }
+
+	if ok, _ := store.Consume(ctx, []byte("unknown")); ok {
+		t.Fatal("expected a challenge never issued to be rejected")
+	}
+
+	store.Issue(ctx, []byte("once"), time.Minute)
+	if ok, _ := store.Consume(ctx, []byte("once")); !ok {
+		t.Fatal("expected an issued challenge to be redeemable")
+	}
+	if ok, _ := store.Consume(ctx, []byte("once")); ok {
+		t.Fatal("expected a challenge to be redeemable only once")
+	}
+
+	store.Issue(ctx, []byte("late"), time.Minute)
+	now = now.Add(time.Minute)
+	if ok, _ := store.Consume(ctx, []byte("late")); ok {
+		t.Fatal("expected an expired challenge to be rejected")
+	}
+
+	store.Issue(ctx, []byte("abandoned"), time.Second)
+	now = now.Add(time.Second)
+	store.Issue(ctx, []byte("next"), time.Second)
+	if len(store.expires) != 1 || len(store.queue) != 1 {
+		t.Fatalf("expected expired challenges to be dropped, %d left (%d queued)", len(store.expires), len(store.queue))
+	}
+
+	// Reissuing a challenge outlives the expiry it was first issued with
+	store.Issue(ctx, []byte("reissued"), time.Second)
+	store.Issue(ctx, []byte("reissued"), time.Minute)
+	now = now.Add(time.Second)
+	store.Issue(ctx, []byte("other"), time.Minute)
+	if ok, _ := store.Consume(ctx, []byte("reissued")); !ok {
+		t.Fatal("expected a reissued challenge to be redeemable until its last expiry")
+	}
+}
+
+func TestRedisChallengeStoreAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	newInstance := func() ChallengeStore {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewRedisChallengeStore(client, "challenge:")
+	}
+	first, second := newInstance(), newInstance()
+
+	if err := first.Issue(ctx, []byte("shared"), time.Minute); err != nil {
+		t.Fatalf("unexpected error issuing: %v", err)
+	}
+	if ok, err := second.Consume(ctx, []byte("shared")); err != nil || !ok {
+		t.Fatalf("expected the other instance to redeem the challenge, got %v, %v", ok, err)
+	}
+	if ok, _ := first.Consume(ctx, []byte("shared")); ok {
+		t.Fatal("expected the challenge to be redeemable once across instances")
+	}
+
+	if err := first.Issue(ctx, []byte("late"), time.Minute); err != nil {
+		t.Fatalf("unexpected error issuing: %v", err)
+	}
+	server.FastForward(time.Minute)
+	if ok, _ := second.Consume(ctx, []byte("late")); ok {
+		t.Fatal("expected an expired challenge to be rejected")
+	}
+}
+
+func TestReplayedEchoedChallenge(t *testing.T) {
+	server := newTestServer(&Config{EchoChallenge: true, ChallengeSecret: []byte("secret")})
+
+	conn := serveTestConn(t, server)
+	reader := bufio.NewReader(conn)
+	challengeType, token := readTokenFrame(t, reader)
+	echo := base64.StdEncoding.EncodeToString(token) + "\n" + challengeType.String() + "\n42\n"
+
+	for _, expected := range []string{"SUCCESS:", "ERROR:" + ErrRespChallengeUsed.Code} {
+		if _, err := conn.Write([]byte(echo)); err != nil {
+			t.Fatalf("unexpected error writing solution: %v", err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected error reading response: %v", err)
+		}
+		if !strings.HasPrefix(line, expected) {
+			t.Fatalf("expected response starting with %q, got %q", expected, line)
+		}
+
+		// Replay the same solution on a new connection
+		conn = serveTestConn(t, server)
+		reader = bufio.NewReader(conn)
+		readTokenFrame(t, reader)
+	}
+}
@@ -0,0 +1,139 @@
+package tcp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"faraway/pkg/protocol"
+)
+
+// A challenge token carries everything needed to verify a solution without
+// per-connection state:
+//
+//	challenge | type (1 byte) | expiry (8 bytes, unix nanoseconds) | epoch (8 bytes) | HMAC-SHA256
+//
+// The whole token is what the client solves, so the type, expiry and epoch
+// are bound into the proof of work as well as the tag. The tag may also cover a
+// binding that isn't sent, such as the fingerprint of the client's TLS
+// certificate: the token then only verifies for that client.
+const (
+	tokenTrailerLength = 1 + 8 + 8
+	tokenMACLength     = sha256.Size
+)
+
+// signChallengeToken wraps challenge into a token tagged with secret and
+// binding, which may be empty, issued in epoch.
+func signChallengeToken(secret, binding []byte, challengeType protocol.ChallengeType, challenge []byte, expiry time.Time, epoch uint64) []byte {
+	token := make([]byte, 0, len(challenge)+tokenTrailerLength+tokenMACLength)
+	token = append(token, challenge...)
+	token = append(token, challengeType.Byte())
+	token = binary.BigEndian.AppendUint64(token, uint64(expiry.UnixNano()))
+	token = binary.BigEndian.AppendUint64(token, epoch)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(token)
+	mac.Write(binding)
+	return mac.Sum(token)
+}
+
+// challengeSecrets are the secrets challenge tokens are tagged with: new
+// tokens with current, while tokens tagged with previous before the last
+// rotation keep verifying until they expire. previous is nil before the
+// first rotation.
+type challengeSecrets struct {
+	current, previous []byte
+}
+
+// verifyChallengeToken checks the token's tag against binding and either
+// secret, that it was issued for challengeType, that it hasn't expired at
+// now and that it was issued no earlier than oldestEpoch.
+func verifyChallengeToken(secrets challengeSecrets, binding, token []byte, challengeType protocol.ChallengeType, now time.Time, oldestEpoch uint64) error {
+	if len(token) <= tokenTrailerLength+tokenMACLength {
+		return NewConnectionError("verifyChallengeToken", ErrChallengeForged, "token too short")
+	}
+
+	signed, tag := token[:len(token)-tokenMACLength], token[len(token)-tokenMACLength:]
+	if !tokenTagged(secrets.current, binding, signed, tag) && (secrets.previous == nil || !tokenTagged(secrets.previous, binding, signed, tag)) {
+		return NewConnectionError("verifyChallengeToken", ErrChallengeForged, "tag mismatch")
+	}
+
+	trailer := signed[len(signed)-tokenTrailerLength:]
+	if trailer[0] != challengeType.Byte() {
+		return NewConnectionError("verifyChallengeToken", ErrChallengeForged, "token issued for another challenge type")
+	}
+	expiry := time.Unix(0, int64(binary.BigEndian.Uint64(trailer[1:9])))
+	if now.After(expiry) {
+		return NewConnectionError("verifyChallengeToken", ErrChallengeExpired, "token expired")
+	}
+	if epoch := binary.BigEndian.Uint64(trailer[9:]); epoch < oldestEpoch {
+		return NewConnectionError("verifyChallengeToken", ErrChallengeExpired,
+			fmt.Sprintf("token issued in epoch %d, the oldest accepted is %d", epoch, oldestEpoch))
+	}
+	return nil
+}
+
+// epochAt returns the challenge epoch at now, counted in EpochLength
+// periods since the Unix epoch so instances sharing a secret agree on it.
+// It is always zero when EpochLength isn't set.
+func (s *Server) epochAt(now time.Time) uint64 {
+	if s.cfg.EpochLength <= 0 {
+		return 0
+	}
+	return uint64(now.UnixNano() / int64(s.cfg.EpochLength))
+}
+
+// oldestEpoch returns the oldest epoch tokens are accepted from at now:
+// the current one and the EpochWindow before it.
+func (s *Server) oldestEpoch(now time.Time) uint64 {
+	epoch := s.epochAt(now)
+	if epoch < s.cfg.EpochWindow {
+		return 0
+	}
+	return epoch - s.cfg.EpochWindow
+}
+
+// tokenTagged reports whether tag is the tag of signed and binding under
+// secret.
+func tokenTagged(secret, binding, signed, tag []byte) bool {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	mac.Write(binding)
+	return hmac.Equal(tag, mac.Sum(nil))
+}
+
+// RotateChallengeSecret makes secret the one new challenge tokens are
+// tagged with. Tokens tagged with the secret it replaces keep verifying
+// until they expire, but those of the one before are rejected, so
+// rotations should be at least a challenge TTL apart.
+func (s *Server) RotateChallengeSecret(secret []byte) {
+	for {
+		secrets := s.secrets.Load()
+		if s.secrets.CompareAndSwap(secrets, &challengeSecrets{current: secret, previous: secrets.current}) {
+			return
+		}
+	}
+}
+
+// clientCertBinding completes the TLS handshake on conn and returns the
+// SHA-256 fingerprint of the client's certificate.
+func clientCertBinding(ctx context.Context, conn net.Conn) ([]byte, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, NewConnectionError("clientCertBinding", ErrClientCertRequired, "connection is not TLS")
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, NewConnectionError("clientCertBinding", ErrClientCertRequired, fmt.Sprintf("handshake failed: %v", err))
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil, NewConnectionError("clientCertBinding", ErrClientCertRequired, "no client certificate")
+	}
+	fingerprint := sha256.Sum256(certificates[0].Raw)
+	return fingerprint[:], nil
+}
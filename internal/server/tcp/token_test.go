@@ -0,0 +1,301 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"faraway/pkg/protocol"
+)
+
+func TestChallengeToken(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	token := signChallengeToken(secret, nil, protocol.ChallengeTypeCPU, []byte("challenge"), now.Add(time.Minute), 0)
+
+	tampered := append([]byte(nil), token...)
+	tampered[0] ^= 0xFF
+
+	tests := []struct {
+		name          string
+		secret        []byte
+		token         []byte
+		challengeType protocol.ChallengeType
+		now           time.Time
+		expected      error
+	}{
+		{"valid", secret, token, protocol.ChallengeTypeCPU, now, nil},
+		{"tampered", secret, tampered, protocol.ChallengeTypeCPU, now, ErrChallengeForged},
+		{"other secret", []byte("other"), token, protocol.ChallengeTypeCPU, now, ErrChallengeForged},
+		{"other type", secret, token, protocol.ChallengeTypeMemory, now, ErrChallengeForged},
+		{"truncated", secret, token[:tokenMACLength], protocol.ChallengeTypeCPU, now, ErrChallengeForged},
+		{"expired", secret, token, protocol.ChallengeTypeCPU, now.Add(2 * time.Minute), ErrChallengeExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyChallengeToken(challengeSecrets{current: tt.secret}, nil, tt.token, tt.challengeType, tt.now, 0)
+			if tt.expected == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+// readTokenFrame reads a challenge frame and returns its type and token.
+func readTokenFrame(t *testing.T, reader *bufio.Reader) (protocol.ChallengeType, []byte) {
+	t.Helper()
+
+	typeByte, err := reader.ReadByte()
+	if err != nil {
+		t.Fatalf("unexpected error reading challenge type: %v", err)
+	}
+	challengeType, err := protocol.ChallengeTypeFromByte(typeByte)
+	if err != nil {
+		t.Fatalf("unexpected challenge type: %v", err)
+	}
+	var length int32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		t.Fatalf("unexpected error reading challenge length: %v", err)
+	}
+	token := make([]byte, length)
+	if _, err := io.ReadFull(reader, token); err != nil {
+		t.Fatalf("unexpected error reading challenge data: %v", err)
+	}
+	return challengeType, token
+}
+
+func TestEchoedChallengeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(token []byte)
+		expected string
+	}{
+		{"echoed token", func([]byte) {}, "SUCCESS:test quote\n"},
+		{"tampered token", func(token []byte) { token[0] ^= 0xFF }, "ERROR:" + ErrRespInvalidChallenge.Code},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(&Config{EchoChallenge: true, ChallengeSecret: []byte("secret")})
+
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			challengeType, token := readTokenFrame(t, reader)
+			if len(token) <= len("challenge") {
+				t.Fatalf("expected a tagged token, got %q", token)
+			}
+
+			tt.tamper(token)
+			echo := base64.StdEncoding.EncodeToString(token) + "\n" + challengeType.String() + "\n42\n"
+			if _, err := conn.Write([]byte(echo)); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			if !strings.HasPrefix(line, tt.expected) {
+				t.Fatalf("expected response starting with %q, got %q", tt.expected, line)
+			}
+		})
+	}
+}
+
+func TestRotatedSecretVerifiesUntilExpiry(t *testing.T) {
+	tests := []struct {
+		name      string
+		rotations int
+		advance   time.Duration
+		expected  string
+	}{
+		{"rotated once", 1, 0, "SUCCESS:test quote\n"},
+		{"rotated once, expired", 1, 2 * time.Minute, "ERROR:" + ErrRespChallengeExpired.Code},
+		{"rotated twice", 2, 0, "ERROR:" + ErrRespInvalidChallenge.Code},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &testClock{now: time.Now()}
+			server := newTestServer(&Config{EchoChallenge: true, ChallengeSecret: []byte("secret"), ChallengeTTL: time.Minute})
+			server.now = clock.Now
+
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			challengeType, token := readTokenFrame(t, reader)
+
+			for i := 0; i < tt.rotations; i++ {
+				server.RotateChallengeSecret([]byte(fmt.Sprintf("secret-%d", i)))
+			}
+			clock.Advance(tt.advance)
+
+			echo := base64.StdEncoding.EncodeToString(token) + "\n" + challengeType.String() + "\n42\n"
+			if _, err := conn.Write([]byte(echo)); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			if !strings.HasPrefix(line, tt.expected) {
+				t.Fatalf("expected response starting with %q, got %q", tt.expected, line)
+			}
+		})
+	}
+}
+
+func TestStaleEpochIsRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		advance  time.Duration
+		expected string
+	}{
+		{"current epoch", 0, "SUCCESS:test quote\n"},
+		{"within the window", 2*time.Second + 500*time.Millisecond, "SUCCESS:test quote\n"},
+		{"past the window", 3 * time.Second, "ERROR:" + ErrRespChallengeExpired.Code},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Issued at the start of an epoch, accepted for two more
+			clock := &testClock{now: time.Unix(1_000_000, 0)}
+			server := newTestServer(&Config{
+				EchoChallenge:   true,
+				ChallengeSecret: []byte("secret"),
+				ChallengeTTL:    time.Hour,
+				ChallengeStore:  NewStatelessChallengeStore(),
+				EpochLength:     time.Second,
+				EpochWindow:     2,
+			})
+			server.now = clock.Now
+
+			conn := serveTestConn(t, server)
+			reader := bufio.NewReader(conn)
+			challengeType, token := readTokenFrame(t, reader)
+			clock.Advance(tt.advance)
+
+			echo := base64.StdEncoding.EncodeToString(token) + "\n" + challengeType.String() + "\n42\n"
+			if _, err := conn.Write([]byte(echo)); err != nil {
+				t.Fatalf("unexpected error writing solution: %v", err)
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error reading response: %v", err)
+			}
+			if !strings.HasPrefix(line, tt.expected) {
+				t.Fatalf("expected response starting with %q, got %q", tt.expected, line)
+			}
+		})
+	}
+}
+
+// newTestCertificate issues a certificate for name, signed by parent or
+// self-signed when parent is nil.
+func newTestCertificate(t *testing.T, name string, parent *tls.Certificate, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	issuer, signer := template, any(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestBoundChallengeCannotBeRelayed(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil, &x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign})
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := newTestCertificate(t, "server", &ca, &x509.Certificate{DNSNames: []string{"server"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+
+	server := newTestServer(&Config{EchoChallenge: true, ChallengeSecret: []byte("secret"), BindClientCert: true})
+
+	// connect opens a TLS connection as the client holding a certificate
+	// for name, returning it ready to read the first challenge frame
+	connect := func(name string) (net.Conn, *bufio.Reader) {
+		clientCert := newTestCertificate(t, name, &ca, &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		clientConn, serverConn := net.Pipe()
+		go server.handleConnection(tls.Server(serverConn, serverTLS))
+		conn := tls.Client(newSocketConn(clientConn, nil), &tls.Config{ServerName: "server", RootCAs: pool, Certificates: []tls.Certificate{clientCert}})
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		reader := bufio.NewReader(conn)
+		readPreamble(t, reader)
+		return conn, reader
+	}
+	submit := func(conn net.Conn, reader *bufio.Reader, challengeType protocol.ChallengeType, token []byte) string {
+		echo := base64.StdEncoding.EncodeToString(token) + "\n" + challengeType.String() + "\n42\n"
+		if _, err := conn.Write([]byte(echo)); err != nil {
+			t.Fatalf("unexpected error writing solution: %v", err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected error reading response: %v", err)
+		}
+		return line
+	}
+
+	connA, readerA := connect("client A")
+	challengeType, token := readTokenFrame(t, readerA)
+
+	// Client B relays the token A solved instead of its own
+	connB, readerB := connect("client B")
+	readTokenFrame(t, readerB)
+	if line := submit(connB, readerB, challengeType, token); !strings.HasPrefix(line, "ERROR:"+ErrRespInvalidChallenge.Code) {
+		t.Fatalf("expected the relayed solution to be rejected, got %q", line)
+	}
+
+	// It stays valid for the client it was issued to
+	if line := submit(connA, readerA, challengeType, token); line != "SUCCESS:test quote\n" {
+		t.Fatalf("expected client A's own solution to be accepted, got %q", line)
+	}
+}
+
+func TestBoundChallengeRequiresClientCertificate(t *testing.T) {
+	server := newTestServer(&Config{EchoChallenge: true, ChallengeSecret: []byte("secret"), BindClientCert: true})
+
+	// A plain connection carries no certificate, so it is closed unanswered
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.handleConnection(serverConn)
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %d bytes (%v)", n, err)
+	}
+}
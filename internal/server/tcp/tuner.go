@@ -0,0 +1,192 @@
+package tcp
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"faraway/internal/usecases"
+	"faraway/pkg/protocol"
+)
+
+// difficultyTuner keeps the median solve time of successful handshakes
+// near a target by nudging the difficulty one step at a time. Solve times
+// are measured by the server, from sending the challenge to receiving the
+// solution, so they include the network round trip.
+//
+// To damp oscillation it only acts on a full window of samples taken at
+// the current difficulty, leaves the difficulty alone while the median is
+// within a factor of two of the target, and starts a fresh window after
+// every change.
+//
+// Once at the max difficulty with the median still under half the target,
+// it can't raise the difficulty any further: the defense is saturated
+// until a window's median is no longer that fast.
+type difficultyTuner struct {
+	setter  usecases.DifficultySetter
+	target  time.Duration
+	min     uint64
+	max     uint64
+	samples int
+	logger  Logger
+
+	mu         sync.Mutex
+	difficulty uint64 // zero until the first sample
+	window     []time.Duration
+
+	saturated atomic.Bool
+}
+
+// newDifficultyTuner returns nil, meaning the difficulty is fixed, unless a
+// target is configured, not per client, and the usecase supports changing
+// difficulty.
+func newDifficultyTuner(cfg *Config, powUsecase usecases.PowUsecase, logger Logger) *difficultyTuner {
+	setter, ok := powUsecase.(usecases.DifficultySetter)
+	if cfg.AutoDifficultyTarget <= 0 || cfg.PerClientDifficulty || !ok {
+		return nil
+	}
+	low, high := tuningRange(cfg, powUsecase)
+	return &difficultyTuner{
+		setter:  setter,
+		target:  cfg.AutoDifficultyTarget,
+		min:     low,
+		max:     high,
+		samples: max(cfg.AutoDifficultySamples, 1),
+		logger:  logger,
+	}
+}
+
+// tuningRange returns the difficulties tuning powUsecase stays within.
+// Tuning below the floor would only get challenges raised to it, and past
+// the ceiling of one of its algorithms would fail to set: hashcash counts
+// hex digits and argon2 bits, so the same number is a very different cost.
+func tuningRange(cfg *Config, powUsecase usecases.PowUsecase) (low, high uint64) {
+	ceiling := usecases.MaxDifficulty(powUsecase)
+	low = max(cfg.AutoDifficultyMin, 1)
+	for _, algorithm := range usecases.EnabledAlgorithms(powUsecase) {
+		low = max(low, cfg.minDifficulty(algorithm))
+	}
+	low = min(low, ceiling)
+	high = min(max(cfg.AutoDifficultyMax, low), ceiling)
+	return low, high
+}
+
+// observe records how long a challenge of the given difficulty took to
+// solve. Samples taken at another difficulty than the current one, i.e.
+// from challenges issued before the last change, are ignored.
+func (t *difficultyTuner) observe(solveTime time.Duration, difficulty uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.difficulty == 0 {
+		t.difficulty = difficulty
+	}
+	if difficulty != t.difficulty {
+		return
+	}
+	t.window = append(t.window, solveTime)
+	if len(t.window) < t.samples {
+		return
+	}
+
+	median := medianDuration(t.window)
+	t.window = t.window[:0]
+	t.setSaturated(median < t.target/2 && t.difficulty >= t.max, median)
+
+	next := t.difficulty
+	switch {
+	case median < t.target/2 && next < t.max:
+		next++
+	case median > t.target*2 && next > t.min:
+		next--
+	}
+	if next == t.difficulty {
+		return
+	}
+	if err := t.setter.SetDifficulty(next); err != nil {
+		t.logger.Error("failed to adjust difficulty", "difficulty", next, "error", err)
+		return
+	}
+	t.logger.Info("difficulty adjusted", "from", t.difficulty, "to", next, "median_solve_time", median, "target", t.target)
+	t.difficulty = next
+}
+
+// setSaturated records whether the defense is saturated, logging when
+// that changes.
+func (t *difficultyTuner) setSaturated(saturated bool, median time.Duration) {
+	if t.saturated.Swap(saturated) == saturated {
+		return
+	}
+	if saturated {
+		t.logger.Error("defense saturated, difficulty at its ceiling", "difficulty", t.difficulty, "median_solve_time", median, "target", t.target)
+	} else {
+		t.logger.Info("defense no longer saturated", "difficulty", t.difficulty, "median_solve_time", median, "target", t.target)
+	}
+}
+
+func medianDuration(samples []time.Duration) time.Duration {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// clientTuner keeps each client's solve time near the target on its own:
+// a client solving in under half the target is challenged a step harder
+// next time, one taking over twice the target a step easier. A client is
+// its connection, which keeps the difficulty in its session across the
+// handshakes it carries.
+type clientTuner struct {
+	target     time.Duration
+	min        uint64
+	max        uint64
+	algorithms []protocol.ChallengeType
+
+	mu       sync.Mutex
+	usecases map[uint64]usecases.PowUsecase
+}
+
+// newClientTuner returns nil, meaning difficulty isn't tuned per client,
+// unless PerClientDifficulty is set along with a target.
+func newClientTuner(cfg *Config, powUsecase usecases.PowUsecase) *clientTuner {
+	if !cfg.PerClientDifficulty || cfg.AutoDifficultyTarget <= 0 {
+		return nil
+	}
+	low, high := tuningRange(cfg, powUsecase)
+	return &clientTuner{
+		target:     cfg.AutoDifficultyTarget,
+		min:        low,
+		max:        high,
+		algorithms: usecases.EnabledAlgorithms(powUsecase),
+		usecases:   make(map[uint64]usecases.PowUsecase),
+	}
+}
+
+// next returns the difficulty of a client's next challenge, after it took
+// solveTime to solve one of the given difficulty.
+func (t *clientTuner) next(solveTime time.Duration, difficulty uint64) uint64 {
+	switch {
+	case solveTime < t.target/2:
+		difficulty++
+	case solveTime > t.target*2:
+		difficulty--
+	}
+	return min(max(difficulty, t.min), t.max)
+}
+
+// usecase returns the PowUsecase issuing challenges at difficulty, shared
+// by every client tuned to it.
+func (t *clientTuner) usecase(difficulty uint64) (usecases.PowUsecase, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if powUsecase, ok := t.usecases[difficulty]; ok {
+		return powUsecase, nil
+	}
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(difficulty, nil, t.algorithms...)
+	if err != nil {
+		return nil, err
+	}
+	t.usecases[difficulty] = powUsecase
+	return powUsecase, nil
+}
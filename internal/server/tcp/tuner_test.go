@@ -0,0 +1,327 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"faraway/internal/usecases"
+	"faraway/internal/usecases/usecasestest"
+	"faraway/pkg/pow/argon2"
+	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
+)
+
+type recordingSetter struct {
+	difficulty uint64
+	changes    int
+}
+
+func (s *recordingSetter) SetDifficulty(difficulty uint64) error {
+	s.difficulty = difficulty
+	s.changes++
+	return nil
+}
+
+func TestDifficultyTunerConvergesToTarget(t *testing.T) {
+	setter := &recordingSetter{difficulty: 1}
+	tuner := &difficultyTuner{
+		setter:  setter,
+		target:  time.Second,
+		min:     1,
+		max:     8,
+		samples: 5,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	// Every step makes solving four times slower: 40ms, 160ms, 640ms, ...
+	solveTime := func(difficulty uint64) time.Duration {
+		return 10 * time.Millisecond << (2 * difficulty)
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < tuner.samples; i++ {
+			// Jitter around the model, plus one outlier per window
+			sample := solveTime(setter.difficulty) + time.Duration(i)*time.Millisecond
+			if i == 0 {
+				sample *= 100
+			}
+			tuner.observe(sample, setter.difficulty)
+		}
+	}
+
+	if setter.difficulty != 3 {
+		t.Fatalf("expected difficulty 3 (640ms per solve), got %d", setter.difficulty)
+	}
+	if setter.changes != 2 {
+		t.Fatalf("expected to settle after 2 changes, got %d", setter.changes)
+	}
+}
+
+func TestDifficultyTunerRespectsBounds(t *testing.T) {
+	setter := &recordingSetter{difficulty: 2}
+	tuner := &difficultyTuner{
+		setter:  setter,
+		target:  time.Second,
+		min:     2,
+		max:     3,
+		samples: 1,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	for i := 0; i < 5; i++ {
+		tuner.observe(time.Millisecond, setter.difficulty)
+	}
+	if setter.difficulty != 3 {
+		t.Fatalf("expected difficulty capped at 3, got %d", setter.difficulty)
+	}
+	for i := 0; i < 5; i++ {
+		tuner.observe(time.Minute, setter.difficulty)
+	}
+	if setter.difficulty != 2 {
+		t.Fatalf("expected difficulty floored at 2, got %d", setter.difficulty)
+	}
+}
+
+func TestDifficultyTunerIgnoresStaleSamples(t *testing.T) {
+	setter := &recordingSetter{difficulty: 1}
+	tuner := &difficultyTuner{
+		setter:  setter,
+		target:  time.Second,
+		min:     1,
+		max:     8,
+		samples: 2,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	tuner.observe(time.Millisecond, 1)
+	tuner.observe(time.Millisecond, 1)
+	// Fast solves of challenges issued before the change don't count
+	tuner.observe(time.Millisecond, 1)
+	tuner.observe(time.Millisecond, 1)
+	if setter.difficulty != 2 || setter.changes != 1 {
+		t.Fatalf("expected a single change to 2, got difficulty %d after %d changes", setter.difficulty, setter.changes)
+	}
+}
+
+func TestPerClientDifficultyFollowsSolveTimes(t *testing.T) {
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(2, nil, protocol.ChallengeTypeCPU)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var logs lockedBuffer
+	clock := &testClock{now: time.Now()}
+	server := NewServer(&Config{
+		Deadline:                5 * time.Second,
+		AutoDifficultyTarget:    time.Second,
+		AutoDifficultyMin:       1,
+		AutoDifficultyMax:       4,
+		PerClientDifficulty:     true,
+		HandshakesPerConnection: 10,
+	}, powUsecase, usecasestest.QuoteUsecase{Quote: "test quote"}, slog.New(slog.NewTextHandler(&logs, nil)))
+	server.now = clock.Now
+
+	tests := []struct {
+		name         string
+		ip           string
+		solveTime    time.Duration
+		difficulties []uint64
+	}{
+		{"fast solver", "10.0.0.1", 100 * time.Millisecond, []uint64{2, 3, 4, 4}},
+		{"slow solver", "10.0.0.2", 5 * time.Second, []uint64{2, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			handled := make(chan struct{})
+			go func() {
+				defer close(handled)
+				server.handleConnection(&remoteAddrConn{Conn: serverConn, remoteAddr: &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 4242}})
+			}()
+
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(clientConn)
+			readPreamble(t, reader)
+
+			// Every handshake over the one connection is tuned on the one before
+			for i, difficulty := range tt.difficulties {
+				challenge := readChallengeFrame(t, reader)
+				solver, err := hashcash.NewHashCash(difficulty)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				clock.Advance(tt.solveTime)
+				if _, err := clientConn.Write([]byte("CPU\n" + solver.FindSolution(challenge) + "\n")); err != nil {
+					t.Fatalf("unexpected error writing solution %d: %v", i+1, err)
+				}
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatalf("unexpected error reading response %d: %v", i+1, err)
+				}
+				if !strings.HasPrefix(line, "SUCCESS:") {
+					t.Fatalf("expected solution %d at difficulty %d accepted, got %q", i+1, difficulty, line)
+				}
+			}
+			// Closing instead of solving the next challenge ends it quietly
+			clientConn.Close()
+			<-handled
+
+			var issued []uint64
+			for _, line := range strings.Split(logs.String(), "\n") {
+				var difficulty uint64
+				if strings.Contains(line, `msg="challenge solved"`) && strings.Contains(line, "ip="+tt.ip) {
+					fmt.Sscanf(line[strings.Index(line, "difficulty="):], "difficulty=%d", &difficulty)
+					issued = append(issued, difficulty)
+				}
+			}
+			if !slices.Equal(issued, tt.difficulties) {
+				t.Fatalf("expected challenges at difficulties %v, got %v", tt.difficulties, issued)
+			}
+			if state, _ := server.ipTracker.get(tt.ip); state.failures != 0 {
+				t.Fatalf("expected no failure recorded for closing the connection, got %d:\n%s", state.failures, logs.String())
+			}
+		})
+	}
+
+	// Each client is tuned on its own, the server-wide difficulty is left alone
+	if server.tuner != nil {
+		t.Fatal("expected no server-wide tuning with per-client difficulty")
+	}
+}
+
+func TestSaturatedDefenseShedsLoad(t *testing.T) {
+	var logs lockedBuffer
+	setter := &recordingSetter{difficulty: 1}
+	server := newTestServer(&Config{MaxConnections: 10, ShedLoad: 50})
+	server.tuner = &difficultyTuner{
+		setter:  setter,
+		target:  time.Second,
+		min:     1,
+		max:     3,
+		samples: 1,
+		logger:  slog.New(slog.NewTextHandler(&logs, nil)),
+	}
+	// Connections handled besides the test's own, so the load is 60
+	server.activeConns.Add(5)
+
+	// Solves stay far faster than the target however hard challenges get
+	for i := 0; i < 10; i++ {
+		server.tuner.observe(time.Millisecond, setter.difficulty)
+	}
+	if setter.difficulty != 3 {
+		t.Fatalf("expected difficulty held at the ceiling of 3, got %d", setter.difficulty)
+	}
+	if !strings.Contains(logs.String(), "defense saturated") {
+		t.Fatalf("expected saturation to be logged, got %q", logs.String())
+	}
+
+	frame, err := io.ReadAll(serveTestConn(t, server))
+	if err != nil {
+		t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	if len(frame) != 1 || frame[0] != protocol.FrameRetryLater {
+		t.Fatalf("expected the connection to be shed, got %x", frame)
+	}
+
+	// Below the shed load, challenges are still issued at the ceiling
+	server.activeConns.Add(-5)
+	readChallengeFrame(t, bufio.NewReader(serveTestConn(t, server)))
+
+	// Solves slowing down end the saturation
+	server.activeConns.Add(5)
+	server.tuner.observe(time.Second, setter.difficulty)
+	if !strings.Contains(logs.String(), "defense no longer saturated") {
+		t.Fatalf("expected the end of saturation to be logged, got %q", logs.String())
+	}
+	readChallengeFrame(t, bufio.NewReader(serveTestConn(t, server)))
+}
+
+func TestDifficultyRaisedBetweenIssueAndVerify(t *testing.T) {
+	powUsecase, err := usecases.NewPowUsecaseWithAlgorithms(1, nil, protocol.ChallengeTypeCPU)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server := NewServer(&Config{Deadline: 5 * time.Second, MaxFailures: 1, FailureWindow: time.Minute},
+		powUsecase, usecasestest.QuoteUsecase{Quote: "test quote"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	clientConn := serveTestConn(t, server)
+	reader := bufio.NewReader(clientConn)
+	challenge := readChallengeFrame(t, reader)
+
+	// The tuner steps up while the client is solving at difficulty 1
+	if err := powUsecase.(usecases.DifficultySetter).SetDifficulty(6); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	solver, err := hashcash.NewHashCash(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := clientConn.Write([]byte("CPU\n" + solver.FindSolution(challenge) + "\n")); err != nil {
+		t.Fatalf("unexpected error writing solution: %v", err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if !strings.HasPrefix(line, "SUCCESS:") {
+		t.Fatalf("expected the solution verified at the issued difficulty, got %q", line)
+	}
+	if server.isPenalized(remoteIP(clientConn)) {
+		t.Fatal("expected no failure recorded against the client")
+	}
+}
+
+func TestTuningRangeBoundedByAlgorithms(t *testing.T) {
+	cfg := &Config{AutoDifficultyMin: 2, AutoDifficultyMax: 12}
+	tests := []struct {
+		name       string
+		algorithms []protocol.ChallengeType
+		low, high  uint64
+	}{
+		{"CPU only", []protocol.ChallengeType{protocol.ChallengeTypeCPU}, 2, 12},
+		// argon2 counts bits, its ceiling bounds the shared difficulty
+		{"memory only", []protocol.ChallengeType{protocol.ChallengeTypeMemory}, 2, argon2.MaxDifficulty},
+		{"both", []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory}, 2, argon2.MaxDifficulty},
+	}
+
+	for _, tt := range tests {
+		powUsecase := &usecasestest.PowUsecase{Enabled: tt.algorithms}
+		if low, high := tuningRange(cfg, powUsecase); low != tt.low || high != tt.high {
+			t.Fatalf("%s: expected range %d-%d, got %d-%d", tt.name, tt.low, tt.high, low, high)
+		}
+	}
+}
+
+func TestDifficultyTunerStopsAtArgon2Cap(t *testing.T) {
+	powUsecase, err := usecases.NewPowUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var logs lockedBuffer
+	tuner := newDifficultyTuner(&Config{AutoDifficultyTarget: time.Second, AutoDifficultyMax: 10, AutoDifficultySamples: 1},
+		powUsecase, slog.New(slog.NewTextHandler(&logs, nil)))
+
+	for difficulty := uint64(1); difficulty <= 10; difficulty++ {
+		tuner.observe(time.Millisecond, min(difficulty, argon2.MaxDifficulty))
+	}
+	memory, err := powUsecase.GenerateMemoryBoundChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if memory.Difficulty != argon2.MaxDifficulty {
+		t.Fatalf("expected difficulty held at argon2's cap of %d, got %d", argon2.MaxDifficulty, memory.Difficulty)
+	}
+	if strings.Contains(logs.String(), "failed to adjust difficulty") {
+		t.Fatalf("expected no difficulty past the cap tried, got %q", logs.String())
+	}
+	if !tuner.saturated.Load() {
+		t.Fatal("expected the defense saturated at the cap")
+	}
+}
@@ -0,0 +1,95 @@
+package tcp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"faraway/pkg/pow/argon2"
+)
+
+// verifierPool bounds how many memory-bound verifications run at once,
+// independently of how many connections are being handled. Verifications
+// beyond the limit queue for a slot for at most timeout.
+type verifierPool struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// newVerifierPool sizes the pool from the configured limit and memory
+// budget, whichever is tighter. It returns nil, meaning verifications run
+// inline, when neither is set.
+func newVerifierPool(cfg *Config) *verifierPool {
+	size := cfg.MaxVerifications
+	if cfg.VerificationMemoryKiB > 0 {
+		byMemory := max(cfg.VerificationMemoryKiB/argon2.MemoryKiB, 1)
+		if size <= 0 || byMemory < size {
+			size = byMemory
+		}
+	}
+	if size <= 0 {
+		return nil
+	}
+	return &verifierPool{
+		slots:   make(chan struct{}, size),
+		timeout: cfg.VerificationQueueTimeout,
+	}
+}
+
+// run calls verify once a slot is free, or fails with ErrVerificationBusy
+// if none frees up within the queue timeout. Verification itself is bounded
+// by ctx, see verifyWithin; pending, if not nil, counts it until it returns.
+func (p *verifierPool) run(ctx context.Context, pending *sync.WaitGroup, verify func() (bool, error)) (bool, error) {
+	if p == nil {
+		return verifyWithin(ctx, pending, verify)
+	}
+
+	var timeout <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		// The slot is held until verify returns, even if it's abandoned,
+		// as its memory stays in use until then
+		return verifyWithin(ctx, pending, func() (bool, error) {
+			defer func() { <-p.slots }()
+			return verify()
+		})
+	case <-timeout:
+		return false, NewConnectionError("verify", ErrVerificationBusy, "no verification slot within queue timeout")
+	case <-ctx.Done():
+		return false, NewConnectionError("verify", ErrVerificationBusy, ctx.Err().Error())
+	}
+}
+
+// verifyWithin calls verify, failing with ErrVerificationTimeout once ctx is
+// done. An argon2 pass can't be interrupted, so an abandoned verification
+// finishes in the background, but the handler is free to answer the client.
+func verifyWithin(ctx context.Context, pending *sync.WaitGroup, verify func() (bool, error)) (bool, error) {
+	type result struct {
+		ok  bool
+		err error
+	}
+	done := make(chan result, 1)
+	if pending != nil {
+		pending.Add(1)
+	}
+	go func() {
+		if pending != nil {
+			defer pending.Done()
+		}
+		ok, err := verify()
+		done <- result{ok, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.ok, r.err
+	case <-ctx.Done():
+		return false, NewConnectionError("verify", ErrVerificationTimeout, ctx.Err().Error())
+	}
+}
@@ -0,0 +1,165 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"faraway/internal/usecases"
+	"faraway/pkg/pow/argon2"
+)
+
+func TestNewVerifierPoolSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		expected int
+	}{
+		{"unbounded", Config{}, 0},
+		{"count limit", Config{MaxVerifications: 4}, 4},
+		{"memory limit", Config{VerificationMemoryKiB: 3 * argon2.MemoryKiB}, 3},
+		{"memory below one pass", Config{VerificationMemoryKiB: 1}, 1},
+		{"tighter limit wins", Config{MaxVerifications: 2, VerificationMemoryKiB: 3 * argon2.MemoryKiB}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newVerifierPool(&tt.cfg)
+			if tt.expected == 0 {
+				if pool != nil {
+					t.Fatalf("expected inline verification, got a pool of %d", cap(pool.slots))
+				}
+				return
+			}
+			if pool == nil || cap(pool.slots) != tt.expected {
+				t.Fatalf("expected a pool of %d, got %+v", tt.expected, pool)
+			}
+		})
+	}
+}
+
+func TestVerifierPoolQueueTimeout(t *testing.T) {
+	pool := newVerifierPool(&Config{MaxVerifications: 1, VerificationQueueTimeout: 10 * time.Millisecond})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go pool.run(context.Background(), nil, func() (bool, error) {
+		close(started)
+		<-release
+		return true, nil
+	})
+	<-started
+	defer close(release)
+
+	_, err := pool.run(context.Background(), nil, func() (bool, error) { return true, nil })
+	if !errors.Is(err, ErrVerificationBusy) {
+		t.Fatalf("expected ErrVerificationBusy, got %v", err)
+	}
+	if resp := ToErrorResponse(err); resp.Code != ErrRespServerBusy.Code {
+		t.Fatalf("expected %v, got %v", ErrRespServerBusy, resp)
+	}
+}
+
+func TestVerifierPoolBoundsConcurrency(t *testing.T) {
+	pool := newVerifierPool(&Config{MaxVerifications: 2})
+
+	var mu sync.Mutex
+	var running, peak int
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.run(context.Background(), nil, func() (bool, error) {
+				mu.Lock()
+				running++
+				peak = max(peak, running)
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return true, nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Fatalf("expected at most 2 concurrent verifications, got %d", peak)
+	}
+}
+
+func TestVerificationBoundedByContext(t *testing.T) {
+	pools := map[string]*verifierPool{
+		"inline": nil,
+		"pooled": newVerifierPool(&Config{MaxVerifications: 1}),
+	}
+	for name, pool := range pools {
+		t.Run(name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			slowVerify := func() (bool, error) {
+				<-release
+				return true, nil
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err := pool.run(ctx, nil, slowVerify)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("expected a prompt timeout, took %s", elapsed)
+			}
+			if !errors.Is(err, ErrVerificationTimeout) {
+				t.Fatalf("expected ErrVerificationTimeout, got %v", err)
+			}
+			if resp := ToErrorResponse(err); resp.Code != ErrRespTimeout.Code {
+				t.Fatalf("expected %v, got %v", ErrRespTimeout, resp)
+			}
+			if pool != nil && len(pool.slots) != 1 {
+				t.Fatal("expected the abandoned verification to keep its slot until it returns")
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryVerification(b *testing.B) {
+	powUsecase, err := usecases.NewPowUsecase(1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	solver, err := usecases.NewSolverUsecase(1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	challenge := []byte("challenge")
+	solution, err := solver.FindMemoryBoundSolution(challenge, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	pools := map[string]*verifierPool{
+		"inline": nil,
+		"pooled": newVerifierPool(&Config{MaxVerifications: 2}),
+	}
+	for name, pool := range pools {
+		b.Run(name, func(b *testing.B) {
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, err := pool.run(context.Background(), nil, func() (bool, error) {
+						return powUsecase.ValidateMemoryBoundSolution(challenge, []byte(solution))
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
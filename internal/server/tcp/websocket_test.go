@@ -0,0 +1,59 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"faraway/internal/websocket"
+)
+
+func TestWebSocketHandshake(t *testing.T) {
+	httpServer := httptest.NewServer(newTestServer(&Config{}).WebSocketHandler())
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(httpServer.URL, "http"))
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	readPreamble(t, reader)
+	challenge := readChallengeFrame(t, reader)
+	if string(challenge) != "challenge" {
+		t.Fatalf("expected the fake challenge, got %q", challenge)
+	}
+
+	if _, err := conn.Write([]byte("CPU\n42\n")); err != nil {
+		t.Fatalf("unexpected error writing solution: %v", err)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	if line != "SUCCESS:test quote\n" {
+		t.Fatalf("expected success, got %q", line)
+	}
+}
+
+func TestRunFailsOnBadWebSocketAddress(t *testing.T) {
+	server := newTestServer(&Config{
+		Address:          "127.0.0.1:0",
+		WebSocketAddress: "127.0.0.1:-1",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Run(ctx); err == nil {
+		t.Fatalf("expected Run to fail on an invalid websocket address")
+	}
+}
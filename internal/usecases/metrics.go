@@ -0,0 +1,100 @@
+package usecases
+
+import (
+	"errors"
+	"time"
+
+	"faraway/internal/domain"
+	"faraway/pkg/protocol"
+)
+
+// Algorithm and operation labels of proof of work timings.
+const (
+	AlgorithmHashcash = "hashcash"
+	AlgorithmArgon2   = "argon2"
+
+	OperationGenerate = "generate"
+	OperationVerify   = "verify"
+)
+
+// ErrNotSupported is returned when a wrapped usecase lacks an optional
+// capability.
+var ErrNotSupported = errors.New("not supported")
+
+// Metrics is the sink proof of work timings, and counts of events such as
+// the client's retries, are reported to.
+type Metrics interface {
+	ObserveDuration(operation, algorithm string, duration time.Duration)
+	IncCounter(name string)
+}
+
+type instrumentedPowUsecase struct {
+	next    PowUsecase
+	metrics Metrics
+	now     func() time.Time
+}
+
+// NewInstrumentedPowUsecase returns a PowUsecase that reports how long
+// next takes to generate and verify challenges, labelled by algorithm.
+// Enabled algorithms, difficulty changes and solution explanations are
+// passed through when next supports them.
+func NewInstrumentedPowUsecase(next PowUsecase, metrics Metrics) PowUsecase {
+	return &instrumentedPowUsecase{
+		next:    next,
+		metrics: metrics,
+		now:     time.Now,
+	}
+}
+
+// observe reports the time since start.
+func (p *instrumentedPowUsecase) observe(operation, algorithm string, start time.Time) {
+	p.metrics.ObserveDuration(operation, algorithm, p.now().Sub(start))
+}
+
+func (p *instrumentedPowUsecase) GenerateCPUBoundChallenge() (*domain.ProofOfWork, error) {
+	defer p.observe(OperationGenerate, AlgorithmHashcash, p.now())
+	return p.next.GenerateCPUBoundChallenge()
+}
+
+func (p *instrumentedPowUsecase) GenerateMemoryBoundChallenge() (*domain.ProofOfWork, error) {
+	defer p.observe(OperationGenerate, AlgorithmArgon2, p.now())
+	return p.next.GenerateMemoryBoundChallenge()
+}
+
+func (p *instrumentedPowUsecase) ValidateCPUBoundSolution(challenge, nonce []byte) bool {
+	defer p.observe(OperationVerify, AlgorithmHashcash, p.now())
+	return p.next.ValidateCPUBoundSolution(challenge, nonce)
+}
+
+func (p *instrumentedPowUsecase) ValidateMemoryBoundSolution(challenge, nonce []byte) (bool, error) {
+	defer p.observe(OperationVerify, AlgorithmArgon2, p.now())
+	return p.next.ValidateMemoryBoundSolution(challenge, nonce)
+}
+
+func (p *instrumentedPowUsecase) Algorithms() []protocol.ChallengeType {
+	return EnabledAlgorithms(p.next)
+}
+
+func (p *instrumentedPowUsecase) SetDifficulty(difficulty uint64) error {
+	setter, ok := p.next.(DifficultySetter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return setter.SetDifficulty(difficulty)
+}
+
+func (p *instrumentedPowUsecase) ExplainCPUBoundSolution(challenge, nonce []byte) (computed, expected string) {
+	explainer, ok := p.next.(SolutionExplainer)
+	if !ok {
+		return ErrNotSupported.Error(), ""
+	}
+	return explainer.ExplainCPUBoundSolution(challenge, nonce)
+}
+
+func (p *instrumentedPowUsecase) ExplainMemoryBoundSolution(challenge, nonce []byte) (computed, expected string, err error) {
+	explainer, ok := p.next.(SolutionExplainer)
+	if !ok {
+		return "", "", ErrNotSupported
+	}
+	return explainer.ExplainMemoryBoundSolution(challenge, nonce)
+}
@@ -0,0 +1,54 @@
+package usecases
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	observed map[string]int
+}
+
+func (m *recordingMetrics) ObserveDuration(operation, algorithm string, duration time.Duration) {
+	m.observed[operation+"/"+algorithm]++
+}
+
+func (m *recordingMetrics) IncCounter(name string) {
+	m.observed[name]++
+}
+
+func TestInstrumentedPowUsecaseLabelsAlgorithms(t *testing.T) {
+	next, err := NewPowUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	metrics := &recordingMetrics{observed: map[string]int{}}
+	pow := NewInstrumentedPowUsecase(next, metrics)
+
+	cpu, err := pow.GenerateCPUBoundChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pow.ValidateCPUBoundSolution(cpu.Challenge, []byte("0"))
+
+	memory, err := pow.GenerateMemoryBoundChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pow.ValidateMemoryBoundSolution(memory.Challenge, []byte("bad"))
+
+	for _, key := range []string{
+		OperationGenerate + "/" + AlgorithmHashcash,
+		OperationVerify + "/" + AlgorithmHashcash,
+		OperationGenerate + "/" + AlgorithmArgon2,
+		OperationVerify + "/" + AlgorithmArgon2,
+	} {
+		if metrics.observed[key] != 1 {
+			t.Fatalf("expected one %s timing, got %v", key, metrics.observed)
+		}
+	}
+
+	if err := pow.(DifficultySetter).SetDifficulty(2); err != nil {
+		t.Fatalf("expected difficulty changes to pass through, got %v", err)
+	}
+}
@@ -1,13 +1,24 @@
 package usecases
 
 import (
+	"errors"
 	"faraway/internal/domain"
 	"faraway/pkg/pow/argon2"
 	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
 	"fmt"
+	"io"
 	"log"
 )
 
+// ErrAlgorithmDisabled is returned for challenges of an algorithm the
+// usecase wasn't set up with.
+var ErrAlgorithmDisabled = errors.New("algorithm disabled")
+
+// ErrInvalidSolutionFormat is returned when a solution can't be parsed,
+// as opposed to a well-formed solution that doesn't verify.
+var ErrInvalidSolutionFormat = errors.New("invalid solution format")
+
 // PowUsecase defines the interface for Proof of Work usecase.
 type PowUsecase interface {
 	GenerateCPUBoundChallenge() (*domain.ProofOfWork, error)
@@ -17,29 +28,156 @@ type PowUsecase interface {
 	ValidateMemoryBoundSolution(challenge, nonce []byte) (bool, error)
 }
 
+// DifficultySetter is implemented by usecases whose difficulty can be
+// changed at runtime, e.g. on a configuration reload.
+type DifficultySetter interface {
+	SetDifficulty(difficulty uint64) error
+}
+
+// DifficultyValidator is implemented by usecases that can verify a
+// solution at the difficulty its challenge was issued at, which a
+// SetDifficulty since may have changed.
+type DifficultyValidator interface {
+	ValidateCPUBoundSolutionAt(challenge, nonce []byte, difficulty uint64) bool
+	ValidateMemoryBoundSolutionAt(challenge, nonce []byte, difficulty uint64) (bool, error)
+}
+
+// VerificationLogger is implemented by usecases that can log the details
+// of every verification at debug level, which they don't unless given a
+// logger.
+type VerificationLogger interface {
+	UseLogger(logger argon2.Logger)
+}
+
+// SolutionExplainer is implemented by usecases that can show how a solution
+// compares to what its challenge requires, to diagnose rejected solutions.
+type SolutionExplainer interface {
+	ExplainCPUBoundSolution(challenge, nonce []byte) (computed, expected string)
+	ExplainMemoryBoundSolution(challenge, nonce []byte) (computed, expected string, err error)
+}
+
+// AlgorithmLister is implemented by usecases that only offer some of the
+// challenge types.
+type AlgorithmLister interface {
+	Algorithms() []protocol.ChallengeType
+}
+
+// EnabledAlgorithms returns the challenge types usecase offers: all of
+// them unless it is an AlgorithmLister.
+func EnabledAlgorithms(usecase PowUsecase) []protocol.ChallengeType {
+	if lister, ok := usecase.(AlgorithmLister); ok {
+		return lister.Algorithms()
+	}
+	return []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory}
+}
+
+// MaxDifficulty returns the highest difficulty every algorithm usecase
+// offers accepts. Hashcash counts hex digits and argon2 bits, so with both
+// enabled argon2's much lower ceiling bounds the shared difficulty.
+func MaxDifficulty(usecase PowUsecase) uint64 {
+	ceiling := uint64(hashcash.MaxDifficulty)
+	for _, algorithm := range EnabledAlgorithms(usecase) {
+		if algorithm == protocol.ChallengeTypeMemory {
+			ceiling = min(ceiling, argon2.MaxDifficulty)
+		}
+	}
+	return ceiling
+}
+
+// powUsecaseImpl offers hashcash, argon2 or both; a disabled algorithm is
+// nil and never constructed.
 type powUsecaseImpl struct {
-	hashcash *hashcash.HashCash
-	argon2   *argon2.Argon2
+	hashcash   *hashcash.HashCash
+	argon2     *argon2.Argon2
+	algorithms []protocol.ChallengeType
 }
 
 // NewPowUsecase initializes the powUsecaseImpl with the specified difficulty.
 func NewPowUsecase(difficulty uint64) (PowUsecase, error) {
-	hashcash, err := hashcash.NewHashCash(difficulty)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize hashcash: %w", err)
+	return NewPowUsecaseWithAlgorithms(difficulty, nil, protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory)
+}
+
+// NewPowUsecaseWithRandom is like NewPowUsecase but draws challenge tokens
+// from random, e.g. a pow.EntropyPool shared by both algorithms.
+func NewPowUsecaseWithRandom(difficulty uint64, random io.Reader) (PowUsecase, error) {
+	return NewPowUsecaseWithAlgorithms(difficulty, random, protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory)
+}
+
+// NewPowUsecaseWithAlgorithms offers only the given algorithms, so e.g. a
+// CPU-only deployment neither allocates for argon2 nor is bound by its
+// difficulty range. A nil random means crypto/rand.
+func NewPowUsecaseWithAlgorithms(difficulty uint64, random io.Reader, algorithms ...protocol.ChallengeType) (PowUsecase, error) {
+	p := &powUsecaseImpl{}
+	for _, algorithm := range algorithms {
+		var err error
+		switch {
+		case algorithm == protocol.ChallengeTypeCPU && p.hashcash == nil:
+			if p.hashcash, err = hashcash.NewHashCash(difficulty); err != nil {
+				return nil, fmt.Errorf("failed to initialize hashcash: %w", err)
+			}
+			if random != nil {
+				p.hashcash.UseRandom(random)
+			}
+		case algorithm == protocol.ChallengeTypeMemory && p.argon2 == nil:
+			if p.argon2, err = argon2.NewArgon2(difficulty); err != nil {
+				return nil, fmt.Errorf("failed to initialize argon2: %w", err)
+			}
+			if random != nil {
+				p.argon2.UseRandom(random)
+			}
+		case algorithm.Valid():
+			continue // listed twice
+		default:
+			return nil, fmt.Errorf("unknown algorithm %v", algorithm)
+		}
+		p.algorithms = append(p.algorithms, algorithm)
 	}
-	argon2, err := argon2.NewArgon2(difficulty)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize argon2: %w", err)
+	if len(p.algorithms) == 0 {
+		return nil, errors.New("no algorithm enabled")
+	}
+	return p, nil
+}
+
+// UseLogger makes argon2 verifications log their challenge, solution and
+// key to logger at debug level.
+func (p *powUsecaseImpl) UseLogger(logger argon2.Logger) {
+	if p.argon2 != nil {
+		p.argon2.UseLogger(logger)
 	}
-	return &powUsecaseImpl{
-		hashcash: hashcash,
-		argon2:   argon2,
-	}, nil
+}
+
+// Algorithms returns the enabled challenge types.
+func (p *powUsecaseImpl) Algorithms() []protocol.ChallengeType {
+	return p.algorithms
+}
+
+// SetDifficulty changes the difficulty of every enabled algorithm. It is
+// safe to call while challenges are being handled; either all change or
+// none.
+func (p *powUsecaseImpl) SetDifficulty(difficulty uint64) error {
+	var previous uint64
+	if p.argon2 != nil {
+		previous = p.argon2.GetDifficulty()
+		if err := p.argon2.SetDifficulty(difficulty); err != nil {
+			return fmt.Errorf("failed to set argon2 difficulty: %w", err)
+		}
+	}
+	if p.hashcash != nil {
+		if err := p.hashcash.SetDifficulty(difficulty); err != nil {
+			if p.argon2 != nil {
+				p.argon2.SetDifficulty(previous)
+			}
+			return fmt.Errorf("failed to set hashcash difficulty: %w", err)
+		}
+	}
+	return nil
 }
 
 // GenerateCPUBoundChallenge creates a new challenge using the hashcash package.
 func (p *powUsecaseImpl) GenerateCPUBoundChallenge() (*domain.ProofOfWork, error) {
+	if p.hashcash == nil {
+		return nil, fmt.Errorf("%w: hashcash", ErrAlgorithmDisabled)
+	}
 	challenge, err := p.hashcash.GenerateChallenge()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate challenge: %w", err)
@@ -53,16 +191,31 @@ func (p *powUsecaseImpl) GenerateCPUBoundChallenge() (*domain.ProofOfWork, error
 // ValidateCPUBoundSolution checks if the provided solution (nonce) is valid for the given challenge.
 // It returns false if the solution is invalid or if any error occurs during verification.
 func (p *powUsecaseImpl) ValidateCPUBoundSolution(challenge, nonce []byte) bool {
+	if p.hashcash == nil {
+		return false
+	}
+	return p.ValidateCPUBoundSolutionAt(challenge, nonce, p.hashcash.GetDifficulty())
+}
+
+// ValidateCPUBoundSolutionAt is like ValidateCPUBoundSolution but checks
+// the solution against difficulty instead of the current one.
+func (p *powUsecaseImpl) ValidateCPUBoundSolutionAt(challenge, nonce []byte, difficulty uint64) bool {
+	if p.hashcash == nil {
+		return false
+	}
 	if len(challenge) == 0 || len(nonce) == 0 {
 		log.Printf("Invalid input: challenge length=%d, nonce length=%d", len(challenge), len(nonce))
 		return false
 	}
 
-	return p.hashcash.Verify(challenge, nonce)
+	return p.hashcash.VerifyWithDifficulty(challenge, nonce, difficulty)
 }
 
 // GenerateMemoryBoundChallenge creates a new challenge using the argon2 package.
 func (p *powUsecaseImpl) GenerateMemoryBoundChallenge() (*domain.ProofOfWork, error) {
+	if p.argon2 == nil {
+		return nil, fmt.Errorf("%w: argon2", ErrAlgorithmDisabled)
+	}
 	challenge, err := p.argon2.GenerateChallenge()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate challenge: %w", err)
@@ -76,15 +229,74 @@ func (p *powUsecaseImpl) GenerateMemoryBoundChallenge() (*domain.ProofOfWork, er
 // ValidateMemoryBoundSolution checks if the provided solution (nonce) is valid for the given challenge.
 // It returns false if the solution is invalid or if any error occurs during verification.
 func (p *powUsecaseImpl) ValidateMemoryBoundSolution(challenge, nonce []byte) (bool, error) {
+	if p.argon2 == nil {
+		return false, fmt.Errorf("%w: argon2", ErrAlgorithmDisabled)
+	}
+	return p.ValidateMemoryBoundSolutionAt(challenge, nonce, p.argon2.GetDifficulty())
+}
+
+// ValidateMemoryBoundSolutionAt is like ValidateMemoryBoundSolution but
+// checks the solution against difficulty instead of the current one.
+func (p *powUsecaseImpl) ValidateMemoryBoundSolutionAt(challenge, nonce []byte, difficulty uint64) (bool, error) {
+	if p.argon2 == nil {
+		return false, fmt.Errorf("%w: argon2", ErrAlgorithmDisabled)
+	}
 	if len(challenge) == 0 || len(nonce) == 0 {
 		log.Printf("Invalid input: challenge length=%d, nonce length=%d", len(challenge), len(nonce))
 		return false, nil
 	}
 
-	isVerified, err := p.argon2.Verify(challenge, string(nonce))
+	if err := checkMemoryBoundNonce(nonce); err != nil {
+		return false, err
+	}
+
+	isVerified, err := p.argon2.VerifyWithDifficulty(challenge, string(nonce), difficulty)
+	if errors.Is(err, argon2.ErrInvalidFormat) {
+		return false, fmt.Errorf("%w: %v", ErrInvalidSolutionFormat, err)
+	}
 	if err != nil {
 		return false, fmt.Errorf("failed to verify argon2 solution: %w", err)
 	}
 
 	return isVerified, nil
 }
+
+// maxMemoryNonceLength is the length of the largest uint64 in decimal.
+const maxMemoryNonceLength = 20
+
+// checkMemoryBoundNonce rejects, without paying for an argon2 pass, a
+// nonce that isn't in the canonical decimal form solvers send: too long to
+// be a uint64, with anything but digits, or with leading zeros. The nonce
+// is all the client controls, the challenge is the server's own salt.
+func checkMemoryBoundNonce(nonce []byte) error {
+	if len(nonce) > maxMemoryNonceLength {
+		return fmt.Errorf("%w: %d-digit nonce", ErrInvalidSolutionFormat, len(nonce))
+	}
+	for _, c := range nonce {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("%w: non-decimal nonce", ErrInvalidSolutionFormat)
+		}
+	}
+	if len(nonce) > 1 && nonce[0] == '0' {
+		return fmt.Errorf("%w: nonce with leading zeros", ErrInvalidSolutionFormat)
+	}
+	return nil
+}
+
+// ExplainCPUBoundSolution returns the hash computed for the solution and
+// the prefix it was expected to have.
+func (p *powUsecaseImpl) ExplainCPUBoundSolution(challenge, nonce []byte) (computed, expected string) {
+	if p.hashcash == nil {
+		return "hashcash disabled", ""
+	}
+	return p.hashcash.Explain(challenge, nonce)
+}
+
+// ExplainMemoryBoundSolution returns the key derived for the solution and
+// the zero bits it was expected to start with.
+func (p *powUsecaseImpl) ExplainMemoryBoundSolution(challenge, nonce []byte) (computed, expected string, err error) {
+	if p.argon2 == nil {
+		return "", "", fmt.Errorf("%w: argon2", ErrAlgorithmDisabled)
+	}
+	return p.argon2.Explain(challenge, string(nonce))
+}
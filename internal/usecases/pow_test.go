@@ -0,0 +1,196 @@
+package usecases
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"faraway/pkg/protocol"
+)
+
+func TestValidateMemoryBoundSolutionMalformed(t *testing.T) {
+	pow, err := NewPowUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, solution := range []string{"GARBAGE", "!!!$!!!", "a$b$c"} {
+		_, err := pow.ValidateMemoryBoundSolution([]byte("challenge"), []byte(solution))
+		if !errors.Is(err, ErrInvalidSolutionFormat) {
+			t.Fatalf("expected ErrInvalidSolutionFormat for %q, got %v", solution, err)
+		}
+	}
+}
+
+func TestValidateMemoryBoundSolutionNonce(t *testing.T) {
+	pow, err := NewPowUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	challenge, err := pow.GenerateMemoryBoundChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	noncanonical := map[string]string{
+		"leading zeros": "01",
+		"signed":        "+1",
+		"spaced":        " 1",
+		"past uint64":   "123456789012345678901",
+	}
+	for name, nonce := range noncanonical {
+		if _, err := pow.ValidateMemoryBoundSolution(challenge.Challenge, []byte(nonce)); !errors.Is(err, ErrInvalidSolutionFormat) {
+			t.Fatalf("%s: expected ErrInvalidSolutionFormat, got %v", name, err)
+		}
+	}
+
+	// A canonical nonce is verified, whether or not it solves the challenge
+	for _, nonce := range []string{"0", "1", "18446744073709551615"} {
+		if _, err := pow.ValidateMemoryBoundSolution(challenge.Challenge, []byte(nonce)); err != nil {
+			t.Fatalf("expected nonce %s to be verified, got %v", nonce, err)
+		}
+	}
+}
+
+func TestUseLoggerLogsMemoryBoundVerifications(t *testing.T) {
+	pow, err := NewPowUsecaseWithAlgorithms(1, nil, protocol.ChallengeTypeMemory)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var logs bytes.Buffer
+	pow.(VerificationLogger).UseLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	challenge, err := pow.GenerateMemoryBoundChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := pow.ValidateMemoryBoundSolution(challenge.Challenge, []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "argon2 verification") {
+		t.Fatalf("expected the verification logged, got %q", logs.String())
+	}
+}
+
+func TestSetDifficultyConcurrentWithGeneration(t *testing.T) {
+	pow, err := NewPowUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	setter := pow.(DifficultySetter)
+
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := setter.SetDifficulty(uint64(i%3 + 1)); err != nil {
+				t.Errorf("unexpected error reloading difficulty: %v", err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				cpu, err := pow.GenerateCPUBoundChallenge()
+				if err != nil {
+					t.Errorf("unexpected error generating challenge: %v", err)
+					return
+				}
+				memory, err := pow.GenerateMemoryBoundChallenge()
+				if err != nil {
+					t.Errorf("unexpected error generating challenge: %v", err)
+					return
+				}
+				for _, d := range []uint64{cpu.Difficulty, memory.Difficulty} {
+					if d < 1 || d > 3 {
+						t.Errorf("unexpected difficulty %d", d)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	<-reloaded
+}
+
+func TestSetDifficultyOutOfRange(t *testing.T) {
+	pow, err := NewPowUsecase(2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Valid for hashcash but not argon2: neither may change
+	if err := pow.(DifficultySetter).SetDifficulty(11); err == nil {
+		t.Fatal("expected an error for an out-of-range difficulty")
+	}
+	cpu, _ := pow.GenerateCPUBoundChallenge()
+	memory, _ := pow.GenerateMemoryBoundChallenge()
+	if cpu.Difficulty != 2 || memory.Difficulty != 2 {
+		t.Fatalf("expected difficulty to stay 2, got %d and %d", cpu.Difficulty, memory.Difficulty)
+	}
+}
+
+func TestEnabledAlgorithms(t *testing.T) {
+	cpu, memory := protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory
+	tests := []struct {
+		name       string
+		algorithms []protocol.ChallengeType
+		difficulty uint64
+	}{
+		// Beyond argon2's difficulty range, which doesn't apply
+		{"CPU only", []protocol.ChallengeType{cpu}, 12},
+		{"memory only", []protocol.ChallengeType{memory}, 1},
+		{"both", []protocol.ChallengeType{cpu, memory}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pow, err := NewPowUsecaseWithAlgorithms(tt.difficulty, nil, tt.algorithms...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := EnabledAlgorithms(pow); !slices.Equal(got, tt.algorithms) {
+				t.Fatalf("expected algorithms %v, got %v", tt.algorithms, got)
+			}
+
+			_, err = pow.GenerateCPUBoundChallenge()
+			if enabled := slices.Contains(tt.algorithms, cpu); enabled != (err == nil) {
+				t.Fatalf("CPU enabled=%v, generation error %v", enabled, err)
+			}
+			_, err = pow.GenerateMemoryBoundChallenge()
+			if enabled := slices.Contains(tt.algorithms, memory); enabled != (err == nil) {
+				t.Fatalf("memory enabled=%v, generation error %v", enabled, err)
+			}
+			if !slices.Contains(tt.algorithms, memory) {
+				if _, err := pow.ValidateMemoryBoundSolution([]byte("challenge"), []byte("a$b")); !errors.Is(err, ErrAlgorithmDisabled) {
+					t.Fatalf("expected ErrAlgorithmDisabled, got %v", err)
+				}
+			}
+		})
+	}
+
+	if _, err := NewPowUsecaseWithAlgorithms(1, nil); err == nil {
+		t.Fatal("expected an error with no algorithm enabled")
+	}
+	if _, err := NewPowUsecaseWithAlgorithms(12, nil, cpu, memory); err == nil {
+		t.Fatal("expected argon2's difficulty range to apply when it is enabled")
+	}
+}
@@ -1,26 +1,477 @@
 package usecases
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"faraway/internal/domain"
+)
+
+var (
+	// ErrEmptyCorpus is returned when a quote corpus without quotes is loaded.
+	ErrEmptyCorpus = errors.New("quote corpus is empty")
+	// ErrInvalidWeight is returned for a weighted corpus with a weight that
+	// isn't a positive finite number.
+	ErrInvalidWeight = errors.New("quote weight must be positive and finite")
 )
 
 // QuoteUsecase defines the interface for quote retrieval.
 type QuoteUsecase interface {
-	GetRandomQuote() string
+	GetRandomQuote() domain.Quote
+}
+
+// QuoteReloader is implemented by quote usecases whose corpus can be
+// replaced while they serve quotes.
+type QuoteReloader interface {
+	Reload(quotes []domain.Quote) error
+}
+
+var defaultQuotes = []domain.Quote{
+	{Text: "Life is what happens when you're busy making other plans.", Author: "John Lennon", Source: "Beautiful Boy"},
+	{Text: "The greatest glory in living lies not in never falling, but in rising every time we fall.", Author: "Nelson Mandela"},
+	{Text: "The way to get started is to quit talking and begin doing.", Author: "Walt Disney"},
+}
+
+// DefaultQuotes returns the built-in quotes NewQuoteUsecase serves.
+func DefaultQuotes() []domain.Quote {
+	return slices.Clone(defaultQuotes)
+}
+
+// maxRemoteCorpusSize bounds the corpus FetchQuotes reads, so a
+// misconfigured URL can't exhaust memory at startup.
+const maxRemoteCorpusSize = 16 << 20
+
+// ParseQuotes parses a corpus of JSON quotes, either an array or one
+// object per line, or else of plain text quotes, one per line. Blank lines
+// are skipped, and a corpus without quotes is an error.
+func ParseQuotes(data []byte) ([]domain.Quote, error) {
+	var quotes []domain.Quote
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &quotes); err != nil {
+			return nil, fmt.Errorf("parsing quotes: %w", err)
+		}
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		for decoder.More() {
+			var quote domain.Quote
+			if err := decoder.Decode(&quote); err != nil {
+				return nil, fmt.Errorf("parsing quote %d: %w", len(quotes)+1, err)
+			}
+			quotes = append(quotes, quote)
+		}
+	default:
+		for _, line := range strings.Split(string(trimmed), "\n") {
+			if text := strings.TrimSpace(line); text != "" {
+				quotes = append(quotes, domain.Quote{Text: text})
+			}
+		}
+	}
+	for i, quote := range quotes {
+		if strings.TrimSpace(quote.Text) == "" {
+			return nil, fmt.Errorf("parsing quotes: quote %d has no text", i+1)
+		}
+	}
+	if len(quotes) == 0 {
+		return nil, ErrEmptyCorpus
+	}
+	return quotes, nil
 }
 
-type quoteUsecaseImpl struct{}
+// FetchQuotes downloads the corpus at url, over HTTP or HTTPS, and parses
+// it with ParseQuotes. It gives up after timeout.
+func FetchQuotes(ctx context.Context, url string, timeout time.Duration) ([]domain.Quote, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching quotes: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching quotes: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching quotes: unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteCorpusSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching quotes: %w", err)
+	}
+	if len(data) > maxRemoteCorpusSize {
+		return nil, fmt.Errorf("fetching quotes: corpus exceeds %d bytes", maxRemoteCorpusSize)
+	}
+	return ParseQuotes(data)
+}
+
+// LoadQuotes returns the corpus at url as FetchQuotes does, or the
+// built-in quotes along with the error if that fails, so a server can
+// still start while the corpus is unreachable.
+func LoadQuotes(ctx context.Context, url string, timeout time.Duration) ([]domain.Quote, error) {
+	quotes, err := FetchQuotes(ctx, url, timeout)
+	if err != nil {
+		return DefaultQuotes(), err
+	}
+	return quotes, nil
+}
+
+// quoteUsecaseImpl serves quotes from a corpus that is never modified once
+// stored, only replaced as a whole, so readers need no lock.
+type quoteUsecaseImpl struct {
+	quotes atomic.Pointer[[]domain.Quote]
+}
 
 func NewQuoteUsecase() QuoteUsecase {
-	return &quoteUsecaseImpl{}
+	usecase, _ := NewQuoteUsecaseWithQuotes(defaultQuotes)
+	return usecase
 }
 
-// GetRandomQuote returns a random quote from a predefined list.
-func (q *quoteUsecaseImpl) GetRandomQuote() string {
-	quotes := []string{
-		"Life is what happens when you're busy making other plans.",
-		"The greatest glory in living lies not in never falling, but in rising every time we fall.",
-		"The way to get started is to quit talking and begin doing.",
+// NewQuoteUsecaseWithQuotes is like NewQuoteUsecase but serves quotes
+// instead of the built-in ones.
+func NewQuoteUsecaseWithQuotes(quotes []domain.Quote) (QuoteUsecase, error) {
+	q := &quoteUsecaseImpl{}
+	if err := q.Reload(quotes); err != nil {
+		return nil, err
 	}
+	return q, nil
+}
+
+// GetRandomQuote returns a random quote from the current corpus.
+func (q *quoteUsecaseImpl) GetRandomQuote() domain.Quote {
+	quotes := *q.quotes.Load()
 	return quotes[rand.Intn(len(quotes))]
 }
+
+// Reload replaces the corpus. Quotes being served concurrently come from
+// either the old or the new corpus, never from a mix of both.
+func (q *quoteUsecaseImpl) Reload(quotes []domain.Quote) error {
+	if len(quotes) == 0 {
+		return ErrEmptyCorpus
+	}
+	// The caller keeps its slice, so it must not be shared
+	corpus := slices.Clone(quotes)
+	q.quotes.Store(&corpus)
+	return nil
+}
+
+// roundRobinQuoteUsecase serves the corpus in order, wrapping around, so
+// every quote is served as often as the others.
+type roundRobinQuoteUsecase struct {
+	cursorFile string
+
+	mu     sync.Mutex
+	quotes []domain.Quote
+	cursor uint64
+
+	// saveMu serializes saves, saved being the cursor last written
+	saveMu sync.Mutex
+	saved  uint64
+}
+
+// CursorPersister is implemented by quote usecases keeping a position in
+// the corpus that PersistCursor saves, so a restarted server can carry on
+// from it.
+type CursorPersister interface {
+	PersistCursor() error
+}
+
+// NewRoundRobinQuoteUsecase returns a QuoteUsecase serving quotes in turn.
+// If cursorFile is set, the position in the corpus is read back from it on
+// start, so a restarted server carries on where it left off instead of
+// serving the first quotes again; the caller saves it with PersistCursor,
+// periodically and on shutdown, away from serving quotes.
+func NewRoundRobinQuoteUsecase(quotes []domain.Quote, cursorFile string) (QuoteUsecase, error) {
+	q := &roundRobinQuoteUsecase{cursorFile: cursorFile}
+	if err := q.Reload(quotes); err != nil {
+		return nil, err
+	}
+	if cursorFile == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(cursorFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("reading quote cursor: %w", err)
+	default:
+		if q.cursor, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("parsing quote cursor: %w", err)
+		}
+	}
+	// Saving it right away finds an unwritable file before serving
+	if err := q.saveCursor(q.cursor); err != nil {
+		return nil, fmt.Errorf("saving quote cursor: %w", err)
+	}
+	q.saved = q.cursor
+	return q, nil
+}
+
+// GetRandomQuote returns the next quote in the corpus.
+func (q *roundRobinQuoteUsecase) GetRandomQuote() domain.Quote {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	quote := q.quotes[q.cursor%uint64(len(q.quotes))]
+	q.cursor++
+	return quote
+}
+
+// PersistCursor saves the cursor to the cursor file, if there is one and
+// quotes were served since the last save. Quotes keep being served while
+// it writes.
+func (q *roundRobinQuoteUsecase) PersistCursor() error {
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	q.mu.Lock()
+	cursor := q.cursor
+	q.mu.Unlock()
+
+	if cursor == q.saved {
+		return nil
+	}
+	if err := q.saveCursor(cursor); err != nil {
+		return fmt.Errorf("saving quote cursor: %w", err)
+	}
+	q.saved = cursor
+	return nil
+}
+
+// Reload replaces the corpus, keeping the cursor: serving goes on from the
+// same position in the new corpus.
+func (q *roundRobinQuoteUsecase) Reload(quotes []domain.Quote) error {
+	if len(quotes) == 0 {
+		return ErrEmptyCorpus
+	}
+	corpus := slices.Clone(quotes)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.quotes = corpus
+	return nil
+}
+
+// saveCursor writes cursor to cursorFile, if set, through a temporary
+// file renamed over it, so a crash never leaves it half written.
+func (q *roundRobinQuoteUsecase) saveCursor(cursor uint64) error {
+	if q.cursorFile == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.cursorFile), filepath.Base(q.cursorFile)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(strconv.FormatUint(cursor, 10) + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.cursorFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+type cachedQuoteUsecase struct {
+	next QuoteUsecase
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu        sync.Mutex
+	quote     domain.Quote
+	expiresAt time.Time
+}
+
+// NewCachedQuoteUsecase returns a QuoteUsecase that serves the same quote
+// from next until ttl elapses, so bursts of requests get a stable quote.
+func NewCachedQuoteUsecase(next QuoteUsecase, ttl time.Duration) QuoteUsecase {
+	return &cachedQuoteUsecase{
+		next: next,
+		ttl:  ttl,
+		now:  time.Now,
+	}
+}
+
+// GetRandomQuote returns the cached quote, refreshing it once it expires.
+func (q *cachedQuoteUsecase) GetRandomQuote() domain.Quote {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	if q.expiresAt.IsZero() || !now.Before(q.expiresAt) {
+		q.quote = q.next.GetRandomQuote()
+		q.expiresAt = now.Add(q.ttl)
+	}
+	return q.quote
+}
+
+// Reload reloads the wrapped usecase and drops the cached quote, which may
+// no longer be in the corpus. It returns ErrNotSupported if the wrapped
+// usecase can't reload.
+func (q *cachedQuoteUsecase) Reload(quotes []domain.Quote) error {
+	reloader, ok := q.next.(QuoteReloader)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := reloader.Reload(quotes); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expiresAt = time.Time{}
+	return nil
+}
+
+// QuoteRandom is the randomness weighted quotes are picked with. A
+// *rand.Rand implements it, but isn't safe for concurrent use on its own.
+type QuoteRandom interface {
+	Intn(n int) int
+	Float64() float64
+}
+
+// globalRandom picks with the goroutine-safe top-level math/rand functions.
+type globalRandom struct{}
+
+func (globalRandom) Intn(n int) int   { return rand.Intn(n) }
+func (globalRandom) Float64() float64 { return rand.Float64() }
+
+// WeightedQuote is a quote served in proportion to its weight.
+type WeightedQuote struct {
+	Quote  domain.Quote
+	Weight float64
+}
+
+// aliasTable picks among weighted quotes in constant time with Vose's
+// alias method: column i is taken with probability prob[i], and otherwise
+// stands for alias[i].
+type aliasTable struct {
+	quotes []domain.Quote
+	prob   []float64
+	alias  []int
+}
+
+func newAliasTable(weighted []WeightedQuote) (*aliasTable, error) {
+	if len(weighted) == 0 {
+		return nil, ErrEmptyCorpus
+	}
+	var total float64
+	for i, wq := range weighted {
+		if !(wq.Weight > 0) || math.IsInf(wq.Weight, 0) {
+			return nil, fmt.Errorf("%w: quote %d has weight %v", ErrInvalidWeight, i, wq.Weight)
+		}
+		total += wq.Weight
+	}
+
+	n := len(weighted)
+	table := &aliasTable{
+		quotes: make([]domain.Quote, n),
+		prob:   make([]float64, n),
+		alias:  make([]int, n),
+	}
+	// Scale weights so the average column is 1, then fill each column
+	// that is short of 1 with the excess of one that is over
+	scaled := make([]float64, n)
+	var small, large []int
+	for i, wq := range weighted {
+		table.quotes[i] = wq.Quote
+		scaled[i] = wq.Weight * float64(n) / total
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+	for len(small) > 0 && len(large) > 0 {
+		s, l := small[len(small)-1], large[len(large)-1]
+		small = small[:len(small)-1]
+		table.prob[s] = scaled[s]
+		table.alias[s] = l
+		scaled[l] -= 1 - scaled[s]
+		if scaled[l] < 1 {
+			large = large[:len(large)-1]
+			small = append(small, l)
+		}
+	}
+	// Whatever is left is 1 up to rounding
+	for _, i := range append(small, large...) {
+		table.prob[i] = 1
+	}
+	return table, nil
+}
+
+func (t *aliasTable) pick(random QuoteRandom) domain.Quote {
+	i := random.Intn(len(t.prob))
+	if random.Float64() < t.prob[i] {
+		return t.quotes[i]
+	}
+	return t.quotes[t.alias[i]]
+}
+
+// weightedQuoteUsecase serves quotes in proportion to their weights. Like
+// quoteUsecaseImpl it swaps whole tables, built once per load.
+type weightedQuoteUsecase struct {
+	random QuoteRandom
+	table  atomic.Pointer[aliasTable]
+}
+
+// NewWeightedQuoteUsecase returns a QuoteUsecase picking quotes in
+// proportion to their weights, in constant time however large the corpus.
+// A nil random uses the top-level math/rand functions.
+func NewWeightedQuoteUsecase(quotes []WeightedQuote, random QuoteRandom) (QuoteUsecase, error) {
+	if random == nil {
+		random = globalRandom{}
+	}
+	q := &weightedQuoteUsecase{random: random}
+	if err := q.ReloadWeighted(quotes); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// GetRandomQuote returns a quote picked by weight from the current corpus.
+func (q *weightedQuoteUsecase) GetRandomQuote() domain.Quote {
+	return q.table.Load().pick(q.random)
+}
+
+// Reload replaces the corpus with quotes of equal weight.
+func (q *weightedQuoteUsecase) Reload(quotes []domain.Quote) error {
+	weighted := make([]WeightedQuote, len(quotes))
+	for i, quote := range quotes {
+		weighted[i] = WeightedQuote{Quote: quote, Weight: 1}
+	}
+	return q.ReloadWeighted(weighted)
+}
+
+// ReloadWeighted replaces the corpus, building its table before swapping
+// it in.
+func (q *weightedQuoteUsecase) ReloadWeighted(quotes []WeightedQuote) error {
+	table, err := newAliasTable(quotes)
+	if err != nil {
+		return err
+	}
+	q.table.Store(table)
+	return nil
+}
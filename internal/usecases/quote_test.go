@@ -0,0 +1,314 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"faraway/internal/domain"
+)
+
+type countingQuoteUsecase struct {
+	calls int
+}
+
+func (q *countingQuoteUsecase) GetRandomQuote() domain.Quote {
+	q.calls++
+	return domain.Quote{Text: fmt.Sprintf("quote %d", q.calls)}
+}
+
+func TestCachedQuoteUsecase(t *testing.T) {
+	now := time.Unix(0, 0)
+	next := &countingQuoteUsecase{}
+	cached := NewCachedQuoteUsecase(next, time.Second).(*cachedQuoteUsecase)
+	cached.now = func() time.Time { return now }
+
+	first := cached.GetRandomQuote()
+	now = now.Add(999 * time.Millisecond)
+	if got := cached.GetRandomQuote(); got != first {
+		t.Fatalf("expected %q within the TTL, got %q", first, got)
+	}
+
+	now = now.Add(time.Millisecond)
+	if got := cached.GetRandomQuote(); got == first {
+		t.Fatalf("expected a new quote after the TTL, got %q again", got)
+	}
+	if next.calls != 2 {
+		t.Fatalf("expected 2 calls to the underlying usecase, got %d", next.calls)
+	}
+}
+
+func TestReloadWhileServingQuotes(t *testing.T) {
+	corpora := [][]domain.Quote{
+		{{Text: "a"}},
+		{{Text: "b"}, {Text: "c", Author: "C"}},
+		{{Text: "d"}, {Text: "e"}, {Text: "f"}, {Text: "g", Source: "G"}},
+	}
+	usecase, err := NewQuoteUsecaseWithQuotes(corpora[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reloader := usecase.(QuoteReloader)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				quote := usecase.GetRandomQuote()
+				if !slices.ContainsFunc(corpora, func(corpus []domain.Quote) bool { return slices.Contains(corpus, quote) }) {
+					t.Errorf("got quote %q from no corpus", quote)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		if err := reloader.Reload(corpora[i%len(corpora)]); err != nil {
+			t.Fatalf("unexpected error reloading: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReloadRejectsEmptyCorpus(t *testing.T) {
+	usecase := NewQuoteUsecase()
+	if err := usecase.(QuoteReloader).Reload(nil); !errors.Is(err, ErrEmptyCorpus) {
+		t.Fatalf("expected ErrEmptyCorpus, got %v", err)
+	}
+	if quote := usecase.GetRandomQuote(); !slices.Contains(defaultQuotes, quote) {
+		t.Fatalf("expected the corpus to be kept, got %q", quote)
+	}
+}
+
+func TestCachedQuoteUsecaseReload(t *testing.T) {
+	next, err := NewQuoteUsecaseWithQuotes([]domain.Quote{{Text: "old"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cached := NewCachedQuoteUsecase(next, time.Hour)
+	if quote := cached.GetRandomQuote(); quote.Text != "old" {
+		t.Fatalf("expected %q, got %q", "old", quote)
+	}
+
+	if err := cached.(QuoteReloader).Reload([]domain.Quote{{Text: "new"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if quote := cached.GetRandomQuote(); quote.Text != "new" {
+		t.Fatalf("expected the reloaded quote, got %q", quote)
+	}
+
+	unreloadable := NewCachedQuoteUsecase(&countingQuoteUsecase{}, time.Hour)
+	if err := unreloadable.(QuoteReloader).Reload([]domain.Quote{{Text: "new"}}); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestWeightedQuoteDistribution(t *testing.T) {
+	weights := []float64{1, 2, 7, 0.5, 9.5}
+	var total float64
+	quotes := make([]WeightedQuote, len(weights))
+	for i, weight := range weights {
+		quotes[i] = WeightedQuote{Quote: domain.Quote{Text: fmt.Sprint(i)}, Weight: weight}
+		total += weight
+	}
+	usecase, err := NewWeightedQuoteUsecase(quotes, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const picks = 200000
+	counts := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		counts[usecase.GetRandomQuote().Text]++
+	}
+	for i, weight := range weights {
+		expected := weight / total
+		got := float64(counts[fmt.Sprint(i)]) / picks
+		if math.Abs(got-expected) > 0.01 {
+			t.Fatalf("quote %d: expected share %.3f, got %.3f", i, expected, got)
+		}
+	}
+}
+
+func TestWeightedQuoteInvalidWeights(t *testing.T) {
+	if _, err := NewWeightedQuoteUsecase(nil, nil); !errors.Is(err, ErrEmptyCorpus) {
+		t.Fatalf("expected ErrEmptyCorpus, got %v", err)
+	}
+	for _, weight := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		quotes := []WeightedQuote{{Quote: domain.Quote{Text: "a"}, Weight: 1}, {Quote: domain.Quote{Text: "b"}, Weight: weight}}
+		if _, err := NewWeightedQuoteUsecase(quotes, nil); !errors.Is(err, ErrInvalidWeight) {
+			t.Fatalf("expected ErrInvalidWeight for weight %v, got %v", weight, err)
+		}
+	}
+}
+
+// benchmarkCorpus is a large corpus with uneven weights.
+func benchmarkCorpus() []WeightedQuote {
+	quotes := make([]WeightedQuote, 100000)
+	for i := range quotes {
+		quotes[i] = WeightedQuote{Quote: domain.Quote{Text: fmt.Sprint(i)}, Weight: float64(i%100 + 1)}
+	}
+	return quotes
+}
+
+func BenchmarkWeightedQuoteAlias(b *testing.B) {
+	usecase, err := NewWeightedQuoteUsecase(benchmarkCorpus(), rand.New(rand.NewSource(1)))
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		usecase.GetRandomQuote()
+	}
+}
+
+// BenchmarkWeightedQuoteScan is the naive alternative: a linear scan of
+// cumulative weights.
+func BenchmarkWeightedQuoteScan(b *testing.B) {
+	quotes := benchmarkCorpus()
+	cumulative := make([]float64, len(quotes))
+	var total float64
+	for i, wq := range quotes {
+		total += wq.Weight
+		cumulative[i] = total
+	}
+	random := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := random.Float64() * total
+		for j, c := range cumulative {
+			if target < c {
+				_ = quotes[j].Quote
+				break
+			}
+		}
+	}
+}
+
+func TestRoundRobinResumesFromPersistedCursor(t *testing.T) {
+	quotes := []domain.Quote{{Text: "first"}, {Text: "second"}, {Text: "third"}}
+	cursorFile := filepath.Join(t.TempDir(), "cursor")
+
+	before, err := NewRoundRobinQuoteUsecase(quotes, cursorFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"first", "second"} {
+		if got := before.GetRandomQuote().Text; got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	// Serving leaves the file alone, saving is the caller's to schedule
+	if data, err := os.ReadFile(cursorFile); err != nil || string(data) != "0\n" {
+		t.Fatalf("expected the cursor file untouched by serving, got %q, %v", data, err)
+	}
+	if err := before.(CursorPersister).PersistCursor(); err != nil {
+		t.Fatalf("unexpected error saving the cursor: %v", err)
+	}
+
+	// A restart picks up the cursor the first provider left
+	after, err := NewRoundRobinQuoteUsecase(quotes, cursorFile)
+	if err != nil {
+		t.Fatalf("unexpected error restarting: %v", err)
+	}
+	for _, want := range []string{"third", "first"} {
+		if got := after.GetRandomQuote().Text; got != want {
+			t.Fatalf("expected %q after the restart, got %q", want, got)
+		}
+	}
+
+	// Failing to save is reported, and serving goes on
+	os.RemoveAll(filepath.Dir(cursorFile))
+	if err := after.(CursorPersister).PersistCursor(); err == nil {
+		t.Fatal("expected an error saving to a removed directory")
+	}
+	if got := after.GetRandomQuote().Text; got != "second" {
+		t.Fatalf("expected %q after a failed save, got %q", "second", got)
+	}
+
+	// Without a cursor file every start begins with the first quote
+	fresh, err := NewRoundRobinQuoteUsecase(quotes, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := fresh.GetRandomQuote().Text; got != "first" {
+		t.Fatalf("expected %q without persistence, got %q", "first", got)
+	}
+}
+
+func TestFetchQuotes(t *testing.T) {
+	corpora := map[string]string{
+		"/text":  "First quote.\n\nSecond quote.\n",
+		"/array": `[{"text":"First quote.","author":"A"},{"text":"Second quote."}]`,
+		"/lines": "{\"text\":\"First quote.\",\"author\":\"A\"}\n{\"text\":\"Second quote.\"}\n",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, corpora[r.URL.Path])
+	}))
+	defer server.Close()
+
+	for path := range corpora {
+		t.Run(path, func(t *testing.T) {
+			quotes, err := LoadQuotes(context.Background(), server.URL+path, time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(quotes) != 2 || quotes[0].Text != "First quote." || quotes[1].Text != "Second quote." {
+				t.Fatalf("expected both quotes to be loaded, got %+v", quotes)
+			}
+			if path != "/text" && quotes[0].Author != "A" {
+				t.Fatalf("expected the author to be loaded, got %+v", quotes[0])
+			}
+		})
+	}
+}
+
+func TestLoadQuotesFallsBackToDefaults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			fmt.Fprint(w, "\n\n")
+		case "/slow":
+			<-r.Context().Done()
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/empty", "/slow", "/error"} {
+		t.Run(path, func(t *testing.T) {
+			quotes, err := LoadQuotes(context.Background(), server.URL+path, 50*time.Millisecond)
+			if err == nil {
+				t.Fatal("expected the failure to be reported")
+			}
+			if path == "/empty" && !errors.Is(err, ErrEmptyCorpus) {
+				t.Fatalf("expected ErrEmptyCorpus, got %v", err)
+			}
+			if !slices.Equal(quotes, DefaultQuotes()) {
+				t.Fatalf("expected the built-in quotes, got %+v", quotes)
+			}
+		})
+	}
+}
@@ -1,41 +1,221 @@
 package usecases
 
 import (
+	"context"
+	"errors"
+	"faraway/internal/domain"
 	"faraway/pkg/pow/argon2"
 	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
 	"fmt"
+	"runtime"
+	"strings"
+	"time"
 )
 
+// ErrUnknownAlgorithm is returned by Solve for a challenge type no solver is
+// registered for.
+var ErrUnknownAlgorithm = errors.New("no solver for challenge type")
+
 type SolverUsecase interface {
+	// Solve dispatches the challenge to the solver of its type.
+	Solve(ctx context.Context, challenge domain.Challenge) (domain.Solution, error)
+
 	FindCPUBoundSolution(challenge []byte) string
-	FindMemoryBoundSolution(challenge []byte) (string, error)
+	// FindMemoryBoundSolution solves at difficulty, or at the solver's own
+	// difficulty when it is zero.
+	FindMemoryBoundSolution(challenge []byte, difficulty uint64) (string, error)
+}
+
+// CPUProgressReporter is implemented by solvers that can report how far
+// CPU-bound solves have got, which at high difficulty take long enough to
+// want feedback.
+type CPUProgressReporter interface {
+	// ReportCPUProgress calls report about every interval while a
+	// CPU-bound challenge is being solved.
+	ReportCPUProgress(interval time.Duration, report func(hashcash.Progress))
 }
 
+// ErrSolveStrategy is returned by ParseSolveStrategy for an unknown strategy.
+var ErrSolveStrategy = errors.New("unsupported solve strategy")
+
+// SolveStrategy trades solve speed against client memory and CPU use.
+// Either way solutions satisfy exactly the parameters the challenge
+// demands: argon2's time, memory and thread counts are fixed by the
+// protocol, so the strategy only changes how the client schedules work.
+type SolveStrategy string
+
+const (
+	// SolveStrategySpeed searches hashcash nonces on every CPU and lets
+	// argon2 solves run concurrently.
+	SolveStrategySpeed SolveStrategy = "speed"
+	// SolveStrategyMemory searches nonces on one goroutine and runs one
+	// argon2 solve at a time, so at most one argon2 buffer is allocated.
+	SolveStrategyMemory SolveStrategy = "memory"
+)
+
+// ParseSolveStrategy maps a configuration value to a SolveStrategy.
+func ParseSolveStrategy(s string) (SolveStrategy, error) {
+	switch strategy := SolveStrategy(strings.ToLower(s)); strategy {
+	case "":
+		return SolveStrategySpeed, nil
+	case SolveStrategySpeed, SolveStrategyMemory:
+		return strategy, nil
+	default:
+		return SolveStrategySpeed, fmt.Errorf("%w: %q", ErrSolveStrategy, s)
+	}
+}
+
+// solveFunc solves the data of a challenge of one type, at difficulty if
+// the challenge came with one and at the solver's own if it is zero.
+type solveFunc func(ctx context.Context, data []byte, difficulty uint64) (string, error)
+
 type solverUsecaseImpl struct {
 	hashcash *hashcash.HashCash
 	argon2   *argon2.Argon2
+	solvers  map[protocol.ChallengeType]solveFunc
 }
 
 // NewSolverUsecase
 func NewSolverUsecase(difficulty uint64) (SolverUsecase, error) {
-	hashcash, err := hashcash.NewHashCash(difficulty)
+	impl, err := newSolverUsecase(UniformDifficulties(difficulty))
+	if err != nil {
+		return nil, err
+	}
+	return impl, nil
+}
+
+// SolverDifficulties are the difficulties a solver solves each algorithm's
+// challenges at. Their ranges differ, hashcash's going up to 64 and
+// argon2's to 10, so one difficulty doesn't always suit both.
+type SolverDifficulties struct {
+	CPU    uint64
+	Memory uint64
+}
+
+// UniformDifficulties solves both algorithms at difficulty.
+func UniformDifficulties(difficulty uint64) SolverDifficulties {
+	return SolverDifficulties{CPU: difficulty, Memory: difficulty}
+}
+
+func newSolverUsecase(difficulties SolverDifficulties) (*solverUsecaseImpl, error) {
+	hashcash, err := hashcash.NewHashCash(difficulties.CPU)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize hashcash: %w", err)
 	}
-	argon2, err := argon2.NewArgon2(difficulty)
+	argon2, err := argon2.NewArgon2(difficulties.Memory)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize argon2: %w", err)
 	}
-	return &solverUsecaseImpl{
+	s := &solverUsecaseImpl{
 		hashcash: hashcash,
 		argon2:   argon2,
-	}, nil
+	}
+	s.solvers = map[protocol.ChallengeType]solveFunc{
+		protocol.ChallengeTypeCPU: func(ctx context.Context, data []byte, difficulty uint64) (string, error) {
+			return s.solveCPUBound(ctx, data, difficulty, 0)
+		},
+		protocol.ChallengeTypeMemory: s.solveMemoryBound,
+	}
+	return s, nil
+}
+
+// NewSolverUsecaseWithStrategy is like NewSolverUsecaseWithEncoding but
+// schedules solving according to strategy.
+func NewSolverUsecaseWithStrategy(difficulty uint64, encoding hashcash.NonceEncoding, strategy SolveStrategy) (SolverUsecase, error) {
+	return NewSolverUsecaseWithDifficulties(UniformDifficulties(difficulty), encoding, strategy)
+}
+
+// NewSolverUsecaseWithDifficulties is like NewSolverUsecaseWithStrategy but
+// solves each algorithm at a difficulty of its own.
+func NewSolverUsecaseWithDifficulties(difficulties SolverDifficulties, encoding hashcash.NonceEncoding, strategy SolveStrategy) (SolverUsecase, error) {
+	impl, err := newSolverUsecase(difficulties)
+	if err != nil {
+		return nil, err
+	}
+	impl.hashcash.UseNonceEncoding(encoding)
+	switch strategy {
+	case SolveStrategySpeed:
+		impl.hashcash.UseWorkers(runtime.NumCPU())
+	case SolveStrategyMemory:
+		impl.hashcash.UseWorkers(1)
+		slot := make(chan struct{}, 1)
+		impl.solvers[protocol.ChallengeTypeMemory] = func(ctx context.Context, data []byte, difficulty uint64) (string, error) {
+			select {
+			case slot <- struct{}{}:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			defer func() { <-slot }()
+			return impl.solveMemoryBound(ctx, data, difficulty)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrSolveStrategy, strategy)
+	}
+	return impl, nil
+}
+
+// NewSolverUsecaseWithEncoding is like NewSolverUsecase but encodes CPU-bound
+// nonces with encoding, for servers expecting a particular hashcash dialect.
+func NewSolverUsecaseWithEncoding(difficulty uint64, encoding hashcash.NonceEncoding) (SolverUsecase, error) {
+	impl, err := newSolverUsecase(UniformDifficulties(difficulty))
+	if err != nil {
+		return nil, err
+	}
+	impl.hashcash.UseNonceEncoding(encoding)
+	return impl, nil
+}
+
+func (s *solverUsecaseImpl) ReportCPUProgress(interval time.Duration, report func(hashcash.Progress)) {
+	s.hashcash.UseProgress(interval, report)
+}
+
+func (s *solverUsecaseImpl) Solve(ctx context.Context, challenge domain.Challenge) (domain.Solution, error) {
+	solve, ok := s.solvers[challenge.Type]
+	if !ok {
+		return domain.Solution{}, fmt.Errorf("%w: %v", ErrUnknownAlgorithm, challenge.Type)
+	}
+
+	// A hint only ever narrows the search, which finds the same kind of
+	// solution on fewer workers
+	if hint := challenge.Hint; hint != nil && hint.Workers > 0 && challenge.Type == protocol.ChallengeTypeCPU {
+		workers := min(hint.Workers, s.hashcash.Workers())
+		solve = func(ctx context.Context, data []byte, difficulty uint64) (string, error) {
+			return s.solveCPUBound(ctx, data, difficulty, workers)
+		}
+	}
+
+	solution, err := solve(ctx, challenge.Data, challenge.Difficulty)
+	if err != nil {
+		return domain.Solution{}, fmt.Errorf("failed to solve %v challenge: %w", challenge.Type, err)
+	}
+	return domain.Solution{Type: challenge.Type, Data: []byte(solution)}, nil
 }
 
 func (s *solverUsecaseImpl) FindCPUBoundSolution(challenge []byte) string {
 	return s.hashcash.FindSolution(challenge)
 }
 
-func (s *solverUsecaseImpl) FindMemoryBoundSolution(challenge []byte) (string, error) {
-	return s.argon2.FindSolution(challenge)
+// solveCPUBound solves at difficulty, or at the solver's own when it is
+// zero, on workers goroutines, or those the solver is set up with when it
+// is zero.
+func (s *solverUsecaseImpl) solveCPUBound(ctx context.Context, challenge []byte, difficulty uint64, workers int) (string, error) {
+	if difficulty == 0 {
+		if workers == 0 {
+			return s.hashcash.FindSolutionContext(ctx, challenge)
+		}
+		return s.hashcash.FindSolutionWithWorkers(ctx, challenge, workers)
+	}
+	return s.hashcash.FindSolutionWithDifficulty(ctx, challenge, difficulty, workers)
+}
+
+func (s *solverUsecaseImpl) FindMemoryBoundSolution(challenge []byte, difficulty uint64) (string, error) {
+	return s.solveMemoryBound(context.Background(), challenge, difficulty)
+}
+
+func (s *solverUsecaseImpl) solveMemoryBound(ctx context.Context, challenge []byte, difficulty uint64) (string, error) {
+	if difficulty == 0 {
+		return s.argon2.FindSolutionContext(ctx, challenge)
+	}
+	return s.argon2.FindSolutionWithDifficulty(ctx, challenge, difficulty)
 }
@@ -0,0 +1,146 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"faraway/internal/domain"
+	"faraway/pkg/pow/argon2"
+	"faraway/pkg/pow/hashcash"
+	"faraway/pkg/protocol"
+)
+
+func TestSolveDispatch(t *testing.T) {
+	solver, err := NewSolverUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pow, err := NewPowUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	challenge := []byte("challenge")
+
+	solution, err := solver.Solve(context.Background(), domain.Challenge{Type: protocol.ChallengeTypeCPU, Data: challenge})
+	if err != nil {
+		t.Fatalf("unexpected error solving CPU challenge: %v", err)
+	}
+	if solution.Type != protocol.ChallengeTypeCPU || !pow.ValidateCPUBoundSolution(challenge, solution.Data) {
+		t.Fatalf("expected a valid CPU solution, got %+v", solution)
+	}
+
+	solution, err = solver.Solve(context.Background(), domain.Challenge{Type: protocol.ChallengeTypeMemory, Data: challenge})
+	if err != nil {
+		t.Fatalf("unexpected error solving Memory challenge: %v", err)
+	}
+	valid, err := pow.ValidateMemoryBoundSolution(challenge, solution.Data)
+	if solution.Type != protocol.ChallengeTypeMemory || err != nil || !valid {
+		t.Fatalf("expected a valid Memory solution, got %+v (%v)", solution, err)
+	}
+}
+
+func TestSolveUnknownAlgorithm(t *testing.T) {
+	solver, err := NewSolverUsecase(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = solver.Solve(context.Background(), domain.Challenge{Type: protocol.ChallengeType(0x02), Data: []byte("challenge")})
+	if !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("expected ErrUnknownAlgorithm, got %v", err)
+	}
+}
+
+func TestSolveStrategies(t *testing.T) {
+	pow, err := NewPowUsecase(2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	challenge := []byte("challenge")
+
+	for _, strategy := range []SolveStrategy{SolveStrategySpeed, SolveStrategyMemory} {
+		solver, err := NewSolverUsecaseWithStrategy(2, hashcash.NonceDecimal, strategy)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", strategy, err)
+		}
+
+		solution, err := solver.Solve(context.Background(), domain.Challenge{Type: protocol.ChallengeTypeCPU, Data: challenge})
+		if err != nil || !pow.ValidateCPUBoundSolution(challenge, solution.Data) {
+			t.Fatalf("%s: expected a valid CPU solution, got %+v (%v)", strategy, solution, err)
+		}
+
+		solution, err = solver.Solve(context.Background(), domain.Challenge{Type: protocol.ChallengeTypeMemory, Data: challenge})
+		if err != nil {
+			t.Fatalf("%s: unexpected error solving Memory challenge: %v", strategy, err)
+		}
+		if valid, err := pow.ValidateMemoryBoundSolution(challenge, solution.Data); err != nil || !valid {
+			t.Fatalf("%s: expected a valid Memory solution, got %+v (%v)", strategy, solution, err)
+		}
+	}
+}
+
+func TestParseSolveStrategy(t *testing.T) {
+	if strategy, err := ParseSolveStrategy("Memory"); err != nil || strategy != SolveStrategyMemory {
+		t.Fatalf("expected memory strategy, got %q (%v)", strategy, err)
+	}
+	if _, err := ParseSolveStrategy("fastest"); !errors.Is(err, ErrSolveStrategy) {
+		t.Fatalf("expected ErrSolveStrategy, got %v", err)
+	}
+	if _, err := NewSolverUsecaseWithStrategy(1, hashcash.NonceDecimal, "fastest"); !errors.Is(err, ErrSolveStrategy) {
+		t.Fatalf("expected ErrSolveStrategy, got %v", err)
+	}
+}
+
+func TestSolverDifficultiesPerAlgorithm(t *testing.T) {
+	// 12 is within hashcash's range but past argon2's
+	if _, err := NewSolverUsecase(12); !errors.Is(err, argon2.ErrDifficultyRange) {
+		t.Fatalf("expected one shared difficulty of 12 to be out of argon2's range, got %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		difficulties SolverDifficulties
+		err          error
+	}{
+		{"each within its range", SolverDifficulties{CPU: 12, Memory: 3}, nil},
+		{"cpu out of range", SolverDifficulties{CPU: 65, Memory: 3}, hashcash.ErrDifficultyRange},
+		{"memory out of range", SolverDifficulties{CPU: 12, Memory: 11}, argon2.ErrDifficultyRange},
+	}
+	for _, tt := range tests {
+		_, err := NewSolverUsecaseWithDifficulties(tt.difficulties, hashcash.NonceDecimal, SolveStrategySpeed)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestSolveAtSentDifficulty(t *testing.T) {
+	verifier, err := argon2.NewArgon2(2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	challenge := []byte("challenge")
+
+	for _, strategy := range []SolveStrategy{SolveStrategySpeed, SolveStrategyMemory} {
+		// The solver's own difficulty is below the one sent
+		solver, err := NewSolverUsecaseWithStrategy(1, hashcash.NonceDecimal, strategy)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", strategy, err)
+		}
+
+		solution, err := solver.Solve(context.Background(), domain.Challenge{Type: protocol.ChallengeTypeMemory, Data: challenge, Difficulty: 2})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", strategy, err)
+		}
+		if ok, err := verifier.Verify(challenge, string(solution.Data)); err != nil || !ok {
+			t.Fatalf("%s: expected a solution at the sent difficulty, got %q (%v)", strategy, solution.Data, err)
+		}
+
+		_, err = solver.Solve(context.Background(), domain.Challenge{Type: protocol.ChallengeTypeMemory, Data: challenge, Difficulty: 11})
+		if !errors.Is(err, argon2.ErrDifficultyRange) {
+			t.Fatalf("%s: expected ErrDifficultyRange for a difficulty past argon2's, got %v", strategy, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Package usecasestest provides test doubles for the usecases interfaces,
+// so transports can be tested without solving real proof-of-work.
+package usecasestest
+
+import (
+	"context"
+	"time"
+
+	"faraway/internal/domain"
+	"faraway/pkg/protocol"
+)
+
+// PowUsecase issues a fixed challenge and accepts or rejects every solution
+// depending on Valid. Enabled restricts the challenge types offered; empty
+// means all of them.
+type PowUsecase struct {
+	Challenge []byte
+	Valid     bool
+	Enabled   []protocol.ChallengeType
+}
+
+func (f *PowUsecase) Algorithms() []protocol.ChallengeType {
+	if len(f.Enabled) == 0 {
+		return []protocol.ChallengeType{protocol.ChallengeTypeCPU, protocol.ChallengeTypeMemory}
+	}
+	return f.Enabled
+}
+
+func (f *PowUsecase) GenerateCPUBoundChallenge() (*domain.ProofOfWork, error) {
+	return &domain.ProofOfWork{Challenge: f.Challenge, Difficulty: 1}, nil
+}
+
+func (f *PowUsecase) GenerateMemoryBoundChallenge() (*domain.ProofOfWork, error) {
+	return &domain.ProofOfWork{Challenge: f.Challenge, Difficulty: 1}, nil
+}
+
+func (f *PowUsecase) ValidateCPUBoundSolution(challenge, nonce []byte) bool {
+	return f.Valid
+}
+
+func (f *PowUsecase) ValidateMemoryBoundSolution(challenge, nonce []byte) (bool, error) {
+	return f.Valid, nil
+}
+
+// QuoteUsecase always returns Quote, attributed to Author.
+type QuoteUsecase struct {
+	Quote  string
+	Author string
+}
+
+func (f QuoteUsecase) GetRandomQuote() domain.Quote {
+	return domain.Quote{Text: f.Quote, Author: f.Author}
+}
+
+// SolverUsecase answers every challenge with Solution after Delay, or fails
+// once ctx is done first.
+type SolverUsecase struct {
+	Solution []byte
+	Delay    time.Duration
+}
+
+func (f SolverUsecase) Solve(ctx context.Context, challenge domain.Challenge) (domain.Solution, error) {
+	select {
+	case <-time.After(f.Delay):
+		return domain.Solution{Type: challenge.Type, Data: f.Solution}, nil
+	case <-ctx.Done():
+		return domain.Solution{}, ctx.Err()
+	}
+}
+
+func (f SolverUsecase) FindCPUBoundSolution(challenge []byte) string {
+	return string(f.Solution)
+}
+
+func (f SolverUsecase) FindMemoryBoundSolution(challenge []byte, difficulty uint64) (string, error) {
+	return string(f.Solution), nil
+}
@@ -0,0 +1,93 @@
+// Package websocket carries the challenge protocol over WebSocket binary
+// messages. It adapts golang.org/x/net/websocket connections to net.Conn so
+// the TCP session code can be reused unchanged.
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// DefaultPath is the HTTP path the protocol is served on when none is set.
+const DefaultPath = "/ws"
+
+// Conn is a WebSocket connection exposed as a byte stream. Reads return the
+// payload of incoming messages in order; each Write is sent as one binary
+// message.
+type Conn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr returns the peer's network address rather than the WebSocket
+// origin reported by the underlying connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func newConn(ws *websocket.Conn, remoteAddr net.Addr) *Conn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &Conn{Conn: ws, remoteAddr: remoteAddr}
+}
+
+// Handler returns an HTTP handler that upgrades requests to WebSocket and
+// passes each connection to serve. The connection is closed when serve
+// returns.
+func Handler(serve func(conn net.Conn)) http.Handler {
+	return websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			conn := newConn(ws, remoteAddr(ws.Request().RemoteAddr))
+			defer conn.Close()
+
+			serve(conn)
+		},
+	}
+}
+
+// Dial opens a WebSocket connection to a ws:// URL.
+func Dial(ctx context.Context, url string) (*Conn, error) {
+	config, err := websocket.NewConfig(url, origin(url))
+	if err != nil {
+		return nil, fmt.Errorf("invalid websocket url: %w", err)
+	}
+
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(ws, ws.RemoteAddr()), nil
+}
+
+// URL builds the ws:// URL of a server address and path, normalizing the
+// leading slash of the path.
+func URL(address, path string) string {
+	return "ws://" + address + NormalizePath(path)
+}
+
+// NormalizePath makes sure path starts with a slash, defaulting to
+// DefaultPath.
+func NormalizePath(path string) string {
+	if path == "" {
+		return DefaultPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+func origin(url string) string {
+	return "http" + strings.TrimPrefix(url, "ws")
+}
+
+func remoteAddr(addr string) net.Addr {
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return tcpAddr
+	}
+	return &net.UnixAddr{Name: addr, Net: "unknown"}
+}
@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dialTestServer(t *testing.T, serve func(conn net.Conn)) *Conn {
+	t.Helper()
+
+	httpServer := httptest.NewServer(Handler(serve))
+	t.Cleanup(httpServer.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, "ws"+strings.TrimPrefix(httpServer.URL, "http"))
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestEchoPayloadSizes(t *testing.T) {
+	conn := dialTestServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+
+	// Cover the 7-bit, 16-bit and 64-bit payload length encodings
+	for _, size := range []int{5, 300, 70000} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatalf("unexpected error writing %d bytes: %v", size, err)
+		}
+
+		echoed := make([]byte, size)
+		if _, err := io.ReadFull(conn, echoed); err != nil {
+			t.Fatalf("unexpected error reading %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(echoed, payload) {
+			t.Fatalf("echoed payload of %d bytes differs", size)
+		}
+	}
+}
+
+func TestCloseFrameEndsStream(t *testing.T) {
+	conn := dialTestServer(t, func(conn net.Conn) {
+		conn.Write([]byte("bye"))
+	})
+
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if string(data) != "bye" {
+		t.Fatalf("expected %q, got %q", "bye", data)
+	}
+}
+
+func TestHandlerRejectsPlainHTTP(t *testing.T) {
+	httpServer := httptest.NewServer(Handler(func(conn net.Conn) {
+		t.Errorf("plain request must not be upgraded")
+	}))
+	defer httpServer.Close()
+
+	resp, err := httpServer.Client().Get(httpServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("expected status 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestURLNormalizesPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"", "ws://localhost:8081/ws"},
+		{"ws", "ws://localhost:8081/ws"},
+		{"/quotes", "ws://localhost:8081/quotes"},
+	}
+
+	for _, tt := range tests {
+		if got := URL("localhost:8081", tt.path); got != tt.expected {
+			t.Fatalf("expected %q for path %q, got %q", tt.expected, tt.path, got)
+		}
+	}
+}
@@ -63,12 +63,16 @@ languages as simpler algorithms like bcrypt or PBKDF2.
 */
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"log/slog"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/argon2"
@@ -80,121 +84,318 @@ const (
 	argon2Memory      = 64 * 1024        // Memory usage (64MB)
 	argon2Threads     = 4                // Number of threads to use
 	argon2KeyLength   = 32               // Length of the generated key
-	argon2SaltLength  = 16               // Length of the salt
 	argon2TokenLength = 16               // Length of the random challenge token
 	argon2MaxTime     = 10 * time.Second // Maximum time allowed to compute the solution
 )
 
+// MaxDifficulty is the highest difficulty, in leading zero bits. Each bit
+// doubles the passes a solution takes, 2^difficulty on average, and a pass
+// over DefaultParams' memory takes tens of milliseconds: at 4 the mean of
+// 16 passes is a second or two, leaving slower solvers room to finish
+// within argon2MaxTime. Memory-bound work is made harder through Params.
+const MaxDifficulty = 4
+
+// MemoryKiB is the memory, in KiB, every argon2 pass of a challenge uses
+// with DefaultParams.
+const MemoryKiB = argon2Memory
+
+// Params are the argon2id parameters of every attempt at a challenge.
+// Solver and verifier must use the same ones, a solution found with other
+// parameters is a different key altogether.
+type Params struct {
+	// Memory is the memory, in KiB, of a pass, Time the number of passes
+	// over it and Threads the lanes filling it in parallel.
+	Memory  uint32
+	Time    uint32
+	Threads uint32
+	// KeyLength is the length of the derived key the difficulty's zero
+	// bits are counted in.
+	KeyLength uint32
+	// SaltLength is the length of generated challenges, which double as the
+	// salt.
+	SaltLength uint32
+}
+
+// DefaultParams are the parameters NewArgon2 uses.
+var DefaultParams = Params{
+	Memory:     argon2Memory,
+	Time:       argon2Time,
+	Threads:    argon2Threads,
+	KeyLength:  argon2KeyLength,
+	SaltLength: argon2TokenLength,
+}
+
+// check reports the first parameter argon2id can't work with. Keys must
+// hold the zero bits of the highest difficulty.
+func (p Params) check() error {
+	switch {
+	case p.Threads < 1 || p.Threads > 255:
+		return fmt.Errorf("%w: threads must be between 1 and 255", ErrInvalidParams)
+	case p.Memory < 8*p.Threads:
+		return fmt.Errorf("%w: memory must be at least 8 KiB per thread", ErrInvalidParams)
+	case p.Time < 1:
+		return fmt.Errorf("%w: time must be at least 1", ErrInvalidParams)
+	case p.KeyLength < 4:
+		return fmt.Errorf("%w: key length must be at least 4", ErrInvalidParams)
+	case p.SaltLength < 8:
+		return fmt.Errorf("%w: salt length must be at least 8", ErrInvalidParams)
+	}
+	return nil
+}
+
 var (
 	ErrDifficultyRange = errors.New("difficulty out of acceptable range")
 	ErrGenerateRandom  = errors.New("failed to generate random challenge")
 	ErrArgon2Timeout   = errors.New("argon2 solution computation timed out")
 	ErrInvalidSolution = errors.New("invalid argon2 solution")
 	ErrInvalidFormat   = errors.New("invalid solution format")
+	ErrInvalidParams   = errors.New("invalid argon2 parameters")
 )
 
-// Argon2 encapsulates the Argon2-based proof-of-work mechanism.
+// Argon2 encapsulates the Argon2-based proof-of-work mechanism. Like
+// hashcash, a solution is a nonce found by search: the argon2id key of the
+// challenge followed by the decimal nonce, salted with the challenge, must
+// start with as many zero bits as the difficulty. Every attempt is a full
+// pass over the memory of its Params.
 type Argon2 struct {
-	difficultyLevel uint64
+	difficultyLevel atomic.Uint64
+	params          Params
+	random          io.Reader
+	logger          Logger
 }
 
-// Solution represents an Argon2 proof-of-work solution
-type Solution struct {
-	Hash string
-	Salt string
+// Logger receives the debug line of every verification. A *slog.Logger
+// is one; its level is checked before the line is built.
+type Logger interface {
+	Debug(msg string, args ...any)
 }
 
+// nopLogger is the Logger of an Argon2 nobody gave one.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+
 // NewArgon2 initializes a new Argon2 proof-of-work with a specified difficulty.
 func NewArgon2(difficulty uint64) (*Argon2, error) {
-	if difficulty < 1 || difficulty > 10 {
-		return nil, fmt.Errorf("%w: difficulty must be between 1 and 10", ErrDifficultyRange)
+	return NewArgon2WithParams(difficulty, DefaultParams)
+}
+
+// NewArgon2WithParams is like NewArgon2 but derives keys with p instead of
+// DefaultParams.
+func NewArgon2WithParams(difficulty uint64, p Params) (*Argon2, error) {
+	if err := checkDifficulty(difficulty); err != nil {
+		return nil, err
 	}
-	return &Argon2{
-		difficultyLevel: difficulty,
-	}, nil
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	pow := &Argon2{
+		params: p,
+		random: rand.Reader,
+		logger: nopLogger{},
+	}
+	pow.difficultyLevel.Store(difficulty)
+	return pow, nil
+}
+
+func checkDifficulty(difficulty uint64) error {
+	if difficulty < 1 || difficulty > MaxDifficulty {
+		return fmt.Errorf("%w: difficulty must be between 1 and %d", ErrDifficultyRange, MaxDifficulty)
+	}
+	return nil
+}
+
+// SetDifficulty changes the difficulty at runtime. It is safe to call while
+// challenges are being generated, solved and verified.
+func (pow *Argon2) SetDifficulty(difficulty uint64) error {
+	if err := checkDifficulty(difficulty); err != nil {
+		return err
+	}
+	pow.difficultyLevel.Store(difficulty)
+	return nil
+}
+
+// UseRandom makes the Argon2 read challenge tokens from r, such as a
+// pow.EntropyPool, instead of crypto/rand directly.
+func (pow *Argon2) UseRandom(r io.Reader) {
+	pow.random = r
+}
+
+// UseLogger makes the Argon2 log verification details to logger, at debug
+// level. Without one nothing is logged.
+func (pow *Argon2) UseLogger(logger Logger) {
+	pow.logger = logger
+}
+
+// debugEnabled reports whether the logger would keep a debug line.
+func (pow *Argon2) debugEnabled() bool {
+	switch logger := pow.logger.(type) {
+	case nopLogger:
+		return false
+	case interface {
+		Enabled(context.Context, slog.Level) bool
+	}:
+		return logger.Enabled(context.Background(), slog.LevelDebug)
+	default:
+		return true
+	}
+}
+
+// base64Value defers base64 encoding bytes until a log record is handled.
+type base64Value []byte
+
+func (v base64Value) LogValue() slog.Value {
+	return slog.StringValue(base64.StdEncoding.EncodeToString(v))
 }
 
 // GenerateChallenge creates a new cryptographically secure random challenge token.
 func (pow *Argon2) GenerateChallenge() ([]byte, error) {
-	bytes := make([]byte, argon2TokenLength)
-	if _, err := rand.Read(bytes); err != nil {
+	bytes := make([]byte, pow.params.SaltLength)
+	if _, err := io.ReadFull(pow.random, bytes); err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrGenerateRandom, err)
 	}
 	return bytes, nil
 }
 
-// FindSolution computes a valid Argon2 solution for the challenge.
-// Returns a solution string in the format "hash$salt" for verification.
+// FindSolution searches for a nonce solving the challenge and returns it
+// in decimal, giving up after argon2MaxTime.
+//
+// There is no state worth caching between attempts: argon2 hashes the
+// challenge, nonce and parameters into its initial block before filling any
+// memory, and every block depends on it, so every attempt recomputes the
+// whole memory. The 64MB of memory would be the one reusable thing, but
+// x/crypto/argon2 allocates it per call and offers no way to pass it in.
+// The 64MB are those of DefaultParams.
 func (pow *Argon2) FindSolution(challenge []byte) (string, error) {
-	// Generate a random salt
-	salt := make([]byte, argon2SaltLength)
-	if _, err := rand.Read(salt); err != nil {
-		return "", fmt.Errorf("%w: %v", ErrGenerateRandom, err)
-	}
-
-	// Start a timeout for Argon2 computation
-	done := make(chan string, 1)
-
-	go func() {
-		// Derive key using Argon2 with memory constraints
-		key := argon2.IDKey(challenge, salt, uint32(pow.difficultyLevel), argon2Memory, argon2Threads, argon2KeyLength)
+	return pow.FindSolutionContext(context.Background(), challenge)
+}
 
-		// Encode both the key and salt in base64
-		hashStr := base64.StdEncoding.EncodeToString(key)
-		saltStr := base64.StdEncoding.EncodeToString(salt)
+// FindSolutionContext is like FindSolution but also gives up once ctx is
+// done.
+func (pow *Argon2) FindSolutionContext(ctx context.Context, challenge []byte) (string, error) {
+	return pow.findSolution(ctx, challenge, pow.difficultyLevel.Load())
+}
 
-		// Combine hash and salt with a separator
-		solution := fmt.Sprintf("%s$%s", hashStr, saltStr)
-		done <- solution
-	}()
+// FindSolutionWithDifficulty is like FindSolutionContext but solves at
+// difficulty instead of the Argon2's own, such as one a server sent with
+// the challenge.
+func (pow *Argon2) FindSolutionWithDifficulty(ctx context.Context, challenge []byte, difficulty uint64) (string, error) {
+	if err := checkDifficulty(difficulty); err != nil {
+		return "", err
+	}
+	return pow.findSolution(ctx, challenge, difficulty)
+}
 
-	select {
-	case solution := <-done:
-		return solution, nil
-	case <-time.After(argon2MaxTime):
-		return "", ErrArgon2Timeout
+func (pow *Argon2) findSolution(ctx context.Context, challenge []byte, difficulty uint64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, argon2MaxTime)
+	defer cancel()
+
+	for nonce := uint64(0); ; nonce++ {
+		// A pass takes long enough to check the context before each one
+		if err := ctx.Err(); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrArgon2Timeout, err)
+		}
+		if leadingZeroBits(pow.computeKey(challenge, nonce)) >= difficulty {
+			return strconv.FormatUint(nonce, 10), nil
+		}
 	}
 }
 
 // Verify checks if the provided solution satisfies the challenge.
-// Solution should be in the format "hash$salt" where both are base64 encoded.
+// Solution should be a decimal nonce.
 func (pow *Argon2) Verify(challenge []byte, solutionStr string) (bool, error) {
-	// Split the solution string to get hash and salt
-	parts := strings.Split(solutionStr, "$")
-	if len(parts) != 2 {
-		return false, ErrInvalidFormat
-	}
+	return pow.VerifyWithDifficulty(challenge, solutionStr, pow.difficultyLevel.Load())
+}
 
-	// Decode the hash and salt from base64
-	hash, err := base64.StdEncoding.DecodeString(parts[0])
+// VerifyWithDifficulty is like Verify but checks the solution against
+// difficulty instead of the Argon2's own, such as the one the challenge
+// was issued at before a SetDifficulty.
+func (pow *Argon2) VerifyWithDifficulty(challenge []byte, solutionStr string, difficulty uint64) (bool, error) {
+	if err := checkDifficulty(difficulty); err != nil {
+		return false, err
+	}
+	nonce, err := parseSolution(solutionStr)
 	if err != nil {
-		return false, fmt.Errorf("invalid hash encoding: %v", err)
+		return false, err
+	}
+
+	computedKey := pow.computeKey(challenge, nonce)
+
+	// Production verification pays nothing for this: the arguments aren't
+	// even built unless debug logs are enabled, and the encodings are only
+	// computed if a handler formats them
+	if pow.debugEnabled() {
+		pow.logger.Debug("argon2 verification",
+			"challenge", base64Value(challenge),
+			"solution", solutionStr,
+			"computed_key", base64Value(computedKey),
+			"difficulty", difficulty)
 	}
 
-	salt, err := base64.StdEncoding.DecodeString(parts[1])
+	return leadingZeroBits(computedKey) >= difficulty, nil
+}
+
+// Explain returns the key derived from the challenge and the solution's
+// nonce, base64 encoded, next to the zero bits it must start with, so a
+// rejected solution can be diagnosed.
+func (pow *Argon2) Explain(challenge []byte, solutionStr string) (computed, expected string, err error) {
+	nonce, err := parseSolution(solutionStr)
 	if err != nil {
-		return false, fmt.Errorf("invalid salt encoding: %v", err)
+		return "", "", err
 	}
+	computedKey := pow.computeKey(challenge, nonce)
+	expected = fmt.Sprintf("%d leading zero bits", pow.difficultyLevel.Load())
+	return base64.StdEncoding.EncodeToString(computedKey), expected, nil
+}
 
-	// Derive the key using the same parameters and salt
-	computedKey := argon2.IDKey(challenge, salt, uint32(pow.difficultyLevel), argon2Memory, argon2Threads, argon2KeyLength)
+// computeKey derives the key for one attempt. The challenge doubles as the
+// salt, it is random and unique per challenge already.
+func (pow *Argon2) computeKey(challenge []byte, nonce uint64) []byte {
+	password := strconv.AppendUint(append([]byte(nil), challenge...), nonce, 10)
+	p := pow.params
+	return argon2.IDKey(password, challenge, p.Time, p.Memory, uint8(p.Threads), p.KeyLength)
+}
 
-	// Debugging output
-	fmt.Printf("Challenge: %s\n", base64.StdEncoding.EncodeToString(challenge))
-	fmt.Printf("Solution: %s\n", solutionStr)
-	fmt.Printf("Computed Key: %s\n", base64.StdEncoding.EncodeToString(computedKey))
-	fmt.Printf("Provided Hash: %s\n", base64.StdEncoding.EncodeToString(hash))
-	fmt.Printf("Salt: %s\n", base64.StdEncoding.EncodeToString(salt))
+// leadingZeroBits counts the zero bits key starts with.
+func leadingZeroBits(key []byte) uint64 {
+	var zeros uint64
+	for _, b := range key {
+		zeros += uint64(bits.LeadingZeros8(b))
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
 
-	// Compare the computed key with the provided hash
-	if len(computedKey) != len(hash) || subtle.ConstantTimeCompare(computedKey, hash) != 1 {
-		return false, nil
+// parseSolution decodes a decimal nonce.
+func parseSolution(solutionStr string) (uint64, error) {
+	nonce, err := strconv.ParseUint(solutionStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidFormat, err)
 	}
+	return nonce, nil
+}
+
+// ExpectedIterations returns the number of passes over memory a solver
+// makes on average for the given difficulty: every pass meets the
+// difficulty with probability 2^-difficulty.
+func ExpectedIterations(difficulty uint64) float64 {
+	return float64(uint64(1) << difficulty)
+}
 
-	return true, nil
+// ExpectedSolveTime estimates how long solving takes at the given
+// difficulty on a machine where one pass over memory takes passDuration.
+func ExpectedSolveTime(difficulty uint64, passDuration time.Duration) time.Duration {
+	return time.Duration(ExpectedIterations(difficulty) * float64(passDuration))
 }
 
 // GetDifficulty returns the current difficulty level
 func (pow *Argon2) GetDifficulty() uint64 {
-	return pow.difficultyLevel
+	return pow.difficultyLevel.Load()
+}
+
+// Params returns the parameters keys are derived with.
+func (pow *Argon2) Params() Params {
+	return pow.params
 }
@@ -0,0 +1,325 @@
+package argon2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpectedSolveTimeScalesWithDifficulty(t *testing.T) {
+	for difficulty := uint64(1); difficulty <= 10; difficulty++ {
+		passes := 1 << difficulty
+		if got := ExpectedIterations(difficulty); got != float64(passes) {
+			t.Fatalf("expected %d passes, got %v", passes, got)
+		}
+		if got := ExpectedSolveTime(difficulty, 50*time.Millisecond); got != time.Duration(passes)*50*time.Millisecond {
+			t.Fatalf("expected %d passes of 50ms, got %v", passes, got)
+		}
+	}
+}
+
+func TestFindSolutionRoundTrip(t *testing.T) {
+	for _, difficulty := range []uint64{1, 2} {
+		pow, err := NewArgon2(difficulty)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		challenge, err := pow.GenerateChallenge()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		solution, err := pow.FindSolution(challenge)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok, err := pow.Verify(challenge, solution); err != nil || !ok {
+			t.Fatalf("expected nonce %q to verify at difficulty %d, got %v, %v", solution, difficulty, ok, err)
+		}
+		if key := pow.computeKey(challenge, mustParse(t, solution)); leadingZeroBits(key) < difficulty {
+			t.Fatalf("expected at least %d zero bits, got key %x", difficulty, key)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	pow, err := NewArgon2(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	challenge := []byte("challenge")
+
+	// Find a nonce that fails the difficulty, half of them do
+	var nonce uint64
+	for leadingZeroBits(pow.computeKey(challenge, nonce)) >= 1 {
+		nonce++
+	}
+	if ok, err := pow.Verify(challenge, strconv.FormatUint(nonce, 10)); err != nil || ok {
+		t.Fatalf("expected nonce %d to be rejected, got %v, %v", nonce, ok, err)
+	}
+
+	for _, solution := range []string{"", "-1", "abc", "hash$salt"} {
+		if _, err := pow.Verify(challenge, solution); !errors.Is(err, ErrInvalidFormat) {
+			t.Fatalf("expected ErrInvalidFormat for %q, got %v", solution, err)
+		}
+	}
+}
+
+// testParams keep passes cheap enough to solve the highest difficulty in tests.
+var testParams = Params{Memory: 64, Time: 1, Threads: 1, KeyLength: 32, SaltLength: 16}
+
+func TestMismatchedParamsFailVerification(t *testing.T) {
+	const difficulty = MaxDifficulty
+	solver, err := NewArgon2WithParams(difficulty, testParams)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	challenge, err := solver.GenerateChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(challenge) != int(testParams.SaltLength) {
+		t.Fatalf("expected a %d-byte challenge, got %d bytes", testParams.SaltLength, len(challenge))
+	}
+	challenge = []byte("fixed challenge!") // Keeps the outcome below deterministic
+	solution, err := solver.FindSolution(challenge)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	matching, err := NewArgon2WithParams(difficulty, testParams)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok, err := matching.Verify(challenge, solution); err != nil || !ok {
+		t.Fatalf("expected the solution to verify with the same params, got %v, %v", ok, err)
+	}
+
+	moreMemory, moreTime := testParams, testParams
+	moreMemory.Memory *= 2
+	moreTime.Time++
+	for _, p := range []Params{moreMemory, moreTime} {
+		verifier, err := NewArgon2WithParams(difficulty, p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok, err := verifier.Verify(challenge, solution); err != nil || ok {
+			t.Fatalf("expected the solution to fail with params %+v, got %v, %v", p, ok, err)
+		}
+	}
+}
+
+func TestNewArgon2WithParamsValidates(t *testing.T) {
+	if pow, err := NewArgon2(1); err != nil || pow.Params() != DefaultParams {
+		t.Fatalf("expected NewArgon2 to use DefaultParams, got %+v, %v", pow.Params(), err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Params)
+	}{
+		{"no threads", func(p *Params) { p.Threads = 0 }},
+		{"too many threads", func(p *Params) { p.Threads = 256; p.Memory = 8 * 256 }},
+		{"memory below 8 KiB per thread", func(p *Params) { p.Memory = 8*p.Threads - 1 }},
+		{"no time", func(p *Params) { p.Time = 0 }},
+		{"short key", func(p *Params) { p.KeyLength = 3 }},
+		{"short salt", func(p *Params) { p.SaltLength = 7 }},
+	}
+	for _, tt := range tests {
+		p := DefaultParams
+		tt.modify(&p)
+		if _, err := NewArgon2WithParams(1, p); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("%s: expected ErrInvalidParams, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestFindSolutionContextCancelled(t *testing.T) {
+	pow, err := NewArgon2(MaxDifficulty)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pow.FindSolutionContext(ctx, []byte("challenge")); !errors.Is(err, ErrArgon2Timeout) {
+		t.Fatalf("expected ErrArgon2Timeout, got %v", err)
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		key  []byte
+		want uint64
+	}{
+		{[]byte{0xff}, 0},
+		{[]byte{0x01, 0xff}, 7},
+		{[]byte{0x00, 0x40}, 9},
+		{[]byte{0x00, 0x00}, 16},
+	}
+	for _, tt := range tests {
+		if got := leadingZeroBits(tt.key); got != tt.want {
+			t.Fatalf("expected %d zero bits in %x, got %d", tt.want, tt.key, got)
+		}
+	}
+}
+
+func mustParse(t *testing.T, solution string) uint64 {
+	t.Helper()
+	nonce, err := parseSolution(solution)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return nonce
+}
+
+// BenchmarkFindSolution measures one solution, which takes 2^difficulty
+// full passes over the memory on average.
+func BenchmarkFindSolution(b *testing.B) {
+	pow, err := NewArgon2(1)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	challenge, err := pow.GenerateChallenge()
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := pow.FindSolution(challenge); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestVerifyDebugLogging(t *testing.T) {
+	for _, level := range []slog.Level{slog.LevelInfo, slog.LevelDebug} {
+		t.Run(level.String(), func(t *testing.T) {
+			pow, err := NewArgon2(1)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var logs bytes.Buffer
+			pow.UseLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: level})))
+
+			challenge := []byte("challenge")
+			solution, err := pow.FindSolution(challenge)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok, err := pow.Verify(challenge, solution); err != nil || !ok {
+				t.Fatalf("expected the solution to verify, got %v, %v", ok, err)
+			}
+
+			encoded := "challenge=" + base64.StdEncoding.EncodeToString(challenge)
+			if logged := strings.Contains(logs.String(), encoded); logged != (level == slog.LevelDebug) {
+				t.Fatalf("expected encodings logged only at debug level, got at %s:\n%s", level, logs.String())
+			}
+		})
+	}
+}
+
+// recordingLogger keeps the message of every debug line.
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Debug(msg string, _ ...any) {
+	l.lines = append(l.lines, msg)
+}
+
+// captureStdout returns what f writes to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	captured := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		captured <- string(out)
+	}()
+	f()
+	w.Close()
+	return <-captured
+}
+
+func TestVerifyWritesNothingToStdout(t *testing.T) {
+	challenge := []byte("challenge")
+	for _, logger := range []*recordingLogger{nil, {}} {
+		pow, err := NewArgon2(1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if logger != nil {
+			pow.UseLogger(logger)
+		}
+		solution, err := pow.FindSolution(challenge)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		out := captureStdout(t, func() {
+			if ok, err := pow.Verify(challenge, solution); err != nil || !ok {
+				t.Errorf("expected the solution to verify, got %v, %v", ok, err)
+			}
+		})
+		if out != "" {
+			t.Fatalf("expected no output, got %q", out)
+		}
+		if logger != nil && len(logger.lines) != 1 {
+			t.Fatalf("expected a single debug line, got %q", logger.lines)
+		}
+	}
+}
+
+// countingHandler counts records without formatting them, so only the
+// cost of building log arguments is measured.
+type countingHandler struct {
+	level slog.Level
+	count int
+}
+
+func (h *countingHandler) Enabled(_ context.Context, level slog.Level) bool { return level >= h.level }
+func (h *countingHandler) Handle(context.Context, slog.Record) error        { h.count++; return nil }
+func (h *countingHandler) WithAttrs([]slog.Attr) slog.Handler               { return h }
+func (h *countingHandler) WithGroup(string) slog.Handler                    { return h }
+
+// BenchmarkVerifyLoggingOff verifies with debug logging off; allocations
+// match verifying with logging never configured.
+func BenchmarkVerifyLoggingOff(b *testing.B) {
+	pow, err := NewArgon2(1)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	handler := &countingHandler{level: slog.LevelInfo}
+	pow.UseLogger(slog.New(handler))
+	challenge := []byte("challenge")
+	solution, err := pow.FindSolution(challenge)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := pow.Verify(challenge, solution); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if handler.count != 0 {
+		b.Fatalf("expected no debug records, got %d", handler.count)
+	}
+}
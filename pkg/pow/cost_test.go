@@ -0,0 +1,273 @@
+package pow
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"faraway/pkg/pow/argon2"
+	"faraway/pkg/pow/hashcash"
+)
+
+// The matched-cost benchmarks compare the CPU-bound and the memory-bound
+// proof of work as the server would run them against each other: each at
+// the difficulty whose expected solve time on this machine is closest to
+// -pow.target. Argon2's time cost, memory and lanes are fixed by the
+// protocol, so its difficulty is all there is to calibrate. Run them with
+//
+//	go test ./pkg/pow -run '^$' -bench MatchedCost -pow.target 250ms
+//
+// and read the comparison printed at the end: the spread of solve times,
+// and the time and memory a server spends verifying one solution.
+var costTarget = flag.Duration("pow.target", 100*time.Millisecond, "solve time the matched-cost benchmarks calibrate difficulties to")
+
+// algorithmCost is one algorithm calibrated to the target solve time, and
+// what was measured at that difficulty.
+type algorithmCost struct {
+	name       string
+	difficulty uint64
+	expected   time.Duration
+	solve      func(challenge []byte) (string, error)
+	verify     func(challenge []byte, solution string) (bool, error)
+
+	solveTimes  []time.Duration
+	verifyTime  time.Duration
+	verifyBytes uint64
+}
+
+// matchDifficulty returns the difficulty within [minimum, maximum] whose
+// expected solve time, iterations(difficulty) tries taking perTry each, is
+// closest to target. Difficulties grow the cost geometrically, so closeness
+// is their ratio.
+func matchDifficulty(iterations func(uint64) float64, perTry, target time.Duration, minimum, maximum uint64) uint64 {
+	best, bestDistance := minimum, math.Inf(1)
+	for difficulty := minimum; difficulty <= maximum; difficulty++ {
+		expected := iterations(difficulty) * float64(perTry)
+		if distance := math.Abs(math.Log(expected / float64(target))); distance < bestDistance {
+			best, bestDistance = difficulty, distance
+		}
+	}
+	return best
+}
+
+// hashcashTryTime measures how long hashcash takes per nonce, from the
+// nonces tried solving a batch of easy challenges.
+func hashcashTryTime(b *testing.B) time.Duration {
+	pow, err := hashcash.NewHashCash(2)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	var tries uint64
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		var nonce uint64
+		if _, err := fmt.Sscan(pow.FindSolution(fmt.Appendf(nil, "calibration-%d", i)), &nonce); err != nil {
+			b.Fatalf("unexpected error parsing nonce: %v", err)
+		}
+		tries += nonce + 1
+	}
+	return time.Since(start) / time.Duration(tries)
+}
+
+// argon2PassTime measures one argon2 pass, the cost of every nonce tried
+// and of every verification.
+func argon2PassTime(b *testing.B) time.Duration {
+	pow, err := argon2.NewArgon2(1)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	const passes = 3
+	start := time.Now()
+	for i := 0; i < passes; i++ {
+		if _, err := pow.Verify([]byte("calibration"), "0"); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return time.Since(start) / passes
+}
+
+// calibrate sets both algorithms up at the difficulty matching target.
+func calibrate(b *testing.B, target time.Duration) []*algorithmCost {
+	tryTime := hashcashTryTime(b)
+	cpuDifficulty := matchDifficulty(hashcash.ExpectedIterations, tryTime, target, 1, 8)
+	cpu, err := hashcash.NewHashCash(cpuDifficulty)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	passTime := argon2PassTime(b)
+	memoryDifficulty := matchDifficulty(argon2.ExpectedIterations, passTime, target, 1, 10)
+	memory, err := argon2.NewArgon2(memoryDifficulty)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	return []*algorithmCost{
+		{
+			name:       "cpu",
+			difficulty: cpuDifficulty,
+			expected:   time.Duration(hashcash.ExpectedIterations(cpuDifficulty) * float64(tryTime)),
+			solve: func(challenge []byte) (string, error) {
+				return cpu.FindSolution(challenge), nil
+			},
+			verify: func(challenge []byte, solution string) (bool, error) {
+				return cpu.Verify(challenge, []byte(solution)), nil
+			},
+		},
+		{
+			name:       "memory",
+			difficulty: memoryDifficulty,
+			expected:   argon2.ExpectedSolveTime(memoryDifficulty, passTime),
+			solve:      memory.FindSolution,
+			verify:     memory.Verify,
+		},
+	}
+}
+
+// BenchmarkMatchedCost solves and verifies with both algorithms at
+// matched cost. Solve times are geometrically distributed for both, so
+// their coefficient of variation is near one whatever the target.
+func BenchmarkMatchedCost(b *testing.B) {
+	costs := calibrate(b, *costTarget)
+	for _, cost := range costs {
+		b.Run(cost.name+"/solve", func(b *testing.B) {
+			cost.solveTimes = cost.solveTimes[:0]
+			for i := 0; i < b.N; i++ {
+				challenge := fmt.Appendf(nil, "challenge-%d", i)
+				start := time.Now()
+				if _, err := cost.solve(challenge); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				cost.solveTimes = append(cost.solveTimes, time.Since(start))
+			}
+			spread := summarizeSolveTimes(cost.solveTimes)
+			b.ReportMetric(float64(spread.p50)/float64(time.Millisecond), "p50-ms")
+			b.ReportMetric(float64(spread.p90)/float64(time.Millisecond), "p90-ms")
+			b.ReportMetric(spread.cv, "cv")
+		})
+
+		b.Run(cost.name+"/verify", func(b *testing.B) {
+			challenge := []byte("challenge")
+			solution, err := cost.solve(challenge)
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if ok, err := cost.verify(challenge, solution); err != nil || !ok {
+					b.Fatalf("expected the solution to verify, got %v, %v", ok, err)
+				}
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			cost.verifyTime = b.Elapsed() / time.Duration(b.N)
+			cost.verifyBytes = (after.TotalAlloc - before.TotalAlloc) / uint64(b.N)
+		})
+	}
+	reportComparison(os.Stdout, *costTarget, costs)
+}
+
+// solveSpread summarizes a sample of solve times.
+type solveSpread struct {
+	p50, p90 time.Duration
+	// cv is the standard deviation over the mean.
+	cv float64
+}
+
+func summarizeSolveTimes(times []time.Duration) solveSpread {
+	if len(times) == 0 {
+		return solveSpread{}
+	}
+	sorted := slices.Clone(times)
+	slices.Sort(sorted)
+
+	var sum float64
+	for _, t := range sorted {
+		sum += float64(t)
+	}
+	mean := sum / float64(len(sorted))
+	var squares float64
+	for _, t := range sorted {
+		squares += (float64(t) - mean) * (float64(t) - mean)
+	}
+	return solveSpread{
+		p50: sorted[len(sorted)/2],
+		p90: sorted[len(sorted)*9/10],
+		cv:  math.Sqrt(squares/float64(len(sorted))) / mean,
+	}
+}
+
+// reportComparison prints the calibrated algorithms side by side, to
+// stdout as the testing package drops the logs of benchmarks with
+// sub-benchmarks. Columns of benchmarks left out by -bench are blank.
+func reportComparison(out io.Writer, target time.Duration, costs []*algorithmCost) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "matched cost at %s per solve\n", target)
+	fmt.Fprintln(w, "algorithm\tdifficulty\texpected\tsolves\tp50\tp90\tcv\tverify\tverify bytes")
+	for _, cost := range costs {
+		fmt.Fprintf(w, "%s\t%d\t%s\t", cost.name, cost.difficulty, cost.expected.Round(time.Microsecond))
+		if spread := summarizeSolveTimes(cost.solveTimes); len(cost.solveTimes) > 0 {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%.2f\t", len(cost.solveTimes), spread.p50.Round(time.Microsecond), spread.p90.Round(time.Microsecond), spread.cv)
+		} else {
+			fmt.Fprint(w, "\t\t\t\t")
+		}
+		if cost.verifyTime > 0 {
+			fmt.Fprintf(w, "%s\t%d\n", cost.verifyTime, cost.verifyBytes)
+		} else {
+			fmt.Fprint(w, "\t\n")
+		}
+	}
+	w.Flush()
+}
+
+func TestMatchDifficulty(t *testing.T) {
+	tests := []struct {
+		name       string
+		iterations func(uint64) float64
+		perTry     time.Duration
+		target     time.Duration
+		want       uint64
+	}{
+		// 16^4 tries of 1µs take 65ms, 16^5 take a second
+		{"cpu", hashcash.ExpectedIterations, time.Microsecond, 100 * time.Millisecond, 4},
+		{"cpu slow machine", hashcash.ExpectedIterations, 20 * time.Microsecond, time.Second, 4},
+		// 2^3 passes of 50ms take 400ms
+		{"memory", argon2.ExpectedIterations, 50 * time.Millisecond, 400 * time.Millisecond, 3},
+		{"memory below the range", argon2.ExpectedIterations, 50 * time.Millisecond, time.Millisecond, 1},
+		{"memory above the range", argon2.ExpectedIterations, 50 * time.Millisecond, time.Hour, 10},
+	}
+	for _, tt := range tests {
+		if got := matchDifficulty(tt.iterations, tt.perTry, tt.target, 1, 10); got != tt.want {
+			t.Fatalf("%s: expected difficulty %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestSummarizeSolveTimes(t *testing.T) {
+	var times []time.Duration
+	for i := 1; i <= 10; i++ {
+		times = append(times, time.Duration(i)*time.Millisecond)
+	}
+	spread := summarizeSolveTimes(times)
+	if spread.p50 != 6*time.Millisecond || spread.p90 != 10*time.Millisecond {
+		t.Fatalf("unexpected percentiles %+v", spread)
+	}
+	// The standard deviation of 1..10 is sqrt(8.25), the mean 5.5
+	if math.Abs(spread.cv-math.Sqrt(8.25)/5.5) > 1e-9 {
+		t.Fatalf("unexpected coefficient of variation %v", spread.cv)
+	}
+	if (summarizeSolveTimes(nil) != solveSpread{}) {
+		t.Fatal("expected an empty spread for no solves")
+	}
+}
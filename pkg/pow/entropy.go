@@ -0,0 +1,57 @@
+package pow
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+// DefaultEntropyPoolSize is the number of random bytes fetched from the
+// system per refill when no size is given.
+const DefaultEntropyPoolSize = 4096
+
+// EntropyPool is an io.Reader that serves bytes from crypto/rand in large
+// chunks, so issuing many small challenges costs one system call per chunk
+// instead of one per challenge. Every byte is handed out at most once, so
+// the output is exactly as strong as crypto/rand itself.
+type EntropyPool struct {
+	source io.Reader
+
+	mu  sync.Mutex
+	buf []byte
+	off int
+}
+
+// NewEntropyPool returns a pool refilled size bytes at a time.
+func NewEntropyPool(size int) *EntropyPool {
+	if size <= 0 {
+		size = DefaultEntropyPoolSize
+	}
+	return &EntropyPool{
+		source: rand.Reader,
+		buf:    make([]byte, size),
+		off:    size,
+	}
+}
+
+// Read fills p with random bytes, refilling the pool as needed.
+func (p *EntropyPool) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for n < len(b) {
+		if p.off == len(p.buf) {
+			if _, err := io.ReadFull(p.source, p.buf); err != nil {
+				return n, err
+			}
+			p.off = 0
+		}
+		copied := copy(b[n:], p.buf[p.off:])
+		// Wipe served bytes so they can't leak through a later refill failure
+		clear(p.buf[p.off : p.off+copied])
+		p.off += copied
+		n += copied
+	}
+	return n, nil
+}
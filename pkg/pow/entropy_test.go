@@ -0,0 +1,61 @@
+package pow
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestEntropyPoolServesEachByteOnce(t *testing.T) {
+	var source bytes.Buffer
+	for i := 0; i < 64; i++ {
+		source.WriteByte(byte(i))
+	}
+	pool := NewEntropyPool(16)
+	pool.source = &source
+
+	var got []byte
+	for i := 0; i < 4; i++ {
+		chunk := make([]byte, 16)
+		if _, err := io.ReadFull(pool, chunk); err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		got = append(got, chunk...)
+	}
+
+	for i, b := range got {
+		if b != byte(i) {
+			t.Fatalf("expected byte %d at offset %d, got %d", i, i, b)
+		}
+	}
+}
+
+func TestEntropyPoolSourceError(t *testing.T) {
+	pool := NewEntropyPool(16)
+	pool.source = bytes.NewReader(nil)
+
+	if _, err := pool.Read(make([]byte, 8)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the source error, got %v", err)
+	}
+}
+
+func BenchmarkChallengeEntropy(b *testing.B) {
+	readers := map[string]io.Reader{
+		"crypto/rand": rand.Reader,
+		"pool":        NewEntropyPool(DefaultEntropyPoolSize),
+	}
+	for name, reader := range readers {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				token := make([]byte, 16)
+				for pb.Next() {
+					if _, err := reader.Read(token); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
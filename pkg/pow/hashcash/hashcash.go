@@ -46,17 +46,26 @@ package hashcash
 */
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	tokenLength   = 16
-	maxDifficulty = 64 // Maximum possible difficulty (SHA-256 output length)
+	tokenLength = 16
+
+	// MaxDifficulty is the highest difficulty, the hex digits of a SHA-256.
+	MaxDifficulty = 64
+
+	ctxCheckInterval = 4096 // Number of nonces tried between context checks
 )
 
 var (
@@ -67,69 +76,220 @@ var (
 
 // ProofOfWork encapsulates a proof-of-work mechanism.
 type HashCash struct {
-	difficultyLevel uint64
+	difficultyLevel atomic.Uint64
+	random          io.Reader
+	encoding        NonceEncoding
+	workers         int
+
+	progressInterval time.Duration
+	reportProgress   func(Progress)
 }
 
 // NewHashCash initializes a ProofOfWork with a specified difficulty.
 func NewHashCash(difficulty uint64) (*HashCash, error) {
-	if difficulty < 1 || difficulty > maxDifficulty {
-		return nil, fmt.Errorf("%w: difficulty must be between 1 and %d", ErrDifficultyRange, maxDifficulty)
+	if err := checkDifficulty(difficulty); err != nil {
+		return nil, err
+	}
+
+	pow := &HashCash{
+		random:  rand.Reader,
+		workers: 1,
+	}
+	pow.difficultyLevel.Store(difficulty)
+	return pow, nil
+}
+
+func checkDifficulty(difficulty uint64) error {
+	if difficulty < 1 || difficulty > MaxDifficulty {
+		return fmt.Errorf("%w: difficulty must be between 1 and %d", ErrDifficultyRange, MaxDifficulty)
+	}
+	return nil
+}
+
+// SetDifficulty changes the difficulty at runtime. It is safe to call while
+// challenges are being generated, solved and verified.
+func (pow *HashCash) SetDifficulty(difficulty uint64) error {
+	if err := checkDifficulty(difficulty); err != nil {
+		return err
 	}
+	pow.difficultyLevel.Store(difficulty)
+	return nil
+}
 
-	return &HashCash{
-		difficultyLevel: difficulty,
-	}, nil
+// UseRandom makes the HashCash read challenge tokens from r, such as a
+// pow.EntropyPool, instead of crypto/rand directly.
+func (pow *HashCash) UseRandom(r io.Reader) {
+	pow.random = r
 }
 
 // GenerateChallenge creates a new challenge using cryptographically secure random numbers.
 func (pow *HashCash) GenerateChallenge() ([]byte, error) {
 	bytes := make([]byte, tokenLength)
-	if _, err := rand.Read(bytes); err != nil {
+	if _, err := io.ReadFull(pow.random, bytes); err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrGenerateRandom, err)
 	}
 	return bytes, nil
 }
 
 // Verify checks if the provided solution satisfies the challenge.
+// The solution's tag, if any, tells how its nonce was encoded.
 func (pow *HashCash) Verify(challengeBytes []byte, solutionBytes []byte) bool {
-	hash := sha256.Sum256([]byte(string(challengeBytes) + string(solutionBytes)))
-	hashStr := hex.EncodeToString(hash[:])
+	return pow.VerifyWithDifficulty(challengeBytes, solutionBytes, pow.difficultyLevel.Load())
+}
+
+// VerifyWithDifficulty is like Verify but checks the solution against
+// difficulty instead of the HashCash's own, such as the one the challenge
+// was issued at before a SetDifficulty.
+func (pow *HashCash) VerifyWithDifficulty(challengeBytes []byte, solutionBytes []byte, difficulty uint64) bool {
+	hashStr, ok := digest(challengeBytes, solutionBytes)
+	if !ok || checkDifficulty(difficulty) != nil {
+		return false
+	}
 
-	// Debugging output
-	fmt.Printf("Challenge: %s\n", challengeBytes)
-	fmt.Printf("Solution: %s\n", string(solutionBytes))
-	fmt.Printf("Computed Hash: %s\n", hashStr)
+	return strings.HasPrefix(hashStr, strings.Repeat("0", int(difficulty)))
+}
 
-	return strings.HasPrefix(hashStr, strings.Repeat("0", int(pow.difficultyLevel)))
+// Explain returns the hex hash of the challenge and solution next to the
+// zero prefix it must start with, so a rejected solution can be diagnosed.
+func (pow *HashCash) Explain(challengeBytes []byte, solutionBytes []byte) (computed, expected string) {
+	expected = strings.Repeat("0", int(pow.difficultyLevel.Load())) + "..."
+	computed, ok := digest(challengeBytes, solutionBytes)
+	if !ok {
+		return "malformed solution", expected
+	}
+	return computed, expected
+}
+
+// digest returns the hex SHA-256 of the challenge followed by the nonce of
+// the solution, or false if the solution can't be parsed.
+func digest(challengeBytes []byte, solutionBytes []byte) (string, bool) {
+	nonce, ok := parseSolution(solutionBytes)
+	if !ok {
+		return "", false
+	}
+	hash := sha256.Sum256([]byte(string(challengeBytes) + string(nonce)))
+	return hex.EncodeToString(hash[:]), true
 }
 
 func (pow *HashCash) GetDifficulty() uint64 {
-	return pow.difficultyLevel
+	return pow.difficultyLevel.Load()
+}
+
+// ExpectedIterations returns the mean number of nonces a solver tries for
+// the given difficulty. Difficulty counts leading zero hex digits, each of
+// which a hash matches with probability 1/16, so the mean is 16^difficulty.
+// The number of tries is geometrically distributed: the median is about
+// ln(2) times the mean.
+func ExpectedIterations(difficulty uint64) float64 {
+	return math.Pow(16, float64(difficulty))
 }
 
 // FindSolution attempts to compute a valid solution for the challenge.
 func (pow *HashCash) FindSolution(challenge []byte) string {
-	return computeSolution(challenge, pow.difficultyLevel)
+	solution, _ := pow.FindSolutionContext(context.Background(), challenge)
+	return solution
+}
+
+// FindSolutionContext is like FindSolution but gives up once ctx is done.
+func (pow *HashCash) FindSolutionContext(ctx context.Context, challenge []byte) (string, error) {
+	return pow.FindSolutionWithWorkers(ctx, challenge, pow.workers)
+}
+
+// FindSolutionWithWorkers is like FindSolutionContext but searches with the
+// given number of goroutines instead of those set by UseWorkers.
+func (pow *HashCash) FindSolutionWithWorkers(ctx context.Context, challenge []byte, workers int) (string, error) {
+	return pow.findSolution(ctx, challenge, pow.difficultyLevel.Load(), workers)
+}
+
+// FindSolutionWithDifficulty is like FindSolutionWithWorkers but solves at
+// difficulty instead of the HashCash's own, such as one a server sent with
+// the challenge. Zero workers searches with those set by UseWorkers.
+func (pow *HashCash) FindSolutionWithDifficulty(ctx context.Context, challenge []byte, difficulty uint64, workers int) (string, error) {
+	if err := checkDifficulty(difficulty); err != nil {
+		return "", err
+	}
+	if workers == 0 {
+		workers = pow.workers
+	}
+	return pow.findSolution(ctx, challenge, difficulty, workers)
+}
+
+func (pow *HashCash) findSolution(ctx context.Context, challenge []byte, difficulty uint64, workers int) (string, error) {
+	progress := pow.startProgress()
+	defer progress.stop()
+	if workers <= 1 {
+		return computeSolution(ctx, challenge, difficulty, pow.encoding, 0, 1, progress)
+	}
+
+	// Every worker takes its own stride of the nonce space; the first
+	// solution found wins and stops the others
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan string, workers)
+	for worker := 0; worker < workers; worker++ {
+		go func() {
+			if solution, err := computeSolution(ctx, challenge, difficulty, pow.encoding, uint64(worker), uint64(workers), progress); err == nil {
+				results <- solution
+			}
+		}()
+	}
+
+	select {
+	case solution := <-results:
+		return solution, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("%w: %v", ErrTimeout, ctx.Err())
+	}
+}
+
+// UseWorkers sets how many goroutines FindSolution searches nonces with.
+// Solutions are the same kind either way; only the search is faster.
+func (pow *HashCash) UseWorkers(workers int) {
+	pow.workers = max(workers, 1)
+}
+
+// Workers returns how many goroutines FindSolution searches nonces with.
+func (pow *HashCash) Workers() int {
+	return pow.workers
+}
+
+// UseNonceEncoding sets how FindSolution encodes nonces. Verify accepts
+// every encoding regardless.
+func (pow *HashCash) UseNonceEncoding(encoding NonceEncoding) {
+	pow.encoding = encoding
 }
 
 // computeSolution iterates through possible nonces to find a valid solution for the challenge.
-func computeSolution(challenge []byte, difficulty uint64) string {
+// It tries first, then every stride-th nonce after it, counting its tries
+// into progress if not nil.
+func computeSolution(ctx context.Context, challenge []byte, difficulty uint64, encoding NonceEncoding, first, stride uint64, progress *solveProgress) (string, error) {
 	zerosPrefix := strings.Repeat("0", int(difficulty))
-	var nonce int
+	nonce := first
+	data := make([]byte, 0, len(challenge)+20)
+
+	for tries := uint64(0); ; tries++ {
+		// Checking the context on every nonce would slow the search down
+		if tries%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return "", fmt.Errorf("%w: %v", ErrTimeout, err)
+			}
+			if tries > 0 {
+				progress.add(ctxCheckInterval)
+			}
+		}
 
-	for {
 		// Concatenate the challenge and the current nonce
-		data := fmt.Sprintf("%s%d", challenge, nonce)
+		data = encoding.appendNonce(append(data[:0], challenge...), nonce)
 
 		// Compute the SHA-256 hash
-		hash := sha256.Sum256([]byte(data))
+		hash := sha256.Sum256(data)
 		hashStr := hex.EncodeToString(hash[:])
 
 		// Check if the hash has the required number of leading zeros
 		if strings.HasPrefix(hashStr, zerosPrefix) {
-			return fmt.Sprintf("%d", nonce)
+			return encoding.formatSolution(nonce), nil
 		}
 
-		nonce++
+		nonce += stride
 	}
 }
@@ -1,8 +1,19 @@
 package hashcash
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewProofOfWork(t *testing.T) {
@@ -63,6 +74,62 @@ func TestVerify(t *testing.T) {
 	}
 }
 
+func TestVerifyWithDifficulty(t *testing.T) {
+	pow, err := NewHashCash(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	challenge, err := pow.GenerateChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error generating challenge: %v", err)
+	}
+	solution := []byte(pow.FindSolution(challenge))
+
+	// A raise after issuing doesn't invalidate a solution checked at the
+	// difficulty it was found for
+	if err := pow.SetDifficulty(8); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !pow.VerifyWithDifficulty(challenge, solution, 1) {
+		t.Fatal("expected the solution valid at difficulty 1")
+	}
+	for _, difficulty := range []uint64{0, MaxDifficulty + 1} {
+		if pow.VerifyWithDifficulty(challenge, solution, difficulty) {
+			t.Fatalf("expected difficulty %d rejected", difficulty)
+		}
+	}
+}
+
+func TestVerifyWritesNothingToStdout(t *testing.T) {
+	pow, err := NewHashCash(2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	challenge, err := pow.GenerateChallenge()
+	if err != nil {
+		t.Fatalf("unexpected error generating challenge: %v", err)
+	}
+	solution := pow.FindSolution(challenge)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	ok := pow.Verify(challenge, []byte(solution))
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if !ok {
+		t.Fatalf("expected valid proof-of-work verification")
+	}
+	if len(out) != 0 {
+		t.Fatalf("expected no output, got %q", out)
+	}
+}
+
 func TestFindSolution(t *testing.T) {
 	pow, err := NewHashCash(2)
 	if err != nil {
@@ -78,6 +145,67 @@ func TestFindSolution(t *testing.T) {
 	}
 }
 
+func TestFindSolutionWithWorkers(t *testing.T) {
+	pow, err := NewHashCash(3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pow.UseWorkers(4)
+
+	for _, challenge := range []string{"challenge", "another", "third"} {
+		solution := pow.FindSolution([]byte(challenge))
+		if !pow.Verify([]byte(challenge), []byte(solution)) {
+			t.Fatalf("expected valid solution for %q, got %q", challenge, solution)
+		}
+	}
+}
+
+func TestFindSolutionReportsProgress(t *testing.T) {
+	pow, err := NewHashCash(4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// At difficulty 4, "progress-1" takes 81492 tries on one worker
+	for _, workers := range []int{1, 4} {
+		var mu sync.Mutex
+		var reports []Progress
+		pow.UseProgress(0, func(p Progress) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports = append(reports, p)
+		})
+		pow.UseWorkers(workers)
+
+		solution := pow.FindSolution([]byte("progress-1"))
+		if !pow.Verify([]byte("progress-1"), []byte(solution)) {
+			t.Fatalf("expected a valid solution, got %q", solution)
+		}
+
+		mu.Lock()
+		reported := len(reports)
+		mu.Unlock()
+		if reported == 0 {
+			t.Fatalf("%d workers: expected progress reports during the solve", workers)
+		}
+		for i := 1; i < reported; i++ {
+			if reports[i].Tries <= reports[i-1].Tries || reports[i].Elapsed < reports[i-1].Elapsed {
+				t.Fatalf("%d workers: expected progress to grow, got %+v after %+v", workers, reports[i], reports[i-1])
+			}
+		}
+
+		// Workers still searching when the solution was found stop
+		// reporting right away
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		late := len(reports) - reported
+		mu.Unlock()
+		if late != 0 {
+			t.Fatalf("%d workers: expected no reports once solved, got %d", workers, late)
+		}
+	}
+}
+
 func TestFindSolutionWithHigherDifficulty(t *testing.T) {
 	pow, err := NewHashCash(4)
 	if err != nil {
@@ -92,3 +220,152 @@ func TestFindSolutionWithHigherDifficulty(t *testing.T) {
 		t.Fatalf("expected valid solution but verification failed")
 	}
 }
+
+func TestFindSolutionWithDifficulty(t *testing.T) {
+	pow, err := NewHashCash(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A server sent a harder challenge than the solver is configured for
+	challenge := []byte("challenge")
+	for _, workers := range []int{0, 4} {
+		solution, err := pow.FindSolutionWithDifficulty(context.Background(), challenge, 3, workers)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !pow.VerifyWithDifficulty(challenge, []byte(solution), 3) {
+			t.Fatalf("%d workers: expected a solution at difficulty 3, got %q", workers, solution)
+		}
+	}
+	if pow.GetDifficulty() != 1 {
+		t.Fatalf("expected the solver's own difficulty unchanged, got %d", pow.GetDifficulty())
+	}
+	if _, err := pow.FindSolutionWithDifficulty(context.Background(), challenge, MaxDifficulty+1, 0); !errors.Is(err, ErrDifficultyRange) {
+		t.Fatalf("expected ErrDifficultyRange, got %v", err)
+	}
+}
+
+func TestNonceEncodings(t *testing.T) {
+	encodings := []NonceEncoding{NonceDecimal, NonceHex, NonceBinary}
+	challenge := []byte("challenge")
+
+	for _, encoding := range encodings {
+		t.Run(encoding.String(), func(t *testing.T) {
+			pow, err := NewHashCash(4)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			pow.UseNonceEncoding(encoding)
+
+			solution := pow.FindSolution(challenge)
+			if !pow.Verify(challenge, []byte(solution)) {
+				t.Fatalf("expected %s solution %q to verify", encoding, solution)
+			}
+
+			// The same nonce value submitted under another encoding hashes
+			// different bytes and must not verify
+			nonce := solvedNonce(t, solution)
+			for _, other := range encodings {
+				if other == encoding {
+					continue
+				}
+				retagged := other.formatSolution(nonce)
+				if pow.Verify(challenge, []byte(retagged)) {
+					t.Fatalf("expected %s solution resubmitted as %s (%q) to be rejected", encoding, other, retagged)
+				}
+			}
+		})
+	}
+}
+
+// solvedNonce recovers the nonce value from a solution in any encoding.
+func solvedNonce(t *testing.T, solution string) uint64 {
+	t.Helper()
+
+	nonce, ok := parseSolution([]byte(solution))
+	if !ok {
+		t.Fatalf("unexpected unparsable solution %q", solution)
+	}
+	var value uint64
+	var err error
+	switch {
+	case strings.HasPrefix(solution, hexTag):
+		value, err = strconv.ParseUint(string(nonce), 16, 64)
+	case strings.HasPrefix(solution, binaryTag):
+		value = binary.BigEndian.Uint64(nonce)
+	default:
+		value, err = strconv.ParseUint(string(nonce), 10, 64)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error parsing nonce %q: %v", solution, err)
+	}
+	return value
+}
+
+func TestVerifyRejectsMalformedTaggedSolutions(t *testing.T) {
+	pow, err := NewHashCash(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, solution := range []string{"hex:", "hex:xyz", "hex:7B", "bin:!!!", "bin:AAAA"} {
+		if pow.Verify([]byte("challenge"), []byte(solution)) {
+			t.Fatalf("expected malformed solution %q to be rejected", solution)
+		}
+	}
+}
+
+func TestExpectedIterationsMatchesMeasuredMedian(t *testing.T) {
+	tests := []struct {
+		difficulty uint64
+		samples    int
+	}{
+		{1, 2000},
+		{2, 500},
+	}
+
+	for _, tt := range tests {
+		pow, err := NewHashCash(tt.difficulty)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		tries := make([]float64, tt.samples)
+		for i := range tries {
+			nonce, err := strconv.ParseUint(pow.FindSolution([]byte(fmt.Sprintf("challenge-%d", i))), 10, 64)
+			if err != nil {
+				t.Fatalf("unexpected error parsing nonce: %v", err)
+			}
+			tries[i] = float64(nonce + 1)
+		}
+		sort.Float64s(tries)
+		median := tries[len(tries)/2]
+
+		// Tries are geometrically distributed, with the median at ln(2)
+		// times the mean
+		expected := math.Ln2 * ExpectedIterations(tt.difficulty)
+		if math.Abs(median-expected)/expected > 0.25 {
+			t.Fatalf("difficulty %d: expected median near %.1f tries, measured %.1f", tt.difficulty, expected, median)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	pow, err := NewHashCash(2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	computed, expected := pow.Explain([]byte("challenge"), []byte("0"))
+	if expected != "00..." {
+		t.Fatalf("expected prefix %q, got %q", "00...", expected)
+	}
+	if len(computed) != 64 {
+		t.Fatalf("expected a hex SHA-256, got %q", computed)
+	}
+
+	if computed, _ := pow.Explain([]byte("challenge"), []byte("hex:zz")); computed != "malformed solution" {
+		t.Fatalf("expected malformed solution, got %q", computed)
+	}
+}
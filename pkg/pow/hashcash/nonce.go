@@ -0,0 +1,106 @@
+package hashcash
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NonceEncoding selects how a nonce is appended to the challenge before
+// hashing, for interop with other hashcash implementations.
+type NonceEncoding int
+
+const (
+	// NonceDecimal appends the nonce as decimal digits. Its solutions are
+	// sent untagged, as they always have been.
+	NonceDecimal NonceEncoding = iota
+	// NonceHex appends the nonce as lowercase hex digits.
+	NonceHex
+	// NonceBinary appends the nonce as 8 big-endian bytes.
+	NonceBinary
+)
+
+// Solution tags telling the verifier how the nonce was encoded. Binary
+// nonces are base64 encoded on the wire to keep solutions on one line.
+const (
+	hexTag    = "hex:"
+	binaryTag = "bin:"
+)
+
+var ErrNonceEncoding = errors.New("unknown nonce encoding")
+
+// ParseNonceEncoding parses "decimal", "hex" or "binary".
+func ParseNonceEncoding(s string) (NonceEncoding, error) {
+	switch strings.ToLower(s) {
+	case "", "decimal":
+		return NonceDecimal, nil
+	case "hex":
+		return NonceHex, nil
+	case "binary":
+		return NonceBinary, nil
+	default:
+		return NonceDecimal, fmt.Errorf("%w: %q", ErrNonceEncoding, s)
+	}
+}
+
+func (e NonceEncoding) String() string {
+	switch e {
+	case NonceDecimal:
+		return "decimal"
+	case NonceHex:
+		return "hex"
+	case NonceBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("NonceEncoding(%d)", int(e))
+	}
+}
+
+// appendNonce appends the hashed form of nonce to dst.
+func (e NonceEncoding) appendNonce(dst []byte, nonce uint64) []byte {
+	switch e {
+	case NonceHex:
+		return strconv.AppendUint(dst, nonce, 16)
+	case NonceBinary:
+		return binary.BigEndian.AppendUint64(dst, nonce)
+	default:
+		return strconv.AppendUint(dst, nonce, 10)
+	}
+}
+
+// formatSolution returns the tagged wire form of nonce.
+func (e NonceEncoding) formatSolution(nonce uint64) string {
+	switch e {
+	case NonceHex:
+		return hexTag + strconv.FormatUint(nonce, 16)
+	case NonceBinary:
+		return binaryTag + base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint64(nil, nonce))
+	default:
+		return strconv.FormatUint(nonce, 10)
+	}
+}
+
+// parseSolution returns the bytes a tagged solution contributes to the hash.
+// Untagged solutions are hashed verbatim.
+func parseSolution(solution []byte) ([]byte, bool) {
+	s := string(solution)
+	switch {
+	case strings.HasPrefix(s, hexTag):
+		digits := strings.TrimPrefix(s, hexTag)
+		if _, err := strconv.ParseUint(digits, 16, 64); err != nil || digits != strings.ToLower(digits) {
+			return nil, false
+		}
+		return []byte(digits), true
+	case strings.HasPrefix(s, binaryTag):
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, binaryTag))
+		if err != nil || len(raw) != 8 {
+			return nil, false
+		}
+		return raw, true
+	default:
+		return solution, true
+	}
+}
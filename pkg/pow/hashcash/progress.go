@@ -0,0 +1,82 @@
+package hashcash
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is how far a solve has got.
+type Progress struct {
+	// Tries is the number of nonces tried so far by all workers, counted
+	// in batches of a few thousand.
+	Tries   uint64
+	Elapsed time.Duration
+}
+
+// UseProgress makes FindSolution call report with its progress about every
+// interval, for as long as it searches. Workers count their tries where
+// they check their context anyway, so the search runs no slower; report
+// is never called concurrently nor once FindSolution returned, and should
+// return quickly. A nil report turns reporting off.
+func (pow *HashCash) UseProgress(interval time.Duration, report func(Progress)) {
+	pow.progressInterval = interval
+	pow.reportProgress = report
+}
+
+// solveProgress tracks the progress of one solve across its workers.
+type solveProgress struct {
+	interval time.Duration
+	report   func(Progress)
+	start    time.Time
+	tries    atomic.Uint64
+
+	// mu serializes reports; next and stopped are guarded by it.
+	mu      sync.Mutex
+	next    time.Time
+	stopped bool
+}
+
+// startProgress starts tracking a solve, or returns nil if progress isn't
+// reported.
+func (pow *HashCash) startProgress() *solveProgress {
+	if pow.reportProgress == nil {
+		return nil
+	}
+	now := time.Now()
+	return &solveProgress{
+		interval: pow.progressInterval,
+		report:   pow.reportProgress,
+		start:    now,
+		next:     now.Add(pow.progressInterval),
+	}
+}
+
+// add counts tries made by a worker and reports progress if it is due.
+// Workers skip reporting while another one is.
+func (p *solveProgress) add(tries uint64) {
+	if p == nil {
+		return
+	}
+	p.tries.Add(tries)
+	if !p.mu.TryLock() {
+		return
+	}
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.stopped || now.Before(p.next) {
+		return
+	}
+	p.next = now.Add(p.interval)
+	p.report(Progress{Tries: p.tries.Load(), Elapsed: now.Sub(p.start)})
+}
+
+// stop ends reporting, waiting for a report in progress to return.
+func (p *solveProgress) stop() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSolveTime = errors.New("invalid reported solve time")
+
+// FrameCapabilities is optionally sent by the server after the preamble and
+// the version frame, ahead of the challenge. It is followed by one length
+// byte and a comma-separated list of the optional features the server
+// accepts; clients use a feature only once it has been advertised.
+const FrameCapabilities byte = 0xF3
+
+// CapabilitySolveTime means the server accepts the time a client took to
+// solve its challenge, reported on the challenge type line as in
+// "CPU/4;1.5s". The report is advisory and only used to tune difficulty.
+const CapabilitySolveTime = "solve-time"
+
+const solveTimeSeparator = ";"
+
+// FormatCapabilities returns the payload of a FrameCapabilities frame.
+func FormatCapabilities(capabilities []string) string {
+	return strings.Join(capabilities, ",")
+}
+
+// ParseCapabilities parses the payload of a FrameCapabilities frame.
+func ParseCapabilities(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// HasCapability reports whether capabilities includes capability.
+func HasCapability(capabilities []string, capability string) bool {
+	return slices.Contains(capabilities, capability)
+}
+
+// AppendSolveTime appends a solve time report to a challenge type line.
+func AppendSolveTime(typeLine string, solveTime time.Duration) string {
+	return typeLine + solveTimeSeparator + solveTime.String()
+}
+
+// CutSolveTime splits the solve time report off a challenge type line. The
+// solve time is zero when the client didn't report one.
+func CutSolveTime(line string) (string, time.Duration, error) {
+	typeLine, report, ok := strings.Cut(line, solveTimeSeparator)
+	if !ok {
+		return line, 0, nil
+	}
+	solveTime, err := time.ParseDuration(report)
+	if err != nil || solveTime <= 0 {
+		return typeLine, 0, fmt.Errorf("%w: %q", ErrInvalidSolveTime, report)
+	}
+	return typeLine, solveTime, nil
+}
@@ -0,0 +1,24 @@
+// Package protocol describes the wire protocol of the proof-of-work quote
+// server, so clients can be written against it without the server's code.
+//
+// On every connection the server sends the Preamble, optionally followed
+// by a FrameVersion and a FrameCapabilities frame. Then comes a challenge
+// frame (see AppendChallengeFrame), optionally preceded by a FrameHint, or
+// a single FrameRetryLater or FrameObserve byte in its place. After
+// solving, the client sends its submission (see AppendSubmission), and the
+// server answers with one response line (see FormatSuccess and
+// FormatError). Servers advertising CapabilitySession follow a success
+// response with a session grant (see FormatSessionGrant), whose token the
+// client may submit instead of solving (see SessionType).
+//
+// Challenges don't carry their difficulty: both ends take it from their
+// configuration, and clients may pin the one they solved at (see
+// FormatSolutionType). Only servers advertising CapabilityDifficulty send
+// it with their challenges. A solution is a nonce, sent as text:
+//
+//   - CPU: the hex SHA-256 of the challenge followed by the decimal nonce
+//     must start with difficulty zero digits.
+//   - Memory: the 32-byte argon2id key of the challenge followed by the
+//     decimal nonce, salted with the challenge, with time cost 1, 64 MiB of
+//     memory and 4 threads, must start with difficulty zero bits.
+package protocol
@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	ErrInvalidChallengeSize       = errors.New("invalid challenge size")
+	ErrInvalidChallengeDifficulty = errors.New("invalid challenge difficulty")
+	ErrInvalidResponse            = errors.New("invalid response line")
+)
+
+// A challenge frame is the challenge type byte, the length of the
+// challenge as a big-endian int32 and the challenge itself.
+
+// CapabilityDifficulty means the server's challenge frames carry the
+// difficulty they were issued at, as a big-endian uint32 between the type
+// byte and the length, so clients solve at the server's difficulty rather
+// than one configured to match it, which the server may tune.
+const CapabilityDifficulty = "difficulty"
+
+// CarriesDifficulty reports whether challenge frames of type t carry their
+// difficulty, given the capabilities the server advertised.
+func CarriesDifficulty(capabilities []string, t ChallengeType) bool {
+	return t.Valid() && HasCapability(capabilities, CapabilityDifficulty)
+}
+
+// AppendChallengeFrame appends a challenge frame to dst.
+func AppendChallengeFrame(dst []byte, t ChallengeType, challenge []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(append(dst, t.Byte()), uint32(len(challenge)))
+	return append(dst, challenge...)
+}
+
+// AppendChallengeFrameWithDifficulty appends a challenge frame carrying
+// its difficulty, as sent by servers advertising CapabilityDifficulty.
+func AppendChallengeFrameWithDifficulty(dst []byte, t ChallengeType, difficulty uint64, challenge []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(append(dst, t.Byte()), uint32(difficulty))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(challenge)))
+	return append(dst, challenge...)
+}
+
+// ReadChallengeDifficulty reads the difficulty a challenge frame carries
+// right after its type byte, which must be positive.
+func ReadChallengeDifficulty(r io.Reader) (uint64, error) {
+	var difficulty uint32
+	if err := binary.Read(r, binary.BigEndian, &difficulty); err != nil {
+		return 0, err
+	}
+	if difficulty == 0 {
+		return 0, fmt.Errorf("%w: 0", ErrInvalidChallengeDifficulty)
+	}
+	return uint64(difficulty), nil
+}
+
+// ReadChallengeData reads the rest of a challenge frame whose type byte was
+// already read: the length and the challenge, which must be between one
+// and maxSize bytes long.
+func ReadChallengeData(r io.Reader, maxSize int64) ([]byte, error) {
+	var length int32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length <= 0 || int64(length) > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidChallengeSize, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// AppendSubmission appends what a client sends once it solved a challenge:
+// the challenge token it was sent, base64 encoded, when the server echoes
+// challenges, then the challenge type line and the solution, each on a
+// line of their own. token is nil otherwise.
+func AppendSubmission(dst, token []byte, typeLine, solution string) []byte {
+	if token != nil {
+		dst = base64.StdEncoding.AppendEncode(dst, token)
+		dst = append(dst, '\n')
+	}
+	dst = append(append(dst, typeLine...), '\n')
+	return append(append(dst, solution...), '\n')
+}
+
+// The server answers a submission with a single line, starting with
+// SuccessPrefix or ErrorPrefix.
+const (
+	SuccessPrefix = "SUCCESS:"
+	ErrorPrefix   = "ERROR:"
+)
+
+// Codes of the error responses a server sends.
+const (
+	CodeInvalidFormat      = "INVALID_FORMAT"
+	CodeTimeout            = "TIMEOUT"
+	CodeInvalidSolution    = "INVALID_SOLUTION"
+	CodeChallengeExpired   = "CHALLENGE_EXPIRED"
+	CodeRateLimited        = "RATE_LIMITED"
+	CodeServerBusy         = "SERVER_BUSY"
+	CodeInvalidChallenge   = "INVALID_CHALLENGE"
+	CodeChallengeUsed      = "CHALLENGE_USED"
+	CodeDifficultyMismatch = "DIFFICULTY_MISMATCH"
+	CodeInvalidSession     = "INVALID_SESSION"
+	CodeReconnect          = "RECONNECT"
+	CodeInternalError      = "INTERNAL_ERROR"
+)
+
+// Quote is the payload of a success response. Author and Source are
+// optional.
+type Quote struct {
+	Text   string `json:"text"`
+	Author string `json:"author,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// ErrorResponse is the payload of an error response. Details are only
+// sent by servers reporting every issue with a solution.
+type ErrorResponse struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+// Response is a parsed response line: either a quote or an error.
+type Response struct {
+	Quote Quote
+	// Error is nil for success responses.
+	Error *ErrorResponse
+}
+
+// FormatSuccess returns the response line carrying quote: "SUCCESS:text",
+// or "SUCCESS:" followed by the JSON quote when it carries an attribution,
+// or when its text would be taken for JSON.
+func FormatSuccess(quote Quote) string {
+	if quote.Author == "" && quote.Source == "" && !strings.HasPrefix(quote.Text, "{") {
+		return SuccessPrefix + quote.Text + "\n"
+	}
+	// A struct of strings always encodes
+	encoded, _ := json.Marshal(quote)
+	return SuccessPrefix + string(encoded) + "\n"
+}
+
+// FormatError returns the response line carrying response:
+// "ERROR:CODE:message", or "ERROR:" followed by the JSON response when it
+// carries details.
+func FormatError(response ErrorResponse) string {
+	if len(response.Details) == 0 {
+		return ErrorPrefix + response.Code + ":" + response.Message + "\n"
+	}
+	encoded, _ := json.Marshal(response)
+	return ErrorPrefix + string(encoded) + "\n"
+}
+
+// ParseResponse parses a response line, with or without its line break.
+func ParseResponse(line string) (Response, error) {
+	line = strings.TrimSpace(line)
+	if payload, ok := strings.CutPrefix(line, SuccessPrefix); ok {
+		if !strings.HasPrefix(payload, "{") {
+			return Response{Quote: Quote{Text: payload}}, nil
+		}
+		var quote Quote
+		if err := json.Unmarshal([]byte(payload), &quote); err != nil {
+			return Response{}, fmt.Errorf("%w: invalid quote", ErrInvalidResponse)
+		}
+		return Response{Quote: quote}, nil
+	}
+
+	payload, ok := strings.CutPrefix(line, ErrorPrefix)
+	if !ok {
+		return Response{}, fmt.Errorf("%w: %q", ErrInvalidResponse, line)
+	}
+	var response ErrorResponse
+	if strings.HasPrefix(payload, "{") {
+		if err := json.Unmarshal([]byte(payload), &response); err != nil {
+			return Response{}, fmt.Errorf("%w: invalid error", ErrInvalidResponse)
+		}
+		return Response{Error: &response}, nil
+	}
+	var found bool
+	if response.Code, response.Message, found = strings.Cut(payload, ":"); !found {
+		return Response{}, fmt.Errorf("%w: invalid error", ErrInvalidResponse)
+	}
+	return Response{Error: &response}, nil
+}
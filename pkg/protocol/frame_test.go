@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestChallengeFrameRoundTrip(t *testing.T) {
+	frame := AppendChallengeFrame(nil, ChallengeTypeMemory, []byte("challenge"))
+	if want := []byte("\x01\x00\x00\x00\x09challenge"); !bytes.Equal(frame, want) {
+		t.Fatalf("expected frame %q, got %q", want, frame)
+	}
+
+	r := bytes.NewReader(frame[1:])
+	data, err := ReadChallengeData(r, 16)
+	if err != nil {
+		t.Fatalf("unexpected error reading challenge: %v", err)
+	}
+	if string(data) != "challenge" {
+		t.Fatalf("expected %q, got %q", "challenge", data)
+	}
+
+	if _, err := ReadChallengeData(bytes.NewReader(frame[1:]), 8); !errors.Is(err, ErrInvalidChallengeSize) {
+		t.Fatalf("expected ErrInvalidChallengeSize above the maximum, got %v", err)
+	}
+	if _, err := ReadChallengeData(bytes.NewReader(frame[1:8]), 16); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF on a truncated frame, got %v", err)
+	}
+}
+
+func TestChallengeFrameWithDifficultyRoundTrip(t *testing.T) {
+	frame := AppendChallengeFrameWithDifficulty(nil, ChallengeTypeMemory, 7, []byte("challenge"))
+	if want := []byte("\x01\x00\x00\x00\x07\x00\x00\x00\x09challenge"); !bytes.Equal(frame, want) {
+		t.Fatalf("expected frame %q, got %q", want, frame)
+	}
+
+	r := bytes.NewReader(frame[1:])
+	difficulty, err := ReadChallengeDifficulty(r)
+	if err != nil || difficulty != 7 {
+		t.Fatalf("expected difficulty 7, got %d (%v)", difficulty, err)
+	}
+	if data, err := ReadChallengeData(r, 16); err != nil || string(data) != "challenge" {
+		t.Fatalf("expected %q, got %q (%v)", "challenge", data, err)
+	}
+
+	zero := AppendChallengeFrameWithDifficulty(nil, ChallengeTypeMemory, 0, []byte("challenge"))
+	if _, err := ReadChallengeDifficulty(bytes.NewReader(zero[1:])); !errors.Is(err, ErrInvalidChallengeDifficulty) {
+		t.Fatalf("expected ErrInvalidChallengeDifficulty for zero, got %v", err)
+	}
+
+	capabilities := []string{CapabilitySolveTime, CapabilityDifficulty}
+	if !CarriesDifficulty(capabilities, ChallengeTypeMemory) ||
+		!CarriesDifficulty(capabilities, ChallengeTypeCPU) ||
+		CarriesDifficulty(nil, ChallengeTypeMemory) ||
+		CarriesDifficulty(nil, ChallengeTypeCPU) {
+		t.Fatalf("expected challenges to carry difficulty only when advertised")
+	}
+}
+
+func TestAppendSubmission(t *testing.T) {
+	if got := string(AppendSubmission(nil, nil, "CPU/4", "42")); got != "CPU/4\n42\n" {
+		t.Fatalf("unexpected submission %q", got)
+	}
+	if got := string(AppendSubmission(nil, []byte("token"), "Memory", "7")); got != "dG9rZW4=\nMemory\n7\n" {
+		t.Fatalf("unexpected echoed submission %q", got)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		response Response
+	}{
+		{"bare quote", "SUCCESS:quote\n", Response{Quote: Quote{Text: "quote"}}},
+		{"attributed quote", `SUCCESS:{"text":"quote","author":"someone"}` + "\n", Response{Quote: Quote{Text: "quote", Author: "someone"}}},
+		{"quote looking like JSON", `SUCCESS:{"text":"{quote"}` + "\n", Response{Quote: Quote{Text: "{quote"}}},
+		{"error", "ERROR:TIMEOUT:Operation timed out\n", Response{Error: &ErrorResponse{Code: CodeTimeout, Message: "Operation timed out"}}},
+		{"detailed error", `ERROR:{"code":"INVALID_SOLUTION","message":"bad","details":["a","b"]}` + "\n",
+			Response{Error: &ErrorResponse{Code: CodeInvalidSolution, Message: "bad", Details: []string{"a", "b"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var line string
+			if tt.response.Error != nil {
+				line = FormatError(*tt.response.Error)
+			} else {
+				line = FormatSuccess(tt.response.Quote)
+			}
+			if line != tt.line {
+				t.Fatalf("expected line %q, got %q", tt.line, line)
+			}
+
+			parsed, err := ParseResponse(line)
+			if err != nil {
+				t.Fatalf("unexpected error parsing %q: %v", line, err)
+			}
+			if !reflect.DeepEqual(parsed, tt.response) {
+				t.Fatalf("expected %+v, got %+v", tt.response, parsed)
+			}
+		})
+	}
+}
+
+func TestParseResponseInvalid(t *testing.T) {
+	for _, line := range []string{"", "OK:quote", "ERROR:no-message", `SUCCESS:{"text":`} {
+		if _, err := ParseResponse(line); !errors.Is(err, ErrInvalidResponse) {
+			t.Fatalf("expected ErrInvalidResponse for %q, got %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidHint = errors.New("invalid challenge hint")
+
+// FrameHint is optionally sent by the server right before the challenge
+// frame. It is followed by one length byte and a Hint in text form, as in
+// "iterations=65536,workers=1". Hints are advisory: clients may use them to
+// tune their solver, but solutions are verified exactly as without them.
+const FrameHint byte = 0xF4
+
+// Hint advises a client on solving the challenge that follows it.
+type Hint struct {
+	// ExpectedIterations is the mean number of nonces tried before one
+	// solves the challenge.
+	ExpectedIterations uint64
+	// Workers is how many nonces are worth trying in parallel; zero means
+	// no recommendation.
+	Workers int
+	// Difficulty is the difficulty the challenge was issued at, so clients
+	// pinning one can tell a mismatch before solving. Zero means the server
+	// doesn't advertise it.
+	Difficulty uint64
+	// Load is how busy the server is, from 1 when idle to MaxLoad when at
+	// capacity, so a client may back off to a quieter time. Zero means the
+	// server doesn't advertise it.
+	Load int
+}
+
+// MaxLoad is the load of a server at capacity.
+const MaxLoad = 100
+
+// FormatHint returns the payload of a FrameHint frame.
+func FormatHint(h Hint) string {
+	text := fmt.Sprintf("iterations=%d,workers=%d", h.ExpectedIterations, h.Workers)
+	if h.Difficulty > 0 {
+		text += fmt.Sprintf(",difficulty=%d", h.Difficulty)
+	}
+	if h.Load > 0 {
+		text += fmt.Sprintf(",load=%d", h.Load)
+	}
+	return text
+}
+
+// ParseHint parses the payload of a FrameHint frame. Unknown keys are
+// skipped, so hints can grow without breaking clients.
+func ParseHint(s string) (Hint, error) {
+	var h Hint
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Hint{}, fmt.Errorf("%w: %q", ErrInvalidHint, s)
+		}
+		var err error
+		switch key {
+		case "iterations":
+			h.ExpectedIterations, err = strconv.ParseUint(value, 10, 64)
+		case "workers":
+			h.Workers, err = strconv.Atoi(value)
+			if err == nil && h.Workers < 0 {
+				err = ErrInvalidHint
+			}
+		case "difficulty":
+			h.Difficulty, err = strconv.ParseUint(value, 10, 64)
+		case "load":
+			h.Load, err = strconv.Atoi(value)
+			if err == nil && (h.Load < 0 || h.Load > MaxLoad) {
+				err = ErrInvalidHint
+			}
+		}
+		if err != nil {
+			return Hint{}, fmt.Errorf("%w: %q", ErrInvalidHint, s)
+		}
+	}
+	return h, nil
+}
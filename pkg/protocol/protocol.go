@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownChallengeType = errors.New("unknown challenge type")
+	ErrInvalidDifficulty    = errors.New("invalid pinned difficulty")
+)
+
+// ChallengeType identifies the proof-of-work algorithm of a challenge.
+// On the wire it is sent by the server as a single byte and echoed back
+// by the client in its text form.
+type ChallengeType byte
+
+const (
+	// ChallengeTypeCPU is a CPU-bound (hashcash) challenge.
+	ChallengeTypeCPU ChallengeType = 0x00
+	// ChallengeTypeMemory is a memory-bound (argon2) challenge.
+	ChallengeTypeMemory ChallengeType = 0x01
+
+	// ChallengeTypeInvalid is returned alongside errors. It is never sent
+	// on the wire.
+	ChallengeTypeInvalid ChallengeType = 0xFF
+)
+
+// Version is the version of the wire protocol described here.
+const Version byte = 0x01
+
+// Preamble is the first thing a server sends on every connection, ahead of
+// any frame, so clients can tell they reached a proof-of-work server
+// speaking this protocol version.
+var Preamble = []byte{'P', 'o', 'W', Version}
+
+// FrameRetryLater is sent by the server in place of a challenge type byte
+// when it is draining or at capacity. No challenge follows; the client is
+// expected to close the connection and retry after a backoff.
+const FrameRetryLater byte = 0xF0
+
+// FrameObserve is sent by the server in place of a challenge type byte when
+// proof of work is not enforced. No challenge follows; the server's response
+// line comes right after it and the client must not send a solution.
+const FrameObserve byte = 0xF1
+
+var challengeTypeNames = map[ChallengeType]string{
+	ChallengeTypeCPU:    "CPU",
+	ChallengeTypeMemory: "Memory",
+}
+
+// String returns the text form of the challenge type as used on the wire.
+func (t ChallengeType) String() string {
+	if name, ok := challengeTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(0x%02x)", byte(t))
+}
+
+// Byte returns the wire byte of the challenge type.
+func (t ChallengeType) Byte() byte {
+	return byte(t)
+}
+
+// Valid reports whether t is a known challenge type.
+func (t ChallengeType) Valid() bool {
+	_, ok := challengeTypeNames[t]
+	return ok
+}
+
+// ParseChallengeType parses the text form of a challenge type.
+func ParseChallengeType(s string) (ChallengeType, error) {
+	for t, name := range challengeTypeNames {
+		if name == s {
+			return t, nil
+		}
+	}
+	return ChallengeTypeInvalid, fmt.Errorf("%w: %q", ErrUnknownChallengeType, s)
+}
+
+// MarshalText encodes the challenge type by its text form, so it reads as
+// "CPU" or "Memory" in JSON.
+func (t ChallengeType) MarshalText() ([]byte, error) {
+	if !t.Valid() {
+		return nil, fmt.Errorf("%w: 0x%02x", ErrUnknownChallengeType, byte(t))
+	}
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText decodes the text form of a challenge type.
+func (t *ChallengeType) UnmarshalText(text []byte) error {
+	parsed, err := ParseChallengeType(string(text))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// ChallengeTypeFromByte converts a wire byte into a challenge type.
+func ChallengeTypeFromByte(b byte) (ChallengeType, error) {
+	t := ChallengeType(b)
+	if !t.Valid() {
+		return ChallengeTypeInvalid, fmt.Errorf("%w: 0x%02x", ErrUnknownChallengeType, b)
+	}
+	return t, nil
+}
+
+// Challenges never carry their difficulty; client and server both take it
+// from their configuration. A client may pin the difficulty it solves at by
+// appending it to the challenge type line it sends back, as in "CPU/4", so
+// a server configured differently reports the mismatch instead of rejecting
+// the solution as invalid.
+const pinSeparator = "/"
+
+// FormatSolutionType returns the challenge type line a client sends ahead
+// of its solution, pinning difficulty unless it is zero.
+func FormatSolutionType(t ChallengeType, difficulty uint64) string {
+	if difficulty == 0 {
+		return t.String()
+	}
+	return t.String() + pinSeparator + strconv.FormatUint(difficulty, 10)
+}
+
+// ParseSolutionType parses a challenge type line as sent by a client. The
+// pinned difficulty is zero when the client didn't pin one.
+func ParseSolutionType(s string) (ChallengeType, uint64, error) {
+	name, pinned, ok := strings.Cut(s, pinSeparator)
+	t, err := ParseChallengeType(name)
+	if err != nil || !ok {
+		return t, 0, err
+	}
+	difficulty, err := strconv.ParseUint(pinned, 10, 64)
+	if err != nil || difficulty == 0 {
+		return ChallengeTypeInvalid, 0, fmt.Errorf("%w: %q", ErrInvalidDifficulty, pinned)
+	}
+	return t, difficulty, nil
+}
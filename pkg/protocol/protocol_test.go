@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChallengeTypeRoundTrip(t *testing.T) {
+	for _, ct := range []ChallengeType{ChallengeTypeCPU, ChallengeTypeMemory} {
+		parsed, err := ParseChallengeType(ct.String())
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", ct.String(), err)
+		}
+		if parsed != ct {
+			t.Fatalf("expected %v, got %v", ct, parsed)
+		}
+
+		fromByte, err := ChallengeTypeFromByte(ct.Byte())
+		if err != nil {
+			t.Fatalf("unexpected error converting byte 0x%02x: %v", ct.Byte(), err)
+		}
+		if fromByte != ct {
+			t.Fatalf("expected %v, got %v", ct, fromByte)
+		}
+	}
+}
+
+func TestChallengeTypeWireValues(t *testing.T) {
+	if ChallengeTypeCPU.Byte() != 0x00 || ChallengeTypeCPU.String() != "CPU" {
+		t.Fatalf("unexpected CPU wire values: 0x%02x %q", ChallengeTypeCPU.Byte(), ChallengeTypeCPU.String())
+	}
+	if ChallengeTypeMemory.Byte() != 0x01 || ChallengeTypeMemory.String() != "Memory" {
+		t.Fatalf("unexpected Memory wire values: 0x%02x %q", ChallengeTypeMemory.Byte(), ChallengeTypeMemory.String())
+	}
+}
+
+func TestChallengeTypeUnknown(t *testing.T) {
+	ct, err := ParseChallengeType("GPU")
+	if !errors.Is(err, ErrUnknownChallengeType) {
+		t.Fatalf("expected ErrUnknownChallengeType, got %v", err)
+	}
+	if ct != ChallengeTypeInvalid || ct.Valid() {
+		t.Fatalf("expected ChallengeTypeInvalid alongside the error, got %v", ct)
+	}
+	if _, err := ParseChallengeType(""); !errors.Is(err, ErrUnknownChallengeType) {
+		t.Fatalf("expected ErrUnknownChallengeType for empty string, got %v", err)
+	}
+	if _, err := ChallengeTypeFromByte(0x02); !errors.Is(err, ErrUnknownChallengeType) {
+		t.Fatalf("expected ErrUnknownChallengeType for byte 0x02, got %v", err)
+	}
+	if ChallengeType(0x02).Valid() {
+		t.Fatalf("expected 0x02 to be invalid")
+	}
+}
+
+func TestSolutionTypePinning(t *testing.T) {
+	for _, difficulty := range []uint64{0, 1, 12} {
+		line := FormatSolutionType(ChallengeTypeMemory, difficulty)
+		ct, pinned, err := ParseSolutionType(line)
+		if err != nil || ct != ChallengeTypeMemory || pinned != difficulty {
+			t.Fatalf("expected Memory pinned at %d from %q, got %v %d (%v)", difficulty, line, ct, pinned, err)
+		}
+	}
+	if line := FormatSolutionType(ChallengeTypeCPU, 0); line != "CPU" {
+		t.Fatalf("expected an unpinned line to be the bare type, got %q", line)
+	}
+	for _, line := range []string{"CPU/", "CPU/0", "CPU/x"} {
+		if _, _, err := ParseSolutionType(line); !errors.Is(err, ErrInvalidDifficulty) {
+			t.Fatalf("expected ErrInvalidDifficulty for %q, got %v", line, err)
+		}
+	}
+	if _, _, err := ParseSolutionType("GPU/1"); !errors.Is(err, ErrUnknownChallengeType) {
+		t.Fatalf("expected ErrUnknownChallengeType, got %v", err)
+	}
+}
+
+func TestSemVerCompatibility(t *testing.T) {
+	minimum, err := ParseSemVer("v1.4.2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		version    string
+		compatible bool
+	}{
+		{"1.4.2", true},
+		{"1.4.10", true},
+		{"1.12.0-rc.1+build.5", true},
+		{"1.4.1", false},
+		{"1.3.9", false},
+		{"0.9.0", false},
+		{"2.0.0", false},
+	}
+	for _, tt := range tests {
+		version, err := ParseSemVer(tt.version)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", tt.version, err)
+		}
+		if got := version.CompatibleWith(minimum); got != tt.compatible {
+			t.Fatalf("expected %s compatible with %s to be %v", tt.version, minimum, tt.compatible)
+		}
+	}
+
+	for _, invalid := range []string{"", "1.4", "1.4.x", "1.4.2.0", "(devel)"} {
+		if _, err := ParseSemVer(invalid); !errors.Is(err, ErrInvalidVersion) {
+			t.Fatalf("expected ErrInvalidVersion for %q, got %v", invalid, err)
+		}
+	}
+}
+
+func TestSolveTimeReport(t *testing.T) {
+	line := AppendSolveTime(FormatSolutionType(ChallengeTypeCPU, 4), 1500*time.Millisecond)
+	if line != "CPU/4;1.5s" {
+		t.Fatalf("unexpected type line %q", line)
+	}
+	typeLine, solveTime, err := CutSolveTime(line)
+	if err != nil || typeLine != "CPU/4" || solveTime != 1500*time.Millisecond {
+		t.Fatalf("unexpected result %q %v (%v)", typeLine, solveTime, err)
+	}
+
+	if _, solveTime, err := CutSolveTime("CPU"); err != nil || solveTime != 0 {
+		t.Fatalf("expected no report, got %v (%v)", solveTime, err)
+	}
+	for _, line := range []string{"CPU;soon", "CPU;-1s", "CPU;0s"} {
+		if _, _, err := CutSolveTime(line); !errors.Is(err, ErrInvalidSolveTime) {
+			t.Fatalf("expected ErrInvalidSolveTime for %q, got %v", line, err)
+		}
+	}
+}
+
+func TestHintRoundTrip(t *testing.T) {
+	hint := Hint{ExpectedIterations: 65536, Workers: 1}
+	text := FormatHint(hint)
+	if text != "iterations=65536,workers=1" {
+		t.Fatalf("unexpected hint %q", text)
+	}
+	if parsed, err := ParseHint(text); err != nil || parsed != hint {
+		t.Fatalf("expected %+v, got %+v (%v)", hint, parsed, err)
+	}
+
+	if parsed, err := ParseHint("iterations=16,future=yes"); err != nil || parsed.ExpectedIterations != 16 {
+		t.Fatalf("expected unknown keys to be skipped, got %+v (%v)", parsed, err)
+	}
+	loaded := Hint{ExpectedIterations: 16, Workers: 1, Difficulty: 4, Load: 75}
+	if parsed, err := ParseHint(FormatHint(loaded)); err != nil || parsed != loaded {
+		t.Fatalf("expected %+v, got %+v (%v)", loaded, parsed, err)
+	}
+	for _, invalid := range []string{"", "iterations", "iterations=many", "workers=-1", "load=-1", "load=101", "difficulty=-1"} {
+		if _, err := ParseHint(invalid); !errors.Is(err, ErrInvalidHint) {
+			t.Fatalf("expected ErrInvalidHint for %q, got %v", invalid, err)
+		}
+	}
+}
+
+func TestSessionGrantRoundTrip(t *testing.T) {
+	line := FormatSessionGrant([]byte("token"), 30*time.Second)
+	if line != "SESSION:30s:dG9rZW4=\n" {
+		t.Fatalf("unexpected grant %q", line)
+	}
+	token, ttl, err := ParseSessionGrant(line)
+	if err != nil || string(token) != "token" || ttl != 30*time.Second {
+		t.Fatalf("expected the token for 30s, got %q for %v (%v)", token, ttl, err)
+	}
+
+	for _, invalid := range []string{"SUCCESS:quote", "SESSION:30s", "SESSION:soon:dG9rZW4=", "SESSION:-1s:dG9rZW4=", "SESSION:30s:", "SESSION:30s:!"} {
+		if _, _, err := ParseSessionGrant(invalid); !errors.Is(err, ErrInvalidSessionGrant) {
+			t.Fatalf("expected ErrInvalidSessionGrant for %q, got %v", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSessionGrant = errors.New("invalid session grant")
+
+// CapabilitySession means the server grants session tokens. A client that
+// solved its challenge gets a grant line right after the success response,
+// and may then present the token instead of a solution until it expires.
+const CapabilitySession = "session"
+
+// SessionPrefix starts a grant line: "SESSION:<ttl>:<base64 token>", the
+// TTL as in "30s".
+const SessionPrefix = "SESSION:"
+
+// SessionType is sent in place of the challenge type line to present a
+// session token, base64 encoded on the solution line. The challenge frame
+// is still read first, and echoed back if the server echoes challenges.
+const SessionType = "SESSION"
+
+// FormatSessionGrant returns the grant line for token, valid for ttl.
+func FormatSessionGrant(token []byte, ttl time.Duration) string {
+	return SessionPrefix + ttl.String() + ":" + base64.StdEncoding.EncodeToString(token) + "\n"
+}
+
+// ParseSessionGrant parses a grant line, with or without its line break.
+func ParseSessionGrant(line string) ([]byte, time.Duration, error) {
+	payload, ok := strings.CutPrefix(strings.TrimSpace(line), SessionPrefix)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %q", ErrInvalidSessionGrant, line)
+	}
+	ttlText, encoded, ok := strings.Cut(payload, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %q", ErrInvalidSessionGrant, line)
+	}
+	ttl, err := time.ParseDuration(ttlText)
+	if err != nil || ttl <= 0 {
+		return nil, 0, fmt.Errorf("%w: invalid TTL %q", ErrInvalidSessionGrant, ttlText)
+	}
+	token, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(token) == 0 {
+		return nil, 0, fmt.Errorf("%w: invalid token", ErrInvalidSessionGrant)
+	}
+	return token, ttl, nil
+}
@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidVersion = errors.New("invalid semantic version")
+
+// FrameVersion is optionally sent by the server right after the preamble,
+// ahead of any other frame. It is followed by one length byte and the
+// server's semantic version in text form, so clients can refuse servers
+// too old or too new for them before any framing goes wrong.
+const FrameVersion byte = 0xF2
+
+// SemVer is a semantic version. Pre-release and build metadata are
+// accepted when parsing but take no part in compatibility.
+type SemVer struct {
+	Major, Minor, Patch uint64
+}
+
+// ParseSemVer parses a version such as "1.4.2" or "v1.4.2-rc.1".
+func ParseSemVer(s string) (SemVer, error) {
+	core, _, _ := strings.Cut(strings.TrimPrefix(s, "v"), "+")
+	core, _, _ = strings.Cut(core, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return SemVer{}, fmt.Errorf("%w: %q", ErrInvalidVersion, s)
+	}
+
+	var numbers [3]uint64
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return SemVer{}, fmt.Errorf("%w: %q", ErrInvalidVersion, s)
+		}
+		numbers[i] = n
+	}
+	return SemVer{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+func (v SemVer) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Less reports whether v precedes other.
+func (v SemVer) Less(other SemVer) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+// CompatibleWith reports whether v can stand in for minimum: it has the
+// same major version and is no older.
+func (v SemVer) CompatibleWith(minimum SemVer) bool {
+	return v.Major == minimum.Major && !v.Less(minimum)
+}